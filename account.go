@@ -0,0 +1,357 @@
+package httpauth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidCSRFToken is returned by CheckCSRF when a form wasn't posted with
+// the session's CSRF token.
+var ErrInvalidCSRFToken = mkerror("invalid CSRF token")
+
+// CSRFField is the name of the form field CSRF tokens are posted in.
+const CSRFField = "csrf_token"
+
+// AccountPages serves self-service account pages under a path prefix:
+//
+//     prefix            the current user's account, with forms to change
+//                       their email and password (GET)
+//     prefix+"login"    log in (GET, POST)
+//     prefix+"register" register with the default role, then log in (GET, POST)
+//     prefix+"logout"   log out (GET asks to confirm, POST)
+//     prefix+"email"    change email, confirmed with the password (POST)
+//     prefix+"password" change password, confirmed with the old one (POST)
+//
+// Every POST must carry the CSRF token passed to the templates. Messages are
+// flashed as usual and rendered on the next page shown.
+type AccountPages struct {
+	// Templates holds the "login", "register", "account" and "logout"
+	// templates, executed with an AccountPage. Redefine any of them before
+	// serving requests to change how the pages look:
+	//
+	//     pages := aaa.AccountHandler("/account/")
+	//     template.Must(pages.Templates.New("login").Parse(loginHTML))
+	Templates *template.Template
+	// Home is where users are sent after logging in, unless they were
+	// redirected to log in from another page. Defaults to the prefix.
+	Home string
+
+	a      Authorizer
+	prefix string
+}
+
+// AccountPage is the data account templates are executed with.
+type AccountPage struct {
+	Prefix    string   // the prefix the pages are mounted at, for form actions
+	User      UserData // the current user, or on admin pages the user being edited
+	Messages  []string
+	CSRFToken string
+	// EmailLogin is set if users can log in with their email; see Login.
+	EmailLogin bool
+}
+
+// CSRFField returns a hidden input holding the CSRF token, to be included in
+// every form.
+func (p AccountPage) CSRFField() template.HTML {
+	return template.HTML(`<input type="hidden" name="` + CSRFField + `" value="` + template.HTMLEscapeString(p.CSRFToken) + `">`)
+}
+
+// AccountHandler returns self-service account pages to be mounted at prefix,
+// which should end with a slash:
+//
+//     http.Handle("/account/", aaa.AccountHandler("/account/"))
+func (a Authorizer) AccountHandler(prefix string) *AccountPages {
+	return &AccountPages{
+		Templates: template.Must(template.New("account").Parse(defaultAccountTemplates)),
+		Home:      prefix,
+		a:         a,
+		prefix:    prefix,
+	}
+}
+
+func (p *AccountPages) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	page := strings.TrimPrefix(req.URL.Path, p.prefix)
+	if req.Method == "POST" {
+		if err := p.a.CheckCSRF(rw, req); err != nil {
+			http.Error(rw, "Invalid or missing CSRF token.", http.StatusForbidden)
+			return
+		}
+	} else if req.Method != "GET" && req.Method != "HEAD" {
+		rw.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(rw, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case page == "" && req.Method != "POST":
+		p.account(rw, req)
+	case page == "login" || page == "register" || page == "logout":
+		if req.Method != "POST" {
+			p.render(rw, req, page, UserData{})
+			return
+		}
+		switch page {
+		case "login":
+			p.login(rw, req)
+		case "register":
+			p.register(rw, req)
+		case "logout":
+			p.a.Logout(rw, req)
+			p.redirect(rw, req, "login")
+		}
+	case (page == "email" || page == "password") && req.Method == "POST":
+		p.change(rw, req, page)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (p *AccountPages) account(rw http.ResponseWriter, req *http.Request) {
+	if err := p.a.Authorize(rw, req, true); err != nil {
+		p.redirect(rw, req, "login")
+		return
+	}
+	user, err := p.a.CurrentUser(rw, req)
+	if err != nil {
+		p.redirect(rw, req, "login")
+		return
+	}
+	p.render(rw, req, "account", user)
+}
+
+func (p *AccountPages) login(rw http.ResponseWriter, req *http.Request) {
+	username := req.PostFormValue("username")
+	err := p.a.Login(rw, req, username, req.PostFormValue("password"), p.Home)
+	if err == ErrAlreadyAuthenticated {
+		http.Redirect(rw, req, p.Home, http.StatusSeeOther)
+	} else if err != nil {
+		p.a.flashError(rw, req, err)
+		p.redirect(rw, req, "login")
+	}
+}
+
+func (p *AccountPages) register(rw http.ResponseWriter, req *http.Request) {
+	user := UserData{Username: req.PostFormValue("username"), Email: req.PostFormValue("email")}
+	password := req.PostFormValue("password")
+	if password != req.PostFormValue("confirm_password") {
+		p.a.addMessage(rw, req, "Passwords don't match.")
+		p.redirect(rw, req, "register")
+		return
+	}
+	if err := p.a.Register(rw, req, user, password); err != nil {
+		p.a.flashError(rw, req, err)
+		p.redirect(rw, req, "register")
+		return
+	}
+	p.a.addMessage(rw, req, "Account created.")
+	p.login(rw, req)
+}
+
+func (p *AccountPages) change(rw http.ResponseWriter, req *http.Request, page string) {
+	if err := p.a.Authorize(rw, req, true); err != nil {
+		p.redirect(rw, req, "login")
+		return
+	}
+	if err := p.a.Reauthenticate(rw, req, req.PostFormValue("password")); err != nil {
+		p.redirect(rw, req, "")
+		return
+	}
+	var err error
+	if page == "email" {
+		err = p.a.Update(rw, req, "", "", req.PostFormValue("new_email"))
+	} else if newPassword := req.PostFormValue("new_password"); newPassword != req.PostFormValue("confirm_password") {
+		p.a.addMessage(rw, req, "Passwords don't match.")
+		p.redirect(rw, req, "")
+		return
+	} else {
+		err = p.a.Update(rw, req, "", newPassword, "")
+	}
+	if err != nil {
+		p.a.flashError(rw, req, err)
+	} else if page == "email" {
+		p.a.addMessage(rw, req, "Email changed.")
+	} else {
+		p.a.addMessage(rw, req, "Password changed.")
+	}
+	p.redirect(rw, req, "")
+}
+
+// flashError adds a message for errors the Authorizer doesn't add one for
+// itself: missing fields, and errors from before hooks, which are shown as
+// they are.
+func (a Authorizer) flashError(rw http.ResponseWriter, req *http.Request, err error) {
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "httpauth: ") {
+		a.addMessage(rw, req, msg)
+		return
+	}
+	if status, e := apiError(err, apiState{}); status == http.StatusBadRequest {
+		runes := []rune(e.Message)
+		a.addMessage(rw, req, string(unicode.ToUpper(runes[0]))+string(runes[1:])+".")
+	}
+}
+
+func (p *AccountPages) redirect(rw http.ResponseWriter, req *http.Request, page string) {
+	http.Redirect(rw, req, p.prefix+page, http.StatusSeeOther)
+}
+
+func (p *AccountPages) render(rw http.ResponseWriter, req *http.Request, name string, user UserData) {
+	data, ok := p.a.newPage(rw, req, p.prefix)
+	if !ok {
+		return
+	}
+	data.User = user
+	p.a.executePage(rw, p.Templates, name, data)
+}
+
+// newPage returns the data every page needs: its messages and CSRF token.
+func (a Authorizer) newPage(rw http.ResponseWriter, req *http.Request, prefix string) (AccountPage, bool) {
+	token, err := a.CSRFToken(rw, req)
+	if err != nil {
+		http.Error(rw, "Couldn't start a session.", http.StatusInternalServerError)
+		return AccountPage{}, false
+	}
+	return AccountPage{Prefix: prefix, Messages: a.Messages(rw, req), CSRFToken: token, EmailLogin: a.ext.uniqueEmails}, true
+}
+
+// executePage renders a page, buffering it so template errors can still be
+// reported with a 500.
+func (a Authorizer) executePage(rw http.ResponseWriter, t *template.Template, name string, data interface{}) {
+	var b bytes.Buffer
+	if err := t.ExecuteTemplate(&b, name, data); err != nil {
+		a.ext.logger.Printf("%s template: %v", name, err)
+		http.Error(rw, "Couldn't render the page.", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	b.WriteTo(rw)
+}
+
+// CSRFToken returns the CSRF token of the browser session making a request,
+// creating one if needed. Forms posting to handlers guarded by CheckCSRF
+// must include it in the CSRFField field.
+func (a Authorizer) CSRFToken(rw http.ResponseWriter, req *http.Request) (string, error) {
+	session, _ := a.cookiejar.Get(req, "csrf")
+	if token, ok := session.Values["token"].(string); ok {
+		return token, nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", mkerror(err.Error())
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	session.Values["token"] = token
+	if err := session.Save(req, rw); err != nil {
+		return "", mkerror(err.Error())
+	}
+	return token, nil
+}
+
+// CheckCSRF makes sure a request's CSRFField form value, or X-CSRF-Token
+// header, matches the token of its browser session, returning
+// ErrInvalidCSRFToken if not.
+func (a Authorizer) CheckCSRF(rw http.ResponseWriter, req *http.Request) error {
+	session, _ := a.cookiejar.Get(req, "csrf")
+	token, ok := session.Values["token"].(string)
+	if !ok {
+		return ErrInvalidCSRFToken
+	}
+	posted := req.Header.Get("X-CSRF-Token")
+	if posted == "" {
+		posted = req.PostFormValue(CSRFField)
+	}
+	if subtle.ConstantTimeCompare([]byte(posted), []byte(token)) != 1 {
+		return ErrInvalidCSRFToken
+	}
+	return nil
+}
+
+const defaultAccountTemplates = `
+{{define "messages"}}{{range .Messages}}<p class="message">{{.}}</p>
+{{end}}{{end}}
+
+{{define "login"}}<!DOCTYPE html>
+<html>
+<head><title>Log in</title></head>
+<body>
+<h1>Log in</h1>
+{{template "messages" .}}
+<form action="{{.Prefix}}login" method="post">
+    {{.CSRFField}}
+    <input type="text" name="username" placeholder="username{{if .EmailLogin}} or email{{end}}" required><br>
+    <input type="password" name="password" placeholder="password" required><br>
+    <button type="submit">Log in</button>
+</form>
+<p><a href="{{.Prefix}}register">Register</a></p>
+</body>
+</html>
+{{end}}
+
+{{define "register"}}<!DOCTYPE html>
+<html>
+<head><title>Register</title></head>
+<body>
+<h1>Register</h1>
+{{template "messages" .}}
+<form action="{{.Prefix}}register" method="post">
+    {{.CSRFField}}
+    <input type="text" name="username" placeholder="username" required><br>
+    <input type="email" name="email" placeholder="email@example.com" required><br>
+    <input type="password" name="password" placeholder="password" required><br>
+    <input type="password" name="confirm_password" placeholder="confirm password" required><br>
+    <button type="submit">Register</button>
+</form>
+<p><a href="{{.Prefix}}login">Log in</a></p>
+</body>
+</html>
+{{end}}
+
+{{define "account"}}<!DOCTYPE html>
+<html>
+<head><title>Your account</title></head>
+<body>
+<h1>{{.User.Username}}</h1>
+{{template "messages" .}}
+<h2>Change email</h2>
+<form action="{{.Prefix}}email" method="post">
+    {{.CSRFField}}
+    <input type="email" name="new_email" value="{{.User.Email}}" required><br>
+    <input type="password" name="password" placeholder="current password" required><br>
+    <button type="submit">Change email</button>
+</form>
+<h2>Change password</h2>
+<form action="{{.Prefix}}password" method="post">
+    {{.CSRFField}}
+    <input type="password" name="password" placeholder="current password" required><br>
+    <input type="password" name="new_password" placeholder="new password" required><br>
+    <input type="password" name="confirm_password" placeholder="confirm new password" required><br>
+    <button type="submit">Change password</button>
+</form>
+<form action="{{.Prefix}}logout" method="post">
+    {{.CSRFField}}
+    <button type="submit">Log out</button>
+</form>
+</body>
+</html>
+{{end}}
+
+{{define "logout"}}<!DOCTYPE html>
+<html>
+<head><title>Log out</title></head>
+<body>
+<h1>Log out</h1>
+{{template "messages" .}}
+<form action="{{.Prefix}}logout" method="post">
+    {{.CSRFField}}
+    <button type="submit">Log out</button>
+</form>
+</body>
+</html>
+{{end}}
+`
@@ -0,0 +1,131 @@
+package httpauth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// Account statuses. Only StatusActive and StatusDisabled are stored in
+// UserData.Status; a user is locked or expired because of LockedUntil and
+// ExpiresAt. An empty Status is the same as StatusActive.
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+	StatusLocked   = "locked"
+	StatusExpired  = "expired"
+)
+
+// ErrAccountDisabled, ErrAccountLocked and ErrAccountExpired are returned by
+// Login and Authorize for users whose account isn't active.
+var (
+	ErrAccountDisabled = mkerror("account disabled")
+	ErrAccountLocked   = mkerror("account locked")
+	ErrAccountExpired  = mkerror("account expired")
+)
+
+// AccountStatus returns the status of a user's account at a given time.
+// Disabled accounts are reported as such even if also locked or expired.
+func (u UserData) AccountStatus(now time.Time) string {
+	switch {
+	case u.Status == StatusDisabled:
+		return StatusDisabled
+	case !u.ExpiresAt.IsZero() && !now.Before(u.ExpiresAt):
+		return StatusExpired
+	case now.Before(u.LockedUntil):
+		return StatusLocked
+	}
+	return StatusActive
+}
+
+// statusError returns a message and error for a user whose account isn't
+// active, or a nil error.
+func statusError(user UserData) (string, error) {
+	var (
+		msg string
+		err error
+	)
+	switch user.AccountStatus(time.Now()) {
+	case StatusDisabled:
+		msg, err = "Your account has been disabled", ErrAccountDisabled
+	case StatusLocked:
+		msg, err = "Your account is locked until "+user.LockedUntil.Format("Jan 2, 2006 15:04 MST"), ErrAccountLocked
+	case StatusExpired:
+		return "Your account has expired.", ErrAccountExpired
+	default:
+		return "", nil
+	}
+	if user.StatusReason != "" {
+		return msg + ": " + user.StatusReason, err
+	}
+	return msg + ".", err
+}
+
+// checkStatus ends the session of a user whose account isn't active, adding a
+// message with the reason.
+func (a Authorizer) checkStatus(rw http.ResponseWriter, req *http.Request, authSession *sessions.Session, user UserData) error {
+	msg, err := statusError(user)
+	if err == nil {
+		return nil
+	}
+	authSession.Options.MaxAge = -1 // kill the cookie
+	authSession.Save(req, rw)
+	a.addMessage(rw, req, msg)
+	return err
+}
+
+// DisableUser suspends a user's account until EnableUser is called. Their
+// data is kept, but they can't log in, and their sessions end. The reason is
+// shown to them when they try.
+func (a Authorizer) DisableUser(username string, reason string) error {
+	return a.updateStatus(username, ActionDisableUser, func(user *UserData) {
+		user.Status = StatusDisabled
+		user.StatusReason = reason
+	})
+}
+
+// LockUser prevents a user from logging in until a given time, ending their
+// sessions. The reason is shown to them when they try.
+func (a Authorizer) LockUser(username string, until time.Time, reason string) error {
+	return a.updateStatus(username, ActionLockUser, func(user *UserData) {
+		user.LockedUntil = until
+		user.StatusReason = reason
+	})
+}
+
+// EnableUser reactivates a user who was disabled or locked. It doesn't change
+// when their account expires.
+func (a Authorizer) EnableUser(username string) error {
+	return a.updateStatus(username, ActionEnableUser, func(user *UserData) {
+		user.Status = StatusActive
+		user.StatusReason = ""
+		user.LockedUntil = time.Time{}
+	})
+}
+
+// SetUserExpiry sets when a user's account expires. A zero time means it
+// never does.
+func (a Authorizer) SetUserExpiry(username string, expires time.Time) error {
+	return a.updateStatus(username, ActionSetUserExpiry, func(user *UserData) {
+		user.ExpiresAt = expires
+	})
+}
+
+func (a Authorizer) updateStatus(username string, action string, update func(user *UserData)) (err error) {
+	req := a.originRequest()
+	defer func() { a.audit(req, action, a.requestActor(req), username, err) }()
+	user, err := a.backend.User(username)
+	if err == ErrMissingUser {
+		return err
+	} else if err != nil {
+		return mkerror(err.Error())
+	}
+	update(&user)
+	user.UpdatedAt = time.Now()
+	a.bumpVersion(&user)
+	if err := a.backend.SaveUser(user); err != nil {
+		return mkerror(err.Error())
+	}
+	return a.afterHooks(action, req, user)
+}
@@ -0,0 +1,95 @@
+package httpauth
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccountStatus(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		user   UserData
+		status string
+	}{
+		{UserData{}, StatusActive},
+		{UserData{Status: StatusActive, LockedUntil: now.Add(-time.Minute)}, StatusActive},
+		{UserData{Status: StatusDisabled, LockedUntil: now.Add(time.Minute)}, StatusDisabled},
+		{UserData{LockedUntil: now.Add(time.Minute)}, StatusLocked},
+		{UserData{ExpiresAt: now.Add(time.Minute)}, StatusActive},
+		{UserData{ExpiresAt: now.Add(-time.Minute), LockedUntil: now.Add(time.Minute)}, StatusExpired},
+	}
+	for i, test := range tests {
+		if status := test.user.AccountStatus(now); status != test.status {
+			t.Errorf("%d: expected %s, got %s", i, test.status, status)
+		}
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "accountStatus_test.gob")
+	defer done()
+	cookies := testLogin(t, auth, "suspended", "user")
+
+	if err := auth.DisableUser("nobody", ""); err != ErrMissingUser {
+		t.Fatalf("DisableUser: expected ErrMissingUser, got %v", err)
+	}
+	if err := auth.DisableUser("suspended", "unpaid invoices"); err != nil {
+		t.Fatalf("DisableUser: %v", err)
+	}
+	rw := httptest.NewRecorder()
+	if err := auth.Authorize(rw, requestWithCookies("GET", "/", cookies), false); err != ErrAccountDisabled {
+		t.Fatalf("Authorize: expected ErrAccountDisabled, got %v", err)
+	}
+	cookies = responseCookies(rw)
+	messages := auth.Messages(rw, requestWithCookies("GET", "/", cookies))
+	if len(messages) != 1 || !strings.Contains(messages[0], "unpaid invoices") {
+		t.Errorf("Messages: reason not shown: %v", messages)
+	}
+	for _, c := range cookies {
+		if c.Name == "auth" && c.MaxAge >= 0 {
+			t.Error("Authorize: session not ended")
+		}
+	}
+
+	rw = httptest.NewRecorder()
+	if err := auth.Login(rw, requestWithCookies("POST", "/", nil), "suspended", "password", "/"); err != ErrAccountDisabled {
+		t.Fatalf("Login: expected ErrAccountDisabled, got %v", err)
+	}
+
+	if err := auth.EnableUser("suspended"); err != nil {
+		t.Fatalf("EnableUser: %v", err)
+	}
+	rw = httptest.NewRecorder()
+	if err := auth.Login(rw, requestWithCookies("POST", "/", nil), "suspended", "password", "/"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	cookies = responseCookies(rw)
+
+	if err := auth.LockUser("suspended", time.Now().Add(time.Hour), "too many attempts"); err != nil {
+		t.Fatalf("LockUser: %v", err)
+	}
+	rw = httptest.NewRecorder()
+	if err := auth.Authorize(rw, requestWithCookies("GET", "/", cookies), false); err != ErrAccountLocked {
+		t.Fatalf("Authorize: expected ErrAccountLocked, got %v", err)
+	}
+	if err := auth.EnableUser("suspended"); err != nil {
+		t.Fatalf("EnableUser: %v", err)
+	}
+
+	if err := auth.SetUserExpiry("suspended", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("SetUserExpiry: %v", err)
+	}
+	rw = httptest.NewRecorder()
+	if err := auth.Login(rw, requestWithCookies("POST", "/", nil), "suspended", "password", "/"); err != ErrAccountExpired {
+		t.Fatalf("Login: expected ErrAccountExpired, got %v", err)
+	}
+	if err := auth.SetUserExpiry("suspended", time.Time{}); err != nil {
+		t.Fatalf("SetUserExpiry: %v", err)
+	}
+	rw = httptest.NewRecorder()
+	if err := auth.Login(rw, requestWithCookies("POST", "/", nil), "suspended", "password", "/"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package httpauth
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var csrfPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// accountClient is a browser visiting pages mounted at prefix.
+type accountClient struct {
+	t      *testing.T
+	server *httptest.Server
+	prefix string
+	client *http.Client
+	token  string
+}
+
+func (c *accountClient) get(page string) (int, string) {
+	resp, err := c.client.Get(c.server.URL + c.prefix + page)
+	return c.read(resp, err)
+}
+
+func (c *accountClient) post(page string, form url.Values) (int, string) {
+	form.Set(CSRFField, c.token)
+	resp, err := c.client.PostForm(c.server.URL+c.prefix+page, form)
+	return c.read(resp, err)
+}
+
+func (c *accountClient) read(resp *http.Response, err error) (int, string) {
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if m := csrfPattern.FindSubmatch(body); m != nil {
+		c.token = string(m[1])
+	}
+	return resp.StatusCode, string(body)
+}
+
+func newAccountClient(t *testing.T, server *httptest.Server, prefix string) *accountClient {
+	jar, _ := cookiejar.New(nil)
+	return &accountClient{t: t, server: server, prefix: prefix, client: &http.Client{Jar: jar}}
+}
+
+func TestAccountPages(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "account_test.gob")
+	defer done()
+	pages := auth.AccountHandler("/account/")
+	template.Must(pages.Templates.New("logout").Parse(`custom logout {{.CSRFField}}`))
+	mux := http.NewServeMux()
+	mux.Handle("/account/", pages)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c := newAccountClient(t, server, "/account/")
+
+	if status, body := c.get(""); status != http.StatusOK || !strings.Contains(body, "Log in to do that.") {
+		t.Fatalf("account page didn't send to login: %d %s", status, body)
+	}
+	if c.token == "" {
+		t.Fatal("login page has no CSRF token")
+	}
+
+	token := c.token
+	c.token = "forged"
+	if status, _ := c.post("register", url.Values{"username": {"web"}, "email": {"web@example.com"}, "password": {"pw"}, "confirm_password": {"pw"}}); status != http.StatusForbidden {
+		t.Errorf("forged CSRF token accepted: %d", status)
+	}
+	c.token = token
+	if _, err := auth.backend.User("web"); err != ErrMissingUser {
+		t.Fatal("user registered despite forged CSRF token")
+	}
+
+	if _, body := c.post("register", url.Values{"username": {"web"}, "password": {"pw"}, "confirm_password": {"pw"}}); !strings.Contains(body, "No email given.") {
+		t.Errorf("missing email not flashed: %s", body)
+	}
+	if _, body := c.post("register", url.Values{"username": {"web"}, "email": {"web@example.com"}, "password": {"pw"}, "confirm_password": {"other"}}); !strings.Contains(body, "Passwords don&#39;t match.") {
+		t.Errorf("mismatched passwords not flashed: %s", body)
+	}
+	status, body := c.post("register", url.Values{"username": {"web"}, "email": {"web@example.com"}, "password": {"pw"}, "confirm_password": {"pw"}})
+	if status != http.StatusOK || !strings.Contains(body, "<h1>web</h1>") || !strings.Contains(body, "Account created.") {
+		t.Fatalf("register didn't log in: %d %s", status, body)
+	}
+
+	if _, body := c.post("email", url.Values{"new_email": {"new@example.com"}, "password": {"wrong"}}); !strings.Contains(body, "Invalid password.") {
+		t.Errorf("email changed with the wrong password: %s", body)
+	}
+	if _, body := c.post("email", url.Values{"new_email": {"new@example.com"}, "password": {"pw"}}); !strings.Contains(body, "Email changed.") || !strings.Contains(body, `value="new@example.com"`) {
+		t.Errorf("email not changed: %s", body)
+	}
+	if _, body := c.post("password", url.Values{"password": {"pw"}, "new_password": {"pw2"}, "confirm_password": {"pw2"}}); !strings.Contains(body, "Password changed.") {
+		t.Errorf("password not changed: %s", body)
+	}
+
+	if _, body := c.get("logout"); !strings.Contains(body, "custom logout") {
+		t.Errorf("overridden template not used: %s", body)
+	}
+	if _, body := c.post("logout", url.Values{}); !strings.Contains(body, "Logged out.") {
+		t.Errorf("logout: %s", body)
+	}
+	if _, body := c.post("login", url.Values{"username": {"web"}, "password": {"pw"}}); !strings.Contains(body, "Invalid username or password.") {
+		t.Errorf("old password still works: %s", body)
+	}
+	if _, body := c.post("login", url.Values{"username": {"web"}, "password": {"pw2"}}); !strings.Contains(body, "<h1>web</h1>") {
+		t.Errorf("login with new password failed: %s", body)
+	}
+	if status, _ := c.get("nothing"); status != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", status)
+	}
+}
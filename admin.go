@@ -0,0 +1,404 @@
+package httpauth
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminPages serves user management pages under a path prefix to users
+// holding a role, who can only manage users whose role isn't higher than
+// theirs, and can't give anyone a higher one:
+//
+//     prefix                   users, searched with ?q= by username prefix,
+//                              or email prefix if it contains an @, and the
+//                              roles defined (GET)
+//     prefix+"users/"+username edit a user (GET); POST with action "update"
+//                              (email, role), "password" (new_password),
+//                              "disable" (reason), "enable" or "delete"
+//
+// Every POST must carry the CSRF token passed to the templates. Admins can't
+// change the role of, disable or delete their own account.
+type AdminPages struct {
+	// Templates holds the "users" and "user" templates, executed with an
+	// AdminPage. Redefine either before serving requests to change how the
+	// pages look.
+	Templates *template.Template
+	// PerPage is the number of users listed per page. Defaults to 25.
+	PerPage int
+	// Login is where users who aren't logged in are sent. Defaults to "/".
+	Login string
+
+	a      Authorizer
+	prefix string
+	role   string
+}
+
+// AdminPage is the data admin templates are executed with.
+type AdminPage struct {
+	AccountPage
+	Users    []UserData // the users on the current page of the list
+	Query    string
+	Page     int // 1-based
+	Pages    int
+	PrevPage int    // 0 on the first page
+	NextPage int    // 0 on the last page
+	Before   string // cursor of the previous page, passed as ?before=
+	After    string // cursor of the next page, passed as ?after=
+	Roles    []RoleInfo
+	Now      time.Time // for calling AccountStatus
+}
+
+// RoleInfo describes a role and the permissions granted to it directly.
+type RoleInfo struct {
+	Name        string   `json:"name"`
+	Level       Role     `json:"level"`
+	Permissions []string `json:"permissions"`
+}
+
+// AdminHandler returns user management pages to be mounted at prefix, which
+// should end with a slash, usable by users passing AuthorizeRole for role:
+//
+//     http.Handle("/admin/", aaa.AdminHandler("/admin/", "admin"))
+func (a Authorizer) AdminHandler(prefix string, role string) *AdminPages {
+	return &AdminPages{
+		Templates: template.Must(template.New("admin").Parse(defaultAdminTemplates)),
+		PerPage:   25,
+		Login:     "/",
+		a:         a,
+		prefix:    prefix,
+		role:      role,
+	}
+}
+
+// Roles returns the roles defined, highest first.
+func (a Authorizer) Roles() []RoleInfo {
+	var roles []RoleInfo
+	for name, level := range a.roles {
+		roles = append(roles, RoleInfo{name, level, a.permissions[name]})
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		if roles[i].Level != roles[j].Level {
+			return roles[i].Level > roles[j].Level
+		}
+		return roles[i].Name < roles[j].Name
+	})
+	return roles
+}
+
+func (p *AdminPages) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if err := p.a.AuthorizeRole(rw, req, p.role, true); err != nil {
+		if status, _ := apiError(err, apiState{}); status == http.StatusUnauthorized {
+			http.Redirect(rw, req, p.Login, http.StatusSeeOther)
+		} else {
+			http.Error(rw, "You don't have sufficient privileges.", http.StatusForbidden)
+		}
+		return
+	}
+	page := strings.TrimPrefix(req.URL.Path, p.prefix)
+	username := strings.TrimPrefix(page, "users/")
+	switch {
+	case req.Method == "POST" && username != page && username != "":
+		if err := p.a.CheckCSRF(rw, req); err != nil {
+			http.Error(rw, "Invalid or missing CSRF token.", http.StatusForbidden)
+			return
+		}
+		p.change(rw, req, username)
+	case req.Method != "GET" && req.Method != "HEAD":
+		rw.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(rw, "Method not allowed.", http.StatusMethodNotAllowed)
+	case page == "":
+		p.list(rw, req)
+	case username != page && username != "":
+		p.user(rw, req, username)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (p *AdminPages) list(rw http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	query := strings.TrimSpace(params.Get("q"))
+	perPage := p.PerPage
+	if perPage <= 0 {
+		perPage = 25
+	}
+	n, _ := strconv.Atoi(params.Get("page"))
+	q := UserQuery{Limit: perPage}
+	if strings.Contains(query, "@") {
+		q.EmailPrefix = query
+	} else {
+		q.UsernamePrefix = query
+	}
+	total, err := p.a.CountUsers(q)
+	if err != nil {
+		http.Error(rw, "Couldn't list users.", http.StatusInternalServerError)
+		return
+	}
+	users, more, less, err := p.search(q, params.Get("after"), params.Get("before"))
+	if err == ErrInvalidCursor {
+		http.Error(rw, "Invalid page.", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(rw, "Couldn't list users.", http.StatusInternalServerError)
+		return
+	}
+	pages := (total + perPage - 1) / perPage
+	if pages == 0 {
+		pages = 1
+	}
+	if !less || n < 1 {
+		n = 1
+	} else if n > pages {
+		n = pages
+	}
+
+	data, ok := p.newPage(rw, req)
+	if !ok {
+		return
+	}
+	data.Users = users
+	data.Query = query
+	data.Page, data.Pages = n, pages
+	if less && len(users) > 0 {
+		data.PrevPage = n - 1
+		if data.PrevPage < 1 {
+			data.PrevPage = 1
+		}
+		data.Before = usernameCursor(users[0], true)
+	}
+	if more && len(users) > 0 {
+		data.NextPage = n + 1
+		data.After = usernameCursor(users[len(users)-1], false)
+	}
+	p.a.executePage(rw, p.Templates, "users", data)
+}
+
+// search returns a page of the users matching q, in username order, after or
+// before a cursor, and whether there are users after and before the page.
+// Pages before a cursor are found by querying in reverse.
+func (p *AdminPages) search(q UserQuery, after string, before string) (users []UserData, more bool, less bool, err error) {
+	if before == "" {
+		q.Cursor = after
+		page, err := p.a.QueryUsers(q)
+		return page.Users, page.NextCursor != "", after != "", err
+	}
+	q.Sort, q.Cursor = "-"+SortByUsername, before
+	page, err := p.a.QueryUsers(q)
+	users = page.Users
+	for i, j := 0, len(users)-1; i < j; i, j = i+1, j-1 {
+		users[i], users[j] = users[j], users[i]
+	}
+	return users, true, page.NextCursor != "", err
+}
+
+// usernameCursor returns the cursor of a page of users sorted by username, or
+// in reverse, ending with user.
+func usernameCursor(user UserData, reverse bool) string {
+	q := UserQuery{}
+	if reverse {
+		q.Sort = "-" + SortByUsername
+	}
+	plan, _ := q.plan()
+	return plan.cursor(user)
+}
+
+func (p *AdminPages) user(rw http.ResponseWriter, req *http.Request, username string) {
+	user, err := p.a.backend.User(username)
+	if err == ErrMissingUser {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		http.Error(rw, "Couldn't load the user.", http.StatusInternalServerError)
+		return
+	}
+	data, ok := p.newPage(rw, req)
+	if !ok {
+		return
+	}
+	data.User = user
+	p.a.executePage(rw, p.Templates, "user", data)
+}
+
+func (p *AdminPages) change(rw http.ResponseWriter, req *http.Request, username string) {
+	a := p.a.ForRequest(req)
+	user, err := a.backend.User(username)
+	if err == ErrMissingUser {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		http.Error(rw, "Couldn't load the user.", http.StatusInternalServerError)
+		return
+	}
+	action, role := req.PostFormValue("action"), req.PostFormValue("role")
+	current, _ := a.CurrentUser(rw, req)
+	if current.Username == username && (action == "disable" || action == "delete" || (action == "update" && role != "" && role != user.Role)) {
+		a.addMessage(rw, req, "You can't do that to your own account.")
+		p.redirect(rw, req, "users/"+username)
+		return
+	}
+	newRole := ""
+	if action == "update" {
+		newRole = role
+	}
+	if err := a.checkRoleCeiling(current, user, newRole); err != nil {
+		a.addMessage(rw, req, "You can't manage users above your own role.")
+		p.redirect(rw, req, "users/"+username)
+		return
+	}
+
+	var message string
+	switch action {
+	case "update":
+		if email := req.PostFormValue("email"); email != "" && email != user.Email {
+			err = a.Update(rw, req, username, "", email)
+		}
+		if err == nil && role != "" && role != user.Role {
+			err = a.SetUserRole(username, role)
+		}
+		message = "Saved."
+	case "password":
+		if password := req.PostFormValue("new_password"); password == "" {
+			err = ErrNoPassword
+		} else {
+			err = a.Update(rw, req, username, password, "")
+		}
+		message = "Password reset."
+	case "disable":
+		err = a.DisableUser(username, req.PostFormValue("reason"))
+		message = "Account disabled."
+	case "enable":
+		err = a.EnableUser(username)
+		message = "Account enabled."
+	case "delete":
+		if err = a.DeleteUser(username); err == nil {
+			a.addMessage(rw, req, "User "+username+" deleted.")
+			p.redirect(rw, req, "")
+			return
+		}
+	default:
+		http.Error(rw, "Unknown action.", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		a.addMessage(rw, req, "Couldn't "+action+" "+username+": "+errorMessage(err)+".")
+	} else {
+		a.addMessage(rw, req, message)
+	}
+	p.redirect(rw, req, "users/"+username)
+}
+
+// checkRoleCeiling returns ErrInsufficientRole unless actor's highest role is
+// at least as high as target's and, if it isn't empty, newRole, so that
+// managing users can't grant more than the actor holds.
+func (a Authorizer) checkRoleCeiling(actor UserData, target UserData, newRole string) error {
+	actorRole, err := a.highestRole(actor)
+	if err != nil {
+		return mkerror(err.Error())
+	}
+	targetRole, err := a.highestRole(target)
+	if err != nil {
+		return mkerror(err.Error())
+	}
+	if targetRole > actorRole || a.roles[newRole] > actorRole {
+		return ErrInsufficientRole
+	}
+	return nil
+}
+
+func (p *AdminPages) newPage(rw http.ResponseWriter, req *http.Request) (AdminPage, bool) {
+	page, ok := p.a.newPage(rw, req, p.prefix)
+	return AdminPage{AccountPage: page, Roles: p.a.Roles(), Now: time.Now()}, ok
+}
+
+func (p *AdminPages) redirect(rw http.ResponseWriter, req *http.Request, page string) {
+	http.Redirect(rw, req, p.prefix+page, http.StatusSeeOther)
+}
+
+const defaultAdminTemplates = `
+{{define "messages"}}{{range .Messages}}<p class="message">{{.}}</p>
+{{end}}{{end}}
+
+{{define "users"}}<!DOCTYPE html>
+<html>
+<head><title>Users</title></head>
+<body>
+<h1>Users</h1>
+{{template "messages" .}}
+<form action="{{.Prefix}}" method="get">
+    <input type="search" name="q" value="{{.Query}}" placeholder="username or email">
+    <button type="submit">Search</button>
+</form>
+<table>
+<tr><th>Username</th><th>Email</th><th>Role</th><th>Status</th><th>Last login</th></tr>
+{{range .Users}}<tr>
+    <td><a href="{{$.Prefix}}users/{{.Username}}">{{.Username}}</a></td>
+    <td>{{.Email}}</td>
+    <td>{{.Role}}</td>
+    <td>{{.AccountStatus $.Now}}</td>
+    <td>{{if not .LastLoginAt.IsZero}}{{.LastLoginAt.Format "2006-01-02 15:04"}}{{end}}</td>
+</tr>
+{{else}}<tr><td colspan="5">No users found.</td></tr>
+{{end}}</table>
+<p>
+    {{if .PrevPage}}<a href="{{.Prefix}}?q={{.Query}}&amp;before={{.Before}}&amp;page={{.PrevPage}}">Previous</a>{{end}}
+    Page {{.Page}} of {{.Pages}}
+    {{if .NextPage}}<a href="{{.Prefix}}?q={{.Query}}&amp;after={{.After}}&amp;page={{.NextPage}}">Next</a>{{end}}
+</p>
+<h2>Roles</h2>
+<table>
+<tr><th>Role</th><th>Level</th><th>Permissions</th></tr>
+{{range .Roles}}<tr><td>{{.Name}}</td><td>{{.Level}}</td><td>{{range $i, $p := .Permissions}}{{if $i}}, {{end}}{{$p}}{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+{{end}}
+
+{{define "user"}}<!DOCTYPE html>
+<html>
+<head><title>{{.User.Username}}</title></head>
+<body>
+<p><a href="{{.Prefix}}">All users</a></p>
+<h1>{{.User.Username}}</h1>
+{{template "messages" .}}
+<p>Status: {{.User.AccountStatus .Now}}{{with .User.StatusReason}} ({{.}}){{end}}</p>
+<form method="post">
+    {{.CSRFField}}
+    <input type="hidden" name="action" value="update">
+    <input type="email" name="email" value="{{.User.Email}}" required><br>
+    <select name="role">
+    {{range .Roles}}<option value="{{.Name}}"{{if eq .Name $.User.Role}} selected{{end}}>{{.Name}}</option>
+    {{end}}</select><br>
+    <button type="submit">Save</button>
+</form>
+<h2>Reset password</h2>
+<form method="post">
+    {{.CSRFField}}
+    <input type="hidden" name="action" value="password">
+    <input type="password" name="new_password" placeholder="new password" required><br>
+    <button type="submit">Reset password</button>
+</form>
+<h2>Account</h2>
+{{$status := .User.AccountStatus .Now}}{{if or (eq $status "disabled") (eq $status "locked")}}<form method="post">
+    {{.CSRFField}}
+    <input type="hidden" name="action" value="enable">
+    <button type="submit">Enable</button>
+</form>
+{{else}}<form method="post">
+    {{.CSRFField}}
+    <input type="hidden" name="action" value="disable">
+    <input type="text" name="reason" placeholder="reason">
+    <button type="submit">Disable</button>
+</form>
+{{end}}<form method="post">
+    {{.CSRFField}}
+    <input type="hidden" name="action" value="delete">
+    <button type="submit">Delete</button>
+</form>
+</body>
+</html>
+{{end}}
+`
@@ -0,0 +1,609 @@
+package httpauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Page sizes of user lists served by AdminAPI.
+const (
+	defaultAPIPerPage = 50
+	maxAPIPerPage     = 500
+)
+
+// AdminAPI serves a versioned JSON API for managing users under a path
+// prefix:
+//
+//     GET    prefix+"v1/users"         list users, filtered by ?role=,
+//                                      ?username= and ?email= prefixes, sorted
+//                                      by ?sort=, paged with ?per_page= and
+//                                      ?cursor=
+//     POST   prefix+"v1/users"         create a user
+//     GET    prefix+"v1/users/{name}"  get a user, with an ETag
+//     PATCH  prefix+"v1/users/{name}"  change a user; If-Match is required
+//     DELETE prefix+"v1/users/{name}"  delete a user; If-Match is optional
+//     GET    prefix+"v1/roles"         list the roles defined
+//     GET    prefix+"v1/openapi.json"  the OpenAPI document describing the API
+//
+// Requests are authenticated with an API key added with AddAPIKey, sent as
+// "Authorization: Bearer <key>", or with the session of a user passing
+// AuthorizeRole for a role. Session-authenticated requests changing anything
+// must also send their CSRF token (see CSRFToken) in an X-CSRF-Token header,
+// and can only manage users whose role isn't higher than the session user's,
+// or give anyone a higher one. Errors are reported with APIErrors.
+//
+// Changes are audited with the session's user as actor or, for API keys,
+// "api-key:" followed by the first 8 hex digits of the key's SHA-256.
+type AdminAPI struct {
+	a      Authorizer
+	prefix string
+	role   string
+	keys   map[[sha256.Size]byte]bool
+
+	mu sync.Mutex // makes checking an ETag and changing the user atomic
+}
+
+// APIUserResponse is the body of responses describing one user.
+type APIUserResponse struct {
+	User APIUser `json:"user"`
+}
+
+// APIUserList is the body of user list responses. Total is the number of
+// users matching the filters, on every page. NextCursor is passed as ?cursor=
+// to get the next page, and is left out on the last.
+type APIUserList struct {
+	Users      []APIUser `json:"users"`
+	Total      int       `json:"total"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// APIRoleList is the body of role list responses.
+type APIRoleList struct {
+	Roles []RoleInfo `json:"roles"`
+}
+
+// APIErrorResponse is the body of error responses.
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIUserCreate is the body of requests creating a user. If Role is empty,
+// the default role is used.
+type APIUserCreate struct {
+	Username   string     `json:"username"`
+	Email      string     `json:"email"`
+	Password   string     `json:"password"`
+	Role       string     `json:"role,omitempty"`
+	Attributes Attributes `json:"attributes,omitempty"`
+}
+
+// APIUserPatch is the body of requests changing a user. Fields left out are
+// unchanged. Status may be "active" or "disabled", with StatusReason
+// explaining a disabling. Attributes are merged as by UpdateAttributes.
+type APIUserPatch struct {
+	Email        *string    `json:"email,omitempty"`
+	Role         *string    `json:"role,omitempty"`
+	Password     *string    `json:"password,omitempty"`
+	Status       *string    `json:"status,omitempty"`
+	StatusReason string     `json:"status_reason,omitempty"`
+	Attributes   Attributes `json:"attributes,omitempty"`
+}
+
+// AdminAPIHandler returns the user administration API to be mounted at
+// prefix, which should end with a slash, usable with an API key or by users
+// passing AuthorizeRole for role:
+//
+//     api := aaa.AdminAPIHandler("/api/", "admin")
+//     api.AddAPIKey(os.Getenv("OPS_API_KEY"))
+//     http.Handle("/api/", api)
+func (a Authorizer) AdminAPIHandler(prefix string, role string) *AdminAPI {
+	return &AdminAPI{a: a, prefix: prefix, role: role, keys: make(map[[sha256.Size]byte]bool)}
+}
+
+// AddAPIKey allows requests bearing key. Only its hash is kept. Keys should
+// be added before the API starts handling requests.
+func (api *AdminAPI) AddAPIKey(key string) {
+	api.keys[sha256.Sum256([]byte(key))] = true
+}
+
+// apiParam is a query or header parameter of an AdminAPI route.
+type apiParam struct {
+	name, in, typ, doc string
+	required           bool
+}
+
+// adminRoute describes an AdminAPI route, for serving it and documenting it.
+type adminRoute struct {
+	method   string
+	path     string // relative to the prefix; {name} matches a username
+	id       string
+	summary  string
+	params   []apiParam
+	request  interface{} // example of the request body, if any
+	status   int
+	response interface{} // example of the response body, if any
+	etag     bool        // whether the response carries an ETag
+	errors   []int
+	serve    func(api *AdminAPI, a Authorizer, rw http.ResponseWriter, req *http.Request, name string)
+}
+
+var adminRoutes = []adminRoute{
+	{"GET", "/v1/users", "listUsers", "List users", []apiParam{
+		{"role", "query", "string", "only users with this role", false},
+		{"username", "query", "string", "only users whose username starts with this, ignoring case", false},
+		{"email", "query", "string", "only users whose email starts with this, ignoring case", false},
+		{"sort", "query", "string", "username (the default), email, created or last_login, prefixed with - to sort in descending order", false},
+		{"per_page", "query", "integer", "users per page, at most 500; defaults to 50", false},
+		{"cursor", "query", "string", "next_cursor of the previous page", false},
+	}, nil, http.StatusOK, APIUserList{}, false, []int{400}, (*AdminAPI).listUsers},
+	{"POST", "/v1/users", "createUser", "Create a user", nil,
+		APIUserCreate{}, http.StatusCreated, APIUserResponse{}, true, []int{400, 409}, (*AdminAPI).createUser},
+	{"GET", "/v1/users/{name}", "getUser", "Get a user", nil,
+		nil, http.StatusOK, APIUserResponse{}, true, []int{404}, (*AdminAPI).getUser},
+	{"PATCH", "/v1/users/{name}", "updateUser", "Change a user", []apiParam{
+		{"If-Match", "header", "string", "ETag of the user as last read, or *", true},
+	}, APIUserPatch{}, http.StatusOK, APIUserResponse{}, true, []int{400, 404, 412, 428}, (*AdminAPI).updateUser},
+	{"DELETE", "/v1/users/{name}", "deleteUser", "Delete a user", []apiParam{
+		{"If-Match", "header", "string", "ETag of the user as last read, or *", false},
+	}, nil, http.StatusNoContent, nil, false, []int{404, 412}, (*AdminAPI).deleteUser},
+	{"GET", "/v1/roles", "listRoles", "List the roles defined", nil,
+		nil, http.StatusOK, APIRoleList{}, false, nil, (*AdminAPI).listRoles},
+}
+
+func (api *AdminAPI) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	path := "/" + strings.TrimPrefix(req.URL.Path, api.prefix)
+	if path == "/v1/openapi.json" && (req.Method == "GET" || req.Method == "HEAD") {
+		writeJSON(rw, http.StatusOK, api.OpenAPI())
+		return
+	}
+	var allowed []string
+	for _, route := range adminRoutes {
+		name, ok := matchRoute(route.path, path)
+		if !ok {
+			continue
+		}
+		if route.method != req.Method {
+			allowed = append(allowed, route.method)
+			continue
+		}
+		a, ok := api.authenticate(rw, req)
+		if ok {
+			route.serve(api, a, rw, req, name)
+		}
+		return
+	}
+	if len(allowed) > 0 {
+		rw.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeAPIError(rw, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use "+strings.Join(allowed, " or "))
+		return
+	}
+	writeAPIError(rw, http.StatusNotFound, CodeNotFound, "no such endpoint")
+}
+
+// matchRoute matches a path against a route's, returning the username
+// matched by {name}.
+func matchRoute(pattern string, path string) (name string, ok bool) {
+	want, got := strings.Split(pattern, "/"), strings.Split(path, "/")
+	if len(want) != len(got) {
+		return "", false
+	}
+	for i := range want {
+		if want[i] == "{name}" && got[i] != "" {
+			name = got[i]
+		} else if want[i] != got[i] {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// authenticate checks a request's API key or session, responding with an
+// error if neither will do. It returns the Authorizer to handle the request
+// with.
+func (api *AdminAPI) authenticate(rw http.ResponseWriter, req *http.Request) (Authorizer, bool) {
+	a := api.a.apiCopy()
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+		if !api.keys[sum] {
+			writeAPIError(rw, http.StatusUnauthorized, CodeNotAuthenticated, "invalid API key")
+			return a, false
+		}
+		return a.actingAs(req, "api-key:"+hex.EncodeToString(sum[:4])), true
+	}
+	a = a.ForRequest(req)
+	if err := a.AuthorizeRole(rw, req, api.role, false); err != nil {
+		a.writeError(rw, err)
+		return a, false
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		if err := a.CheckCSRF(rw, req); err != nil {
+			writeAPIError(rw, http.StatusForbidden, CodeForbidden, "missing or invalid X-CSRF-Token header")
+			return a, false
+		}
+	}
+	return a, true
+}
+
+func (api *AdminAPI) listUsers(a Authorizer, rw http.ResponseWriter, req *http.Request, _ string) {
+	query := req.URL.Query()
+	perPage := defaultAPIPerPage
+	if s := query.Get("per_page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxAPIPerPage {
+			writeAPIError(rw, http.StatusBadRequest, CodeInvalidRequest, "invalid per_page")
+			return
+		}
+		perPage = n
+	}
+	q := UserQuery{
+		Role:           query.Get("role"),
+		UsernamePrefix: query.Get("username"),
+		EmailPrefix:    query.Get("email"),
+		Sort:           query.Get("sort"),
+		Limit:          perPage,
+		Cursor:         query.Get("cursor"),
+	}
+	page, err := a.QueryUsers(q)
+	if err == ErrInvalidCursor || err == ErrInvalidSort {
+		writeAPIError(rw, http.StatusBadRequest, CodeInvalidRequest, errorMessage(err))
+		return
+	} else if err != nil {
+		a.writeError(rw, err)
+		return
+	}
+	list := APIUserList{Users: []APIUser{}, NextCursor: page.NextCursor}
+	if list.Total, err = a.CountUsers(q); err != nil {
+		a.writeError(rw, err)
+		return
+	}
+	for _, user := range page.Users {
+		list.Users = append(list.Users, NewAPIUser(user))
+	}
+	writeJSON(rw, http.StatusOK, list)
+}
+
+func (api *AdminAPI) createUser(a Authorizer, rw http.ResponseWriter, req *http.Request, _ string) {
+	var body APIUserCreate
+	if !decodeJSON(rw, req, &body) {
+		return
+	}
+	role := body.Role
+	if role == "" {
+		role = a.defaultRole
+	}
+	if err := a.checkAdminRoleCeiling(rw, req, UserData{}, role); err != nil {
+		a.writeError(rw, err)
+		return
+	}
+	user := UserData{Username: body.Username, Email: body.Email, Role: body.Role, Attributes: body.Attributes}
+	if err := a.Register(rw, req, user, body.Password); err != nil {
+		a.writeError(rw, err)
+		return
+	}
+	rw.Header().Set("Location", api.prefix+"v1/users/"+body.Username)
+	api.writeUser(a, rw, body.Username, http.StatusCreated)
+}
+
+func (api *AdminAPI) getUser(a Authorizer, rw http.ResponseWriter, req *http.Request, name string) {
+	api.writeUser(a, rw, name, http.StatusOK)
+}
+
+func (api *AdminAPI) updateUser(a Authorizer, rw http.ResponseWriter, req *http.Request, name string) {
+	var body APIUserPatch
+	if !decodeJSON(rw, req, &body) {
+		return
+	}
+	if req.Header.Get("If-Match") == "" {
+		writeAPIError(rw, http.StatusPreconditionRequired, CodePreconditionRequired, "If-Match header required")
+		return
+	}
+	if msg := body.validate(a); msg != "" {
+		writeAPIError(rw, http.StatusBadRequest, CodeInvalidRequest, msg)
+		return
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	user, ok := api.checkETag(a, rw, req, name)
+	if !ok {
+		return
+	}
+	if err := a.applyPatch(rw, req, user, body); err != nil {
+		a.writeError(rw, err)
+		return
+	}
+	api.writeUser(a, rw, name, http.StatusOK)
+}
+
+// validate returns why a patch can't be applied, or "" if it can.
+func (patch APIUserPatch) validate(a Authorizer) string {
+	switch {
+	case patch.Email != nil && *patch.Email == "":
+		return "email can't be empty"
+	case patch.Password != nil && *patch.Password == "":
+		return "password can't be empty"
+	case patch.Status != nil && *patch.Status != StatusActive && *patch.Status != StatusDisabled:
+		return "status must be active or disabled"
+	}
+	if patch.Role != nil {
+		if _, ok := a.roles[*patch.Role]; !ok {
+			return errorMessage(ErrNonexistentRole)
+		}
+	}
+	if err := validateAttributes(patch.Attributes); err != nil {
+		return errorMessage(err)
+	}
+	return ""
+}
+
+// checkAdminRoleCeiling makes sure the admin whose session a request was
+// made with can manage target and give users newRole, if it isn't empty. API
+// keys and SCIM tokens can manage every user.
+func (a Authorizer) checkAdminRoleCeiling(rw http.ResponseWriter, req *http.Request, target UserData, newRole string) error {
+	if a.origin != nil && a.origin.actor != "" {
+		return nil
+	}
+	actor, err := a.CurrentUser(rw, req)
+	if err != nil {
+		return err
+	}
+	return a.checkRoleCeiling(actor, target, newRole)
+}
+
+// applyPatch makes the changes described by a validated patch to a user.
+func (a Authorizer) applyPatch(rw http.ResponseWriter, req *http.Request, user UserData, patch APIUserPatch) error {
+	newRole := ""
+	if patch.Role != nil {
+		newRole = *patch.Role
+	}
+	if err := a.checkAdminRoleCeiling(rw, req, user, newRole); err != nil {
+		return err
+	}
+	if patch.Email != nil || patch.Password != nil {
+		var email, password string
+		if patch.Email != nil && *patch.Email != user.Email {
+			email = *patch.Email
+		}
+		if patch.Password != nil {
+			password = *patch.Password
+		}
+		if email != "" || password != "" {
+			if err := a.Update(rw, req, user.Username, password, email); err != nil {
+				return err
+			}
+		}
+	}
+	if patch.Role != nil && *patch.Role != user.Role {
+		if err := a.SetUserRole(user.Username, *patch.Role); err != nil {
+			return err
+		}
+	}
+	if patch.Status != nil {
+		var err error
+		if *patch.Status == StatusDisabled {
+			err = a.DisableUser(user.Username, patch.StatusReason)
+		} else if user.AccountStatus(time.Now()) != StatusActive {
+			err = a.EnableUser(user.Username)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(patch.Attributes) > 0 {
+		return a.UpdateAttributes(rw, req, user.Username, patch.Attributes)
+	}
+	return nil
+}
+
+func (api *AdminAPI) deleteUser(a Authorizer, rw http.ResponseWriter, req *http.Request, name string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	user, ok := api.checkETag(a, rw, req, name)
+	if !ok {
+		return
+	}
+	if err := a.checkAdminRoleCeiling(rw, req, user, ""); err != nil {
+		a.writeError(rw, err)
+		return
+	}
+	if err := a.DeleteUser(name); err != nil {
+		a.writeError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (api *AdminAPI) listRoles(a Authorizer, rw http.ResponseWriter, req *http.Request, _ string) {
+	writeJSON(rw, http.StatusOK, APIRoleList{a.Roles()})
+}
+
+// loadUser loads a user, responding with an error if they can't be.
+func (api *AdminAPI) loadUser(a Authorizer, rw http.ResponseWriter, name string) (UserData, bool) {
+	user, err := a.backend.User(name)
+	if err == ErrMissingUser {
+		writeAPIError(rw, http.StatusNotFound, CodeNotFound, "no such user")
+		return user, false
+	} else if err != nil {
+		a.writeError(rw, mkerror(err.Error()))
+		return user, false
+	}
+	return user, true
+}
+
+// checkETag loads a user and makes sure they match the request's If-Match
+// header, if any.
+func (api *AdminAPI) checkETag(a Authorizer, rw http.ResponseWriter, req *http.Request, name string) (UserData, bool) {
+	user, ok := api.loadUser(a, rw, name)
+	if !ok {
+		return user, false
+	}
+	if match := req.Header.Get("If-Match"); match != "" && match != "*" && match != userETag(user) {
+		rw.Header().Set("ETag", userETag(user))
+		writeAPIError(rw, http.StatusPreconditionFailed, CodePreconditionFailed, "user has changed")
+		return user, false
+	}
+	return user, true
+}
+
+func (api *AdminAPI) writeUser(a Authorizer, rw http.ResponseWriter, name string, status int) {
+	user, ok := api.loadUser(a, rw, name)
+	if !ok {
+		return
+	}
+	rw.Header().Set("ETag", userETag(user))
+	writeJSON(rw, status, APIUserResponse{NewAPIUser(user)})
+}
+
+// userETag returns an entity tag changing whenever a user does.
+func userETag(user UserData) string {
+	h := sha256.New()
+	json.NewEncoder(h).Encode(user)
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// OpenAPI returns an OpenAPI 3 document describing the API, generated from
+// the routes it serves and the types of their bodies.
+func (api *AdminAPI) OpenAPI() map[string]interface{} {
+	schemas := schemaSet{}
+	errorBody := map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(APIErrorResponse{}))},
+	}
+	paths := make(map[string]map[string]interface{})
+	for _, route := range adminRoutes {
+		op := map[string]interface{}{"operationId": route.id, "summary": route.summary}
+		var params []interface{}
+		if strings.Contains(route.path, "{name}") {
+			params = append(params, map[string]interface{}{
+				"name": "name", "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, p := range route.params {
+			params = append(params, map[string]interface{}{
+				"name": p.name, "in": p.in, "required": p.required, "description": p.doc,
+				"schema": map[string]interface{}{"type": p.typ},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if route.request != nil {
+			op["requestBody"] = map[string]interface{}{"required": true, "content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(route.request))},
+			}}
+		}
+		success := map[string]interface{}{"description": http.StatusText(route.status)}
+		if route.response != nil {
+			success["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(route.response))},
+			}
+		}
+		if route.etag {
+			success["headers"] = map[string]interface{}{
+				"ETag": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			}
+		}
+		responses := map[string]interface{}{strconv.Itoa(route.status): success}
+		for _, status := range append([]int{401, 403}, route.errors...) {
+			responses[strconv.Itoa(status)] = map[string]interface{}{"description": http.StatusText(status), "content": errorBody}
+		}
+		op["responses"] = responses
+		if paths[route.path] == nil {
+			paths[route.path] = make(map[string]interface{})
+		}
+		paths[route.path][strings.ToLower(route.method)] = op
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "httpauth user administration", "version": "1"},
+		"servers": []interface{}{map[string]interface{}{"url": strings.TrimSuffix(api.prefix, "/")}},
+		"paths":   paths,
+		"security": []interface{}{
+			map[string]interface{}{"apiKey": []string{}},
+			map[string]interface{}{"session": []string{}},
+		},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"apiKey":  map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "auth"},
+			},
+		},
+	}
+}
+
+// schemaSet collects the JSON schemas of the struct types used in an OpenAPI
+// document, by name.
+type schemaSet map[string]interface{}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the JSON schema of a type, referring to struct types by name
+// and adding them to the set.
+func (s schemaSet) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		return s.schema(t.Elem())
+	case t.Kind() == reflect.Struct:
+		if _, ok := s[t.Name()]; !ok {
+			s[t.Name()] = nil // in case it refers to itself
+			s[t.Name()] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	panic(fmt.Sprintf("httpauth: no JSON schema for %v", t))
+}
+
+// object returns the JSON schema of a struct, following its json tags. Fields
+// which aren't omitempty or pointers are required.
+func (s schemaSet) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name, options := f.Name, ""
+		if tag := strings.SplitN(f.Tag.Get("json"), ",", 2); tag[0] == "-" {
+			continue
+		} else {
+			if tag[0] != "" {
+				name = tag[0]
+			}
+			if len(tag) > 1 {
+				options = tag[1]
+			}
+		}
+		properties[name] = s.schema(f.Type)
+		if !strings.Contains(options, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+	object := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		object["required"] = required
+	}
+	return object
+}
@@ -0,0 +1,246 @@
+package httpauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminAPI(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "adminAPI_test.gob")
+	defer done()
+	api := auth.AdminAPIHandler("/api/", "admin")
+	api.AddAPIKey("ops-key")
+
+	call := func(method string, path string, body string, header http.Header) (*httptest.ResponseRecorder, map[string]json.RawMessage) {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		for key := range header {
+			req.Header.Set(key, header.Get(key))
+		}
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, req)
+		var decoded map[string]json.RawMessage
+		json.Unmarshal(rw.Body.Bytes(), &decoded)
+		return rw, decoded
+	}
+	key := http.Header{"Authorization": {"Bearer ops-key"}}
+	withKey := func(name, value string) http.Header {
+		h := http.Header{"Authorization": {"Bearer ops-key"}}
+		h.Set(name, value)
+		return h
+	}
+
+	if rw, body := call("GET", "/api/v1/users", "", nil); rw.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request: %d %s", rw.Code, body)
+	}
+	if rw, _ := call("GET", "/api/v1/users", "", http.Header{"Authorization": {"Bearer wrong"}}); rw.Code != http.StatusUnauthorized {
+		t.Errorf("wrong API key accepted: %d", rw.Code)
+	}
+
+	for _, u := range []string{`{"username": "carol", "email": "carol@example.com", "password": "pw", "role": "admin"}`,
+		`{"username": "alice", "email": "Alice@Example.com", "password": "pw"}`,
+		`{"username": "bob", "email": "bob@example.com", "password": "pw", "attributes": {"team": "ops"}}`} {
+		if rw, _ := call("POST", "/api/v1/users", u, key); rw.Code != http.StatusCreated || rw.Header().Get("ETag") == "" || !strings.HasPrefix(rw.Header().Get("Location"), "/api/v1/users/") {
+			t.Fatalf("create: %d %s", rw.Code, rw.Body.String())
+		}
+	}
+	if rw, _ := call("POST", "/api/v1/users", `{"username": "bob", "email": "bob@example.com", "password": "pw"}`, key); rw.Code != http.StatusConflict {
+		t.Errorf("duplicate created: %d", rw.Code)
+	}
+	if rw, _ := call("POST", "/api/v1/users", `{"username": "dan", "email": "dan@example.com", "password": "pw", "role": "god"}`, key); rw.Code != http.StatusBadRequest {
+		t.Errorf("bad role accepted: %d", rw.Code)
+	}
+
+	var list APIUserList
+	rw, _ := call("GET", "/api/v1/users?per_page=2", "", key)
+	json.Unmarshal(rw.Body.Bytes(), &list)
+	if list.Total != 3 || len(list.Users) != 2 || list.Users[1].Username != "bob" || list.NextCursor == "" {
+		t.Errorf("page 1: %+v", list)
+	}
+	rw, _ = call("GET", "/api/v1/users?per_page=2&cursor="+list.NextCursor, "", key)
+	list = APIUserList{}
+	json.Unmarshal(rw.Body.Bytes(), &list)
+	if list.Total != 3 || len(list.Users) != 1 || list.Users[0].Username != "carol" || list.NextCursor != "" {
+		t.Errorf("page 2: %+v", list)
+	}
+	_, body := call("GET", "/api/v1/users?role=user&email=ALICE@", "", key)
+	if json.Unmarshal(body["users"], &list.Users); len(list.Users) != 1 || list.Users[0].Username != "alice" {
+		t.Errorf("filtered: %+v", list.Users)
+	}
+	_, body = call("GET", "/api/v1/users?sort=-username&username=b", "", key)
+	if json.Unmarshal(body["users"], &list.Users); len(list.Users) != 1 || list.Users[0].Username != "bob" {
+		t.Errorf("filtered by username: %+v", list.Users)
+	}
+	for _, params := range []string{"per_page=1000", "sort=age", "cursor=nonsense"} {
+		if rw, _ := call("GET", "/api/v1/users?"+params, "", key); rw.Code != http.StatusBadRequest {
+			t.Errorf("%s accepted: %d", params, rw.Code)
+		}
+	}
+
+	rw, body = call("GET", "/api/v1/users/bob", "", key)
+	etag := rw.Header().Get("ETag")
+	if rw.Code != http.StatusOK || etag == "" || !strings.Contains(string(body["user"]), `"team":"ops"`) {
+		t.Fatalf("get: %d %s", rw.Code, rw.Body.String())
+	}
+	if rw, _ = call("GET", "/api/v1/users/nobody", "", key); rw.Code != http.StatusNotFound {
+		t.Errorf("missing user: %d", rw.Code)
+	}
+
+	patch := `{"email": "robert@example.com", "role": "admin", "status": "disabled", "status_reason": "left", "attributes": {"team": ""}}`
+	if rw, _ = call("PATCH", "/api/v1/users/bob", patch, key); rw.Code != http.StatusPreconditionRequired {
+		t.Errorf("patch without If-Match: %d", rw.Code)
+	}
+	if rw, _ = call("PATCH", "/api/v1/users/bob", patch, withKey("If-Match", `"stale"`)); rw.Code != http.StatusPreconditionFailed || rw.Header().Get("ETag") != etag {
+		t.Errorf("patch with stale If-Match: %d", rw.Code)
+	}
+	rw, body = call("PATCH", "/api/v1/users/bob", patch, withKey("If-Match", etag))
+	var user APIUser
+	json.Unmarshal(body["user"], &user)
+	if rw.Code != http.StatusOK || user.Email != "robert@example.com" || user.Role != "admin" || user.Status != StatusDisabled || len(user.Attributes) != 0 {
+		t.Errorf("patch: %d %s", rw.Code, rw.Body.String())
+	}
+	if rw.Header().Get("ETag") == etag {
+		t.Errorf("ETag unchanged by patch")
+	}
+	if rw, _ = call("PATCH", "/api/v1/users/bob", `{"role": "admin"}`, withKey("If-Match", etag)); rw.Code != http.StatusPreconditionFailed {
+		t.Errorf("lost update allowed: %d", rw.Code)
+	}
+	if rw, _ = call("PATCH", "/api/v1/users/bob", `{"status": "gone"}`, withKey("If-Match", "*")); rw.Code != http.StatusBadRequest {
+		t.Errorf("bad status accepted: %d", rw.Code)
+	}
+
+	if rw, _ = call("DELETE", "/api/v1/users/bob", "", withKey("If-Match", etag)); rw.Code != http.StatusPreconditionFailed {
+		t.Errorf("delete with stale If-Match: %d", rw.Code)
+	}
+	if rw, _ = call("DELETE", "/api/v1/users/bob", "", key); rw.Code != http.StatusNoContent {
+		t.Errorf("delete: %d %s", rw.Code, rw.Body.String())
+	}
+	if _, err := auth.backend.User("bob"); err != ErrMissingUser {
+		t.Errorf("bob not deleted")
+	}
+
+	_, body = call("GET", "/api/v1/roles", "", key)
+	if !strings.Contains(string(body["roles"]), `{"name":"admin","level":80`) {
+		t.Errorf("roles: %s", body["roles"])
+	}
+	if rw, _ = call("PUT", "/api/v1/roles", "", key); rw.Code != http.StatusMethodNotAllowed || rw.Header().Get("Allow") != "GET" {
+		t.Errorf("PUT allowed: %d", rw.Code)
+	}
+
+	// sessions work too, with a CSRF token for changes
+	cookies := testLogin(t, auth, "boss", "admin")
+	req := requestWithCookies("GET", "/", cookies)
+	rw = httptest.NewRecorder()
+	token, _ := auth.CSRFToken(rw, req)
+	cookies = append(cookies, responseCookies(rw)...)
+	for _, c := range []struct {
+		method string
+		token  string
+		status int
+	}{{"GET", "", http.StatusOK}, {"DELETE", "", http.StatusForbidden}, {"DELETE", token, http.StatusNoContent}} {
+		req = requestWithCookies(c.method, "/api/v1/users/alice", cookies)
+		req.Header.Set("X-CSRF-Token", c.token)
+		rw = httptest.NewRecorder()
+		api.ServeHTTP(rw, req)
+		if rw.Code != c.status {
+			t.Errorf("%s with session and token %q: expected %d, got %d", c.method, c.token, c.status, rw.Code)
+		}
+	}
+
+	// sessions can't manage users above their own role, but API keys can
+	auth.roles["root"] = 100
+	auth.backend.SaveUser(UserData{Username: "root", Email: "root@example.com", Role: "root"})
+	for _, c := range []struct {
+		method, path, body string
+	}{
+		{"PATCH", "/api/v1/users/root", `{"password": "taken-over"}`},
+		{"DELETE", "/api/v1/users/root", ""},
+		{"PATCH", "/api/v1/users/carol", `{"role": "root"}`},
+		{"POST", "/api/v1/users", `{"username": "dan", "email": "dan@example.com", "password": "pw", "role": "root"}`},
+	} {
+		req = requestWithCookies(c.method, c.path, cookies)
+		req.Body = ioutil.NopCloser(strings.NewReader(c.body))
+		req.Header.Set("X-CSRF-Token", token)
+		req.Header.Set("If-Match", "*")
+		rw = httptest.NewRecorder()
+		api.ServeHTTP(rw, req)
+		if rw.Code != http.StatusForbidden {
+			t.Errorf("%s %s %s with an admin session: expected 403, got %d", c.method, c.path, c.body, rw.Code)
+		}
+	}
+	if rw, _ := call("PATCH", "/api/v1/users/carol", `{"role": "root"}`, withKey("If-Match", "*")); rw.Code != http.StatusOK {
+		t.Errorf("PATCH with an API key: %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestAdminAPIOpenAPI(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "adminAPI_test.gob")
+	defer done()
+	rw := httptest.NewRecorder()
+	auth.AdminAPIHandler("/api/", "admin").ServeHTTP(rw, requestWithCookies("GET", "/api/v1/openapi.json", nil))
+	var doc struct {
+		OpenAPI    string                                `json:"openapi"`
+		Servers    []struct{ URL string }                `json:"servers"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+				Required   []string                   `json:"required"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.0.3" || len(doc.Servers) != 1 || doc.Servers[0].URL != "/api" {
+		t.Errorf("bad header: %s", rw.Body.String())
+	}
+	for _, route := range adminRoutes {
+		if _, ok := doc.Paths[route.path][strings.ToLower(route.method)]; !ok {
+			t.Errorf("%s %s not documented", route.method, route.path)
+		}
+	}
+	patch := doc.Components.Schemas["APIUserPatch"]
+	if _, ok := patch.Properties["status_reason"]; !ok || len(patch.Required) != 0 {
+		t.Errorf("APIUserPatch schema: %+v", patch)
+	}
+	user := doc.Components.Schemas["APIUser"]
+	if string(user.Properties["created_at"]) != `{"format":"date-time","type":"string"}` || !containsString(user.Required, "username") {
+		t.Errorf("APIUser schema: %+v", user)
+	}
+	if !strings.Contains(string(doc.Components.Schemas["APIUserList"].Properties["users"]), `"$ref":"#/components/schemas/APIUser"`) {
+		t.Errorf("APIUserList doesn't refer to APIUser")
+	}
+}
+
+func TestAdminAPIAuditActor(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "adminAPI_test.gob")
+	defer done()
+	api := auth.AdminAPIHandler("/api/", "admin")
+	api.AddAPIKey("ops-key")
+	sink := &memoryAuditSink{}
+	auth.AddAuditSink(sink)
+
+	req, _ := http.NewRequest("POST", "/api/v1/users", strings.NewReader(`{"username": "created", "email": "created@example.com", "password": "pw"}`))
+	req.Header.Set("Authorization", "Bearer ops-key")
+	api.ServeHTTP(httptest.NewRecorder(), req)
+	req, _ = http.NewRequest("DELETE", "/api/v1/users/created", nil)
+	req.Header.Set("Authorization", "Bearer ops-key")
+	api.ServeHTTP(httptest.NewRecorder(), req)
+
+	sum := sha256.Sum256([]byte("ops-key"))
+	actor := "api-key:" + hex.EncodeToString(sum[:4])
+	if len(sink.events) != 2 {
+		t.Fatalf("expected 2 events, got %v", sink.events)
+	}
+	for _, e := range sink.events {
+		if e.Actor != actor || e.Target != "created" {
+			t.Errorf("expected %s to be audited as the actor, got %v", actor, e)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package httpauth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAdminPages(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "admin_test.gob")
+	defer done()
+	auth.SetRolePermissions("admin", "users.manage")
+	req, _ := http.NewRequest("POST", "/", nil)
+	for i := 0; i < 12; i++ {
+		user := UserData{Username: fmt.Sprintf("user%02d", i), Email: fmt.Sprintf("user%02d@example.com", i)}
+		if err := auth.Register(httptest.NewRecorder(), req, user, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auth.Register(httptest.NewRecorder(), req, UserData{Username: "boss", Email: "boss@example.com", Role: "admin"}, "password")
+	auth.roles["root"] = 100
+	auth.Register(httptest.NewRecorder(), req, UserData{Username: "zroot", Email: "zroot@example.com", Role: "root"}, "password")
+
+	mux := http.NewServeMux()
+	admin := auth.AdminHandler("/admin/", "admin")
+	admin.PerPage = 5
+	mux.Handle("/admin/", admin)
+	mux.Handle("/account/", auth.AccountHandler("/account/"))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	login := func(username string) *accountClient {
+		c := newAccountClient(t, server, "/account/")
+		c.get("login")
+		if _, body := c.post("login", url.Values{"username": {username}, "password": {"password"}}); !strings.Contains(body, "<h1>"+username+"</h1>") {
+			t.Fatalf("couldn't log in as %s: %s", username, body)
+		}
+		c.prefix = "/admin/"
+		return c
+	}
+
+	anonymous := newAccountClient(t, server, "/admin/")
+	anonymous.client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	if status, _ := anonymous.get(""); status != http.StatusSeeOther {
+		t.Errorf("anonymous user not redirected: %d", status)
+	}
+	if status, _ := login("user00").get(""); status != http.StatusForbidden {
+		t.Errorf("user without the role let in: %d", status)
+	}
+
+	c := login("boss")
+	status, body := c.get("")
+	if status != http.StatusOK || !strings.Contains(body, "boss@example.com") || !strings.Contains(body, "Page 1 of 3") || strings.Contains(body, "user04") {
+		t.Errorf("first page: %d %s", status, body)
+	}
+	if !strings.Contains(body, "users.manage") {
+		t.Errorf("role permissions not shown")
+	}
+	link := func(body string, text string) string {
+		match := regexp.MustCompile(`<a href="/admin/([^"]*)">` + text + `</a>`).FindStringSubmatch(body)
+		if match == nil {
+			t.Fatalf("no %s link: %s", text, body)
+		}
+		return strings.Replace(match[1], "&amp;", "&", -1)
+	}
+	_, body = c.get(link(body, "Next"))
+	if _, body = c.get(link(body, "Next")); !strings.Contains(body, "user11") || strings.Contains(body, "user08") || !strings.Contains(body, "Page 3 of 3") || strings.Contains(body, ">Next<") {
+		t.Errorf("last page: %s", body)
+	}
+	if _, body = c.get(link(body, "Previous")); !strings.Contains(body, "user04") || !strings.Contains(body, "user08") || strings.Contains(body, "user09") || !strings.Contains(body, "Page 2 of 3") {
+		t.Errorf("previous page: %s", body)
+	}
+	if _, body = c.get(link(body, "Previous")); !strings.Contains(body, "boss") || !strings.Contains(body, "Page 1 of 3") || strings.Contains(body, ">Previous<") {
+		t.Errorf("back to the first page: %s", body)
+	}
+	if status, _ := c.get("?after=nonsense"); status != http.StatusBadRequest {
+		t.Errorf("invalid cursor: %d", status)
+	}
+	if _, body = c.get("?q=USER1"); !strings.Contains(body, "user10") || !strings.Contains(body, "user11") || strings.Contains(body, "user02") || !strings.Contains(body, "Page 1 of 1") {
+		t.Errorf("search: %s", body)
+	}
+	if _, body = c.get("?q=user03@"); !strings.Contains(body, "user03@example.com") || strings.Contains(body, "user04") {
+		t.Errorf("email search: %s", body)
+	}
+
+	if _, body = c.get("users/user01"); !strings.Contains(body, `value="user01@example.com"`) {
+		t.Fatalf("user page: %s", body)
+	}
+	c.post("users/user01", url.Values{"action": {"update"}, "email": {"changed@example.com"}, "role": {"admin"}})
+	if user, _ := auth.backend.User("user01"); user.Email != "changed@example.com" || user.Role != "admin" {
+		t.Errorf("user not updated: %+v", user)
+	}
+	if _, body = c.post("users/user01", url.Values{"action": {"update"}, "role": {"nope"}}); !strings.Contains(body, "Couldn&#39;t update user01: nonexistent role.") {
+		t.Errorf("bad role accepted: %s", body)
+	}
+	if _, body = c.post("users/user01", url.Values{"action": {"update"}, "role": {"root"}}); !strings.Contains(body, "You can&#39;t manage users above your own role.") {
+		t.Errorf("role above the admin's granted: %s", body)
+	}
+	c.post("users/zroot", url.Values{"action": {"password"}, "new_password": {"reset"}})
+	if err := auth.Login(httptest.NewRecorder(), requestWithCookies("POST", "/", nil), "zroot", "reset", "/"); err == nil {
+		t.Error("password of a user above the admin reset")
+	}
+	if user, _ := auth.backend.User("user01"); user.Role != "admin" {
+		t.Errorf("user01 given a role above the admin's: %s", user.Role)
+	}
+	c.post("users/user02", url.Values{"action": {"password"}, "new_password": {"reset"}})
+	if err := auth.Login(httptest.NewRecorder(), requestWithCookies("POST", "/", nil), "user02", "reset", "/"); err != nil {
+		t.Errorf("password not reset: %v", err)
+	}
+	if _, body = c.post("users/user03", url.Values{"action": {"disable"}, "reason": {"spam"}}); !strings.Contains(body, "Status: disabled (spam)") {
+		t.Errorf("user not disabled: %s", body)
+	}
+	if _, body = c.post("users/user03", url.Values{"action": {"enable"}}); !strings.Contains(body, "Status: active") {
+		t.Errorf("user not enabled: %s", body)
+	}
+	if _, body = c.post("users/boss", url.Values{"action": {"delete"}}); !strings.Contains(body, "You can&#39;t do that to your own account.") {
+		t.Errorf("admin deleted themselves: %s", body)
+	}
+	if _, body = c.post("users/user04", url.Values{"action": {"delete"}}); !strings.Contains(body, "User user04 deleted.") {
+		t.Errorf("user not deleted: %s", body)
+	}
+	if _, err := auth.backend.User("user04"); err != ErrMissingUser {
+		t.Errorf("user04 still exists")
+	}
+
+	token := c.token
+	c.token = "forged"
+	if status, _ := c.post("users/user05", url.Values{"action": {"delete"}}); status != http.StatusForbidden {
+		t.Errorf("forged CSRF token accepted: %d", status)
+	}
+	c.token = token
+	if status, _ := c.get("users/nobody"); status != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing user, got %d", status)
+	}
+}
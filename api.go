@@ -0,0 +1,301 @@
+package httpauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Error codes returned in the JSON bodies of API handlers.
+const (
+	CodeInvalidRequest       = "invalid_request"       // 400
+	CodeInvalidCredentials   = "invalid_credentials"   // 401
+	CodeNotAuthenticated     = "not_authenticated"     // 401
+	CodeAccountDisabled      = "account_disabled"      // 403
+	CodeAccountLocked        = "account_locked"        // 403
+	CodeAccountExpired       = "account_expired"       // 403
+	CodeForbidden            = "forbidden"             // 403
+	CodeRejected             = "rejected"              // 403, by a before hook
+	CodeNotFound             = "not_found"             // 404
+	CodeMethodNotAllowed     = "method_not_allowed"    // 405
+	CodeAlreadyAuthenticated = "already_authenticated" // 409
+	CodeUsernameTaken        = "username_taken"        // 409
+	CodeEmailTaken           = "email_taken"           // 409
+	CodePreconditionFailed   = "precondition_failed"   // 412
+	CodePreconditionRequired = "precondition_required" // 428
+	CodeInternal             = "internal_error"        // 500
+)
+
+// maxAPIBody limits the size of JSON request bodies.
+const maxAPIBody = 1 << 20
+
+// apiState is set on copies of an Authorizer handling JSON API requests,
+// which don't add messages or redirect.
+type apiState struct {
+	login  bool // logging in, so a missing user means bad credentials
+	vetoed bool // a before hook rejected the action
+}
+
+// APIError is the body of API error responses:
+//
+//     {"error": {"code": "invalid_credentials", "message": "invalid username or password"}}
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// APIUser is how users are represented in API responses.
+type APIUser struct {
+	Username    string     `json:"username"`
+	Email       string     `json:"email"`
+	Role        string     `json:"role"`
+	Status      string     `json:"status"`
+	Attributes  Attributes `json:"attributes,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// NewAPIUser returns the API representation of a user, which leaves out the
+// password hash.
+func NewAPIUser(user UserData) APIUser {
+	u := APIUser{
+		Username:   user.Username,
+		Email:      user.Email,
+		Role:       user.Role,
+		Status:     user.AccountStatus(time.Now()),
+		Attributes: user.Attributes,
+	}
+	if !user.CreatedAt.IsZero() {
+		u.CreatedAt = &user.CreatedAt
+	}
+	if !user.LastLoginAt.IsZero() {
+		u.LastLoginAt = &user.LastLoginAt
+	}
+	return u
+}
+
+// apiCopy returns a copy of the Authorizer for handling an API request.
+func (a Authorizer) apiCopy() Authorizer {
+	a.api = &apiState{}
+	return a
+}
+
+// LoginHandler returns a handler logging users in from a JSON body:
+//
+//     POST {"username": "...", "password": "..."}
+//
+// The username may also be an email, once RequireUniqueEmails has been called;
+// see Login. It responds 200 with {"user": ...}, or with an APIError: 400, 401
+// (invalid_credentials), 403 (account_disabled, account_locked,
+// account_expired, rejected) or 409 (already_authenticated). It never
+// redirects or adds messages.
+func (a Authorizer) LoginHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if !readJSON(rw, req, &body) {
+			return
+		}
+		if body.Username == "" || body.Password == "" {
+			writeAPIError(rw, http.StatusBadRequest, CodeInvalidRequest, "username and password are required")
+			return
+		}
+		api := a.apiCopy()
+		api.api.login = true
+		if err := api.Login(rw, req, body.Username, body.Password, ""); err != nil {
+			api.writeError(rw, err)
+			return
+		}
+		user, err := a.loginUser(body.Username)
+		if err != nil {
+			api.writeError(rw, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, map[string]APIUser{"user": NewAPIUser(user)})
+	})
+}
+
+// RegisterHandler returns a handler registering users from a JSON body:
+//
+//     POST {"username": "...", "email": "...", "password": "...", "attributes": {...}}
+//
+// Users get the default role. Only attributes allowed with
+// SetUserEditableAttributes can be given. It responds 201 with
+// {"user": ...}, or with an APIError: 400, 403 (rejected) or 409
+// (username_taken, email_taken).
+// Registering doesn't log the user in.
+func (a Authorizer) RegisterHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Username   string     `json:"username"`
+			Email      string     `json:"email"`
+			Password   string     `json:"password"`
+			Attributes Attributes `json:"attributes"`
+		}
+		if !readJSON(rw, req, &body) {
+			return
+		}
+		api := a.apiCopy()
+		if err := api.checkUserEditable(body.Attributes); err != nil {
+			api.writeError(rw, err)
+			return
+		}
+		user := UserData{Username: body.Username, Email: body.Email, Attributes: body.Attributes}
+		if err := api.Register(rw, req, user, body.Password); err != nil {
+			api.writeError(rw, err)
+			return
+		}
+		user, err := a.backend.User(body.Username)
+		if err != nil {
+			api.writeError(rw, err)
+			return
+		}
+		writeJSON(rw, http.StatusCreated, map[string]APIUser{"user": NewAPIUser(user)})
+	})
+}
+
+// LogoutHandler returns a handler ending the session on POST, responding
+// 204.
+func (a Authorizer) LogoutHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			writeAPIError(rw, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use POST")
+			return
+		}
+		api := a.apiCopy()
+		if err := api.Logout(rw, req); err != nil {
+			api.writeError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// MeHandler returns a handler responding to GET with the current user, as
+// {"user": ...}, or 401 (not_authenticated) or 403 if the account isn't
+// active.
+func (a Authorizer) MeHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			writeAPIError(rw, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use GET")
+			return
+		}
+		api := a.apiCopy()
+		user, err := api.CurrentUser(rw, req)
+		if err != nil {
+			api.writeError(rw, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, map[string]APIUser{"user": NewAPIUser(user)})
+	})
+}
+
+// RequireRole returns a handler calling next only for users holding role, or
+// any logged in user if role is empty. Other requests get a JSON 401
+// (not_authenticated) or 403 (forbidden, or an account status code) instead
+// of a redirect.
+func (a Authorizer) RequireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		api := a.apiCopy()
+		var err error
+		if role == "" {
+			err = api.Authorize(rw, req, false)
+		} else {
+			err = api.AuthorizeRole(rw, req, role, false)
+		}
+		if err != nil {
+			api.writeError(rw, err)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// writeError responds with the APIError describing an error returned by an
+// Authorizer method.
+func (a Authorizer) writeError(rw http.ResponseWriter, err error) {
+	state := apiState{}
+	if a.api != nil {
+		state = *a.api
+	}
+	status, e := apiError(err, state)
+	writeAPIError(rw, status, e.Code, e.Message)
+}
+
+// errorMessage returns an error's message without the "httpauth: " prefixes
+// added as it was passed up.
+func errorMessage(err error) string {
+	msg := err.Error()
+	for strings.HasPrefix(msg, "httpauth: ") {
+		msg = strings.TrimPrefix(msg, "httpauth: ")
+	}
+	return msg
+}
+
+func apiError(err error, state apiState) (int, APIError) {
+	switch msg := errorMessage(err); {
+	case err == ErrAccountDisabled:
+		return http.StatusForbidden, APIError{CodeAccountDisabled, msg}
+	case err == ErrAccountLocked:
+		return http.StatusForbidden, APIError{CodeAccountLocked, msg}
+	case err == ErrAccountExpired:
+		return http.StatusForbidden, APIError{CodeAccountExpired, msg}
+	case state.login && (err == ErrUserNotFound || err == ErrWrongPassword):
+		return http.StatusUnauthorized, APIError{CodeInvalidCredentials, "invalid username or password"}
+	case err == ErrNotLoggedIn || err == ErrNewSession || err == ErrUserNotFound ||
+		err == ErrNoSessionUser || err == ErrMissingUser:
+		return http.StatusUnauthorized, APIError{CodeNotAuthenticated, "not logged in"}
+	case err == ErrInsufficientRole || err == ErrMissingPermission:
+		return http.StatusForbidden, APIError{CodeForbidden, "insufficient privileges"}
+	case err == ErrAlreadyAuthenticated:
+		return http.StatusConflict, APIError{CodeAlreadyAuthenticated, "already logged in"}
+	case err == ErrUserExists:
+		return http.StatusConflict, APIError{CodeUsernameTaken, "username has been taken"}
+	case err == ErrEmailTaken:
+		return http.StatusConflict, APIError{CodeEmailTaken, msg}
+	case err == ErrNoUsername || err == ErrInvalidUsername || err == ErrNoEmail || err == ErrNoPassword ||
+		err == ErrNonexistentRole || err == ErrInvalidStatus || err == ErrInvalidAttributeName ||
+		err == ErrAttributeNotEditable:
+		return http.StatusBadRequest, APIError{CodeInvalidRequest, msg}
+	case state.vetoed:
+		return http.StatusForbidden, APIError{CodeRejected, msg}
+	}
+	return http.StatusInternalServerError, APIError{CodeInternal, "internal error"}
+}
+
+// readJSON decodes a POSTed JSON body, responding with an error if it can't.
+func readJSON(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	if req.Method != "POST" {
+		writeAPIError(rw, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "use POST")
+		return false
+	}
+	return decodeJSON(rw, req, v)
+}
+
+// decodeJSON decodes a JSON request body, responding with an error if it
+// can't.
+func decodeJSON(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	if req.Body == nil {
+		writeAPIError(rw, http.StatusBadRequest, CodeInvalidRequest, "missing body")
+		return false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxAPIBody)).Decode(v); err != nil {
+		writeAPIError(rw, http.StatusBadRequest, CodeInvalidRequest, "invalid JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func writeAPIError(rw http.ResponseWriter, status int, code string, message string) {
+	writeJSON(rw, status, map[string]APIError{"error": {code, message}})
+}
@@ -0,0 +1,138 @@
+package httpauth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// apiRequest sends a request to handler, returning the response recorder and
+// its decoded JSON body.
+func apiRequest(t *testing.T, handler http.Handler, method string, body string, cookies []*http.Cookie) (*httptest.ResponseRecorder, map[string]json.RawMessage) {
+	req, _ := http.NewRequest(method, "/", strings.NewReader(body))
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	var decoded map[string]json.RawMessage
+	if rw.Body.Len() > 0 {
+		if err := json.Unmarshal(rw.Body.Bytes(), &decoded); err != nil {
+			t.Fatalf("response isn't JSON: %q", rw.Body.String())
+		}
+	}
+	return rw, decoded
+}
+
+func expectAPIError(t *testing.T, rw *httptest.ResponseRecorder, body map[string]json.RawMessage, status int, code string) {
+	t.Helper()
+	var e APIError
+	json.Unmarshal(body["error"], &e)
+	if rw.Code != status || e.Code != code {
+		t.Errorf("expected %d %s, got %d %s", status, code, rw.Code, rw.Body.String())
+	}
+	if rw.Header().Get("Location") != "" {
+		t.Errorf("API responses shouldn't redirect")
+	}
+	for _, cookie := range responseCookies(rw) {
+		if cookie.Name == "messages" {
+			t.Errorf("API responses shouldn't add messages")
+		}
+	}
+}
+
+func TestAPIHandlers(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "api_test.gob")
+	defer done()
+	auth.AddBeforeHook(ActionRegister, func(e HookEvent) error {
+		if strings.HasSuffix(e.User.Email, "@blocked.example") {
+			return errors.New("domain blocked")
+		}
+		return nil
+	})
+	auth.SetUserEditableAttributes("theme")
+	register, login, logout, me := auth.RegisterHandler(), auth.LoginHandler(), auth.LogoutHandler(), auth.MeHandler()
+
+	rw, body := apiRequest(t, register, "POST", `{"username": "spa", "email": "spa@example.com", "password": "secret", "attributes": {"theme": "dark"}}`, nil)
+	if rw.Code != http.StatusCreated || !strings.Contains(string(body["user"]), `"username":"spa"`) || strings.Contains(rw.Body.String(), "Hash") {
+		t.Fatalf("register: %d %s", rw.Code, rw.Body.String())
+	}
+	rw, body = apiRequest(t, register, "POST", `{"username": "spa", "email": "spa@example.com", "password": "secret"}`, nil)
+	expectAPIError(t, rw, body, http.StatusConflict, CodeUsernameTaken)
+	rw, body = apiRequest(t, register, "POST", `{"username": "finance", "email": "finance@example.com", "password": "secret", "attributes": {"department": "finance"}}`, nil)
+	expectAPIError(t, rw, body, http.StatusBadRequest, CodeInvalidRequest)
+	rw, body = apiRequest(t, register, "POST", `{"username": "nomail", "password": "secret"}`, nil)
+	expectAPIError(t, rw, body, http.StatusBadRequest, CodeInvalidRequest)
+	rw, body = apiRequest(t, register, "POST", `{"username": `, nil)
+	expectAPIError(t, rw, body, http.StatusBadRequest, CodeInvalidRequest)
+	rw, body = apiRequest(t, register, "GET", "", nil)
+	expectAPIError(t, rw, body, http.StatusMethodNotAllowed, CodeMethodNotAllowed)
+	rw, body = apiRequest(t, register, "POST", `{"username": "blocked", "email": "x@blocked.example", "password": "secret"}`, nil)
+	expectAPIError(t, rw, body, http.StatusForbidden, CodeRejected)
+
+	rw, body = apiRequest(t, login, "POST", `{"username": "spa", "password": "wrong"}`, nil)
+	expectAPIError(t, rw, body, http.StatusUnauthorized, CodeInvalidCredentials)
+	rw, body = apiRequest(t, login, "POST", `{"username": "nobody", "password": "secret"}`, nil)
+	expectAPIError(t, rw, body, http.StatusUnauthorized, CodeInvalidCredentials)
+	rw, body = apiRequest(t, me, "GET", "", nil)
+	expectAPIError(t, rw, body, http.StatusUnauthorized, CodeNotAuthenticated)
+
+	rw, body = apiRequest(t, login, "POST", `{"username": "spa", "password": "secret"}`, nil)
+	if rw.Code != http.StatusOK || rw.Header().Get("Location") != "" || !strings.Contains(string(body["user"]), `"role":"user"`) {
+		t.Fatalf("login: %d %v %s", rw.Code, rw.Header(), rw.Body.String())
+	}
+	cookies := responseCookies(rw)
+	rw, body = apiRequest(t, login, "POST", `{"username": "spa", "password": "secret"}`, cookies)
+	expectAPIError(t, rw, body, http.StatusConflict, CodeAlreadyAuthenticated)
+
+	rw, body = apiRequest(t, me, "GET", "", cookies)
+	var user APIUser
+	json.Unmarshal(body["user"], &user)
+	if rw.Code != http.StatusOK || user.Username != "spa" || user.Attributes["theme"] != "dark" || user.Status != StatusActive {
+		t.Errorf("me: %d %s", rw.Code, rw.Body.String())
+	}
+
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { rw.WriteHeader(http.StatusTeapot) })
+	if rw, _ = apiRequest(t, auth.RequireRole("", ok), "GET", "", cookies); rw.Code != http.StatusTeapot {
+		t.Errorf("RequireRole: logged in user not let through: %d", rw.Code)
+	}
+	rw, body = apiRequest(t, auth.RequireRole("admin", ok), "GET", "", cookies)
+	expectAPIError(t, rw, body, http.StatusForbidden, CodeForbidden)
+	rw, body = apiRequest(t, auth.RequireRole("user", ok), "GET", "", nil)
+	expectAPIError(t, rw, body, http.StatusUnauthorized, CodeNotAuthenticated)
+
+	auth.DisableUser("spa", "")
+	rw, body = apiRequest(t, auth.RequireRole("user", ok), "GET", "", cookies)
+	expectAPIError(t, rw, body, http.StatusForbidden, CodeAccountDisabled)
+	auth.EnableUser("spa")
+
+	if rw, _ = apiRequest(t, logout, "POST", "", cookies); rw.Code != http.StatusNoContent {
+		t.Errorf("logout: %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		err    error
+		state  apiState
+		status int
+		code   string
+	}{
+		{ErrWrongPassword, apiState{login: true}, http.StatusUnauthorized, CodeInvalidCredentials},
+		{ErrUserNotFound, apiState{}, http.StatusUnauthorized, CodeNotAuthenticated},
+		{ErrInsufficientRole, apiState{}, http.StatusForbidden, CodeForbidden},
+		{ErrUserExists, apiState{}, http.StatusConflict, CodeUsernameTaken},
+		{ErrInvalidAttributeName, apiState{}, http.StatusBadRequest, CodeInvalidRequest},
+		// errors merely sharing a message aren't mistaken for the sentinels
+		{errors.New("httpauth: user not logged in"), apiState{}, http.StatusInternalServerError, CodeInternal},
+		{mkerror("already authenticated"), apiState{}, http.StatusInternalServerError, CodeInternal},
+	}
+	for _, test := range tests {
+		if status, e := apiError(test.err, test.state); status != test.status || e.Code != test.code {
+			t.Errorf("apiError(%v): expected %d %s, got %d %s", test.err, test.status, test.code, status, e.Code)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package httpauth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AttributeRule is a named rule in an AttributePolicy. Effect is PolicyAllow
+// or PolicyDeny, and applies when Condition, an expression (see
+// NewAttributePolicy), evaluates to true.
+type AttributeRule struct {
+	Name      string `json:"name" yaml:"name"`
+	Effect    string `json:"effect" yaml:"effect"`
+	Condition string `json:"condition" yaml:"condition"`
+}
+
+type compiledRule struct {
+	AttributeRule
+	condition expression
+}
+
+// AttributePolicy makes authorization decisions from attributes of a user, a
+// request and the resource being accessed. Deny rules take precedence: a
+// request is allowed if no deny rule matches and at least one allow rule
+// does. If no rule matches at all, the policy's default applies.
+type AttributePolicy struct {
+	rules        []compiledRule
+	defaultAllow bool
+}
+
+// RuleResult records how a single rule was evaluated.
+type RuleResult struct {
+	Rule    string
+	Effect  string
+	Matched bool
+	Err     error
+}
+
+// Decision is the outcome of evaluating an AttributePolicy. Rule names the
+// rule that decided it, and is empty if the default applied. Results is only
+// filled in by Explain.
+type Decision struct {
+	Allowed bool
+	Rule    string
+	Reason  string
+	Results []RuleResult
+}
+
+func (d Decision) String() string {
+	verdict := "denied"
+	if d.Allowed {
+		verdict = "allowed"
+	}
+	if d.Rule == "" {
+		return verdict + ": " + d.Reason
+	}
+	return fmt.Sprintf("%s by rule %q: %s", verdict, d.Rule, d.Reason)
+}
+
+// NewAttributePolicy compiles a set of rules. defaultEffect is PolicyAllow or
+// PolicyDeny.
+//
+// Conditions are boolean expressions over the attributes returned by
+// RequestAttributes, for example:
+//
+//     user.email_domain == "example.com" && cidr(request.ip, "10.0.0.0/8")
+//     time.hour < 9 || time.hour >= 17 || time.weekday in ["Saturday", "Sunday"]
+//     resource.owner == user.username || user.role_level >= 80
+//
+// Expressions support string, number, boolean and list literals, the
+// comparison operators == != < <= > >=, the in operator for list membership,
+// !, && and ||, parentheses, and the functions cidr(ip, network),
+// hasPrefix(s, prefix), hasSuffix(s, suffix), contains(s, substring) and
+// lower(s). Missing attributes evaluate to null.
+func NewAttributePolicy(defaultEffect string, rules ...AttributeRule) (*AttributePolicy, error) {
+	p := &AttributePolicy{}
+	switch defaultEffect {
+	case PolicyAllow:
+		p.defaultAllow = true
+	case PolicyDeny:
+	default:
+		return nil, mkerror(fmt.Sprintf("unknown policy effect %q", defaultEffect))
+	}
+	for i, rule := range rules {
+		if rule.Effect != PolicyAllow && rule.Effect != PolicyDeny {
+			return nil, mkerror(fmt.Sprintf("rule %d: unknown policy effect %q", i, rule.Effect))
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i)
+		}
+		condition, err := compileExpression(rule.Condition)
+		if err != nil {
+			return nil, err
+		}
+		p.rules = append(p.rules, compiledRule{rule, condition})
+	}
+	return p, nil
+}
+
+// Evaluate decides whether the attributes in env are allowed.
+func (p *AttributePolicy) Evaluate(env map[string]interface{}) Decision {
+	return p.evaluate(env, false)
+}
+
+// Explain is like Evaluate, but evaluates every rule and records each result
+// in the decision.
+func (p *AttributePolicy) Explain(env map[string]interface{}) Decision {
+	return p.evaluate(env, true)
+}
+
+func (p *AttributePolicy) evaluate(env map[string]interface{}, explain bool) Decision {
+	var (
+		d       Decision
+		allowed *compiledRule
+		denied  *compiledRule
+		reason  string
+	)
+	for i := range p.rules {
+		rule := &p.rules[i]
+		matched, err := rule.condition.eval(env)
+		if err != nil && rule.Effect == PolicyDeny {
+			// fail closed: a deny rule that can't be evaluated denies
+			matched = true
+		}
+		if explain {
+			d.Results = append(d.Results, RuleResult{rule.Name, rule.Effect, matched, err})
+		}
+		if !matched {
+			continue
+		}
+		if rule.Effect == PolicyDeny && denied == nil {
+			denied = rule
+			reason = "condition matched"
+			if err != nil {
+				reason = err.Error()
+			}
+			if !explain {
+				break
+			}
+		} else if rule.Effect == PolicyAllow && allowed == nil {
+			allowed = rule
+		}
+	}
+	switch {
+	case denied != nil:
+		d.Rule = denied.Name
+		d.Reason = reason
+	case allowed != nil:
+		d.Allowed = true
+		d.Rule = allowed.Name
+		d.Reason = "condition matched"
+	default:
+		d.Allowed = p.defaultAllow
+		d.Reason = "no rule matched"
+	}
+	return d
+}
+
+// RequestAttributes collects the attributes policies are evaluated against.
+//
+//     user.username, user.email, user.email_domain, user.role
+//     user.role_level      numeric value of the user's role
+//     user.attributes.*    the user's Attributes; users can set those allowed
+//                          with SetUserEditableAttributes themselves
+//     request.method, request.path, request.host, request.user_agent
+//     request.ip           client address, from the connection only
+//     time.hour, time.minute, time.weekday ("Monday"), time.unix (server local time)
+//     resource.*           whatever was passed in resource
+func (a Authorizer) RequestAttributes(req *http.Request, user UserData, resource map[string]interface{}) map[string]interface{} {
+	domain := ""
+	if i := strings.LastIndex(user.Email, "@"); i >= 0 {
+		domain = strings.ToLower(user.Email[i+1:])
+	}
+	now := time.Now()
+	if resource == nil {
+		resource = make(map[string]interface{})
+	}
+	return map[string]interface{}{
+		"user": map[string]interface{}{
+			"username":     user.Username,
+			"email":        user.Email,
+			"email_domain": domain,
+			"role":         user.Role,
+			"role_level":   a.roles[user.Role],
+			"attributes":   map[string]string(user.Attributes),
+		},
+		"request": map[string]interface{}{
+			"method":     req.Method,
+			"path":       req.URL.Path,
+			"host":       req.Host,
+			"ip":         remoteIP(req),
+			"user_agent": req.UserAgent(),
+		},
+		"time": map[string]interface{}{
+			"hour":    now.Hour(),
+			"minute":  now.Minute(),
+			"weekday": now.Weekday().String(),
+			"unix":    now.Unix(),
+		},
+		"resource": resource,
+	}
+}
+
+// AttributeCheck returns an AuthorizeCheck enforcing an AttributePolicy, for
+// use with AddAuthorizeCheck. resource may be nil; otherwise it supplies the
+// resource attributes for each request.
+func (a Authorizer) AttributeCheck(p *AttributePolicy, resource func(req *http.Request) map[string]interface{}) AuthorizeCheck {
+	return func(req *http.Request, user UserData) error {
+		var attrs map[string]interface{}
+		if resource != nil {
+			attrs = resource(req)
+		}
+		if d := p.Evaluate(a.RequestAttributes(req, user, attrs)); !d.Allowed {
+			return mkerror("attribute policy " + d.String())
+		}
+		return nil
+	}
+}
+
+// AuthorizeAttributes runs Authorize on a user, then evaluates an
+// AttributePolicy for them against a resource, in explain mode. The decision
+// is returned even on failure so callers can log or display it.
+func (a Authorizer) AuthorizeAttributes(rw http.ResponseWriter, req *http.Request, p *AttributePolicy, resource map[string]interface{}, redirectWithMessage bool) (Decision, error) {
+	if err := a.Authorize(rw, req, redirectWithMessage); err != nil {
+		return Decision{Reason: "not logged in"}, err
+	}
+	authSession, _ := a.cookiejar.Get(req, "auth")
+	username := authSession.Values["username"]
+	user, err := a.requestUser(req, username.(string))
+	if err != nil {
+		return Decision{Reason: "user not found"}, ErrUserNotFound
+	}
+	d := p.Explain(a.RequestAttributes(req, user, resource))
+	if !d.Allowed {
+		a.addMessage(rw, req, "You don't have sufficient privileges.")
+		return d, mkerror("attribute policy " + d.String())
+	}
+	return d, nil
+}
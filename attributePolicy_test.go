@@ -0,0 +1,99 @@
+package httpauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAttributePolicy(t *testing.T) {
+	if _, err := NewAttributePolicy("maybe"); err == nil {
+		t.Fatal("NewAttributePolicy: accepted unknown default")
+	}
+	if _, err := NewAttributePolicy(PolicyDeny, AttributeRule{Effect: PolicyAllow, Condition: "true &&"}); err == nil {
+		t.Fatal("NewAttributePolicy: accepted invalid condition")
+	}
+
+	p, err := NewAttributePolicy(PolicyDeny,
+		AttributeRule{Name: "staff", Effect: PolicyAllow, Condition: `user.email_domain == "example.com"`},
+		AttributeRule{Name: "owner", Effect: PolicyAllow, Condition: `resource.owner == user.username`},
+		AttributeRule{Name: "office", Effect: PolicyDeny, Condition: `!cidr(request.ip, "10.0.0.0/8")`},
+	)
+	if err != nil {
+		t.Fatalf("NewAttributePolicy: %v", err)
+	}
+	env := func(email, ip, owner string) map[string]interface{} {
+		return map[string]interface{}{
+			"user":     map[string]interface{}{"username": "username", "email_domain": email},
+			"request":  map[string]interface{}{"ip": ip},
+			"resource": map[string]interface{}{"owner": owner},
+		}
+	}
+	tests := []struct {
+		env     map[string]interface{}
+		allowed bool
+		rule    string
+	}{
+		{env("example.com", "10.0.0.1", ""), true, "staff"},
+		{env("other.com", "10.0.0.1", "username"), true, "owner"},
+		{env("other.com", "10.0.0.1", "someone"), false, ""},
+		{env("example.com", "8.8.8.8", ""), false, "office"},
+	}
+	for i, test := range tests {
+		d := p.Evaluate(test.env)
+		if d.Allowed != test.allowed || d.Rule != test.rule {
+			t.Errorf("test %d: got %v", i, d)
+		}
+	}
+
+	d := p.Explain(env("example.com", "8.8.8.8", "username"))
+	if d.Allowed || d.Rule != "office" {
+		t.Errorf("Explain: got %v", d)
+	}
+	if len(d.Results) != 3 {
+		t.Fatalf("Explain: expected 3 results, got %d", len(d.Results))
+	}
+	for _, r := range d.Results {
+		if !r.Matched {
+			t.Errorf("Explain: rule %s should have matched", r.Rule)
+		}
+	}
+
+	// deny rules that can't be evaluated deny
+	p, _ = NewAttributePolicy(PolicyAllow, AttributeRule{Effect: PolicyDeny, Condition: `user.missing > 3`})
+	if d := p.Evaluate(env("", "", "")); d.Allowed {
+		t.Errorf("Broken deny rule allowed access: %v", d)
+	}
+}
+
+func TestAuthorizeAttributes(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "attributes_test.gob")
+	defer done()
+	cookies := testLogin(t, auth, "attrsuser", "user")
+
+	p, err := NewAttributePolicy(PolicyDeny,
+		AttributeRule{Name: "own", Effect: PolicyAllow, Condition: `resource.owner == user.username && user.role_level >= 40`},
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rw := httptest.NewRecorder()
+	req := requestWithCookies("GET", "/", cookies)
+	if d, err := auth.AuthorizeAttributes(rw, req, p, map[string]interface{}{"owner": "attrsuser"}, false); err != nil {
+		t.Fatalf("AuthorizeAttributes: %v (%v)", err, d)
+	}
+	if d, err := auth.AuthorizeAttributes(rw, req, p, map[string]interface{}{"owner": "other"}, false); err == nil || d.Allowed {
+		t.Fatalf("AuthorizeAttributes: allowed access to another user's resource: %v", d)
+	}
+
+	// as an Authorize extension
+	auth.AddAuthorizeCheck(auth.AttributeCheck(p, func(req *http.Request) map[string]interface{} {
+		return map[string]interface{}{"owner": req.URL.Query().Get("owner")}
+	}))
+	if err := auth.Authorize(rw, requestWithCookies("GET", "/?owner=attrsuser", cookies), false); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if err := auth.AuthorizeRole(rw, requestWithCookies("GET", "/?owner=other", cookies), "user", false); err == nil {
+		t.Fatal("AuthorizeRole: check not run")
+	}
+}
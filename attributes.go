@@ -0,0 +1,184 @@
+package httpauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrAttributeNotEditable is returned when users try to set an attribute on
+// themselves that isn't one of those allowed with SetUserEditableAttributes.
+var ErrAttributeNotEditable = mkerror("attribute can't be set by the user")
+
+// Attributes holds extra profile data about a user, such as a display name,
+// phone number or preferences. Values are stored as strings so every backend
+// can keep them; the typed getters and setters convert them. Structured
+// values can be stored as JSON with SetJSON.
+//
+// Keys can't be empty, contain dots or start with "$". They're available to
+// attribute policies as user.attributes.<key>.
+type Attributes map[string]string
+
+// Get returns the value of an attribute and whether it was set.
+func (a Attributes) Get(key string) (string, bool) {
+	v, ok := a[key]
+	return v, ok
+}
+
+// Int returns the value of an attribute set with SetInt.
+func (a Attributes) Int(key string) (int64, bool) {
+	v, err := strconv.ParseInt(a[key], 10, 64)
+	return v, err == nil
+}
+
+// Float returns the value of an attribute set with SetFloat.
+func (a Attributes) Float(key string) (float64, bool) {
+	v, err := strconv.ParseFloat(a[key], 64)
+	return v, err == nil
+}
+
+// Bool returns the value of an attribute set with SetBool.
+func (a Attributes) Bool(key string) (bool, bool) {
+	v, err := strconv.ParseBool(a[key])
+	return v, err == nil
+}
+
+// Time returns the value of an attribute set with SetTime.
+func (a Attributes) Time(key string) (time.Time, bool) {
+	v, err := time.Parse(time.RFC3339Nano, a[key])
+	return v, err == nil
+}
+
+// JSON decodes an attribute set with SetJSON into v.
+func (a Attributes) JSON(key string, v interface{}) error {
+	s, ok := a[key]
+	if !ok {
+		return mkerror("attribute " + key + " not set")
+	}
+	return json.Unmarshal([]byte(s), v)
+}
+
+// Set sets an attribute to a string.
+func (a Attributes) Set(key string, v string) {
+	a[key] = v
+}
+
+// SetInt sets an attribute to an integer.
+func (a Attributes) SetInt(key string, v int64) {
+	a[key] = strconv.FormatInt(v, 10)
+}
+
+// SetFloat sets an attribute to a floating point number.
+func (a Attributes) SetFloat(key string, v float64) {
+	a[key] = strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// SetBool sets an attribute to a boolean.
+func (a Attributes) SetBool(key string, v bool) {
+	a[key] = strconv.FormatBool(v)
+}
+
+// SetTime sets an attribute to a time.
+func (a Attributes) SetTime(key string, v time.Time) {
+	a[key] = v.Format(time.RFC3339Nano)
+}
+
+// SetJSON sets an attribute to the JSON encoding of v, which may be any
+// value encoding/json can marshal, such as a struct of preferences.
+func (a Attributes) SetJSON(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return mkerror(err.Error())
+	}
+	a[key] = string(data)
+	return nil
+}
+
+// Delete removes an attribute.
+func (a Attributes) Delete(key string) {
+	delete(a, key)
+}
+
+func validateAttributes(attrs Attributes) error {
+	for key := range attrs {
+		if key == "" || strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+			return ErrInvalidAttributeName
+		}
+	}
+	return nil
+}
+
+// SetUserEditableAttributes sets the attributes users can set on themselves,
+// when registering through RegisterHandler or with UpdateAttributes and an
+// empty username. By default they can't set any. Attributes policies rely on,
+// such as a department, shouldn't be editable by users. It should be called
+// before the Authorizer starts handling requests.
+func (a Authorizer) SetUserEditableAttributes(keys ...string) {
+	a.ext.userAttributes = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		a.ext.userAttributes[key] = true
+	}
+}
+
+// checkUserEditable returns ErrAttributeNotEditable unless users can set
+// every attribute in attrs on themselves.
+func (a Authorizer) checkUserEditable(attrs Attributes) error {
+	for key := range attrs {
+		if !a.ext.userAttributes[key] {
+			return ErrAttributeNotEditable
+		}
+	}
+	return nil
+}
+
+// UpdateAttributes changes attributes of an existing user. As with Update, an
+// empty username u updates the current user from the session, who can only
+// change the attributes allowed with SetUserEditableAttributes. Attributes
+// set to an empty string are removed; others are left unchanged.
+func (a Authorizer) UpdateAttributes(rw http.ResponseWriter, req *http.Request, u string, attrs Attributes) (err error) {
+	username := u
+	defer func() { a.audit(req, ActionUpdateAttributes, a.requestActor(req), username, err) }()
+	if err := validateAttributes(attrs); err != nil {
+		return err
+	}
+	if username == "" {
+		if err := a.checkUserEditable(attrs); err != nil {
+			return err
+		}
+		authSession, err := a.cookiejar.Get(req, "auth")
+		if err != nil {
+			return mkerror("couldn't get session needed to update user: " + err.Error())
+		}
+		var ok bool
+		username, ok = authSession.Values["username"].(string)
+		if !ok {
+			return mkerror("not logged in")
+		}
+	}
+	user, err := a.backend.User(username)
+	if err == ErrMissingUser {
+		a.addMessage(rw, req, "User doesn't exist.")
+		return mkerror("user doesn't exists")
+	} else if err != nil {
+		return mkerror(err.Error())
+	}
+	if user.Attributes == nil {
+		user.Attributes = make(Attributes)
+	}
+	for key, v := range attrs {
+		if v == "" {
+			delete(user.Attributes, key)
+		} else {
+			user.Attributes[key] = v
+		}
+	}
+	user.UpdatedAt = time.Now()
+	if err := a.backend.SaveUser(user); err != nil {
+		a.addMessage(rw, req, err.Error())
+		return mkerror(err.Error())
+	}
+	forgetRequestUser(req, username)
+	return a.afterHooks(ActionUpdateAttributes, req, user)
+}
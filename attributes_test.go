@@ -0,0 +1,98 @@
+package httpauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAttributes(t *testing.T) {
+	attrs := make(Attributes)
+	now := time.Date(2020, 5, 6, 7, 8, 9, 10, time.UTC)
+	attrs.Set("name", "Name")
+	attrs.SetInt("age", -3)
+	attrs.SetFloat("score", 1.5)
+	attrs.SetBool("admin", true)
+	attrs.SetTime("seen", now)
+	if err := attrs.SetJSON("prefs", struct{ Theme string }{"dark"}); err != nil {
+		t.Fatalf("SetJSON: %v", err)
+	}
+
+	if v, ok := attrs.Get("name"); !ok || v != "Name" {
+		t.Errorf("Get: got %q", v)
+	}
+	if v, ok := attrs.Int("age"); !ok || v != -3 {
+		t.Errorf("Int: got %d", v)
+	}
+	if v, ok := attrs.Float("score"); !ok || v != 1.5 {
+		t.Errorf("Float: got %v", v)
+	}
+	if v, ok := attrs.Bool("admin"); !ok || !v {
+		t.Errorf("Bool: got %v", v)
+	}
+	if v, ok := attrs.Time("seen"); !ok || !v.Equal(now) {
+		t.Errorf("Time: got %v", v)
+	}
+	var prefs struct{ Theme string }
+	if err := attrs.JSON("prefs", &prefs); err != nil || prefs.Theme != "dark" {
+		t.Errorf("JSON: got %v, %v", prefs, err)
+	}
+	if _, ok := attrs.Int("name"); ok {
+		t.Error("Int: parsed a string attribute")
+	}
+	attrs.Delete("name")
+	if _, ok := attrs.Get("name"); ok {
+		t.Error("Delete: attribute still set")
+	}
+}
+
+func TestRegisterAttributes(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "attributes_test.gob")
+	defer done()
+	auth.SetUserEditableAttributes("name", "phone")
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", nil)
+
+	user := UserData{Username: "badattrs", Email: "badattrs@example.com", Attributes: Attributes{"a.b": "c"}}
+	if err := auth.Register(rw, req, user, "password"); err == nil {
+		t.Fatal("Register: accepted invalid attribute name")
+	}
+	user = UserData{Username: "attrs", Email: "attrs@example.com", Attributes: Attributes{"name": "Attrs", "phone": "555"}}
+	if err := auth.Register(rw, req, user, "password"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := auth.Login(rw, req, "attrs", "password", "/"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	req = requestWithCookies("POST", "/", responseCookies(rw))
+
+	if err := auth.UpdateAttributes(rw, req, "", Attributes{"phone": "", "department": "sales"}); err != ErrAttributeNotEditable {
+		t.Fatalf("UpdateAttributes: expected ErrAttributeNotEditable, got %v", err)
+	}
+	if err := auth.UpdateAttributes(rw, req, "", Attributes{"phone": ""}); err != nil {
+		t.Fatalf("UpdateAttributes: %v", err)
+	}
+	if err := auth.UpdateAttributes(rw, req, "attrs", Attributes{"department": "sales"}); err != nil {
+		t.Fatalf("UpdateAttributes: %v", err)
+	}
+	if err := auth.UpdateAttributes(rw, req, "", Attributes{"$bad": "x"}); err == nil {
+		t.Fatal("UpdateAttributes: accepted invalid attribute name")
+	}
+	// Update keeps attributes
+	if err := auth.Update(rw, req, "", "", "new@example.com"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	user, err := auth.CurrentUser(rw, req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(user.Attributes) != 2 || user.Attributes["name"] != "Attrs" || user.Attributes["department"] != "sales" {
+		t.Fatalf("Attributes not updated properly: %v", user.Attributes)
+	}
+
+	p, _ := NewAttributePolicy(PolicyDeny, AttributeRule{Effect: PolicyAllow, Condition: `user.attributes.department == "sales"`})
+	if d := p.Evaluate(auth.RequestAttributes(req, user, nil)); !d.Allowed {
+		t.Errorf("Attributes not available to policies: %v", d)
+	}
+}
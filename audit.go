@@ -0,0 +1,259 @@
+package httpauth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audited actions.
+const (
+	ActionRegister          = "register"
+	ActionLogin             = "login"
+	ActionLogout            = "logout"
+	ActionUpdate            = "update"
+	ActionUpdateAttributes  = "update_attributes"
+	ActionDeleteUser        = "delete_user"
+	ActionDisableUser       = "disable_user"
+	ActionEnableUser        = "enable_user"
+	ActionLockUser          = "lock_user"
+	ActionSetUserExpiry     = "set_user_expiry"
+	ActionImpersonate       = "impersonate"
+	ActionStopImpersonating = "stop_impersonating"
+	ActionSetRole           = "set_role"
+)
+
+// Audit event outcomes.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// AuditEvent describes something done to a user. Actor is the user who did
+// it, and is empty for calls, like DeleteUser, made outside of a request
+// unless the Authorizer was returned by ForRequest. Reason explains failures.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Target  string    `json:"target"`
+	Action  string    `json:"action"`
+	Outcome string    `json:"outcome"`
+	Reason  string    `json:"reason,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+}
+
+// An AuditSink records audit events. Sinks may be called concurrently.
+type AuditSink interface {
+	Audit(e AuditEvent) error
+}
+
+// AddAuditSink adds a sink receiving an event for every registration, login,
+// logout, update, deletion and other change made to users through the
+// Authorizer. Sinks should be added before the Authorizer starts handling
+// requests.
+func (a Authorizer) AddAuditSink(sink AuditSink) {
+	a.ext.auditSinks = append(a.ext.auditSinks, sink)
+}
+
+// audit sends an event to every sink. req may be nil. Errors from sinks are
+// logged.
+func (a Authorizer) audit(req *http.Request, action string, actor string, target string, err error) {
+	if len(a.ext.auditSinks) == 0 {
+		return
+	}
+	e := AuditEvent{
+		Time:    time.Now(),
+		Actor:   actor,
+		Target:  target,
+		Action:  action,
+		Outcome: OutcomeSuccess,
+	}
+	if err != nil {
+		e.Outcome = OutcomeFailure
+		e.Reason = err.Error()
+	}
+	if req != nil {
+		e.IP = remoteIP(req)
+	}
+	for _, sink := range a.ext.auditSinks {
+		if err := sink.Audit(e); err != nil {
+			a.ext.logger.Printf("audit: %v", err)
+		}
+	}
+}
+
+// origin is the request, and the actor if not its session's user, changes
+// made through an Authorizer copy are attributed to.
+type origin struct {
+	req   *http.Request
+	actor string
+}
+
+// ForRequest returns a copy of the Authorizer attributing the changes made
+// by methods not taking a request, such as SetUserRole, DisableUser and
+// DeleteUser, to the user logged in to req: they're recorded as the actor of
+// audit events and webhooks, with req's IP, and hooks are passed req.
+func (a Authorizer) ForRequest(req *http.Request) Authorizer {
+	a.origin = &origin{req: req}
+	return a
+}
+
+// actingAs returns a copy of the Authorizer attributing every change it
+// makes, whatever the request, to actor, such as an API key.
+func (a Authorizer) actingAs(req *http.Request, actor string) Authorizer {
+	a.origin = &origin{req: req, actor: actor}
+	return a
+}
+
+// originRequest returns the request set by ForRequest, or nil.
+func (a Authorizer) originRequest() *http.Request {
+	if a.origin == nil {
+		return nil
+	}
+	return a.origin.req
+}
+
+// requestActor returns the name of the user really behind a request's
+// session, or "" if there isn't one. Copies returned by actingAs always
+// return their actor.
+func (a Authorizer) requestActor(req *http.Request) string {
+	if a.origin != nil && a.origin.actor != "" {
+		return a.origin.actor
+	}
+	if req == nil {
+		return ""
+	}
+	authSession, err := a.cookiejar.Get(req, "auth")
+	if err != nil {
+		return ""
+	}
+	if impersonator, ok := authSession.Values["impersonator"].(string); ok {
+		return impersonator
+	}
+	username, _ := authSession.Values["username"].(string)
+	return username
+}
+
+// FileAuditSink writes audit events to a file as JSON, one per line.
+//
+// A hash chained sink adds the fields "prev" and "hash" to each line. hash is
+// the hex SHA-256 of prev followed by the line's event JSON, and prev is the
+// previous line's hash, so any change to, insertion in or removal from the
+// middle of the log is detected by VerifyAuditLog.
+type FileAuditSink struct {
+	mu      sync.Mutex
+	f       *os.File
+	chained bool
+	prev    string
+}
+
+type chainedAuditEvent struct {
+	AuditEvent
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// NewFileAuditSink opens a file, creating it if needed, to append audit
+// events to as JSON lines.
+func NewFileAuditSink(filename string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, mkerror(err.Error())
+	}
+	return &FileAuditSink{f: f}, nil
+}
+
+// NewHashChainedAuditSink is like NewFileAuditSink, but chains each event to
+// the previous one by hash. The chain continues from the last event already
+// in the file, which must have been written by a hash chained sink.
+func NewHashChainedAuditSink(filename string) (*FileAuditSink, error) {
+	prev, err := verifyAuditLog(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	s, err := NewFileAuditSink(filename)
+	if err != nil {
+		return nil, err
+	}
+	s.chained = true
+	s.prev = prev
+	return s, nil
+}
+
+// Audit appends an event to the file.
+func (s *FileAuditSink) Audit(e AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if s.chained {
+		hash := auditHash(s.prev, data)
+		data, err = json.Marshal(chainedAuditEvent{e, s.prev, hash})
+		if err != nil {
+			return err
+		}
+		s.prev = hash
+	}
+	_, err = s.f.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (s *FileAuditSink) Close() error {
+	return s.f.Close()
+}
+
+func auditHash(prev string, event []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write(event)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyAuditLog checks the hash chain of a file written by a hash chained
+// sink, returning an error naming the first line that doesn't match.
+//
+// Truncating the end of the log can't be detected from the file alone; keep
+// the latest hash somewhere else to check for that.
+func VerifyAuditLog(filename string) error {
+	_, err := verifyAuditLog(filename)
+	return err
+}
+
+// verifyAuditLog verifies a log and returns its last hash.
+func verifyAuditLog(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var prev string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var e chainedAuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return "", mkerror(fmt.Sprintf("audit log line %d: %v", line, err))
+		}
+		data, err := json.Marshal(e.AuditEvent)
+		if err != nil {
+			return "", mkerror(fmt.Sprintf("audit log line %d: %v", line, err))
+		}
+		if e.Prev != prev || e.Hash != auditHash(prev, data) {
+			return "", mkerror(fmt.Sprintf("audit log line %d: hash chain broken", line))
+		}
+		prev = e.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return "", mkerror(err.Error())
+	}
+	return prev, nil
+}
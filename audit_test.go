@@ -0,0 +1,201 @@
+package httpauth
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (s *memoryAuditSink) Audit(e AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func TestAuditEvents(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "audit_test.gob")
+	defer done()
+	sink := &memoryAuditSink{}
+	auth.AddAuditSink(sink)
+
+	cookies := testLogin(t, auth, "audited", "user")
+	req := requestWithCookies("POST", "/", cookies)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rw := httptest.NewRecorder()
+	auth.Login(rw, requestWithCookies("POST", "/", nil), "audited", "wrongpassword", "/")
+	if err := auth.Update(rw, req, "", "", "new@example.com"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.Logout(rw, req); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.DeleteUser("audited"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []AuditEvent{
+		{Actor: "audited", Target: "audited", Action: ActionRegister, Outcome: OutcomeSuccess},
+		{Actor: "audited", Target: "audited", Action: ActionLogin, Outcome: OutcomeSuccess},
+		{Actor: "audited", Target: "audited", Action: ActionLogin, Outcome: OutcomeFailure},
+		{Actor: "audited", Target: "audited", Action: ActionUpdate, Outcome: OutcomeSuccess, IP: "192.0.2.1"},
+		{Actor: "audited", Target: "audited", Action: ActionLogout, Outcome: OutcomeSuccess, IP: "192.0.2.1"},
+		{Actor: "", Target: "audited", Action: ActionDeleteUser, Outcome: OutcomeSuccess},
+	}
+	if len(sink.events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d: %v", len(expected), len(sink.events), sink.events)
+	}
+	for i, e := range sink.events {
+		if e.Time.IsZero() {
+			t.Errorf("%d: event time not set", i)
+		}
+		if (e.Reason != "") != (e.Outcome == OutcomeFailure) {
+			t.Errorf("%d: reason %q doesn't match outcome %s", i, e.Reason, e.Outcome)
+		}
+		e.Time = time.Time{}
+		e.Reason = ""
+		if e != expected[i] {
+			t.Errorf("%d: expected %v, got %v", i, expected[i], e)
+		}
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	file := "audit_test.log"
+	os.Remove(file)
+	defer os.Remove(file)
+	sink, err := NewFileAuditSink(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sink.Audit(AuditEvent{Time: time.Now(), Actor: "actor", Target: "target", Action: ActionLogin, Outcome: OutcomeSuccess})
+	sink.Audit(AuditEvent{Time: time.Now(), Actor: "actor", Target: "target", Action: ActionLogout, Outcome: OutcomeSuccess})
+	sink.Close()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+	var actions []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Invalid JSON line: %v", err)
+		}
+		actions = append(actions, e.Action)
+	}
+	if len(actions) != 2 || actions[0] != ActionLogin || actions[1] != ActionLogout {
+		t.Fatalf("Events not written properly: %v", actions)
+	}
+}
+
+func TestHashChainedAuditSink(t *testing.T) {
+	file := "audit_chain_test.log"
+	os.Remove(file)
+	defer os.Remove(file)
+	for i := 0; i < 2; i++ {
+		// reopening continues the chain
+		sink, err := NewHashChainedAuditSink(file)
+		if err != nil {
+			t.Fatalf("NewHashChainedAuditSink: %v", err)
+		}
+		for _, target := range []string{"alice", "bob"} {
+			if err := sink.Audit(AuditEvent{Time: time.Now(), Actor: "admin", Target: target, Action: ActionDeleteUser, Outcome: OutcomeSuccess}); err != nil {
+				t.Fatalf("Audit: %v", err)
+			}
+		}
+		sink.Close()
+	}
+	if err := VerifyAuditLog(file); err != nil {
+		t.Fatalf("VerifyAuditLog: %v", err)
+	}
+
+	data, _ := ioutil.ReadFile(file)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 lines, got %d", len(lines))
+	}
+	tampered := strings.Replace(string(data), `"target":"bob"`, `"target":"eve"`, 1)
+	ioutil.WriteFile(file, []byte(tampered), 0600)
+	if err := VerifyAuditLog(file); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("VerifyAuditLog: tampering not detected: %v", err)
+	}
+	removed := strings.Join(append(lines[:1:1], lines[2:]...), "\n") + "\n"
+	ioutil.WriteFile(file, []byte(removed), 0600)
+	if err := VerifyAuditLog(file); err == nil {
+		t.Fatal("VerifyAuditLog: removed line not detected")
+	}
+	if _, err := NewHashChainedAuditSink(file); err == nil {
+		t.Fatal("NewHashChainedAuditSink: continued broken chain")
+	}
+}
+
+func TestAuditRegisterByAdmin(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "audit_admin_test.gob")
+	defer done()
+	cookies := testLogin(t, auth, "admin", "admin")
+	sink := &memoryAuditSink{}
+	auth.AddAuditSink(sink)
+	req, _ := http.NewRequest("POST", "/", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	if err := auth.Register(httptest.NewRecorder(), req, UserData{Username: "newuser", Email: "new@example.com"}, "password"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(sink.events) != 1 || sink.events[0].Actor != "admin" || sink.events[0].Target != "newuser" {
+		t.Fatalf("Register by admin not audited properly: %v", sink.events)
+	}
+}
+
+func TestAuditForRequest(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "audit_admin_test.gob")
+	defer done()
+	cookies := testLogin(t, auth, "admin", "admin")
+	testLogin(t, auth, "target", "user")
+	sink := &memoryAuditSink{}
+	auth.AddAuditSink(sink)
+	var hooked []HookEvent
+	auth.AddAfterHook(ActionDeleteUser, func(e HookEvent) error {
+		hooked = append(hooked, e)
+		return nil
+	})
+	req := requestWithCookies("POST", "/", cookies)
+	req.RemoteAddr = "192.0.2.1:1234"
+	a := auth.ForRequest(req)
+	if err := a.SetUserRole("target", "admin"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := a.DisableUser("target", ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := a.DeleteUser("target"); err != nil {
+		t.Fatal(err.Error())
+	}
+	actions := []string{ActionSetRole, ActionDisableUser, ActionDeleteUser}
+	if len(sink.events) != len(actions) {
+		t.Fatalf("expected %d events, got %v", len(actions), sink.events)
+	}
+	for i, e := range sink.events {
+		if e.Action != actions[i] || e.Actor != "admin" || e.Target != "target" || e.IP != "192.0.2.1" {
+			t.Errorf("%d: unexpected %v", i, e)
+		}
+	}
+	if len(hooked) != 1 || hooked[0].Actor != "admin" || hooked[0].Request != req {
+		t.Errorf("DeleteUser hook not passed the request: %v", hooked)
+	}
+}
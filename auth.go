@@ -20,7 +20,12 @@ package httpauth
 
 import (
 	"errors"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"golang.org/x/crypto/bcrypt"
@@ -34,6 +39,33 @@ var (
 	ErrMissingUser = mkerror("can't find user")
 )
 
+// Errors returned by Login and the methods authorizing requests.
+// ErrUserNotFound is returned when the user logging in, or the one in the
+// session, doesn't exist.
+var (
+	ErrAlreadyAuthenticated = mkerror("already authenticated")
+	ErrUserNotFound         = mkerror("user not found")
+	ErrWrongPassword        = mkerror("password doesn't match")
+	ErrNewSession           = mkerror("new authorization session")
+	ErrNotLoggedIn          = mkerror("user not logged in")
+	ErrNoSessionUser        = mkerror("User not found in authsession")
+	ErrInsufficientRole     = mkerror("user doesn't have high enough role")
+	ErrMissingPermission    = mkerror("user doesn't have permission")
+)
+
+// Errors returned by Register, Update and the other methods changing users
+// when given invalid data.
+var (
+	ErrUserExists           = mkerror("user already exists")
+	ErrNoUsername           = mkerror("no username given")
+	ErrInvalidUsername      = mkerror("invalid username")
+	ErrNoEmail              = mkerror("no email given")
+	ErrNoPassword           = mkerror("no password given")
+	ErrNonexistentRole      = mkerror("nonexistent role")
+	ErrInvalidStatus        = mkerror("invalid account status")
+	ErrInvalidAttributeName = mkerror("invalid attribute name")
+)
+
 // Role represents an interal role. Roles are essentially a string mapped to an
 // integer. Roles must be greater than zero.
 type Role int
@@ -42,11 +74,34 @@ type Role int
 // and role as well as a hash of their password. When creating
 // users, you should not specify a hash; it will be generated in the Register
 // and Update functions.
+//
+// Status, StatusReason, LockedUntil and ExpiresAt describe whether the account
+// may be used; see AccountStatus. Attributes holds any other profile data.
+//
+// The remaining fields are maintained by the Authorizer.
 type UserData struct {
 	Username string `bson:"Username"`
 	Email    string `bson:"Email"`
 	Hash     []byte `bson:"Hash"`
 	Role     string `bson:"Role"`
+
+	Status       string    `bson:"Status"`
+	StatusReason string    `bson:"StatusReason"`
+	LockedUntil  time.Time `bson:"LockedUntil"`
+	ExpiresAt    time.Time `bson:"ExpiresAt"`
+
+	Attributes Attributes `bson:"Attributes,omitempty"`
+
+	CreatedAt         time.Time `bson:"CreatedAt"`
+	UpdatedAt         time.Time `bson:"UpdatedAt"`
+	LastLoginAt       time.Time `bson:"LastLoginAt"`
+	LastLoginIP       string    `bson:"LastLoginIP"`
+	PasswordChangedAt time.Time `bson:"PasswordChangedAt"`
+	// FailedLoginCount counts wrong passwords since the last login.
+	FailedLoginCount int `bson:"FailedLoginCount"`
+	// Version is incremented whenever the user's role, account status,
+	// password or email is changed; see EnableSessionClaims.
+	Version int `bson:"Version"`
 }
 
 // Authorizer structures contain the store of user session cookies a reference
@@ -56,8 +111,43 @@ type Authorizer struct {
 	backend     AuthBackend
 	defaultRole string
 	roles       map[string]Role
+	permissions map[string][]string
+	ext         *extensions
+	api         *apiState // set on copies handling JSON API requests
+	origin      *origin   // set on copies returned by ForRequest
+}
+
+// extensions holds optional behaviour shared by every copy of an Authorizer.
+type extensions struct {
+	checks            []AuthorizeCheck
+	impersonationRole string
+	logger            *log.Logger
+	reauthMaxAge      time.Duration
+
+	loginHistory           bool
+	loginHistoryMaxAge     time.Duration
+	loginHistoryMaxPerUser int
+	loginHistoryPruning    loginHistoryPruning
+	newDevice              NewDeviceFunc
+
+	auditSinks []AuditSink
+	hooks      *hooks
+	metrics    *Metrics
+	tracer     Tracer
+
+	claims       bool
+	claimsMaxAge time.Duration
+	versions     userVersions
+
+	uniqueEmails bool
+
+	userAttributes map[string]bool // editable by users themselves
 }
 
+// AuthorizeCheck is an extra check run by Authorize once a user's session has
+// been validated. Returning an error denies access.
+type AuthorizeCheck func(req *http.Request, user UserData) error
+
 // The AuthBackend interface defines a set of methods an AuthBackend must
 // implement.
 type AuthBackend interface {
@@ -70,6 +160,9 @@ type AuthBackend interface {
 
 // Helper function to add a user directed message to a message queue.
 func (a Authorizer) addMessage(rw http.ResponseWriter, req *http.Request, message string) {
+	if a.api != nil {
+		return
+	}
 	messageSession, _ := a.cookiejar.Get(req, "messages")
 	defer messageSession.Save(req, rw)
 	messageSession.AddFlash(message)
@@ -78,6 +171,9 @@ func (a Authorizer) addMessage(rw http.ResponseWriter, req *http.Request, messag
 // Helper function to save a redirect to the page a user tried to visit before
 // logging in.
 func (a Authorizer) goBack(rw http.ResponseWriter, req *http.Request) {
+	if a.api != nil {
+		return
+	}
 	redirectSession, _ := a.cookiejar.Get(req, "redirects")
 	defer redirectSession.Save(req, rw)
 	redirectSession.Flashes()
@@ -88,6 +184,15 @@ func mkerror(msg string) error {
 	return errors.New("httpauth: " + msg)
 }
 
+// remoteIP returns the address of the client a request came from, without its
+// port. Forwarding headers aren't trusted.
+func remoteIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
 // NewAuthorizer returns a new Authorizer given an AuthBackend, a cookie store
 // key, a default user role, and a map of roles. If the key changes, logged in
 // users will need to reauthenticate.
@@ -106,6 +211,15 @@ func NewAuthorizer(backend AuthBackend, key []byte, defaultRole string, roles ma
 	a.cookiejar = sessions.NewCookieStore([]byte(key))
 	a.backend = backend
 	a.roles = roles
+	a.permissions = make(map[string][]string)
+	a.ext = &extensions{
+		logger: log.New(os.Stderr, "httpauth: ", log.LstdFlags),
+		hooks: &hooks{
+			before: make(map[string][]Hook),
+			after:  make(map[string][]Hook),
+			async:  make(map[string][]Hook),
+		},
+	}
 	a.defaultRole = defaultRole
 	if _, ok := roles[defaultRole]; !ok {
 		return a, mkerror("httpauth: defaultRole missing")
@@ -116,23 +230,82 @@ func NewAuthorizer(backend AuthBackend, key []byte, defaultRole string, roles ma
 // Login logs a user in. They will be redirected to dest or to the last
 // location an authorization redirect was triggered (if found) on success. A
 // message will be added to the session on failure with the reason.
-func (a Authorizer) Login(rw http.ResponseWriter, req *http.Request, u string, p string, dest string) error {
+// Users whose account is disabled, locked or expired can't log in.
+// Successful logins record the time and IP address on the user, and wrong
+// passwords increment their FailedLoginCount. See also EnableLoginHistory.
+// u may be a username or, once RequireUniqueEmails has been called and if no
+// user has that username, an email.
+func (a Authorizer) Login(rw http.ResponseWriter, req *http.Request, u string, p string, dest string) (err error) {
+	a, span := a.startSpan(req, "Login")
+	setSpanUser(span, u)
+	defer func() { endSpan(span, err) }()
+	defer func() { a.audit(req, ActionLogin, u, u, err) }()
 	session, _ := a.cookiejar.Get(req, "auth")
 	if session.Values["username"] == u {
-		return mkerror("already authenticated")
+		return ErrAlreadyAuthenticated
 	}
-	if user, err := a.backend.User(u); err == nil {
-		verify := bcrypt.CompareHashAndPassword(user.Hash, []byte(p))
-		if verify != nil {
-			a.addMessage(rw, req, "Invalid username or password.")
-			return mkerror("password doesn't match")
+	user, err := a.loginUser(u)
+	if err != nil {
+		a.recordLogin(req, UserData{Username: u}, LoginUnknownUser)
+		a.addMessage(rw, req, "Invalid username or password.")
+		return ErrUserNotFound
+	}
+	if u != user.Username {
+		// logging in with an email
+		u = user.Username
+		setSpanUser(span, u)
+		if session.Values["username"] == u {
+			return ErrAlreadyAuthenticated
 		}
-	} else {
+	}
+	span.SetAttribute("role", user.Role)
+	verify := bcrypt.CompareHashAndPassword(user.Hash, []byte(p))
+	if verify != nil {
+		user.FailedLoginCount++
+		if err := a.backend.SaveUser(user); err != nil {
+			a.ext.logger.Printf("failed login count for %s: %v", user.Username, err)
+		}
+		forgetRequestUser(req, user.Username)
+		a.recordLogin(req, user, LoginBadPassword)
 		a.addMessage(rw, req, "Invalid username or password.")
-		return mkerror("user not found")
+		return ErrWrongPassword
+	}
+	if msg, err := statusError(user); err != nil {
+		a.recordLogin(req, user, user.AccountStatus(time.Now()))
+		a.addMessage(rw, req, msg)
+		return err
 	}
+	if err := a.beforeHooks(ActionLogin, req, user); err != nil {
+		a.recordLogin(req, user, LoginVetoed)
+		return err
+	}
+	a.recordLogin(req, user, LoginSuccess)
+	user.LastLoginAt = time.Now()
+	user.LastLoginIP = remoteIP(req)
+	user.FailedLoginCount = 0
+	if err := a.backend.SaveUser(user); err != nil {
+		return mkerror(err.Error())
+	}
+	forgetRequestUser(req, user.Username)
+
 	session.Values["username"] = u
+	session.Values["authenticated_at"] = time.Now().Unix()
+	if tenant := a.userTenant(u); tenant != "" {
+		session.Values["tenant"] = tenant
+	} else {
+		delete(session.Values, "tenant")
+	}
+	delete(session.Values, "impersonator")
+	if err := a.setClaims(session, user); err != nil {
+		return mkerror(err.Error())
+	}
 	session.Save(req, rw)
+	if err := a.afterHooks(ActionLogin, req, user); err != nil {
+		return err
+	}
+	if a.api != nil {
+		return nil
+	}
 
 	redirectSession, _ := a.cookiejar.Get(req, "redirects")
 	if flashes := redirectSession.Flashes(); len(flashes) > 0 {
@@ -146,32 +319,65 @@ func (a Authorizer) Login(rw http.ResponseWriter, req *http.Request, u string, p
 // username is in use.
 //
 // Pass in a instance of UserData with at least a username and email specified. If no role
-// is given, the default one is used.
+// is given, the default one is used. Any Attributes given are saved with the
+// user. The email is normalized with NormalizeEmail; see also
+// RequireUniqueEmails. Usernames can't contain TenantSeparator; see
+// RegisterInTenant.
 func (a Authorizer) Register(rw http.ResponseWriter, req *http.Request, user UserData, password string) error {
+	return a.register(rw, req, user, password, "")
+}
+
+// register implements Register and RegisterInTenant, saving the user under
+// their tenant username if tenant isn't empty.
+func (a Authorizer) register(rw http.ResponseWriter, req *http.Request, user UserData, password string, tenant string) (err error) {
+	a, span := a.startSpan(req, "Register")
+	setSpanUser(span, user.Username)
+	defer func() { endSpan(span, err) }()
+	defer func() {
+		actor := a.requestActor(req)
+		if actor == "" {
+			actor = user.Username
+		}
+		a.audit(req, ActionRegister, actor, user.Username, err)
+		a.ext.metrics.registration(err)
+	}()
 	if user.Username == "" {
-		return mkerror("no username given")
+		return ErrNoUsername
+	}
+	if strings.Contains(user.Username, TenantSeparator) {
+		return ErrInvalidUsername
 	}
+	if tenant != "" {
+		user.Username = TenantUsername(tenant, user.Username)
+	}
+	user.Email = NormalizeEmail(user.Email)
 	if user.Email == "" {
-		return mkerror("no email given")
+		return ErrNoEmail
 	}
 	if user.Hash != nil {
 		return mkerror("hash will be overwritten")
 	}
 	if password == "" {
-		return mkerror("no password given")
+		return ErrNoPassword
 	}
 
 	// Validate username
-	_, err := a.backend.User(user.Username)
+	_, err = a.backend.User(user.Username)
 	if err == nil {
 		a.addMessage(rw, req, "Username has been taken.")
-		return mkerror("user already exists")
+		return ErrUserExists
 	} else if err != ErrMissingUser {
 		if err != nil {
 			return mkerror(err.Error())
 		}
 		return nil
 	}
+	if err := a.checkEmail(user.Username, user.Email); err != nil {
+		if err == ErrEmailTaken {
+			a.addMessage(rw, req, "Email is already in use.")
+		}
+		return err
+	}
 
 	// Generate and save hash
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -179,22 +385,43 @@ func (a Authorizer) Register(rw http.ResponseWriter, req *http.Request, user Use
 		return mkerror("couldn't save password: " + err.Error())
 	}
 	user.Hash = hash
+	now := time.Now()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.PasswordChangedAt = now
+
+	switch user.Status {
+	case "", StatusActive, StatusDisabled:
+	default:
+		return ErrInvalidStatus
+	}
+	if err := validateAttributes(user.Attributes); err != nil {
+		return err
+	}
 
 	// Validate role
 	if user.Role == "" {
 		user.Role = a.defaultRole
 	} else {
 		if _, ok := a.roles[user.Role]; !ok {
-			return mkerror("nonexistent role")
+			return ErrNonexistentRole
 		}
 	}
+	span.SetAttribute("role", user.Role)
 
+	if err := a.beforeHooks(ActionRegister, req, user); err != nil {
+		return err
+	}
 	err = a.backend.SaveUser(user)
-	if err != nil {
+	if err == ErrEmailTaken {
+		// saved by someone else since checkEmail
+		a.addMessage(rw, req, "Email is already in use.")
+		return err
+	} else if err != nil {
 		a.addMessage(rw, req, err.Error())
 		return mkerror(err.Error())
 	}
-	return nil
+	return a.afterHooks(ActionRegister, req, user)
 }
 
 // Update changes data for an existing user.
@@ -206,14 +433,27 @@ func (a Authorizer) Register(rw http.ResponseWriter, req *http.Request, user Use
 //  If an empty password p is passed then it keeps the original rather than
 //    regenerating the hash, if a new password is passed then it regenerates the hash.
 //  If an empty email e is passed then it keeps the orginal rather than updating it,
-//    if a new email is passedn then it updates it.
-func (a Authorizer) Update(rw http.ResponseWriter, req *http.Request, u string, p string, e string) error {
+//    if a new email is passedn then it updates it, normalized with
+//    NormalizeEmail. See also RequireUniqueEmails.
+//  Attributes are changed with UpdateAttributes.
+//  If RequireReauthForUpdates has been used, self-edits changing the password
+//    or email fail with ErrReauthRequired unless the user has recently
+//    reauthenticated.
+//  Self-edits changing the password or email fail with ErrImpersonating while
+//    the session is impersonating the user.
+func (a Authorizer) Update(rw http.ResponseWriter, req *http.Request, u string, p string, e string) (err error) {
 	var (
 		hash     []byte
 		email    string
 		username string
 		ok       bool
 	)
+	a, span := a.startSpan(req, "Update")
+	defer func() {
+		setSpanUser(span, username)
+		endSpan(span, err)
+	}()
+	defer func() { a.audit(req, ActionUpdate, a.requestActor(req), username, err) }()
 	if u != "" {
 		username = u
 	} else {
@@ -225,6 +465,16 @@ func (a Authorizer) Update(rw http.ResponseWriter, req *http.Request, u string,
 		if !ok {
 			return mkerror("not logged in")
 		}
+		if p != "" || e != "" {
+			if err := a.refuseImpersonating(rw, req, authSession); err != nil {
+				return err
+			}
+		}
+		if a.ext.reauthMaxAge > 0 && (p != "" || e != "") {
+			if err := a.RequireRecentAuth(rw, req, a.ext.reauthMaxAge); err != nil {
+				return err
+			}
+		}
 	}
 	user, err := a.backend.User(username)
 	if err == ErrMissingUser {
@@ -241,19 +491,43 @@ func (a Authorizer) Update(rw http.ResponseWriter, req *http.Request, u string,
 	} else {
 		hash = user.Hash
 	}
-	if e != "" {
+	if e = NormalizeEmail(e); e != "" {
 		email = e
+		if err := a.checkEmail(username, email); err != nil {
+			if err == ErrEmailTaken {
+				a.addMessage(rw, req, "Email is already in use.")
+			}
+			return err
+		}
 	} else {
 		email = user.Email
 	}
 
-	newuser := UserData{username, email, hash, user.Role}
+	newuser := user
+	newuser.Email = email
+	newuser.Hash = hash
+	newuser.UpdatedAt = time.Now()
+	if p != "" {
+		newuser.PasswordChangedAt = newuser.UpdatedAt
+	}
+	if p != "" || e != "" {
+		a.bumpVersion(&newuser)
+	}
 
+	if err := a.beforeHooks(ActionUpdate, req, newuser); err != nil {
+		return err
+	}
 	err = a.backend.SaveUser(newuser)
-	if err != nil {
+	if err == ErrEmailTaken {
+		// saved by someone else since checkEmail
+		a.addMessage(rw, req, "Email is already in use.")
+		return err
+	} else if err != nil {
 		a.addMessage(rw, req, err.Error())
+		return mkerror(err.Error())
 	}
-	return nil
+	forgetRequestUser(req, username)
+	return a.afterHooks(ActionUpdate, req, newuser)
 }
 
 // Authorize checks if a user is logged in and returns an error on failed
@@ -261,13 +535,22 @@ func (a Authorizer) Update(rw http.ResponseWriter, req *http.Request, u string,
 // will be saved and a "Login to do that." message will be saved to the
 // messages list. The next time the user logs in, they will be redirected back
 // to the saved page.
-func (a Authorizer) Authorize(rw http.ResponseWriter, req *http.Request, redirectWithMessage bool) error {
+//
+// If the account of the user behind the session (the impersonator, while
+// impersonating) is no longer active, the session is ended and a message with
+// the reason is always added.
+func (a Authorizer) Authorize(rw http.ResponseWriter, req *http.Request, redirectWithMessage bool) (err error) {
+	a, span := a.startSpan(req, "Authorize")
+	defer func() { endSpan(span, err) }()
 	authSession, err := a.cookiejar.Get(req, "auth")
 	if err != nil {
 		if redirectWithMessage {
 			a.goBack(rw, req)
 		}
-		return mkerror("new authorization session")
+		return ErrNewSession
+	}
+	if _, _, ok := a.trustedClaims(authSession); ok && !authSession.IsNew {
+		return nil
 	}
 	/*if authSession.IsNew {
 	    if redirectWithMessage {
@@ -276,9 +559,11 @@ func (a Authorizer) Authorize(rw http.ResponseWriter, req *http.Request, redirec
 	    }
 	    return mkerror("no session existed")
 	}*/
+	var user UserData
 	username := authSession.Values["username"]
 	if !authSession.IsNew && username != nil {
-		_, err := a.backend.User(username.(string))
+		setSpanUser(span, username.(string))
+		user, err = a.requestUser(req, username.(string))
 		if err == ErrMissingUser {
 			authSession.Options.MaxAge = -1 // kill the cookie
 			authSession.Save(req, rw)
@@ -286,75 +571,236 @@ func (a Authorizer) Authorize(rw http.ResponseWriter, req *http.Request, redirec
 				a.goBack(rw, req)
 				a.addMessage(rw, req, "Log in to do that.")
 			}
-			return mkerror("user not found")
+			return ErrUserNotFound
 		} else if err != nil {
 			return mkerror(err.Error())
 		}
+		actor, err := a.sessionActor(rw, req, authSession, user)
+		if err != nil {
+			return err
+		}
+		if err := a.checkStatus(rw, req, authSession, actor); err != nil {
+			return err
+		}
 	}
 	if username == nil {
 		if redirectWithMessage {
 			a.goBack(rw, req)
 			a.addMessage(rw, req, "Log in to do that.")
 		}
-		return mkerror("user not logged in")
+		return ErrNotLoggedIn
+	}
+	for _, check := range a.ext.checks {
+		if err := check(req, user); err != nil {
+			if redirectWithMessage {
+				a.addMessage(rw, req, "You don't have sufficient privileges.")
+			}
+			return err
+		}
+	}
+	if a.claimsApply(authSession) {
+		// revalidated; refresh the claims
+		a.setVersion(user.Username, user.Version)
+		if err := a.setClaims(authSession, user); err != nil {
+			return mkerror(err.Error())
+		}
+		authSession.Save(req, rw)
 	}
 	return nil
 }
 
-// AuthorizeRole runs Authorize on a user, then makes sure their role is at
-// least as high as the specified one, failing if not.
-func (a Authorizer) AuthorizeRole(rw http.ResponseWriter, req *http.Request, role string, redirectWithMessage bool) error {
+// AddAuthorizeCheck adds a check to be run by Authorize, and so by every
+// function building on it, after a user's session has been validated. Checks
+// should be added before the Authorizer starts handling requests.
+func (a Authorizer) AddAuthorizeCheck(check AuthorizeCheck) {
+	a.ext.checks = append(a.ext.checks, check)
+}
+
+// AuthorizeRole runs Authorize on a user, then makes sure their role, or a
+// role inherited from one of their groups, is at least as high as the
+// specified one, failing if not. If a tenant has been selected with
+// SelectTenant, the user's role in that tenant is used instead.
+func (a Authorizer) AuthorizeRole(rw http.ResponseWriter, req *http.Request, role string, redirectWithMessage bool) (err error) {
+	a, span := a.startSpan(req, "AuthorizeRole")
+	span.SetAttribute("role", role)
+	defer func() { endSpan(span, err) }()
 	r, ok := a.roles[role]
 	if !ok {
 		return mkerror("role not found")
 	}
 	if err := a.Authorize(rw, req, redirectWithMessage); err != nil {
+		return err
+	}
+	roles, _, err := a.sessionGrants(rw, req)
+	if err == ErrMissingUser {
+		return ErrUserNotFound
+	} else if err != nil {
 		return mkerror(err.Error())
 	}
-	authSession, _ := a.cookiejar.Get(req, "auth") // should I check err? I've already checked in call to Authorize
-	username := authSession.Values["username"]
-	if user, err := a.backend.User(username.(string)); err == nil {
-		if a.roles[user.Role] >= r {
+	for _, role := range roles {
+		if a.roles[role] >= r {
 			return nil
 		}
-		a.addMessage(rw, req, "You don't have sufficient privileges.")
-		return mkerror("user doesn't have high enough role")
 	}
-	return mkerror("user not found")
+	a.ext.metrics.denial(role)
+	a.addMessage(rw, req, "You don't have sufficient privileges.")
+	return ErrInsufficientRole
+}
+
+// SetRolePermissions grants a set of named permissions to a role, replacing
+// any previously granted to it. A user holds every permission granted to their
+// own role or to any lower role.
+func (a Authorizer) SetRolePermissions(role string, permissions ...string) error {
+	if _, ok := a.roles[role]; !ok {
+		return mkerror("role not found")
+	}
+	a.permissions[role] = permissions
+	return nil
+}
+
+// hasPermission checks if a role has been granted a permission, either
+// directly or through a lower role.
+func (a Authorizer) hasPermission(role string, permission string) bool {
+	r, ok := a.roles[role]
+	if !ok {
+		return false
+	}
+	for name, perms := range a.permissions {
+		if a.roles[name] > r {
+			continue
+		}
+		for _, p := range perms {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AuthorizePermission runs Authorize on a user, then makes sure they hold the
+// specified permission through their roles or groups, failing if not.
+func (a Authorizer) AuthorizePermission(rw http.ResponseWriter, req *http.Request, permission string, redirectWithMessage bool) (err error) {
+	a, span := a.startSpan(req, "AuthorizePermission")
+	span.SetAttribute("permission", permission)
+	defer func() { endSpan(span, err) }()
+	if err := a.Authorize(rw, req, redirectWithMessage); err != nil {
+		return err
+	}
+	roles, permissions, err := a.sessionGrants(rw, req)
+	if err == ErrMissingUser {
+		return ErrUserNotFound
+	} else if err != nil {
+		return mkerror(err.Error())
+	}
+	if containsString(permissions, permission) {
+		return nil
+	}
+	for _, role := range roles {
+		if a.hasPermission(role, permission) {
+			return nil
+		}
+	}
+	a.addMessage(rw, req, "You don't have sufficient privileges.")
+	return ErrMissingPermission
 }
 
 // CurrentUser returns the currently logged in user and a boolean validating
 // the information.
 func (a Authorizer) CurrentUser(rw http.ResponseWriter, req *http.Request) (user UserData, e error) {
+	a, span := a.startSpan(req, "CurrentUser")
+	defer func() { endSpan(span, e) }()
 	if err := a.Authorize(rw, req, false); err != nil {
-		return user, mkerror(err.Error())
+		return user, err
 	}
 	authSession, _ := a.cookiejar.Get(req, "auth")
 
 	username, ok := authSession.Values["username"].(string)
 	if !ok {
-		return user, mkerror("User not found in authsession")
+		return user, ErrNoSessionUser
 	}
-	return a.backend.User(username)
+	return a.requestUser(req, username)
 }
 
 // Logout clears an authentication session and add a logged out message.
-func (a Authorizer) Logout(rw http.ResponseWriter, req *http.Request) error {
+func (a Authorizer) Logout(rw http.ResponseWriter, req *http.Request) (err error) {
+	a, span := a.startSpan(req, "Logout")
+	defer func() { endSpan(span, err) }()
+	actor := a.requestActor(req)
 	session, _ := a.cookiejar.Get(req, "auth")
 	defer session.Save(req, rw)
+	username, loggedIn := session.Values["username"].(string)
+	setSpanUser(span, username)
+	var user UserData
+	if loggedIn {
+		user, _ = a.backend.User(username)
+		if err := a.beforeHooks(ActionLogout, req, user); err != nil {
+			return err
+		}
+		a.audit(req, ActionLogout, actor, username, nil)
+	}
 
 	session.Options.MaxAge = -1 // kill the cookie
 	a.addMessage(rw, req, "Logged out.")
+	if loggedIn {
+		return a.afterHooks(ActionLogout, req, user)
+	}
 	return nil
 }
 
-// DeleteUser removes a user from the Authorize. ErrMissingUser is returned if
-// the user to be deleted isn't found.
-func (a Authorizer) DeleteUser(username string) error {
-	err := a.backend.DeleteUser(username)
+// DeleteUser removes a user from the Authorize, along with their group and
+// tenant memberships and login history. ErrMissingUser is returned if the user
+// to be deleted isn't found.
+func (a Authorizer) DeleteUser(username string) (err error) {
+	req := a.originRequest()
+	a, span := a.startSpan(req, "DeleteUser")
+	setSpanUser(span, username)
+	defer func() { endSpan(span, err) }()
+	defer func() { a.audit(req, ActionDeleteUser, a.requestActor(req), username, err) }()
+	user, uerr := a.backend.User(username)
+	if uerr == nil {
+		if err := a.beforeHooks(ActionDeleteUser, req, user); err != nil {
+			return err
+		}
+	}
+	err = a.backend.DeleteUser(username)
 	if err != nil && err != ErrDeleteNull {
 		return mkerror(err.Error())
 	}
+	if gb, ok := asGroupBackend(a.backend); ok && err == nil {
+		groups, gerr := gb.Groups()
+		if gerr != nil {
+			return mkerror(gerr.Error())
+		}
+		for _, g := range groups {
+			if users, ok := removeString(g.Users, username); ok {
+				g.Users = users
+				if gerr := gb.SaveGroup(g); gerr != nil {
+					return mkerror(gerr.Error())
+				}
+			}
+		}
+	}
+	if hb, ok := asLoginHistoryBackend(a.backend); ok && err == nil {
+		if herr := hb.DeleteLoginAttempts(username); herr != nil {
+			return mkerror(herr.Error())
+		}
+	}
+	if tb, ok := asTenantBackend(a.backend); ok && err == nil {
+		memberships, terr := tb.Memberships(username)
+		if terr != nil {
+			return mkerror(terr.Error())
+		}
+		for _, m := range memberships {
+			if terr := tb.DeleteMembership(m.Tenant, username); terr != nil {
+				return mkerror(terr.Error())
+			}
+		}
+	}
+	if err == nil {
+		a.setVersion(username, deletedVersion)
+		return a.afterHooks(ActionDeleteUser, req, user)
+	}
 	return err
 }
 
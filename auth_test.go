@@ -1,9 +1,13 @@
 package httpauth
 
 import (
+	"bytes"
+	"errors"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -200,3 +204,117 @@ func TestDeleteUser(t *testing.T) {
 
 	os.Remove(file)
 }
+
+// saveFailingBackend fails to save users.
+type saveFailingBackend struct {
+	AuthBackend
+}
+
+func (b saveFailingBackend) SaveUser(user UserData) error {
+	return errors.New("can't save")
+}
+
+func TestLoginMetadata(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "metadata_test.gob")
+	defer done()
+	before := time.Now()
+	testLogin(t, auth, "metadata", "user")
+	user, err := auth.backend.User("metadata")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if user.CreatedAt.Before(before) || !user.UpdatedAt.Equal(user.CreatedAt) || !user.PasswordChangedAt.Equal(user.CreatedAt) {
+		t.Errorf("Register: timestamps not set: %v, %v, %v", user.CreatedAt, user.UpdatedAt, user.PasswordChangedAt)
+	}
+	if user.LastLoginAt.Before(user.CreatedAt) || user.LastLoginIP != "" {
+		t.Errorf("Login: metadata not set: %v, %q", user.LastLoginAt, user.LastLoginIP)
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	for i := 0; i < 2; i++ {
+		auth.Login(rw, req, "metadata", "wrongpassword", "/")
+	}
+	if user, _ = auth.backend.User("metadata"); user.FailedLoginCount != 2 {
+		t.Errorf("Login: expected 2 failed logins, got %d", user.FailedLoginCount)
+	}
+	if err := auth.Login(rw, req, "metadata", "password", "/"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if user, _ = auth.backend.User("metadata"); user.FailedLoginCount != 0 || user.LastLoginIP != "192.0.2.1" {
+		t.Errorf("Login: metadata not updated: %d, %q", user.FailedLoginCount, user.LastLoginIP)
+	}
+
+	var logs bytes.Buffer
+	auth.SetLogger(log.New(&logs, "", 0))
+	failing := auth
+	failing.backend = saveFailingBackend{auth.backend}
+	req, _ = http.NewRequest("POST", "/", nil)
+	if err := failing.Login(rw, req, "metadata", "wrongpassword", "/"); err == nil || !strings.Contains(logs.String(), "failed login count for metadata: can't save") {
+		t.Errorf("Login: expected the failed save to be logged, got %v, %q", err, logs.String())
+	}
+
+	created := user.CreatedAt
+	if err := auth.Update(rw, req, "metadata", "newpassword", ""); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	user, _ = auth.backend.User("metadata")
+	if !user.CreatedAt.Equal(created) || user.UpdatedAt.Before(created) || !user.PasswordChangedAt.Equal(user.UpdatedAt) {
+		t.Errorf("Update: timestamps not updated: %v, %v, %v", user.CreatedAt, user.UpdatedAt, user.PasswordChangedAt)
+	}
+}
+
+// newTestAuthorizer returns an Authorizer backed by a fresh gob file and a
+// function cleaning it up.
+func newTestAuthorizer(t *testing.T, file string) (Authorizer, func()) {
+	os.Remove(file)
+	if _, err := os.Create(file); err != nil {
+		t.Fatal(err.Error())
+	}
+	backend, err := NewGobFileAuthBackend(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	roles := make(map[string]Role)
+	roles["user"] = 40
+	roles["admin"] = 80
+	auth, err := NewAuthorizer(backend, []byte("testkey"), "user", roles)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return auth, func() {
+		backend.Close()
+		os.Remove(file)
+	}
+}
+
+// testLogin registers a user with the password "password" and returns the
+// cookies of a session logged in as them.
+func testLogin(t testing.TB, auth Authorizer, username string, role string) []*http.Cookie {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", nil)
+	user := UserData{Username: username, Email: username + "@example.com", Role: role}
+	if err := auth.Register(rw, req, user, "password"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	rw = httptest.NewRecorder()
+	if err := auth.Login(rw, req, username, "password", "/"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	return responseCookies(rw)
+}
+
+// responseCookies returns the cookies set on a recorded response.
+func responseCookies(rw *httptest.ResponseRecorder) []*http.Cookie {
+	return (&http.Response{Header: rw.Header()}).Cookies()
+}
+
+// requestWithCookies creates a request carrying cookies.
+func requestWithCookies(method string, url string, cookies []*http.Cookie) *http.Request {
+	req, _ := http.NewRequest(method, url, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	return req
+}
@@ -2,7 +2,12 @@ package httpauth
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func testBackendAuthorizer(t *testing.T, backend AuthBackend) {
@@ -16,12 +21,12 @@ func testBackendAuthorizer(t *testing.T, backend AuthBackend) {
 }
 
 func testBackendSaveUser(t *testing.T, backend AuthBackend) {
-	user2 := UserData{"username2", "email2", []byte("passwordhash2"), "role2"}
+	user2 := UserData{Username: "username2", Email: "email2", Hash: []byte("passwordhash2"), Role: "role2"}
 	if err := backend.SaveUser(user2); err != nil {
 		t.Fatalf("SaveUser sql error: %v", err)
 	}
 
-	user := UserData{"username", "email", []byte("passwordhash"), "role"}
+	user := UserData{Username: "username", Email: "email", Hash: []byte("passwordhash"), Role: "role"}
 	if err := backend.SaveUser(user); err != nil {
 		t.Fatalf("SaveUser sql error: %v", err)
 	}
@@ -121,7 +126,12 @@ func testBackendUsers(t *testing.T, backend AuthBackend) {
 }
 
 func testBackendUpdateUser(t *testing.T, backend AuthBackend) {
-	user2 := UserData{"username", "newemail", []byte("newpassword"), "newrole"}
+	locked := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	user2 := UserData{Username: "username", Email: "newemail", Hash: []byte("newpassword"), Role: "newrole",
+		Status: StatusDisabled, StatusReason: "reason", LockedUntil: locked,
+		Attributes: Attributes{"name": "User Name", "age": "42"},
+		CreatedAt:  locked, LastLoginAt: locked, LastLoginIP: "10.0.0.1", FailedLoginCount: 3,
+		Version: 7}
 	if err := backend.SaveUser(user2); err != nil {
 		t.Fatalf("SaveUser sql error: %v", err)
 	}
@@ -141,6 +151,24 @@ func testBackendUpdateUser(t *testing.T, backend AuthBackend) {
 	if !bytes.Equal(u2.Hash, []byte("newpassword")) {
 		t.Fatal("User password not correct.")
 	}
+	if u2.Status != StatusDisabled || u2.StatusReason != "reason" {
+		t.Fatalf("User status not correct: %q, %q", u2.Status, u2.StatusReason)
+	}
+	if !u2.LockedUntil.Equal(locked) || !u2.ExpiresAt.IsZero() {
+		t.Fatalf("User status times not correct: %v, %v", u2.LockedUntil, u2.ExpiresAt)
+	}
+	if age, _ := u2.Attributes.Int("age"); len(u2.Attributes) != 2 || u2.Attributes["name"] != "User Name" || age != 42 {
+		t.Fatalf("User attributes not correct: %v", u2.Attributes)
+	}
+	if !u2.CreatedAt.Equal(locked) || !u2.LastLoginAt.Equal(locked) || !u2.UpdatedAt.IsZero() {
+		t.Fatalf("User timestamps not correct: %v, %v, %v", u2.CreatedAt, u2.LastLoginAt, u2.UpdatedAt)
+	}
+	if u2.LastLoginIP != "10.0.0.1" || u2.FailedLoginCount != 3 {
+		t.Fatalf("User login metadata not correct: %q, %d", u2.LastLoginIP, u2.FailedLoginCount)
+	}
+	if u2.Version != 7 {
+		t.Fatalf("User version not correct: %d", u2.Version)
+	}
 }
 
 func testBackendDeleteUser(t *testing.T, backend AuthBackend) {
@@ -155,6 +183,434 @@ func testBackendDeleteUser(t *testing.T, backend AuthBackend) {
 	}
 }
 
+func testBackendGroups(t *testing.T, backend AuthBackend) {
+	gb, ok := backend.(GroupBackend)
+	if !ok {
+		t.Fatal("Backend doesn't implement GroupBackend")
+	}
+	if _, err := gb.Group("group"); err != ErrMissingGroup {
+		t.Fatalf("Group: expected ErrMissingGroup, got %v", err)
+	}
+	group := Group{Name: "group", Roles: []string{"role"}, Permissions: []string{"perm"}, Users: []string{"username"}}
+	if err := gb.SaveGroup(group); err != nil {
+		t.Fatalf("SaveGroup error: %v", err)
+	}
+	group2 := Group{Name: "group2", Users: []string{"username", "username2"}, Groups: []string{"group"}}
+	if err := gb.SaveGroup(group2); err != nil {
+		t.Fatalf("SaveGroup error: %v", err)
+	}
+	group2.Users = []string{"username2"}
+	if err := gb.SaveGroup(group2); err != nil {
+		t.Fatalf("SaveGroup error: %v", err)
+	}
+
+	g, err := gb.Group("group2")
+	if err != nil {
+		t.Fatalf("Group error: %v", err)
+	}
+	if len(g.Users) != 1 || g.Users[0] != "username2" {
+		t.Errorf("Group users not correct: %v", g.Users)
+	}
+	if len(g.Groups) != 1 || g.Groups[0] != "group" {
+		t.Errorf("Group nested groups not correct: %v", g.Groups)
+	}
+	groups, err := gb.Groups()
+	if err != nil {
+		t.Fatalf("Groups error: %v", err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("Wrong amount of groups found: %d", len(groups))
+	}
+	for _, g := range groups {
+		if g.Name == "group" && (len(g.Roles) != 1 || g.Roles[0] != "role" || len(g.Permissions) != 1 || len(g.Users) != 1) {
+			t.Errorf("Group not correct: %+v", g)
+		}
+	}
+	names, err := gb.UserGroupNames("username2")
+	if err != nil {
+		t.Fatalf("UserGroupNames error: %v", err)
+	}
+	if len(names) != 1 || names[0] != "group2" {
+		t.Errorf("UserGroupNames not correct: %v", names)
+	}
+	names, err = gb.ParentGroupNames("group")
+	if err != nil {
+		t.Fatalf("ParentGroupNames error: %v", err)
+	}
+	if len(names) != 1 || names[0] != "group2" {
+		t.Errorf("ParentGroupNames not correct: %v", names)
+	}
+
+	if err := gb.DeleteGroup("group2"); err != nil {
+		t.Fatalf("DeleteGroup error: %v", err)
+	}
+	if err := gb.DeleteGroup("group2"); err != ErrMissingGroup {
+		t.Fatalf("DeleteGroup should have returned ErrMissingGroup: got %v", err)
+	}
+}
+
+func testBackendTenants(t *testing.T, backend AuthBackend) {
+	tb, ok := backend.(TenantBackend)
+	if !ok {
+		t.Fatal("Backend doesn't implement TenantBackend")
+	}
+	if _, err := tb.Tenant("tenant"); err != ErrMissingTenant {
+		t.Fatalf("Tenant: expected ErrMissingTenant, got %v", err)
+	}
+	for _, tenant := range []Tenant{{"tenant", "Tenant"}, {"tenant2", "Tenant 2"}} {
+		if err := tb.SaveTenant(tenant); err != nil {
+			t.Fatalf("SaveTenant error: %v", err)
+		}
+	}
+	if err := tb.SaveTenant(Tenant{"tenant", "Renamed"}); err != nil {
+		t.Fatalf("SaveTenant error: %v", err)
+	}
+	if tenant, err := tb.Tenant("tenant"); err != nil || tenant.DisplayName != "Renamed" {
+		t.Fatalf("Tenant not updated: %v, %v", tenant, err)
+	}
+	if tenants, err := tb.Tenants(); err != nil || len(tenants) != 2 {
+		t.Fatalf("Wrong amount of tenants found: %v, %v", tenants, err)
+	}
+
+	for _, m := range []Membership{
+		{"tenant", "username2", "role"},
+		{"tenant2", "username2", "role"},
+		{"tenant2", "username2", "role2"},
+		{"tenant2", "username3", "role"},
+	} {
+		if err := tb.SaveMembership(m); err != nil {
+			t.Fatalf("SaveMembership error: %v", err)
+		}
+	}
+	memberships, err := tb.Memberships("username2")
+	if err != nil {
+		t.Fatalf("Memberships error: %v", err)
+	}
+	if len(memberships) != 2 || memberships[0].Tenant != "tenant" || memberships[1].Role != "role2" {
+		t.Errorf("Memberships not correct: %v", memberships)
+	}
+	members, err := tb.TenantMembers("tenant2")
+	if err != nil {
+		t.Fatalf("TenantMembers error: %v", err)
+	}
+	if len(members) != 2 || members[0].Username != "username2" || members[1].Username != "username3" {
+		t.Errorf("TenantMembers not correct: %v", members)
+	}
+	if err := tb.DeleteMembership("tenant2", "username3"); err != nil {
+		t.Fatalf("DeleteMembership error: %v", err)
+	}
+	if err := tb.DeleteMembership("tenant2", "username3"); err != ErrMissingMembership {
+		t.Fatalf("DeleteMembership should have returned ErrMissingMembership: got %v", err)
+	}
+
+	if err := tb.DeleteTenant("tenant2"); err != nil {
+		t.Fatalf("DeleteTenant error: %v", err)
+	}
+	if err := tb.DeleteTenant("tenant2"); err != ErrMissingTenant {
+		t.Fatalf("DeleteTenant should have returned ErrMissingTenant: got %v", err)
+	}
+	if members, _ := tb.TenantMembers("tenant2"); len(members) != 0 {
+		t.Errorf("DeleteTenant left memberships: %v", members)
+	}
+}
+
+func testBackendLoginAttempts(t *testing.T, backend AuthBackend) {
+	hb, ok := backend.(LoginHistoryBackend)
+	if !ok {
+		t.Fatal("Backend doesn't implement LoginHistoryBackend")
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		outcome := LoginSuccess
+		if i%2 == 1 {
+			outcome = LoginBadPassword
+		}
+		attempt := LoginAttempt{"username2", start.Add(time.Duration(i) * time.Minute), "10.0.0.1", "agent", outcome}
+		if err := hb.SaveLoginAttempt(attempt); err != nil {
+			t.Fatalf("SaveLoginAttempt error: %v", err)
+		}
+	}
+	hb.SaveLoginAttempt(LoginAttempt{"other", start, "10.0.0.2", "agent", LoginSuccess})
+
+	attempts, total, err := hb.LoginAttempts("username2", 1, 2)
+	if err != nil {
+		t.Fatalf("LoginAttempts error: %v", err)
+	}
+	if total != 5 || len(attempts) != 2 || !attempts[0].Time.Equal(start.Add(3*time.Minute)) {
+		t.Fatalf("LoginAttempts not correct: %d, %v", total, attempts)
+	}
+	if attempts[0].IP != "10.0.0.1" || attempts[0].UserAgent != "agent" || attempts[0].Outcome != LoginBadPassword {
+		t.Errorf("LoginAttempt not loaded properly: %v", attempts[0])
+	}
+	if known, err := hb.KnownDevice("username2", "10.0.0.1", "agent"); err != nil || !known {
+		t.Errorf("KnownDevice: expected known device, got %v, %v", known, err)
+	}
+	if known, _ := hb.KnownDevice("username2", "10.0.0.2", "agent"); known {
+		t.Error("KnownDevice: another user's device known")
+	}
+
+	if err := hb.PruneLoginAttempts("username2", start.Add(time.Minute), 3); err != nil {
+		t.Fatalf("PruneLoginAttempts error: %v", err)
+	}
+	if attempts, total, _ = hb.LoginAttempts("username2", 0, 0); total != 3 || len(attempts) != 3 || !attempts[2].Time.Equal(start.Add(2*time.Minute)) {
+		t.Fatalf("PruneLoginAttempts: kept %d, %v", total, attempts)
+	}
+	if err := hb.PruneLoginAttempts("", start.Add(4*time.Minute), 0); err != nil {
+		t.Fatalf("PruneLoginAttempts error: %v", err)
+	}
+	if _, total, _ = hb.LoginAttempts("other", 0, 0); total != 0 {
+		t.Errorf("PruneLoginAttempts: other user's attempts not pruned")
+	}
+	if _, total, _ = hb.LoginAttempts("username2", 0, 0); total != 1 {
+		t.Errorf("PruneLoginAttempts: expected 1 remaining attempt, got %d", total)
+	}
+	if err := hb.DeleteLoginAttempts("username"); err != nil {
+		t.Fatalf("DeleteLoginAttempts error: %v", err)
+	}
+}
+
+func testBackendWebhooks(t *testing.T, backend AuthBackend) {
+	wb, ok := backend.(WebhookBackend)
+	if !ok {
+		t.Fatal("Backend doesn't implement WebhookBackend")
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := WebhookDelivery{"id1", "http://example.com/hook", WebhookUserCreated, []byte(`{"a":1}`), 0, start, "", false, start.Add(time.Second)}
+	second := WebhookDelivery{"id2", "http://example.com/hook", WebhookUserDeleted, []byte(`{"b":2}`), 0, start, "", false, start}
+	for _, d := range []WebhookDelivery{first, second} {
+		if err := wb.SaveWebhookDelivery(d); err != nil {
+			t.Fatalf("SaveWebhookDelivery error: %v", err)
+		}
+	}
+	pending, err := wb.WebhookDeliveries(false)
+	if err != nil {
+		t.Fatalf("WebhookDeliveries error: %v", err)
+	}
+	if len(pending) != 2 || pending[0].ID != "id2" || pending[1].ID != "id1" {
+		t.Fatalf("WebhookDeliveries not sorted oldest first: %v", pending)
+	}
+
+	first.Attempts = 3
+	first.LastError = "timeout"
+	first.Dead = true
+	if err := wb.SaveWebhookDelivery(first); err != nil {
+		t.Fatalf("SaveWebhookDelivery error: %v", err)
+	}
+	d, err := wb.WebhookDelivery("id1")
+	if err != nil {
+		t.Fatalf("WebhookDelivery error: %v", err)
+	}
+	if d.Attempts != 3 || d.LastError != "timeout" || !d.Dead || d.Event != WebhookUserCreated ||
+		string(d.Payload) != `{"a":1}` || !d.CreatedAt.Equal(start.Add(time.Second)) || !d.NextAttempt.Equal(start) {
+		t.Errorf("WebhookDelivery not loaded properly: %v", d)
+	}
+	if dead, _ := wb.WebhookDeliveries(true); len(dead) != 1 || dead[0].ID != "id1" {
+		t.Errorf("WebhookDeliveries: expected one dead delivery, got %v", dead)
+	}
+	if _, err := wb.WebhookDelivery("missing"); err != ErrMissingDelivery {
+		t.Errorf("WebhookDelivery: expected ErrMissingDelivery, got %v", err)
+	}
+
+	for _, id := range []string{"id1", "id2"} {
+		if err := wb.DeleteWebhookDelivery(id); err != nil {
+			t.Fatalf("DeleteWebhookDelivery error: %v", err)
+		}
+	}
+	if err := wb.DeleteWebhookDelivery("id1"); err != ErrMissingDelivery {
+		t.Errorf("DeleteWebhookDelivery: expected ErrMissingDelivery, got %v", err)
+	}
+	if pending, _ := wb.WebhookDeliveries(false); len(pending) != 0 {
+		t.Errorf("DeleteWebhookDelivery: deliveries remain: %v", pending)
+	}
+}
+
+func testBackendQueryUsers(t *testing.T, backend AuthBackend) {
+	qb, ok := backend.(UserQueryBackend)
+	if !ok {
+		t.Fatal("Backend doesn't implement UserQueryBackend")
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		user := UserData{Username: fmt.Sprintf("queried%d", i), Email: fmt.Sprintf("Q%d@example.com", i%3), Role: "queried",
+			CreatedAt: start.Add(time.Duration(5-i) * time.Minute)}
+		if err := backend.SaveUser(user); err != nil {
+			t.Fatalf("SaveUser error: %v", err)
+		}
+	}
+	defer func() {
+		for i := 0; i < 5; i++ {
+			backend.DeleteUser(fmt.Sprintf("queried%d", i))
+		}
+	}()
+	names := func(page UserPage) (names []string) {
+		for _, user := range page.Users {
+			names = append(names, user.Username)
+		}
+		return
+	}
+
+	tests := []struct {
+		query UserQuery
+		pages [][]string
+	}{
+		{UserQuery{Role: "queried", Limit: 2}, [][]string{{"queried0", "queried1"}, {"queried2", "queried3"}, {"queried4"}}},
+		{UserQuery{Role: "queried", Limit: 5}, [][]string{{"queried0", "queried1", "queried2", "queried3", "queried4"}}},
+		{UserQuery{Role: "queried", Sort: "-username", Limit: 3}, [][]string{{"queried4", "queried3", "queried2"}, {"queried1", "queried0"}}},
+		{UserQuery{Role: "queried", Sort: "created", Limit: 2}, [][]string{{"queried4", "queried3"}, {"queried2", "queried1"}, {"queried0"}}},
+		{UserQuery{Role: "queried", Sort: "email", Limit: 2}, [][]string{{"queried0", "queried3"}, {"queried1", "queried4"}, {"queried2"}}},
+		{UserQuery{Role: "queried", Sort: "-email", Limit: 2}, [][]string{{"queried2", "queried4"}, {"queried1", "queried3"}, {"queried0"}}},
+		{UserQuery{UsernamePrefix: "QUERIED", EmailPrefix: "q1@", Limit: 1}, [][]string{{"queried1"}, {"queried4"}}},
+		{UserQuery{UsernamePrefix: "queried_"}, [][]string{nil}},
+	}
+	for _, test := range tests {
+		q := test.query
+		for i, want := range test.pages {
+			page, err := qb.QueryUsers(q)
+			if err != nil {
+				t.Fatalf("QueryUsers(%+v) error: %v", q, err)
+			}
+			if got := names(page); !reflect.DeepEqual(got, want) {
+				t.Fatalf("QueryUsers(%+v) page %d: expected %v, got %v", test.query, i+1, want, got)
+			}
+			if (page.NextCursor == "") != (i == len(test.pages)-1) {
+				t.Fatalf("QueryUsers(%+v) page %d: unexpected cursor %q", test.query, i+1, page.NextCursor)
+			}
+			q.Cursor = page.NextCursor
+		}
+	}
+	if page, _ := qb.QueryUsers(UserQuery{Role: "queried", Limit: 1}); !page.Users[0].CreatedAt.Equal(start.Add(5 * time.Minute)) {
+		t.Errorf("QueryUsers: user not loaded properly: %v", page.Users[0])
+	}
+
+	if n, err := qb.CountUsers(UserQuery{Role: "queried", Limit: 1, Cursor: "ignored"}); err != nil || n != 5 {
+		t.Errorf("CountUsers: expected 5, got %d, %v", n, err)
+	}
+	if n, _ := qb.CountUsers(UserQuery{EmailPrefix: "q2"}); n != 1 {
+		t.Errorf("CountUsers: expected 1 user with an email prefix, got %d", n)
+	}
+
+	page, _ := qb.QueryUsers(UserQuery{Role: "queried", Limit: 1})
+	if _, err := qb.QueryUsers(UserQuery{Role: "queried", Sort: "email", Cursor: page.NextCursor}); err != ErrInvalidCursor {
+		t.Errorf("QueryUsers: expected ErrInvalidCursor for another sort's cursor, got %v", err)
+	}
+	if _, err := qb.QueryUsers(UserQuery{Cursor: "garbage!"}); err != ErrInvalidCursor {
+		t.Errorf("QueryUsers: expected ErrInvalidCursor, got %v", err)
+	}
+	if _, err := qb.QueryUsers(UserQuery{Sort: "hash"}); err != ErrInvalidSort {
+		t.Errorf("QueryUsers: expected ErrInvalidSort, got %v", err)
+	}
+}
+
+func testBackendForEachUser(t *testing.T, backend AuthBackend) {
+	ib, ok := backend.(UserIteratorBackend)
+	if !ok {
+		t.Fatal("Backend doesn't implement UserIteratorBackend")
+	}
+	for _, username := range []string{"iterated2", "iterated0", "iterated1"} {
+		if err := backend.SaveUser(UserData{Username: username, Email: username + "@example.com", Role: "iterated"}); err != nil {
+			t.Fatalf("SaveUser error: %v", err)
+		}
+		defer backend.DeleteUser(username)
+	}
+	var names []string
+	err := ib.ForEachUser(context.Background(), func(user UserData) error {
+		if user.Role == "iterated" {
+			names = append(names, user.Username)
+		}
+		if user.Username == "iterated1" && user.Email != "iterated1@example.com" {
+			t.Errorf("ForEachUser: user not loaded properly: %v", user)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEachUser error: %v", err)
+	}
+	if want := []string{"iterated0", "iterated1", "iterated2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ForEachUser: expected %v, got %v", want, names)
+	}
+
+	n := 0
+	err = ib.ForEachUser(context.Background(), func(user UserData) error {
+		n++
+		return ErrStopIteration
+	})
+	if err != nil || n != 1 {
+		t.Errorf("ForEachUser: expected to stop after 1 user without error, got %d, %v", n, err)
+	}
+	failed := errors.New("failed")
+	if err := ib.ForEachUser(context.Background(), func(user UserData) error { return failed }); err != failed {
+		t.Errorf("ForEachUser: expected fn's error, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n = 0
+	err = ib.ForEachUser(ctx, func(user UserData) error {
+		n++
+		cancel()
+		return nil
+	})
+	if err != context.Canceled || n != 1 {
+		t.Errorf("ForEachUser: expected to stop after 1 user with context.Canceled, got %d, %v", n, err)
+	}
+}
+
+func testBackendUserByEmail(t *testing.T, backend AuthBackend) {
+	eb, ok := backend.(EmailBackend)
+	if !ok {
+		t.Fatal("Backend doesn't implement EmailBackend")
+	}
+	for i, email := range []string{"shared@example.com", "shared@example.com", "other@example.com"} {
+		username := fmt.Sprintf("emailed%d", 2-i)
+		if err := backend.SaveUser(UserData{Username: username, Email: email, Role: "emailed"}); err != nil {
+			t.Fatalf("SaveUser error: %v", err)
+		}
+		defer backend.DeleteUser(username)
+	}
+	user, err := eb.UserByEmail(" Shared@Example.com")
+	if err != nil {
+		t.Fatalf("UserByEmail error: %v", err)
+	}
+	if user.Username != "emailed1" || user.Role != "emailed" {
+		t.Errorf("UserByEmail: expected the lowest username with the email, got %v", user)
+	}
+	if user, _ := eb.UserByEmail("other@example.com"); user.Username != "emailed0" {
+		t.Errorf("UserByEmail: expected emailed0, got %v", user)
+	}
+	if _, err := eb.UserByEmail("missing@example.com"); err != ErrMissingUser {
+		t.Errorf("UserByEmail: expected ErrMissingUser, got %v", err)
+	}
+}
+
+func testBackendUniqueEmails(t *testing.T, backend AuthBackend) {
+	ub, ok := backend.(UniqueEmailBackend)
+	if !ok {
+		t.Fatal("Backend doesn't implement UniqueEmailBackend")
+	}
+	for _, username := range []string{"unique0", "unique1"} {
+		if err := backend.SaveUser(UserData{Username: username, Email: "unique@example.com"}); err != nil {
+			t.Fatalf("SaveUser error: %v", err)
+		}
+		defer backend.DeleteUser(username)
+	}
+	if err := ub.RequireUniqueEmails(); err == nil {
+		t.Error("RequireUniqueEmails: expected an error with users sharing an email")
+	}
+	backend.DeleteUser("unique1")
+	for i := 0; i < 2; i++ {
+		if err := ub.RequireUniqueEmails(); err != nil {
+			t.Fatalf("RequireUniqueEmails error: %v", err)
+		}
+	}
+	if err := backend.SaveUser(UserData{Username: "unique1", Email: "unique@example.com"}); err != ErrEmailTaken {
+		t.Errorf("SaveUser: expected ErrEmailTaken, got %v", err)
+	}
+	if err := backend.SaveUser(UserData{Username: "unique0", Email: "unique@example.com", Role: "changed"}); err != nil {
+		t.Errorf("SaveUser: saving a user with their own email failed: %v", err)
+	}
+	if err := backend.SaveUser(UserData{Username: "unique1", Email: "other-unique@example.com"}); err != nil {
+		t.Errorf("SaveUser error: %v", err)
+	}
+}
+
 func testBackendClose(t *testing.T, backend AuthBackend) {
 	backend.Close()
 }
@@ -168,6 +624,14 @@ func testBackend(t *testing.T, backend AuthBackend) {
 	testBackendUsers(t, backend)
 	testBackendUpdateUser(t, backend)
 	testBackendDeleteUser(t, backend)
+	testBackendGroups(t, backend)
+	testBackendTenants(t, backend)
+	testBackendLoginAttempts(t, backend)
+	testBackendWebhooks(t, backend)
+	testBackendQueryUsers(t, backend)
+	testBackendForEachUser(t, backend)
+	testBackendUserByEmail(t, backend)
+	testBackendUniqueEmails(t, backend)
 	testBackendClose(t, backend)
 }
 
@@ -188,6 +652,26 @@ func testAfterReopen(t *testing.T, backend AuthBackend) {
 	if !bytes.Equal(users[0].Hash, []byte("passwordhash2")) {
 		t.Error("User password not correct.")
 	}
+	groups, err := backend.(GroupBackend).Groups()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(groups) != 1 || groups[0].Name != "group" {
+		t.Fatalf("Groups not loaded properly: %v", groups)
+	}
+	if len(groups[0].Users) != 1 || groups[0].Users[0] != "username" {
+		t.Errorf("Group members not loaded properly: %v", groups[0].Users)
+	}
+	memberships, err := backend.(TenantBackend).Memberships("username2")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(memberships) != 1 || memberships[0].Tenant != "tenant" {
+		t.Fatalf("Memberships not loaded properly: %v", memberships)
+	}
+	if _, total, err := backend.(LoginHistoryBackend).LoginAttempts("username2", 0, 0); err != nil || total != 1 {
+		t.Fatalf("Login attempts not loaded properly: %d, %v", total, err)
+	}
 }
 
 func testDelete2(t *testing.T, backend AuthBackend) {
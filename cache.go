@@ -0,0 +1,197 @@
+package httpauth
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// requestUsers memoizes the users loaded while handling a request, so
+// Authorize, AuthorizeRole, CurrentUser and friends look each user up once.
+type requestUsers struct {
+	mu    sync.Mutex
+	users map[string]UserData
+}
+
+type requestUsersKey struct{}
+
+// requestUserCache returns the users memoized for a request, adding an empty
+// set to its context if there is none. The context is replaced in place, as
+// gorilla/sessions does for its registry, so callers holding req see it.
+func requestUserCache(req *http.Request) *requestUsers {
+	if c, ok := req.Context().Value(requestUsersKey{}).(*requestUsers); ok {
+		return c
+	}
+	c := &requestUsers{users: make(map[string]UserData)}
+	*req = *req.WithContext(context.WithValue(req.Context(), requestUsersKey{}, c))
+	return c
+}
+
+// requestUser loads a user, at most once per request. Users saved through
+// the Authorizer while handling the request are loaded again; changes made
+// elsewhere are seen from the next request.
+func (a Authorizer) requestUser(req *http.Request, username string) (UserData, error) {
+	if req == nil {
+		return a.backend.User(username)
+	}
+	c := requestUserCache(req)
+	c.mu.Lock()
+	user, ok := c.users[username]
+	c.mu.Unlock()
+	if ok {
+		return cloneUser(user), nil
+	}
+	user, err := a.backend.User(username)
+	if err != nil {
+		return user, err
+	}
+	c.mu.Lock()
+	c.users[username] = cloneUser(user)
+	c.mu.Unlock()
+	return user, nil
+}
+
+// forgetRequestUser drops a user memoized for a request, once they've been
+// saved.
+func forgetRequestUser(req *http.Request, username string) {
+	if req == nil {
+		return
+	}
+	if c, ok := req.Context().Value(requestUsersKey{}).(*requestUsers); ok {
+		c.mu.Lock()
+		delete(c.users, username)
+		c.mu.Unlock()
+	}
+}
+
+// cloneUser copies a user deeply enough that changing the copy's Hash or
+// Attributes leaves the original alone.
+func cloneUser(user UserData) UserData {
+	if user.Hash != nil {
+		user.Hash = append([]byte(nil), user.Hash...)
+	}
+	if user.Attributes != nil {
+		attrs := make(Attributes, len(user.Attributes))
+		for key, value := range user.Attributes {
+			attrs[key] = value
+		}
+		user.Attributes = attrs
+	}
+	return user
+}
+
+// CachingBackend wraps a backend, keeping up to size recently loaded users in
+// memory for ttl. Users saved or deleted through it are invalidated; use
+// Invalidate or Purge after changing users by other means, such as another
+// process sharing the database, or rely on ttl to bound how stale they get.
+// Optional interfaces of the wrapped backend are passed through.
+type CachingBackend struct {
+	wrappedBackend
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // most recently used at the front
+	gen     uint64     // incremented by invalidations
+}
+
+type cacheEntry struct {
+	username string
+	user     UserData
+	expires  time.Time
+}
+
+// NewCachingBackend returns a CachingBackend wrapping backend.
+func NewCachingBackend(backend AuthBackend, ttl time.Duration, size int) *CachingBackend {
+	return &CachingBackend{
+		wrappedBackend: wrappedBackend{backend, passThrough},
+		ttl:            ttl,
+		size:           size,
+		entries:        make(map[string]*list.Element),
+		lru:            list.New(),
+	}
+}
+
+// User returns a cached user, or loads and caches them. Missing users aren't
+// cached.
+func (b *CachingBackend) User(username string) (UserData, error) {
+	b.mu.Lock()
+	if elem, ok := b.entries[username]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			b.lru.MoveToFront(elem)
+			b.mu.Unlock()
+			return cloneUser(entry.user), nil
+		}
+		b.remove(elem)
+	}
+	gen := b.gen
+	b.mu.Unlock()
+
+	user, err := b.backend.User(username)
+	if err != nil || b.size <= 0 {
+		return user, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.gen != gen {
+		// invalidated while loading; what was loaded may be stale
+		return user, nil
+	}
+	if elem, ok := b.entries[username]; ok {
+		b.remove(elem)
+	}
+	entry := &cacheEntry{username, cloneUser(user), time.Now().Add(b.ttl)}
+	b.entries[username] = b.lru.PushFront(entry)
+	for b.lru.Len() > b.size {
+		b.remove(b.lru.Back())
+	}
+	return user, nil
+}
+
+// SaveUser saves a user in the wrapped backend and invalidates them.
+func (b *CachingBackend) SaveUser(user UserData) error {
+	defer b.Invalidate(user.Username)
+	return b.backend.SaveUser(user)
+}
+
+// DeleteUser deletes a user from the wrapped backend and invalidates them.
+func (b *CachingBackend) DeleteUser(username string) error {
+	defer b.Invalidate(username)
+	return b.backend.DeleteUser(username)
+}
+
+// Invalidate drops a user from the cache.
+func (b *CachingBackend) Invalidate(username string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gen++
+	if elem, ok := b.entries[username]; ok {
+		b.remove(elem)
+	}
+}
+
+// Purge empties the cache.
+func (b *CachingBackend) Purge() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gen++
+	b.entries = make(map[string]*list.Element)
+	b.lru.Init()
+}
+
+// Len returns the number of users cached, including expired ones not yet
+// dropped.
+func (b *CachingBackend) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lru.Len()
+}
+
+func (b *CachingBackend) remove(elem *list.Element) {
+	b.lru.Remove(elem)
+	delete(b.entries, elem.Value.(*cacheEntry).username)
+}
@@ -0,0 +1,180 @@
+package httpauth
+
+import (
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingBackend counts calls to User.
+type countingBackend struct {
+	AuthBackend
+	lookups *int64
+}
+
+func (b countingBackend) User(username string) (UserData, error) {
+	atomic.AddInt64(b.lookups, 1)
+	return b.AuthBackend.User(username)
+}
+
+func newCountingAuthorizer(t testing.TB, file string, wrap func(AuthBackend) AuthBackend) (Authorizer, *int64, func()) {
+	os.Remove(file)
+	if _, err := os.Create(file); err != nil {
+		t.Fatal(err.Error())
+	}
+	gob, err := NewGobFileAuthBackend(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lookups := new(int64)
+	var backend AuthBackend = countingBackend{gob, lookups}
+	if wrap != nil {
+		backend = wrap(backend)
+	}
+	auth, err := NewAuthorizer(backend, []byte("testkey"), "user", map[string]Role{"user": 40, "admin": 80})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return auth, lookups, func() { os.Remove(file) }
+}
+
+func TestRequestUserMemo(t *testing.T) {
+	auth, lookups, done := newCountingAuthorizer(t, "cache_test.gob", nil)
+	defer done()
+	cookies := testLogin(t, auth, "memo", "user")
+
+	rw := httptest.NewRecorder()
+	req := requestWithCookies("GET", "/", cookies)
+	atomic.StoreInt64(lookups, 0)
+	if err := auth.AuthorizeRole(rw, req, "user", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	user, err := auth.CurrentUser(rw, req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := atomic.LoadInt64(lookups); n != 1 {
+		t.Errorf("expected 1 backend lookup per request, got %d", n)
+	}
+
+	user.Attributes = Attributes{"changed": "locally"}
+	if again, _ := auth.CurrentUser(rw, req); again.Attributes["changed"] != "" {
+		t.Error("memoized user shared with callers")
+	}
+	auth.SetUserEditableAttributes("theme")
+	if err := auth.UpdateAttributes(rw, req, "", Attributes{"theme": "dark"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if user, _ := auth.CurrentUser(rw, req); user.Attributes["theme"] != "dark" {
+		t.Error("user saved during the request not reloaded")
+	}
+
+	atomic.StoreInt64(lookups, 0)
+	auth.CurrentUser(rw, requestWithCookies("GET", "/", cookies))
+	if n := atomic.LoadInt64(lookups); n != 1 {
+		t.Errorf("new request: expected 1 backend lookup, got %d", n)
+	}
+}
+
+func TestCachingBackend(t *testing.T) {
+	var cache *CachingBackend
+	auth, lookups, done := newCountingAuthorizer(t, "cache_test.gob", func(b AuthBackend) AuthBackend {
+		cache = NewCachingBackend(b, time.Hour, 2)
+		return cache
+	})
+	defer done()
+	for _, username := range []string{"one", "two", "three"} {
+		testLogin(t, auth, username, "user")
+	}
+
+	atomic.StoreInt64(lookups, 0)
+	for i := 0; i < 3; i++ {
+		if _, err := cache.User("one"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if n := atomic.LoadInt64(lookups); n != 1 {
+		t.Errorf("expected 1 lookup for cached user, got %d", n)
+	}
+	cache.User("two")
+	cache.User("three")
+	if cache.Len() != 2 {
+		t.Errorf("cache not bounded: %d entries", cache.Len())
+	}
+	atomic.StoreInt64(lookups, 0)
+	cache.User("one")
+	if n := atomic.LoadInt64(lookups); n != 1 {
+		t.Error("least recently used user not evicted")
+	}
+
+	user, _ := cache.User("one")
+	user.Email = "new@example.com"
+	if err := cache.SaveUser(user); err != nil {
+		t.Fatal(err.Error())
+	}
+	if user, _ := cache.User("one"); user.Email != "new@example.com" {
+		t.Error("SaveUser didn't invalidate the cached user")
+	}
+	if err := auth.DeleteUser("one"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := cache.User("one"); err != ErrMissingUser {
+		t.Errorf("DeleteUser didn't invalidate the cached user: %v", err)
+	}
+
+	atomic.StoreInt64(lookups, 0)
+	cache.User("two")
+	cache.Invalidate("two")
+	cache.User("two")
+	cache.Purge()
+	cache.User("two")
+	if n := atomic.LoadInt64(lookups); n != 3 {
+		t.Errorf("expected Invalidate and Purge to force lookups, got %d", n)
+	}
+	gob := cache.backend.(countingBackend).AuthBackend
+	if _, ok := asGroupBackend(NewCachingBackend(gob, time.Hour, 2)); !ok {
+		t.Error("CachingBackend hides GroupBackend")
+	}
+
+	expiring := NewCachingBackend(countingBackend{gob, lookups}, time.Millisecond, 10)
+	atomic.StoreInt64(lookups, 0)
+	expiring.User("two")
+	time.Sleep(5 * time.Millisecond)
+	expiring.User("two")
+	if n := atomic.LoadInt64(lookups); n != 2 {
+		t.Errorf("expired user not reloaded: %d lookups", n)
+	}
+}
+
+// benchmarkHandler runs what a typical handler does, AuthorizeRole followed
+// by CurrentUser, reporting backend lookups per request.
+func benchmarkHandler(b *testing.B, wrap func(AuthBackend) AuthBackend) {
+	auth, lookups, done := newCountingAuthorizer(b, "cache_bench.gob", wrap)
+	defer done()
+	cookies := testLogin(b, auth, "bench", "user")
+	rw := httptest.NewRecorder()
+	atomic.StoreInt64(lookups, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := requestWithCookies("GET", "/", cookies)
+		if err := auth.AuthorizeRole(rw, req, "user", false); err != nil {
+			b.Fatal(err.Error())
+		}
+		if _, err := auth.CurrentUser(rw, req); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(lookups))/float64(b.N), "lookups/op")
+}
+
+func BenchmarkHandlerLookups(b *testing.B) {
+	benchmarkHandler(b, nil)
+}
+
+func BenchmarkHandlerLookupsCachingBackend(b *testing.B) {
+	benchmarkHandler(b, func(backend AuthBackend) AuthBackend {
+		return NewCachingBackend(backend, time.Minute, 100)
+	})
+}
@@ -0,0 +1,197 @@
+package httpauth
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// EnableSessionClaims makes Login store a user's roles, the permissions their
+// groups grant and their Version in the auth cookie, which is signed. Until
+// the claims are older than revalidate, Authorize, AuthorizeRole and
+// AuthorizePermission trust them instead of reading the backend; after that,
+// the user is loaded again and the claims refreshed.
+//
+// Changes made through this Authorizer which increment a user's Version, such
+// as SetUserRole, DisableUser, password changes and DeleteUser, invalidate
+// their claims at once. Other changes, such as ones made to groups, take
+// effect when claims are revalidated. Versions are only remembered in memory:
+// when several processes share a backend, a user disabled or demoted by one
+// keeps the access their claims grant in the others for up to revalidate, so
+// keep it short or don't enable claims if that's unacceptable.
+//
+// Claims are never trusted after the user's ExpiresAt, or while they're
+// locked, even before revalidate has passed.
+//
+// Claims aren't used while impersonating, while a tenant is selected, or if
+// checks have been added with AddAuthorizeCheck.
+func (a Authorizer) EnableSessionClaims(revalidate time.Duration) {
+	a.ext.claims = true
+	a.ext.claimsMaxAge = revalidate
+}
+
+// SetUserRole changes a user's role.
+func (a Authorizer) SetUserRole(username string, role string) error {
+	if _, ok := a.roles[role]; !ok {
+		return ErrNonexistentRole
+	}
+	return a.updateStatus(username, ActionSetRole, func(user *UserData) {
+		user.Role = role
+	})
+}
+
+// userVersions remembers the Version of users this process has changed, so
+// claims made stale by those changes aren't trusted.
+//
+// Versions recorded longer ago than claims are trusted can't make any claims
+// stale, and are evicted whenever the map has doubled in size since it was
+// last swept.
+type userVersions struct {
+	mu       sync.Mutex
+	versions map[string]userVersion
+	sweepAt  int
+}
+
+type userVersion struct {
+	version int
+	set     time.Time
+}
+
+// deletedVersion is the version recorded for deleted users.
+const deletedVersion = -1
+
+func (v *userVersions) set(username string, version int, maxAge time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.versions == nil {
+		v.versions = make(map[string]userVersion)
+	}
+	now := time.Now()
+	v.versions[username] = userVersion{version, now}
+	if len(v.versions) < v.sweepAt {
+		return
+	}
+	for name, known := range v.versions {
+		if now.Sub(known.set) > maxAge {
+			delete(v.versions, name)
+		}
+	}
+	v.sweepAt = 2*len(v.versions) + 64
+}
+
+func (v *userVersions) stale(username string, version int) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	known, ok := v.versions[username]
+	return ok && known.version != version
+}
+
+// setVersion records a user's Version.
+func (a Authorizer) setVersion(username string, version int) {
+	a.ext.versions.set(username, version, a.ext.claimsMaxAge)
+}
+
+// bumpVersion increments a user's Version before they're saved.
+func (a Authorizer) bumpVersion(user *UserData) {
+	user.Version++
+	a.setVersion(user.Username, user.Version)
+}
+
+// claimsApply reports whether a session's claims may be used.
+func (a Authorizer) claimsApply(authSession *sessions.Session) bool {
+	if !a.ext.claims || len(a.ext.checks) > 0 {
+		return false
+	}
+	if _, ok := authSession.Values["impersonator"]; ok {
+		return false
+	}
+	if _, ok := authSession.Values["tenant"]; ok {
+		return false
+	}
+	return true
+}
+
+// trustedClaims returns the roles and permissions claimed in a session, if
+// they can be trusted.
+func (a Authorizer) trustedClaims(authSession *sessions.Session) (roles []string, permissions []string, ok bool) {
+	if !a.claimsApply(authSession) {
+		return nil, nil, false
+	}
+	username, ok1 := authSession.Values["username"].(string)
+	roles, ok2 := authSession.Values["claims_roles"].([]string)
+	version, ok3 := authSession.Values["claims_version"].(int)
+	checked, ok4 := authSession.Values["claims_checked"].(int64)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil, nil, false
+	}
+	now := time.Now()
+	if now.Sub(time.Unix(checked, 0)) > a.ext.claimsMaxAge {
+		return nil, nil, false
+	}
+	if expires, _ := authSession.Values["claims_expires"].(int64); expires != 0 && !now.Before(time.Unix(0, expires)) {
+		return nil, nil, false
+	}
+	if locked, _ := authSession.Values["claims_locked_until"].(int64); locked != 0 && now.Before(time.Unix(0, locked)) {
+		return nil, nil, false
+	}
+	if a.ext.versions.stale(username, version) {
+		return nil, nil, false
+	}
+	permissions, _ = authSession.Values["claims_permissions"].([]string)
+	return roles, permissions, true
+}
+
+// setClaims stores a user's grants and version in their session, if claims
+// are enabled. The caller saves the session.
+func (a Authorizer) setClaims(authSession *sessions.Session, user UserData) error {
+	if !a.claimsApply(authSession) {
+		clearClaims(authSession)
+		return nil
+	}
+	roles, permissions, err := a.grants(user)
+	if err != nil {
+		return err
+	}
+	authSession.Values["claims_roles"] = roles
+	authSession.Values["claims_permissions"] = permissions
+	authSession.Values["claims_version"] = user.Version
+	authSession.Values["claims_checked"] = time.Now().Unix()
+	authSession.Values["claims_expires"] = unixNano(user.ExpiresAt)
+	authSession.Values["claims_locked_until"] = unixNano(user.LockedUntil)
+	return nil
+}
+
+// unixNano returns t as nanoseconds since the epoch, or 0 if t is zero.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func clearClaims(authSession *sessions.Session) {
+	delete(authSession.Values, "claims_roles")
+	delete(authSession.Values, "claims_permissions")
+	delete(authSession.Values, "claims_version")
+	delete(authSession.Values, "claims_checked")
+	delete(authSession.Values, "claims_expires")
+	delete(authSession.Values, "claims_locked_until")
+}
+
+// sessionGrants returns the roles and extra permissions of the user logged in
+// to a request, from their session's claims if they can be trusted. Call
+// after Authorize. ErrMissingUser is returned if the user isn't found.
+func (a Authorizer) sessionGrants(rw http.ResponseWriter, req *http.Request) (roles []string, permissions []string, e error) {
+	authSession, _ := a.cookiejar.Get(req, "auth")
+	if roles, permissions, ok := a.trustedClaims(authSession); ok {
+		return roles, permissions, nil
+	}
+	username, _ := authSession.Values["username"].(string)
+	user, err := a.requestUser(req, username)
+	if err != nil {
+		return nil, nil, ErrMissingUser
+	}
+	return a.requestGrants(rw, req, user)
+}
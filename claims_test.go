@@ -0,0 +1,148 @@
+package httpauth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSessionClaims(t *testing.T) {
+	auth, lookups, done := newCountingAuthorizer(t, "claims_test.gob", nil)
+	defer done()
+	auth.EnableSessionClaims(time.Hour)
+	cookies := testLogin(t, auth, "claimed", "user")
+
+	rw := httptest.NewRecorder()
+	atomic.StoreInt64(lookups, 0)
+	if err := auth.AuthorizeRole(rw, requestWithCookies("GET", "/", cookies), "user", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.AuthorizeRole(rw, requestWithCookies("GET", "/", cookies), "admin", false); err == nil {
+		t.Fatal("AuthorizeRole: expected denial")
+	}
+	if n := atomic.LoadInt64(lookups); n != 0 {
+		t.Errorf("expected claims to be trusted without backend reads, got %d", n)
+	}
+
+	if err := auth.SetUserRole("claimed", "admin"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if user, _ := auth.backend.User("claimed"); user.Role != "admin" || user.Version != 1 {
+		t.Fatalf("SetUserRole: role %q, version %d", user.Role, user.Version)
+	}
+	rw = httptest.NewRecorder()
+	if err := auth.AuthorizeRole(rw, requestWithCookies("GET", "/", cookies), "admin", false); err != nil {
+		t.Fatalf("AuthorizeRole: role change not seen: %v", err)
+	}
+	if refreshed := responseCookies(rw); len(refreshed) > 0 {
+		cookies = refreshed
+	}
+	atomic.StoreInt64(lookups, 0)
+	if err := auth.AuthorizeRole(httptest.NewRecorder(), requestWithCookies("GET", "/", cookies), "admin", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := atomic.LoadInt64(lookups); n != 0 {
+		t.Errorf("refreshed claims not trusted: %d backend reads", n)
+	}
+
+	if err := auth.DisableUser("claimed", ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), requestWithCookies("GET", "/", cookies), false); err != ErrAccountDisabled {
+		t.Errorf("Authorize: expected disabled account, got %v", err)
+	}
+	auth.EnableUser("claimed")
+	if err := auth.DeleteUser("claimed"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), requestWithCookies("GET", "/", cookies), false); err == nil {
+		t.Error("Authorize: deleted user's claims trusted")
+	}
+}
+
+func TestSessionClaimsRevalidate(t *testing.T) {
+	auth, lookups, done := newCountingAuthorizer(t, "claims_test.gob", nil)
+	defer done()
+	auth.EnableSessionClaims(time.Hour)
+	cookies := testLogin(t, auth, "stale", "user")
+
+	// changed behind the Authorizer's back, as by another process
+	user, _ := auth.backend.User("stale")
+	user.Role = "admin"
+	user.Version++
+	auth.backend.SaveUser(user)
+	if err := auth.AuthorizeRole(httptest.NewRecorder(), requestWithCookies("GET", "/", cookies), "admin", false); err == nil {
+		t.Fatal("AuthorizeRole: expected stale claims to be trusted until revalidation")
+	}
+
+	auth.EnableSessionClaims(0)
+	atomic.StoreInt64(lookups, 0)
+	if err := auth.AuthorizeRole(httptest.NewRecorder(), requestWithCookies("GET", "/", cookies), "admin", false); err != nil {
+		t.Errorf("AuthorizeRole: claims not revalidated: %v", err)
+	}
+	if n := atomic.LoadInt64(lookups); n != 1 {
+		t.Errorf("revalidation: expected 1 backend read, got %d", n)
+	}
+}
+
+func TestSessionClaimsSkipped(t *testing.T) {
+	auth, lookups, done := newCountingAuthorizer(t, "claims_test.gob", nil)
+	defer done()
+	auth.EnableSessionClaims(time.Hour)
+	cookies := testLogin(t, auth, "checked", "user")
+	auth.AddAuthorizeCheck(func(req *http.Request, user UserData) error { return nil })
+	atomic.StoreInt64(lookups, 0)
+	if err := auth.AuthorizeRole(httptest.NewRecorder(), requestWithCookies("GET", "/", cookies), "user", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := atomic.LoadInt64(lookups); n == 0 {
+		t.Error("claims trusted despite an AuthorizeCheck")
+	}
+}
+
+func TestSessionClaimsExpiry(t *testing.T) {
+	auth, lookups, done := newCountingAuthorizer(t, "claims_test.gob", nil)
+	defer done()
+	auth.EnableSessionClaims(time.Hour)
+	req, _ := http.NewRequest("POST", "/", nil)
+	if err := auth.Register(httptest.NewRecorder(), req, UserData{Username: "expiring", Email: "expiring@example.com"}, "password"); err != nil {
+		t.Fatal(err.Error())
+	}
+	user, _ := auth.backend.User("expiring")
+	user.ExpiresAt = time.Now().Add(200 * time.Millisecond)
+	auth.backend.SaveUser(user)
+	rw := httptest.NewRecorder()
+	if err := auth.Login(rw, req, "expiring", "password", "/"); err != nil {
+		t.Fatal(err.Error())
+	}
+	cookies := responseCookies(rw)
+
+	atomic.StoreInt64(lookups, 0)
+	if err := auth.Authorize(httptest.NewRecorder(), requestWithCookies("GET", "/", cookies), false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := atomic.LoadInt64(lookups); n != 0 {
+		t.Errorf("expected claims to be trusted before the account expires, got %d backend reads", n)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if err := auth.Authorize(httptest.NewRecorder(), requestWithCookies("GET", "/", cookies), false); err != ErrAccountExpired {
+		t.Errorf("Authorize: expected claims not to be trusted after the account expired, got %v", err)
+	}
+}
+
+func TestUserVersionsEviction(t *testing.T) {
+	var v userVersions
+	for i := 0; i < 1000; i++ {
+		v.set(fmt.Sprintf("user%d", i), 1, 0)
+	}
+	if len(v.versions) > 100 {
+		t.Errorf("expected old versions to be evicted, %d remembered", len(v.versions))
+	}
+	v.set("recent", 2, time.Hour)
+	if !v.stale("recent", 1) || v.stale("recent", 2) {
+		t.Error("recent version not remembered")
+	}
+}
@@ -0,0 +1,173 @@
+package httpauth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ErrEmailTaken is returned by Register and Update, once RequireUniqueEmails
+// has been called, when another user has the email given.
+var ErrEmailTaken = mkerror("email already in use")
+
+// The EmailBackend interface is implemented by AuthBackends able to look users
+// up by email. All backends in this package implement it.
+type EmailBackend interface {
+	// UserByEmail returns the user with an email, which is normalized with
+	// NormalizeEmail and compared with the ones stored. ErrMissingUser is
+	// returned if there's none. If several users have the email, the one
+	// with the lowest username is returned.
+	UserByEmail(email string) (UserData, error)
+}
+
+// The UniqueEmailBackend interface is implemented by AuthBackends able to
+// enforce unique emails themselves, so that two users saved at once can't
+// end up sharing one. All backends in this package implement it.
+type UniqueEmailBackend interface {
+	// RequireUniqueEmails makes SaveUser fail with ErrEmailTaken when another
+	// user has the email of the user saved. It fails if users already share
+	// an email.
+	RequireUniqueEmails() error
+}
+
+// NormalizeEmail returns an email address without surrounding spaces, in
+// lower case. Register and Update normalize emails before saving them.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// RequireUniqueEmails makes Register and Update fail with ErrEmailTaken when
+// the email given belongs to another user, and lets users log in with their
+// email. Backends implementing UniqueEmailBackend enforce it themselves, with
+// a unique index in SQL and Mongo; with others, emails are only checked
+// before saving, so two users registering with the same email at once may
+// both succeed. An error is returned, and emails aren't required to be
+// unique, if users already share an email.
+func (a Authorizer) RequireUniqueEmails() error {
+	if ub, ok := asUniqueEmailBackend(a.backend); ok {
+		if err := ub.RequireUniqueEmails(); err != nil {
+			return mkerror(err.Error())
+		}
+	}
+	a.ext.uniqueEmails = true
+	return nil
+}
+
+// UserByEmail returns the user with an email, compared after normalizing it.
+// Users saved with emails that aren't normalized aren't found until
+// NormalizeEmails is run. Backends not implementing EmailBackend are searched
+// user by user.
+func (a Authorizer) UserByEmail(email string) (user UserData, err error) {
+	email = NormalizeEmail(email)
+	if eb, ok := asEmailBackend(a.backend); ok {
+		user, err = eb.UserByEmail(email)
+	} else {
+		err = ErrMissingUser
+		ferr := a.ForEachUser(context.Background(), func(u UserData) error {
+			if u.Email != email {
+				return nil
+			}
+			user, err = u, nil
+			return ErrStopIteration
+		})
+		if ferr != nil {
+			err = ferr
+		}
+	}
+	if err != nil && err != ErrMissingUser {
+		return user, mkerror(err.Error())
+	}
+	return user, err
+}
+
+// loginUser returns the user with username u or, if there's none, unique
+// emails are required and u looks like an email, with email u. Emails aren't
+// accepted otherwise, as several users could share one.
+func (a Authorizer) loginUser(u string) (UserData, error) {
+	user, err := a.backend.User(u)
+	if err == ErrMissingUser && a.ext.uniqueEmails && strings.Contains(u, "@") {
+		return a.UserByEmail(u)
+	}
+	return user, err
+}
+
+// checkEmail returns ErrEmailTaken if unique emails are required and a user
+// other than username has email.
+func (a Authorizer) checkEmail(username string, email string) error {
+	if !a.ext.uniqueEmails {
+		return nil
+	}
+	user, err := a.UserByEmail(email)
+	if err == ErrMissingUser || (err == nil && user.Username == username) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return ErrEmailTaken
+}
+
+// NormalizeEmails normalizes the emails of users saved with emails that
+// weren't, such as those registered before Register normalized them, so
+// UserByEmail finds them. It returns the number of users changed.
+func (a Authorizer) NormalizeEmails(ctx context.Context) (int, error) {
+	// changing users while iterating fails with some databases
+	var users []UserData
+	err := a.ForEachUser(ctx, func(user UserData) error {
+		if email := NormalizeEmail(user.Email); email != user.Email {
+			user.Email = email
+			users = append(users, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, user := range users {
+		if err := a.backend.SaveUser(user); err != nil {
+			return i, mkerror(err.Error())
+		}
+	}
+	return len(users), nil
+}
+
+// emailTaken reports whether a user other than user has their email, for
+// backends keeping users in memory.
+func emailTaken(users map[string]UserData, user UserData) bool {
+	for _, other := range users {
+		if other.Email == user.Email && other.Username != user.Username {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedEmail returns an error if several users have the same email, for
+// backends keeping users in memory.
+func sharedEmail(users map[string]UserData) error {
+	seen := make(map[string]bool, len(users))
+	for _, user := range users {
+		if seen[user.Email] {
+			return fmt.Errorf("several users have the email %q", user.Email)
+		}
+		seen[user.Email] = true
+	}
+	return nil
+}
+
+// userByEmail implements UserByEmail for backends keeping users in memory.
+func userByEmail(users map[string]UserData, email string) (UserData, error) {
+	var (
+		found UserData
+		ok    bool
+	)
+	email = NormalizeEmail(email)
+	for _, user := range users {
+		if user.Email == email && (!ok || user.Username < found.Username) {
+			found, ok = user, true
+		}
+	}
+	if !ok {
+		return found, ErrMissingUser
+	}
+	return found, nil
+}
@@ -0,0 +1,141 @@
+package httpauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	for email, want := range map[string]string{
+		"user@example.com":    "user@example.com",
+		" User@Example.COM\n": "user@example.com",
+		"":                    "",
+		"ÉLODIE@EXAMPLE.COM ": "élodie@example.com",
+	} {
+		if got := NormalizeEmail(email); got != want {
+			t.Errorf("NormalizeEmail(%q): expected %q, got %q", email, want, got)
+		}
+	}
+}
+
+func TestLoginWithEmail(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "email_test.gob")
+	defer done()
+	req, _ := http.NewRequest("POST", "/", nil)
+	user := UserData{Username: "mailer", Email: " Mailer@Example.com"}
+	if err := auth.Register(httptest.NewRecorder(), req, user, "password"); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := auth.backend.User("mailer"); user.Email != "mailer@example.com" {
+		t.Errorf("Register: email not normalized: %q", user.Email)
+	}
+	if err := auth.Login(httptest.NewRecorder(), req, "mailer@example.com", "password", "/"); err == nil {
+		t.Error("Login with email succeeded without unique emails")
+	}
+
+	auth.RequireUniqueEmails()
+
+	rw := httptest.NewRecorder()
+	if err := auth.Login(rw, req, "MAILER@example.com", "password", "/"); err != nil {
+		t.Fatalf("Login with email: %v", err)
+	}
+	req = requestWithCookies("GET", "/", responseCookies(rw))
+	if user, err := auth.CurrentUser(httptest.NewRecorder(), req); err != nil || user.Username != "mailer" {
+		t.Errorf("Login with email: expected to be logged in as mailer, got %v, %v", user.Username, err)
+	}
+	if err := auth.Login(httptest.NewRecorder(), req, "mailer@example.com", "password", "/"); err == nil || err.Error() != "httpauth: already authenticated" {
+		t.Errorf("Login with email: expected already authenticated, got %v", err)
+	}
+	req, _ = http.NewRequest("POST", "/", nil)
+	if err := auth.Login(httptest.NewRecorder(), req, "nobody@example.com", "password", "/"); err == nil {
+		t.Error("Login with an unknown email succeeded")
+	}
+	if err := auth.Login(httptest.NewRecorder(), req, "mailer@example.com", "wrong", "/"); err == nil {
+		t.Error("Login with email and a wrong password succeeded")
+	}
+
+	rw, body := apiRequest(t, auth.LoginHandler(), "POST", `{"username": "mailer@example.com", "password": "password"}`, nil)
+	if rw.Code != http.StatusOK || string(body["user"]) == "" {
+		t.Errorf("LoginHandler with email: %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestUniqueEmails(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "email_test.gob")
+	defer done()
+	req, _ := http.NewRequest("POST", "/", nil)
+	register := func(username, email string) error {
+		return auth.Register(httptest.NewRecorder(), req, UserData{Username: username, Email: email}, "password")
+	}
+	if err := register("first", "taken@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := register("second", "Taken@example.com"); err != nil {
+		t.Fatalf("Register: duplicate emails should be allowed by default: %v", err)
+	}
+	if err := auth.RequireUniqueEmails(); err == nil || auth.ext.uniqueEmails {
+		t.Error("RequireUniqueEmails: expected an error with users sharing an email")
+	}
+	auth.DeleteUser("second")
+
+	if err := auth.RequireUniqueEmails(); err != nil {
+		t.Fatal(err)
+	}
+	if err := register("third", " TAKEN@example.com"); err != ErrEmailTaken {
+		t.Errorf("Register: expected ErrEmailTaken, got %v", err)
+	}
+	if err := auth.backend.SaveUser(UserData{Username: "third", Email: "taken@example.com"}); err != ErrEmailTaken {
+		t.Errorf("SaveUser: expected the backend to enforce unique emails, got %v", err)
+	}
+	if err := register("third", "third@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Update(httptest.NewRecorder(), req, "third", "", "taken@EXAMPLE.com"); err != ErrEmailTaken {
+		t.Errorf("Update: expected ErrEmailTaken, got %v", err)
+	}
+	if err := auth.Update(httptest.NewRecorder(), req, "first", "", "Taken@example.com"); err != nil {
+		t.Errorf("Update: keeping one's own email failed: %v", err)
+	}
+	if err := auth.Update(httptest.NewRecorder(), req, "third", "", "New@Example.com"); err != nil {
+		t.Errorf("Update: %v", err)
+	}
+	if user, _ := auth.backend.User("third"); user.Email != "new@example.com" {
+		t.Errorf("Update: email not normalized: %q", user.Email)
+	}
+
+	rw, body := apiRequest(t, auth.RegisterHandler(), "POST", `{"username": "fourth", "email": "new@example.com", "password": "secret"}`, nil)
+	expectAPIError(t, rw, body, http.StatusConflict, CodeEmailTaken)
+}
+
+func TestUserByEmail(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "email_test.gob")
+	defer done()
+	for _, user := range []UserData{
+		{Username: "legacy", Email: "Legacy@Example.com"},
+		{Username: "current", Email: "current@example.com"},
+	} {
+		if err := auth.backend.SaveUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fallback := auth
+	fallback.backend = usersOnlyBackend{auth.backend}
+	for _, a := range []Authorizer{auth, fallback} {
+		if user, err := a.UserByEmail("CURRENT@example.com"); err != nil || user.Username != "current" {
+			t.Errorf("UserByEmail: expected current, got %v, %v", user.Username, err)
+		}
+		if _, err := a.UserByEmail("legacy@example.com"); err != ErrMissingUser {
+			t.Errorf("UserByEmail: expected ErrMissingUser for an email saved unnormalized, got %v", err)
+		}
+	}
+
+	n, err := auth.NormalizeEmails(context.Background())
+	if err != nil || n != 1 {
+		t.Fatalf("NormalizeEmails: expected 1 user changed, got %d, %v", n, err)
+	}
+	if user, err := auth.UserByEmail("legacy@example.com"); err != nil || user.Username != "legacy" {
+		t.Errorf("UserByEmail after NormalizeEmails: expected legacy, got %v, %v", user.Username, err)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
-	"strings"
 	"os"
 
 	"github.com/apexskier/httpauth"
@@ -95,7 +94,7 @@ func getLogin(rw http.ResponseWriter, req *http.Request) {
 func postLogin(rw http.ResponseWriter, req *http.Request) {
 	username := req.PostFormValue("username")
 	password := req.PostFormValue("password")
-	if err := aaa.Login(rw, req, username, password, "/"); err == nil || (err != nil && strings.Contains(err.Error(), "already authenticated")) {
+	if err := aaa.Login(rw, req, username, password, "/"); err == nil || err == httpauth.ErrAlreadyAuthenticated {
 		http.Redirect(rw, req, "/", http.StatusSeeOther)
 	} else if err != nil {
 		fmt.Println(err)
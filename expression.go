@@ -0,0 +1,512 @@
+package httpauth
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expression is a compiled boolean expression, evaluated against a tree of
+// attributes. The language is described on NewAttributePolicy.
+type expression struct {
+	source string
+	root   exprNode
+}
+
+// exprNode is a node in a parsed expression.
+type exprNode interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+type (
+	exprLiteral struct{ value interface{} }
+	exprAttr    struct{ path []string }
+	exprList    struct{ items []exprNode }
+	exprNot     struct{ operand exprNode }
+	exprBinary  struct {
+		op          string
+		left, right exprNode
+	}
+	exprCall struct {
+		name string
+		args []exprNode
+	}
+)
+
+// token kinds
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type exprToken struct {
+	kind  int
+	text  string
+	value interface{}
+	pos   int
+}
+
+func mkexprerror(source string, pos int, msg string) error {
+	return mkerror(fmt.Sprintf("expression %q: %s at %d", source, msg, pos))
+}
+
+func lexExpression(source string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			j := i + 1
+			for ; j < len(source) && rune(source[j]) != c; j++ {
+				if source[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(source) {
+				return nil, mkexprerror(source, start, "unterminated string")
+			}
+			text := source[i : j+1]
+			if c == '\'' {
+				text = `"` + strings.Replace(source[i+1:j], `"`, `\"`, -1) + `"`
+			}
+			value, err := strconv.Unquote(text)
+			if err != nil {
+				return nil, mkexprerror(source, start, "invalid string")
+			}
+			tokens = append(tokens, exprToken{tokString, source[i : j+1], value, start})
+			i = j + 1
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(source) && (unicode.IsDigit(rune(source[i])) || source[i] == '.') {
+				i++
+			}
+			value, err := strconv.ParseFloat(source[start:i], 64)
+			if err != nil {
+				return nil, mkexprerror(source, start, "invalid number")
+			}
+			tokens = append(tokens, exprToken{tokNumber, source[start:i], value, start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(source) && (unicode.IsLetter(rune(source[i])) || unicode.IsDigit(rune(source[i])) || source[i] == '_' || source[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokIdent, source[start:i], nil, start})
+		default:
+			start := i
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(source[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, mkexprerror(source, start, fmt.Sprintf("unexpected %q", c))
+			}
+			tokens = append(tokens, exprToken{tokOp, op, nil, start})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{tokEOF, "", nil, len(source)}), nil
+}
+
+type exprParser struct {
+	source string
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) accept(op string) bool {
+	if t := p.peek(); (t.kind == tokOp || t.kind == tokIdent) && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return mkexprerror(p.source, t.pos, fmt.Sprintf("expected %q", op))
+	}
+	return nil
+}
+
+// compileExpression parses an expression so it can be evaluated.
+func compileExpression(source string) (expression, error) {
+	tokens, err := lexExpression(source)
+	if err != nil {
+		return expression{}, err
+	}
+	p := &exprParser{source: source, tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return expression{}, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return expression{}, mkexprerror(source, t.pos, fmt.Sprintf("unexpected %q", t.text))
+	}
+	return expression{source, root}, nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{"||", left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{"&&", left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return exprNot{operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if p.accept(op) {
+			right, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return exprBinary{op, left, right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseList(end string) ([]exprNode, error) {
+	var items []exprNode
+	if p.accept(end) {
+		return items, nil
+	}
+	for {
+		item, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if p.accept(end) {
+			return items, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString, tokNumber:
+		return exprLiteral{t.value}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return exprLiteral{true}, nil
+		case "false":
+			return exprLiteral{false}, nil
+		case "null":
+			return exprLiteral{nil}, nil
+		}
+		if p.accept("(") {
+			if _, ok := exprFuncs[t.text]; !ok {
+				return nil, mkexprerror(p.source, t.pos, fmt.Sprintf("unknown function %q", t.text))
+			}
+			args, err := p.parseList(")")
+			if err != nil {
+				return nil, err
+			}
+			return exprCall{t.text, args}, nil
+		}
+		return exprAttr{strings.Split(t.text, ".")}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		case "[":
+			items, err := p.parseList("]")
+			if err != nil {
+				return nil, err
+			}
+			return exprList{items}, nil
+		}
+	}
+	if t.kind == tokEOF {
+		return nil, mkexprerror(p.source, t.pos, "unexpected end")
+	}
+	return nil, mkexprerror(p.source, t.pos, fmt.Sprintf("unexpected %q", t.text))
+}
+
+// eval evaluates the expression, which must result in a boolean.
+func (e expression) eval(env map[string]interface{}) (bool, error) {
+	v, err := e.root.eval(env)
+	if err != nil {
+		return false, mkerror(fmt.Sprintf("expression %q: %v", e.source, err))
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, mkerror(fmt.Sprintf("expression %q: result %v isn't a boolean", e.source, v))
+	}
+	return b, nil
+}
+
+func (n exprLiteral) eval(env map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n exprAttr) eval(env map[string]interface{}) (interface{}, error) {
+	var v interface{} = env
+	for _, name := range n.path {
+		switch m := v.(type) {
+		case map[string]interface{}:
+			v = m[name]
+		case map[string]string:
+			s, ok := m[name]
+			if !ok {
+				return nil, nil
+			}
+			v = s
+		default:
+			return nil, nil
+		}
+	}
+	return normalizeExprValue(v), nil
+}
+
+func (n exprList) eval(env map[string]interface{}) (interface{}, error) {
+	items := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		v, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = v
+	}
+	return items, nil
+}
+
+func (n exprNot) eval(env map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! applied to non-boolean %v", v)
+	}
+	return !b, nil
+}
+
+func (n exprBinary) eval(env map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "&&" || n.op == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s applied to non-boolean %v", n.op, left)
+		}
+		if (n.op == "&&" && !l) || (n.op == "||" && l) {
+			return l, nil
+		}
+		right, err := n.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s applied to non-boolean %v", n.op, right)
+		}
+		return r, nil
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return exprEqual(left, right), nil
+	case "!=":
+		return !exprEqual(left, right), nil
+	case "in":
+		items, ok := right.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("in applied to non-list %v", right)
+		}
+		for _, item := range items {
+			if exprEqual(left, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	switch l := left.(type) {
+	case float64:
+		if r, ok := right.(float64); ok {
+			return compareOrdered(n.op, l < r, l == r), nil
+		}
+	case string:
+		if r, ok := right.(string); ok {
+			return compareOrdered(n.op, l < r, l == r), nil
+		}
+	}
+	return nil, fmt.Errorf("can't compare %v %s %v", left, n.op, right)
+}
+
+func compareOrdered(op string, less bool, equal bool) bool {
+	switch op {
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	}
+	return !less
+}
+
+func exprEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// normalizeExprValue converts numbers to float64 and string slices to lists
+// so attributes can be compared with literals.
+func normalizeExprValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case Role:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case []string:
+		items := make([]interface{}, len(v))
+		for i, s := range v {
+			items[i] = s
+		}
+		return items
+	}
+	return v
+}
+
+var exprFuncs = map[string]func(args []interface{}) (interface{}, error){
+	"cidr": func(args []interface{}) (interface{}, error) {
+		ip, network, err := stringArgs2("cidr", args)
+		if err != nil {
+			return nil, err
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		parsed := net.ParseIP(ip)
+		return parsed != nil && ipnet.Contains(parsed), nil
+	},
+	"hasPrefix": func(args []interface{}) (interface{}, error) {
+		s, prefix, err := stringArgs2("hasPrefix", args)
+		return strings.HasPrefix(s, prefix), err
+	},
+	"hasSuffix": func(args []interface{}) (interface{}, error) {
+		s, suffix, err := stringArgs2("hasSuffix", args)
+		return strings.HasSuffix(s, suffix), err
+	},
+	"contains": func(args []interface{}) (interface{}, error) {
+		s, sub, err := stringArgs2("contains", args)
+		return strings.Contains(s, sub), err
+	},
+	"lower": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("lower takes 1 argument")
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("lower applied to non-string %v", args[0])
+		}
+		return strings.ToLower(s), nil
+	},
+}
+
+func stringArgs2(name string, args []interface{}) (string, string, error) {
+	if len(args) != 2 {
+		return "", "", fmt.Errorf("%s takes 2 arguments", name)
+	}
+	a, aok := args[0].(string)
+	b, bok := args[1].(string)
+	if !aok || !bok {
+		return "", "", fmt.Errorf("%s applied to non-strings %v, %v", name, args[0], args[1])
+	}
+	return a, b, nil
+}
+
+func (n exprCall) eval(env map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return exprFuncs[n.name](args)
+}
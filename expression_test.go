@@ -0,0 +1,94 @@
+package httpauth
+
+import (
+	"testing"
+)
+
+func TestExpressionEval(t *testing.T) {
+	env := map[string]interface{}{
+		"user": map[string]interface{}{
+			"username":   "username",
+			"role_level": Role(40),
+			"groups":     []string{"staff", "ops"},
+		},
+		"request": map[string]interface{}{
+			"ip": "10.1.2.3",
+		},
+		"attrs": map[string]string{
+			"team": "blue",
+		},
+	}
+	tests := []struct {
+		source string
+		result bool
+	}{
+		{`true`, true},
+		{`!false`, true},
+		{`user.username == "username"`, true},
+		{`user.username == 'username'`, true},
+		{`user.username != "other"`, true},
+		{`user.role_level >= 40 && user.role_level < 80`, true},
+		{`user.role_level > 40 || user.username == "username"`, true},
+		{`!(user.role_level > 40)`, true},
+		{`user.missing == null`, true},
+		{`user.missing.deeper == null`, true},
+		{`attrs.team == "blue"`, true},
+		{`attrs.missing == null`, true},
+		{`"ops" in user.groups`, true},
+		{`"dev" in user.groups`, false},
+		{`user.role_level in [20, 40]`, true},
+		{`cidr(request.ip, "10.0.0.0/8")`, true},
+		{`cidr(request.ip, "192.168.0.0/16")`, false},
+		{`hasSuffix(lower("Me@Example.COM"), "@example.com")`, true},
+		{`hasPrefix(user.username, "user") && contains(user.username, "rna")`, true},
+		{`"a" < "b"`, true},
+		{`false && user.missing > 3`, false},
+	}
+	for _, test := range tests {
+		e, err := compileExpression(test.source)
+		if err != nil {
+			t.Errorf("compile %s: %v", test.source, err)
+			continue
+		}
+		result, err := e.eval(env)
+		if err != nil {
+			t.Errorf("eval %s: %v", test.source, err)
+		} else if result != test.result {
+			t.Errorf("eval %s: got %v, expected %v", test.source, result, test.result)
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	for _, source := range []string{
+		``,
+		`user.username ==`,
+		`(true`,
+		`"unterminated`,
+		`nosuchfunc(1)`,
+		`true false`,
+		`1.2.3 == 1`,
+		`a # b`,
+	} {
+		if _, err := compileExpression(source); err == nil {
+			t.Errorf("compile %s: expected error", source)
+		}
+	}
+	for _, source := range []string{
+		`"text"`,
+		`1 < "2"`,
+		`!"text"`,
+		`"a" in "abc"`,
+		`cidr("10.0.0.1", "notanetwork")`,
+		`1 && true`,
+	} {
+		e, err := compileExpression(source)
+		if err != nil {
+			t.Errorf("compile %s: %v", source, err)
+			continue
+		}
+		if _, err := e.eval(nil); err == nil {
+			t.Errorf("eval %s: expected error", source)
+		}
+	}
+}
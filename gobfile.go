@@ -1,10 +1,13 @@
 package httpauth
 
 import (
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 )
 
 // ErrMissingBackend is returned by NewGobFileAuthBackend when the file doesn't
@@ -18,6 +21,28 @@ var (
 type GobFileAuthBackend struct {
 	filepath string
 	users    map[string]UserData
+	groups   map[string]Group
+
+	tenants     map[string]Tenant
+	memberships map[string]Membership
+	logins      map[string][]LoginAttempt
+	webhooks    map[string]WebhookDelivery
+
+	// mu guards the maps and uniqueEmails, which are shared by copies of
+	// the backend.
+	mu           *sync.RWMutex
+	uniqueEmails *bool
+}
+
+// gobFileData is what's stored in a gob file. Older files contain only the
+// users map.
+type gobFileData struct {
+	Users       map[string]UserData
+	Groups      map[string]Group
+	Tenants     map[string]Tenant
+	Memberships map[string]Membership
+	Logins      map[string][]LoginAttempt
+	Webhooks    map[string]WebhookDelivery
 }
 
 // NewGobFileAuthBackend initializes a new backend by loading a map of users
@@ -25,14 +50,28 @@ type GobFileAuthBackend struct {
 // If the file doesn't exist, returns an error.
 func NewGobFileAuthBackend(filepath string) (b GobFileAuthBackend, e error) {
 	b.filepath = filepath
+	b.mu = new(sync.RWMutex)
+	b.uniqueEmails = new(bool)
 	if _, err := os.Stat(b.filepath); err == nil {
 		f, err := os.Open(b.filepath)
 		defer f.Close()
 		if err != nil {
 			return b, fmt.Errorf("gobfilebackend: %v", err.Error())
 		}
+		var data gobFileData
 		dec := gob.NewDecoder(f)
-		dec.Decode(&b.users)
+		if err := dec.Decode(&data); err == nil {
+			b.users = data.Users
+			b.groups = data.Groups
+			b.tenants = data.Tenants
+			b.memberships = data.Memberships
+			b.logins = data.Logins
+			b.webhooks = data.Webhooks
+		} else {
+			f.Seek(0, 0)
+			dec = gob.NewDecoder(f)
+			dec.Decode(&b.users)
+		}
 	} else if !os.IsNotExist(err) {
 		return b, fmt.Errorf("gobfilebackend: %v", err.Error())
 	} else {
@@ -41,34 +80,96 @@ func NewGobFileAuthBackend(filepath string) (b GobFileAuthBackend, e error) {
 	if b.users == nil {
 		b.users = make(map[string]UserData)
 	}
+	if b.groups == nil {
+		b.groups = make(map[string]Group)
+	}
+	if b.tenants == nil {
+		b.tenants = make(map[string]Tenant)
+	}
+	if b.memberships == nil {
+		b.memberships = make(map[string]Membership)
+	}
+	if b.logins == nil {
+		b.logins = make(map[string][]LoginAttempt)
+	}
+	if b.webhooks == nil {
+		b.webhooks = make(map[string]WebhookDelivery)
+	}
 	return b, nil
 }
 
 // User returns the user with the given username. Error is set to
 // ErrMissingUser if user is not found.
 func (b GobFileAuthBackend) User(username string) (user UserData, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	if user, ok := b.users[username]; ok {
 		return user, nil
 	}
 	return user, ErrMissingUser
 }
 
+// UserByEmail returns the user with the given email. Error is set to
+// ErrMissingUser if no user has it.
+func (b GobFileAuthBackend) UserByEmail(email string) (UserData, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return userByEmail(b.users, email)
+}
+
 // Users returns a slice of all users.
 func (b GobFileAuthBackend) Users() (us []UserData, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	for _, user := range b.users {
 		us = append(us, user)
 	}
 	return
 }
 
+// QueryUsers returns a page of the users matching a query.
+func (b GobFileAuthBackend) QueryUsers(q UserQuery) (UserPage, error) {
+	us, _ := b.Users()
+	return queryUsers(us, q)
+}
+
+// CountUsers returns the number of users matching a query's filters.
+func (b GobFileAuthBackend) CountUsers(q UserQuery) (int, error) {
+	us, _ := b.Users()
+	return countUsers(us, q)
+}
+
+// ForEachUser calls fn with each user, in username order.
+func (b GobFileAuthBackend) ForEachUser(ctx context.Context, fn func(user UserData) error) error {
+	us, _ := b.Users()
+	return forEachUser(ctx, us, fn)
+}
+
 // SaveUser adds a new user, replacing one with the same username, and saves a
 // gob file.
 func (b GobFileAuthBackend) SaveUser(user UserData) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if *b.uniqueEmails && emailTaken(b.users, user) {
+		return ErrEmailTaken
+	}
 	b.users[user.Username] = user
 	err := b.save()
 	return err
 }
 
+// RequireUniqueEmails makes SaveUser fail with ErrEmailTaken when another user
+// has the email of the user saved, until the backend is reopened.
+func (b GobFileAuthBackend) RequireUniqueEmails() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := sharedEmail(b.users); err != nil {
+		return fmt.Errorf("gobfilebackend: %v", err)
+	}
+	*b.uniqueEmails = true
+	return nil
+}
+
 func (b GobFileAuthBackend) save() error {
 	f, err := os.Create(b.filepath)
 	defer f.Close()
@@ -76,25 +177,279 @@ func (b GobFileAuthBackend) save() error {
 		return errors.New("gobfilebackend: failed to edit auth file")
 	}
 	enc := gob.NewEncoder(f)
-	err = enc.Encode(b.users)
+	err = enc.Encode(gobFileData{b.users, b.groups, b.tenants, b.memberships, b.logins, b.webhooks})
 	if err != nil {
-		fmt.Errorf("gobfilebackend: save: %v", err)
+		return fmt.Errorf("gobfilebackend: save: %v", err)
 	}
 	return nil
 }
 
 // DeleteUser removes a user, raising ErrDeleteNull if that user was missing.
 func (b GobFileAuthBackend) DeleteUser(username string) error {
-	_, err := b.User(username)
-	if err == ErrMissingUser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.users[username]; !ok {
 		return ErrDeleteNull
-	} else if err != nil {
-		return fmt.Errorf("gobfilebackend: %v", err)
 	}
 	delete(b.users, username)
 	return b.save()
 }
 
+// Group returns the group with the given name. Error is set to
+// ErrMissingGroup if the group is not found.
+func (b GobFileAuthBackend) Group(name string) (group Group, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if group, ok := b.groups[name]; ok {
+		return group, nil
+	}
+	return group, ErrMissingGroup
+}
+
+// Groups returns a slice of all groups.
+func (b GobFileAuthBackend) Groups() (groups []Group, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, group := range b.groups {
+		groups = append(groups, group)
+	}
+	return
+}
+
+// UserGroupNames returns the names of the groups the user is a direct member
+// of.
+func (b GobFileAuthBackend) UserGroupNames(username string) (names []string, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, group := range b.groups {
+		if containsString(group.Users, username) {
+			names = append(names, group.Name)
+		}
+	}
+	return
+}
+
+// ParentGroupNames returns the names of the groups the named group is directly
+// nested in.
+func (b GobFileAuthBackend) ParentGroupNames(name string) (names []string, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, group := range b.groups {
+		if containsString(group.Groups, name) {
+			names = append(names, group.Name)
+		}
+	}
+	return
+}
+
+// SaveGroup adds a new group, replacing one with the same name, and saves a
+// gob file.
+func (b GobFileAuthBackend) SaveGroup(group Group) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.groups[group.Name] = group
+	return b.save()
+}
+
+// DeleteGroup removes a group, raising ErrMissingGroup if it was missing.
+func (b GobFileAuthBackend) DeleteGroup(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.groups[name]; !ok {
+		return ErrMissingGroup
+	}
+	delete(b.groups, name)
+	return b.save()
+}
+
+// Tenant returns the tenant with the given name. Error is set to
+// ErrMissingTenant if the tenant is not found.
+func (b GobFileAuthBackend) Tenant(name string) (tenant Tenant, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if tenant, ok := b.tenants[name]; ok {
+		return tenant, nil
+	}
+	return tenant, ErrMissingTenant
+}
+
+// Tenants returns a slice of all tenants.
+func (b GobFileAuthBackend) Tenants() (tenants []Tenant, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, tenant := range b.tenants {
+		tenants = append(tenants, tenant)
+	}
+	return
+}
+
+// SaveTenant adds a new tenant, replacing one with the same name, and saves a gob
+// file.
+func (b GobFileAuthBackend) SaveTenant(tenant Tenant) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tenants[tenant.Name] = tenant
+	return b.save()
+}
+
+// DeleteTenant removes a tenant and its memberships, raising ErrMissingTenant
+// if it was missing.
+func (b GobFileAuthBackend) DeleteTenant(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.tenants[name]; !ok {
+		return ErrMissingTenant
+	}
+	delete(b.tenants, name)
+	for key, m := range b.memberships {
+		if m.Tenant == name {
+			delete(b.memberships, key)
+		}
+	}
+	return b.save()
+}
+
+// SaveMembership adds a user to a tenant, replacing their previous role.
+func (b GobFileAuthBackend) SaveMembership(m Membership) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.memberships[membershipKey(m.Tenant, m.Username)] = m
+	return b.save()
+}
+
+// DeleteMembership removes a user from a tenant, raising ErrMissingMembership
+// if they weren't a member.
+func (b GobFileAuthBackend) DeleteMembership(tenant string, username string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := membershipKey(tenant, username)
+	if _, ok := b.memberships[key]; !ok {
+		return ErrMissingMembership
+	}
+	delete(b.memberships, key)
+	return b.save()
+}
+
+// Memberships returns a user's tenant memberships, sorted by tenant.
+func (b GobFileAuthBackend) Memberships(username string) (memberships []Membership, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, m := range b.memberships {
+		if m.Username == username {
+			memberships = append(memberships, m)
+		}
+	}
+	sortMemberships(memberships)
+	return
+}
+
+// TenantMembers returns a tenant's memberships, sorted by username.
+func (b GobFileAuthBackend) TenantMembers(tenant string) (memberships []Membership, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, m := range b.memberships {
+		if m.Tenant == tenant {
+			memberships = append(memberships, m)
+		}
+	}
+	sortMemberships(memberships)
+	return
+}
+
+// SaveLoginAttempt records a login attempt, and saves a gob file.
+func (b GobFileAuthBackend) SaveLoginAttempt(attempt LoginAttempt) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.logins[attempt.Username] = append(b.logins[attempt.Username], attempt)
+	return b.save()
+}
+
+// LoginAttempts returns a user's login attempts, newest first.
+func (b GobFileAuthBackend) LoginAttempts(username string, offset, limit int) (attempts []LoginAttempt, total int, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	attempts, total = pageLoginAttempts(b.logins[username], offset, limit)
+	return
+}
+
+// KnownDevice reports whether a user has logged in successfully from an IP
+// address with a user agent before.
+func (b GobFileAuthBackend) KnownDevice(username, ip, userAgent string) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return knownDevice(b.logins[username], ip, userAgent), nil
+}
+
+// PruneLoginAttempts removes old login attempts.
+func (b GobFileAuthBackend) PruneLoginAttempts(username string, before time.Time, keep int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if username == "" {
+		for username, attempts := range b.logins {
+			b.logins[username] = pruneLoginAttempts(attempts, before, 0)
+		}
+	} else {
+		b.logins[username] = pruneLoginAttempts(b.logins[username], before, keep)
+	}
+	return b.save()
+}
+
+// DeleteLoginAttempts removes all of a user's login attempts.
+func (b GobFileAuthBackend) DeleteLoginAttempts(username string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.logins[username]; !ok {
+		return nil
+	}
+	delete(b.logins, username)
+	return b.save()
+}
+
+// SaveWebhookDelivery queues a webhook delivery, replacing the one with the
+// same ID, and saves a gob file.
+func (b GobFileAuthBackend) SaveWebhookDelivery(d WebhookDelivery) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.webhooks[d.ID] = d
+	return b.save()
+}
+
+// WebhookDelivery returns the webhook delivery with the given ID. Error is set
+// to ErrMissingDelivery if it is not found.
+func (b GobFileAuthBackend) WebhookDelivery(id string) (d WebhookDelivery, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if d, ok := b.webhooks[id]; ok {
+		return d, nil
+	}
+	return d, ErrMissingDelivery
+}
+
+// WebhookDeliveries returns pending or dead webhook deliveries, oldest first.
+func (b GobFileAuthBackend) WebhookDeliveries(dead bool) (deliveries []WebhookDelivery, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, d := range b.webhooks {
+		if d.Dead == dead {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sortDeliveries(deliveries)
+	return
+}
+
+// DeleteWebhookDelivery removes a webhook delivery, raising ErrMissingDelivery
+// if it was missing.
+func (b GobFileAuthBackend) DeleteWebhookDelivery(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.webhooks[id]; !ok {
+		return ErrMissingDelivery
+	}
+	delete(b.webhooks, id)
+	return b.save()
+}
+
 // Close cleans up the backend. Currently a no-op for gobfiles.
 func (b GobFileAuthBackend) Close() {
 
@@ -1,6 +1,7 @@
 package httpauth
 
 import (
+	"encoding/gob"
 	"os"
 	"testing"
 )
@@ -46,3 +47,37 @@ func TestGobReopen(t *testing.T) {
 
 	testBackend2(t, b)
 }
+
+func TestGobLegacyFormat(t *testing.T) {
+	defer os.Remove(gobfile)
+	f, err := os.Create(gobfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	users := map[string]UserData{"legacy": {Username: "legacy", Email: "legacy@example.com"}}
+	if err := gob.NewEncoder(f).Encode(users); err != nil {
+		t.Fatal(err.Error())
+	}
+	f.Close()
+
+	b, err := NewGobFileAuthBackend(gobfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if user, err := b.User("legacy"); err != nil || user.Email != "legacy@example.com" {
+		t.Fatalf("Legacy user not loaded: %v", err)
+	}
+	if err := b.SaveGroup(Group{Name: "group"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err = NewGobFileAuthBackend(gobfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := b.User("legacy"); err != nil {
+		t.Fatal("User lost after upgrading file format")
+	}
+	if _, err := b.Group("group"); err != nil {
+		t.Fatal("Group not saved")
+	}
+}
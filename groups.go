@@ -0,0 +1,276 @@
+package httpauth
+
+import (
+	"sort"
+)
+
+// ErrMissingGroup is returned by GroupBackends when a group is not found.
+var ErrMissingGroup = mkerror("can't find group")
+
+// Group is a named set of users and other groups. Members inherit the
+// group's roles and permissions, as do members of any nested group.
+type Group struct {
+	Name        string   `bson:"Name"`
+	Roles       []string `bson:"Roles"`
+	Permissions []string `bson:"Permissions"`
+	Users       []string `bson:"Users"`
+	Groups      []string `bson:"Groups"`
+}
+
+// The GroupBackend interface is implemented by AuthBackends able to store
+// groups. All backends in this package implement it.
+type GroupBackend interface {
+	SaveGroup(g Group) error
+	Group(name string) (group Group, e error)
+	Groups() (groups []Group, e error)
+	DeleteGroup(name string) error
+	// UserGroupNames and ParentGroupNames return the names of the groups
+	// directly containing a user or a group, so a user's groups can be found
+	// without loading every group.
+	UserGroupNames(username string) (names []string, e error)
+	ParentGroupNames(name string) (names []string, e error)
+}
+
+func (a Authorizer) groupBackend() (GroupBackend, error) {
+	gb, ok := asGroupBackend(a.backend)
+	if !ok {
+		return nil, mkerror("backend doesn't support groups")
+	}
+	return gb, nil
+}
+
+// SaveGroup creates or replaces a group. Its roles and nested groups must
+// exist, and nesting may not be circular.
+func (a Authorizer) SaveGroup(g Group) error {
+	gb, err := a.groupBackend()
+	if err != nil {
+		return err
+	}
+	if g.Name == "" {
+		return mkerror("no group name given")
+	}
+	for _, role := range g.Roles {
+		if _, ok := a.roles[role]; !ok {
+			return ErrNonexistentRole
+		}
+	}
+	groups, err := groupMap(gb)
+	if err != nil {
+		return err
+	}
+	groups[g.Name] = g
+	for _, child := range g.Groups {
+		if _, ok := groups[child]; !ok {
+			return mkerror("nonexistent group " + child)
+		}
+		if child == g.Name || descendants(groups, child)[g.Name] {
+			return mkerror("circular group nesting")
+		}
+	}
+	if err := gb.SaveGroup(g); err != nil {
+		return mkerror(err.Error())
+	}
+	return nil
+}
+
+// DeleteGroup removes a group, and removes it from any groups it was nested
+// in. ErrMissingGroup is returned if the group isn't found.
+func (a Authorizer) DeleteGroup(name string) error {
+	gb, err := a.groupBackend()
+	if err != nil {
+		return err
+	}
+	groups, err := gb.Groups()
+	if err != nil {
+		return mkerror(err.Error())
+	}
+	for _, parent := range groups {
+		if remaining, ok := removeString(parent.Groups, name); ok {
+			parent.Groups = remaining
+			if err := gb.SaveGroup(parent); err != nil {
+				return mkerror(err.Error())
+			}
+		}
+	}
+	err = gb.DeleteGroup(name)
+	if err != nil && err != ErrMissingGroup {
+		return mkerror(err.Error())
+	}
+	return err
+}
+
+// AddGroupMember adds a user to a group.
+func (a Authorizer) AddGroupMember(group string, username string) error {
+	if _, err := a.backend.User(username); err != nil {
+		return mkerror(err.Error())
+	}
+	return a.updateGroup(group, func(g *Group) error {
+		if !containsString(g.Users, username) {
+			g.Users = append(g.Users, username)
+		}
+		return nil
+	})
+}
+
+// RemoveGroupMember removes a user from a group.
+func (a Authorizer) RemoveGroupMember(group string, username string) error {
+	return a.updateGroup(group, func(g *Group) error {
+		g.Users, _ = removeString(g.Users, username)
+		return nil
+	})
+}
+
+// AddSubgroup nests child in group, so child's members inherit group's roles
+// and permissions.
+func (a Authorizer) AddSubgroup(group string, child string) error {
+	return a.updateGroup(group, func(g *Group) error {
+		if !containsString(g.Groups, child) {
+			g.Groups = append(g.Groups, child)
+		}
+		return nil
+	})
+}
+
+// RemoveSubgroup removes a nested group from group.
+func (a Authorizer) RemoveSubgroup(group string, child string) error {
+	return a.updateGroup(group, func(g *Group) error {
+		g.Groups, _ = removeString(g.Groups, child)
+		return nil
+	})
+}
+
+func (a Authorizer) updateGroup(name string, update func(g *Group) error) error {
+	gb, err := a.groupBackend()
+	if err != nil {
+		return err
+	}
+	g, err := gb.Group(name)
+	if err == ErrMissingGroup {
+		return err
+	} else if err != nil {
+		return mkerror(err.Error())
+	}
+	if err := update(&g); err != nil {
+		return err
+	}
+	return a.SaveGroup(g)
+}
+
+// UserGroups returns every group a user belongs to, directly or through
+// nesting, sorted by name.
+func (a Authorizer) UserGroups(username string) ([]Group, error) {
+	gb, ok := asGroupBackend(a.backend)
+	if !ok {
+		return nil, nil
+	}
+	queue, err := gb.UserGroupNames(username)
+	if err != nil {
+		return nil, mkerror(err.Error())
+	}
+	found := make(map[string]bool)
+	var names []string
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if found[name] {
+			continue
+		}
+		found[name] = true
+		names = append(names, name)
+		parents, err := gb.ParentGroupNames(name)
+		if err != nil {
+			return nil, mkerror(err.Error())
+		}
+		queue = append(queue, parents...)
+	}
+	sort.Strings(names)
+	groups := make([]Group, 0, len(names))
+	for _, name := range names {
+		g, err := gb.Group(name)
+		if err == ErrMissingGroup {
+			continue
+		} else if err != nil {
+			return nil, mkerror(err.Error())
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// EffectiveRoles returns the roles a user holds, their own followed by any
+// inherited from groups.
+func (a Authorizer) EffectiveRoles(username string) ([]string, error) {
+	user, err := a.backend.User(username)
+	if err != nil {
+		return nil, err
+	}
+	roles, _, err := a.grants(user)
+	return roles, err
+}
+
+// grants returns the roles a user holds and the permissions granted to them
+// by groups.
+func (a Authorizer) grants(user UserData) (roles []string, permissions []string, e error) {
+	roles = []string{user.Role}
+	groups, err := a.UserGroups(user.Username)
+	if err != nil {
+		return roles, nil, err
+	}
+	for _, g := range groups {
+		for _, role := range g.Roles {
+			if !containsString(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+		permissions = append(permissions, g.Permissions...)
+	}
+	return roles, permissions, nil
+}
+
+func groupMap(gb GroupBackend) (map[string]Group, error) {
+	groups, err := gb.Groups()
+	if err != nil {
+		return nil, mkerror(err.Error())
+	}
+	m := make(map[string]Group, len(groups))
+	for _, g := range groups {
+		m[g.Name] = g
+	}
+	return m, nil
+}
+
+// descendants returns the names of all groups nested, at any depth, in the
+// named group.
+func descendants(groups map[string]Group, name string) map[string]bool {
+	found := make(map[string]bool)
+	queue := []string{name}
+	for len(queue) > 0 {
+		g := groups[queue[0]]
+		queue = queue[1:]
+		for _, child := range g.Groups {
+			if !found[child] {
+				found[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	return found
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) ([]string, bool) {
+	for i, item := range list {
+		if item == s {
+			return append(list[:i:i], list[i+1:]...), true
+		}
+	}
+	return list, false
+}
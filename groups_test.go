@@ -0,0 +1,97 @@
+package httpauth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "groups_test.gob")
+	defer done()
+	cookies := testLogin(t, auth, "groupuser", "user")
+	testLogin(t, auth, "otheruser", "user")
+
+	if err := auth.SaveGroup(Group{Name: "admins", Roles: []string{"nonexistent"}}); err == nil {
+		t.Fatal("SaveGroup: accepted nonexistent role")
+	}
+	if err := auth.SaveGroup(Group{Name: "admins", Roles: []string{"admin"}, Permissions: []string{"reports.export"}}); err != nil {
+		t.Fatalf("SaveGroup: %v", err)
+	}
+	if err := auth.SaveGroup(Group{Name: "ops"}); err != nil {
+		t.Fatalf("SaveGroup: %v", err)
+	}
+	if err := auth.AddGroupMember("ops", "nobody"); err == nil {
+		t.Fatal("AddGroupMember: added nonexistent user")
+	}
+	if err := auth.AddGroupMember("ops", "groupuser"); err != nil {
+		t.Fatalf("AddGroupMember: %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	req := requestWithCookies("GET", "/", cookies)
+	if err := auth.AuthorizeRole(rw, req, "admin", false); err == nil {
+		t.Fatal("AuthorizeRole: user not in admins was authorized")
+	}
+
+	// members of nested groups inherit roles and permissions
+	if err := auth.AddSubgroup("admins", "ops"); err != nil {
+		t.Fatalf("AddSubgroup: %v", err)
+	}
+	if err := auth.AddSubgroup("ops", "admins"); err == nil {
+		t.Fatal("AddSubgroup: allowed circular nesting")
+	}
+	if err := auth.AuthorizeRole(rw, req, "admin", false); err != nil {
+		t.Fatalf("AuthorizeRole: role not inherited through nested group: %v", err)
+	}
+	if err := auth.AuthorizePermission(rw, req, "reports.export", false); err != nil {
+		t.Fatalf("AuthorizePermission: permission not inherited through nested group: %v", err)
+	}
+	roles, err := auth.EffectiveRoles("groupuser")
+	if err != nil {
+		t.Fatalf("EffectiveRoles: %v", err)
+	}
+	if len(roles) != 2 || roles[0] != "user" || roles[1] != "admin" {
+		t.Errorf("EffectiveRoles: got %v", roles)
+	}
+	groups, err := auth.UserGroups("groupuser")
+	if err != nil {
+		t.Fatalf("UserGroups: %v", err)
+	}
+	if len(groups) != 2 || groups[0].Name != "admins" || groups[1].Name != "ops" {
+		t.Errorf("UserGroups: got %v", groups)
+	}
+	if groups, _ := auth.UserGroups("otheruser"); len(groups) != 0 {
+		t.Errorf("UserGroups: otheruser shouldn't be in any group, got %v", groups)
+	}
+
+	if err := auth.RemoveSubgroup("admins", "ops"); err != nil {
+		t.Fatalf("RemoveSubgroup: %v", err)
+	}
+	if err := auth.AuthorizeRole(rw, req, "admin", false); err == nil {
+		t.Fatal("AuthorizeRole: role still inherited after RemoveSubgroup")
+	}
+
+	if err := auth.AddSubgroup("admins", "ops"); err != nil {
+		t.Fatalf("AddSubgroup: %v", err)
+	}
+	if err := auth.DeleteGroup("ops"); err != nil {
+		t.Fatalf("DeleteGroup: %v", err)
+	}
+	if err := auth.DeleteGroup("ops"); err != ErrMissingGroup {
+		t.Fatalf("DeleteGroup: expected ErrMissingGroup, got %v", err)
+	}
+	gb := auth.backend.(GroupBackend)
+	if g, _ := gb.Group("admins"); len(g.Groups) != 0 {
+		t.Errorf("DeleteGroup: deleted group still nested: %v", g.Groups)
+	}
+
+	if err := auth.AddGroupMember("admins", "otheruser"); err != nil {
+		t.Fatalf("AddGroupMember: %v", err)
+	}
+	if err := auth.DeleteUser("otheruser"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if g, _ := gb.Group("admins"); len(g.Users) != 0 {
+		t.Errorf("DeleteUser: deleted user still a member: %v", g.Users)
+	}
+}
@@ -0,0 +1,213 @@
+package httpauth
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Default size of the worker pool running asynchronous hooks, used unless
+// SetHookWorkers is called first.
+const (
+	defaultHookWorkers   = 4
+	defaultHookQueueSize = 64
+)
+
+// HookEvent is passed to hooks registered for an action: ActionRegister,
+// ActionLogin, ActionLogout, ActionUpdate or ActionDeleteUser. After hooks
+// can also be registered for ActionUpdateAttributes and the account status
+// actions, such as ActionDisableUser.
+//
+// For before hooks, User is the user as it is about to be saved (or, for
+// Login, Logout and DeleteUser, as it is). For after hooks, it's the final
+// user. Request is nil for DeleteUser and the account status actions, which
+// aren't called with a request, unless the Authorizer was returned by
+// ForRequest, and for asynchronous hooks, which may run after the request has
+// finished. Actor is the user making the change, as in AuditEvent.
+type HookEvent struct {
+	Action  string
+	User    UserData
+	IP      string
+	Actor   string
+	Request *http.Request
+}
+
+// Hook is a function run before or after an Authorizer method.
+type Hook func(e HookEvent) error
+
+type asyncHook struct {
+	hook Hook
+	e    HookEvent
+}
+
+// hooks holds the hooks registered with an Authorizer.
+type hooks struct {
+	before map[string][]Hook
+	after  map[string][]Hook
+	async  map[string][]Hook
+
+	mu      sync.RWMutex
+	queue   chan asyncHook
+	done    chan struct{} // closed by StopHooks
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+// AddBeforeHook adds a hook run before an action takes effect. Returning an
+// error vetoes it: the method returns the error without doing anything, for
+// example to reject a registration from a blocked domain. Hooks should be
+// added before the Authorizer starts handling requests.
+func (a Authorizer) AddBeforeHook(action string, hook Hook) {
+	a.ext.hooks.before[action] = append(a.ext.hooks.before[action], hook)
+}
+
+// AddAfterHook adds a hook run once an action has succeeded, before the
+// method returns. An error from the hook is returned by the method, although
+// the action has already taken effect.
+func (a Authorizer) AddAfterHook(action string, hook Hook) {
+	a.ext.hooks.after[action] = append(a.ext.hooks.after[action], hook)
+}
+
+// AddAsyncAfterHook adds a hook run by a pool of workers once an action has
+// succeeded. Errors are logged. If the pool's queue is full, the hook is
+// dropped and logged rather than holding up the method.
+func (a Authorizer) AddAsyncAfterHook(action string, hook Hook) {
+	a.ext.hooks.async[action] = append(a.ext.hooks.async[action], hook)
+}
+
+// SetHookWorkers sets the number of workers running asynchronous hooks, and
+// how many queued hooks they may fall behind by. It must be called before
+// any asynchronous hook runs; otherwise 4 workers and a queue of 64 are used.
+func (a Authorizer) SetHookWorkers(workers int, queueSize int) error {
+	h := a.ext.hooks
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.queue != nil {
+		return mkerror("hook workers already started")
+	}
+	if workers < 1 || queueSize < 0 {
+		return mkerror("invalid hook worker pool size")
+	}
+	a.startHookWorkers(workers, queueSize)
+	return nil
+}
+
+// startHookWorkers starts the worker pool. h.mu must be held.
+func (a Authorizer) startHookWorkers(workers int, queueSize int) {
+	h := a.ext.hooks
+	queue := make(chan asyncHook, queueSize)
+	done := make(chan struct{})
+	h.queue, h.done = queue, done
+	run := func(job asyncHook) {
+		if err := job.hook(job.e); err != nil {
+			a.ext.logger.Printf("%s hook for %s: %v", job.e.Action, job.e.User.Username, err)
+		}
+	}
+	for i := 0; i < workers; i++ {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			for {
+				select {
+				case job := <-queue:
+					run(job)
+				case <-done:
+					// finish what's queued, then stop
+					for {
+						select {
+						case job := <-queue:
+							run(job)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+}
+
+// StopHooks waits for queued asynchronous hooks to finish, and stops the
+// workers. Asynchronous hooks for later actions are dropped.
+func (a Authorizer) StopHooks() {
+	h := a.ext.hooks
+	h.mu.Lock()
+	if h.stopped {
+		h.mu.Unlock()
+		return
+	}
+	h.stopped = true
+	if h.done != nil {
+		// the queue itself stays open, as afterHooks may still be sending
+		close(h.done)
+	}
+	h.mu.Unlock()
+	h.wg.Wait()
+}
+
+func (a Authorizer) beforeHooks(action string, req *http.Request, user UserData) error {
+	for _, hook := range a.ext.hooks.before[action] {
+		if err := hook(a.newHookEvent(action, req, user)); err != nil {
+			if a.api != nil {
+				a.api.vetoed = true
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// afterHooks runs the synchronous after hooks for an action, then queues the
+// asynchronous ones.
+func (a Authorizer) afterHooks(action string, req *http.Request, user UserData) error {
+	for _, hook := range a.ext.hooks.after[action] {
+		if err := hook(a.newHookEvent(action, req, user)); err != nil {
+			return mkerror("after " + action + " hook: " + err.Error())
+		}
+	}
+	async := a.ext.hooks.async[action]
+	if len(async) == 0 {
+		return nil
+	}
+	e := a.newHookEvent(action, req, user)
+	e.Request = nil
+	h := a.ext.hooks
+	h.mu.RLock()
+	if h.queue == nil && !h.stopped {
+		// start the default pool
+		h.mu.RUnlock()
+		h.mu.Lock()
+		if h.queue == nil && !h.stopped {
+			a.startHookWorkers(defaultHookWorkers, defaultHookQueueSize)
+		}
+		h.mu.Unlock()
+		h.mu.RLock()
+	}
+	queue, done, stopped := h.queue, h.done, h.stopped
+	h.mu.RUnlock()
+	if stopped {
+		a.ext.logger.Printf("%s hook for %s dropped: hooks stopped", action, user.Username)
+		return nil
+	}
+	for _, hook := range async {
+		select {
+		case <-done:
+			a.ext.logger.Printf("%s hook for %s dropped: hooks stopped", action, user.Username)
+			return nil
+		default:
+		}
+		select {
+		case queue <- asyncHook{hook, e}:
+		default:
+			a.ext.logger.Printf("%s hook for %s dropped: queue full", action, user.Username)
+		}
+	}
+	return nil
+}
+
+func (a Authorizer) newHookEvent(action string, req *http.Request, user UserData) HookEvent {
+	e := HookEvent{Action: action, User: user, Actor: a.requestActor(req), Request: req}
+	if req != nil {
+		e.IP = remoteIP(req)
+	}
+	return e
+}
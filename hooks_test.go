@@ -0,0 +1,155 @@
+package httpauth
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "hooks_test.gob")
+	defer done()
+	var calls []string
+	record := func(when string) Hook {
+		return func(e HookEvent) error {
+			calls = append(calls, when+" "+e.Action+" "+e.User.Username)
+			return nil
+		}
+	}
+	for _, action := range []string{ActionRegister, ActionLogin, ActionLogout, ActionUpdate, ActionDeleteUser} {
+		auth.AddBeforeHook(action, record("before"))
+		auth.AddAfterHook(action, record("after"))
+	}
+	auth.AddBeforeHook(ActionRegister, func(e HookEvent) error {
+		if strings.HasSuffix(e.User.Email, "@blocked.example") {
+			return errors.New("domain blocked")
+		}
+		return nil
+	})
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", nil)
+	err := auth.Register(rw, req, UserData{Username: "blocked", Email: "blocked@blocked.example"}, "password")
+	if err == nil || err.Error() != "domain blocked" {
+		t.Fatalf("Register: expected veto, got %v", err)
+	}
+	if _, err := auth.backend.User("blocked"); err != ErrMissingUser {
+		t.Fatal("Register: vetoed user saved")
+	}
+
+	cookies := testLogin(t, auth, "hooked", "user")
+	req = requestWithCookies("POST", "/", cookies)
+	if err := auth.Update(rw, req, "", "", "new@example.com"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.Logout(rw, req); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.DeleteUser("hooked"); err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []string{
+		"before register blocked",
+		"before register hooked", "after register hooked",
+		"before login hooked", "after login hooked",
+		"before update hooked", "after update hooked",
+		"before logout hooked", "after logout hooked",
+		"before delete_user hooked", "after delete_user hooked",
+	}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Hooks called in wrong order:\n%v\nexpected\n%v", calls, expected)
+	}
+
+	auth.AddAfterHook(ActionDeleteUser, func(e HookEvent) error { return errors.New("cleanup failed") })
+	testLogin(t, auth, "hooked2", "user")
+	if err := auth.DeleteUser("hooked2"); err == nil || !strings.Contains(err.Error(), "cleanup failed") {
+		t.Fatalf("DeleteUser: after hook error not returned: %v", err)
+	}
+}
+
+func TestAsyncHooks(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "hooks_async_test.gob")
+	defer done()
+	if err := auth.SetHookWorkers(0, 1); err == nil {
+		t.Fatal("SetHookWorkers: accepted no workers")
+	}
+	if err := auth.SetHookWorkers(2, 8); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.SetHookWorkers(2, 1); err == nil {
+		t.Fatal("SetHookWorkers: allowed restarting workers")
+	}
+	var (
+		mu    sync.Mutex
+		users []string
+	)
+	auth.AddAsyncAfterHook(ActionRegister, func(e HookEvent) error {
+		if e.Request != nil {
+			t.Error("Async hook received request")
+		}
+		mu.Lock()
+		users = append(users, e.User.Username)
+		mu.Unlock()
+		return nil
+	})
+	for _, name := range []string{"async1", "async2", "async3"} {
+		testLogin(t, auth, name, "user")
+	}
+	auth.StopHooks()
+	if len(users) != 3 {
+		t.Fatalf("Expected 3 async hook calls, got %v", users)
+	}
+	testLogin(t, auth, "async4", "user")
+	auth.StopHooks()
+	if len(users) != 3 {
+		t.Fatalf("Async hook ran after StopHooks: %v", users)
+	}
+}
+
+func TestAsyncHooksQueueFull(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "hooks_full_test.gob")
+	defer done()
+	var logs bytes.Buffer
+	auth.SetLogger(log.New(&logs, "", 0))
+	if err := auth.SetHookWorkers(1, 1); err != nil {
+		t.Fatal(err.Error())
+	}
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	auth.AddAsyncAfterHook(ActionRegister, func(e HookEvent) error {
+		started <- e.User.Username
+		<-release
+		return nil
+	})
+	testLogin(t, auth, "full1", "user")
+	<-started // the only worker is now busy
+	testLogin(t, auth, "full2", "user")
+	testLogin(t, auth, "full3", "user")
+
+	stopped := make(chan struct{})
+	go func() {
+		auth.StopHooks()
+		close(stopped)
+	}()
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("StopHooks didn't return")
+	}
+	if name := <-started; name != "full2" {
+		t.Errorf("Expected queued hook for full2 to run, got %s", name)
+	}
+	if len(started) != 0 {
+		t.Errorf("Hook ran for full3 although the queue was full")
+	}
+	if !strings.Contains(logs.String(), "register hook for full3 dropped: queue full") {
+		t.Errorf("Dropped hook not logged: %s", logs.String())
+	}
+}
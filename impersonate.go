@@ -0,0 +1,157 @@
+package httpauth
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+// SetImpersonationRole sets the lowest role allowed to impersonate other
+// users. Impersonation is disabled until this is called.
+func (a Authorizer) SetImpersonationRole(role string) error {
+	if _, ok := a.roles[role]; !ok {
+		return mkerror("role not found")
+	}
+	a.ext.impersonationRole = role
+	return nil
+}
+
+// SetLogger sets where the Authorizer logs noteworthy events, such as the
+// start and end of impersonation. It defaults to standard error.
+func (a Authorizer) SetLogger(logger *log.Logger) {
+	a.ext.logger = logger
+}
+
+// highestRole returns the value of the highest role a user holds, directly or
+// through groups.
+func (a Authorizer) highestRole(user UserData) (Role, error) {
+	roles, _, err := a.grants(user)
+	if err != nil {
+		return 0, err
+	}
+	var highest Role
+	for _, role := range roles {
+		if a.roles[role] > highest {
+			highest = a.roles[role]
+		}
+	}
+	return highest, nil
+}
+
+// Impersonate switches the current session to another user, so support staff
+// can see what they see. The real user is remembered in the session and
+// reported by CurrentIdentities. Only users holding the role set with
+// SetImpersonationRole (or higher) may impersonate, and only users with a
+// lower role than their own. Impersonating sessions can't reauthenticate or
+// change the user's own password or email.
+func (a Authorizer) Impersonate(rw http.ResponseWriter, req *http.Request, username string) (err error) {
+	defer func() { a.audit(req, ActionImpersonate, a.requestActor(req), username, err) }()
+	if a.ext.impersonationRole == "" {
+		return mkerror("impersonation is disabled")
+	}
+	if err := a.AuthorizeRole(rw, req, a.ext.impersonationRole, false); err != nil {
+		return err
+	}
+	authSession, _ := a.cookiejar.Get(req, "auth")
+	if _, ok := authSession.Values["impersonator"]; ok {
+		return mkerror("already impersonating")
+	}
+	actor, err := a.backend.User(authSession.Values["username"].(string))
+	if err != nil {
+		return mkerror(err.Error())
+	}
+	target, err := a.backend.User(username)
+	if err == ErrMissingUser {
+		a.addMessage(rw, req, "User doesn't exist.")
+		return err
+	} else if err != nil {
+		return mkerror(err.Error())
+	}
+	actorRole, err := a.highestRole(actor)
+	if err != nil {
+		return mkerror(err.Error())
+	}
+	targetRole, err := a.highestRole(target)
+	if err != nil {
+		return mkerror(err.Error())
+	}
+	if targetRole >= actorRole {
+		a.addMessage(rw, req, "You can't impersonate that user.")
+		return mkerror("can't impersonate user with equal or higher role")
+	}
+
+	authSession.Values["impersonator"] = actor.Username
+	authSession.Values["username"] = target.Username
+	delete(authSession.Values, "tenant")
+	delete(authSession.Values, "authenticated_at")
+	clearClaims(authSession)
+	if err := authSession.Save(req, rw); err != nil {
+		return mkerror(err.Error())
+	}
+	a.ext.logger.Printf("%s started impersonating %s", actor.Username, target.Username)
+	return nil
+}
+
+// StopImpersonating switches an impersonating session back to the real user.
+func (a Authorizer) StopImpersonating(rw http.ResponseWriter, req *http.Request) error {
+	authSession, err := a.cookiejar.Get(req, "auth")
+	if err != nil {
+		return mkerror(err.Error())
+	}
+	actor, ok := authSession.Values["impersonator"].(string)
+	if !ok {
+		return mkerror("not impersonating")
+	}
+	target, _ := authSession.Values["username"].(string)
+	authSession.Values["username"] = actor
+	delete(authSession.Values, "impersonator")
+	delete(authSession.Values, "tenant")
+	delete(authSession.Values, "authenticated_at")
+	clearClaims(authSession)
+	if err := authSession.Save(req, rw); err != nil {
+		return mkerror(err.Error())
+	}
+	a.ext.logger.Printf("%s stopped impersonating %s", actor, target)
+	a.audit(req, ActionStopImpersonating, actor, target, nil)
+	return nil
+}
+
+// CurrentIdentities is like CurrentUser, but also returns the actor: the user
+// really behind the session. Unless an impersonation is in progress, actor is
+// the same as user.
+func (a Authorizer) CurrentIdentities(rw http.ResponseWriter, req *http.Request) (user UserData, actor UserData, e error) {
+	user, err := a.CurrentUser(rw, req)
+	if err != nil {
+		return user, actor, err
+	}
+	authSession, _ := a.cookiejar.Get(req, "auth")
+	impersonator, ok := authSession.Values["impersonator"].(string)
+	if !ok {
+		return user, user, nil
+	}
+	actor, err = a.requestUser(req, impersonator)
+	if err != nil {
+		return user, actor, mkerror(err.Error())
+	}
+	return user, actor, nil
+}
+
+// sessionActor returns the user really behind a session for user: the
+// impersonator, if there is one. A session impersonating on behalf of a user
+// who no longer exists is ended.
+func (a Authorizer) sessionActor(rw http.ResponseWriter, req *http.Request, authSession *sessions.Session, user UserData) (UserData, error) {
+	impersonator, ok := authSession.Values["impersonator"].(string)
+	if !ok {
+		return user, nil
+	}
+	actor, err := a.requestUser(req, impersonator)
+	if err == ErrMissingUser {
+		authSession.Options.MaxAge = -1 // kill the cookie
+		authSession.Save(req, rw)
+		return actor, mkerror("impersonator not found")
+	} else if err != nil {
+		return actor, mkerror(err.Error())
+	}
+	return actor, nil
+}
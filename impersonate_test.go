@@ -0,0 +1,97 @@
+package httpauth
+
+import (
+	"bytes"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImpersonate(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "impersonate_test.gob")
+	defer done()
+	var logs bytes.Buffer
+	auth.SetLogger(log.New(&logs, "", 0))
+	adminCookies := testLogin(t, auth, "support", "admin")
+	userCookies := testLogin(t, auth, "customer", "user")
+	testLogin(t, auth, "otheradmin", "admin")
+
+	rw := httptest.NewRecorder()
+	if err := auth.Impersonate(rw, requestWithCookies("GET", "/", adminCookies), "customer"); err == nil {
+		t.Fatal("Impersonate: allowed before SetImpersonationRole")
+	}
+	if err := auth.SetImpersonationRole("admin"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.Impersonate(rw, requestWithCookies("GET", "/", userCookies), "support"); err == nil {
+		t.Fatal("Impersonate: allowed for unprivileged user")
+	}
+	if err := auth.Impersonate(rw, requestWithCookies("GET", "/", adminCookies), "otheradmin"); err == nil {
+		t.Fatal("Impersonate: allowed impersonating user with equal role")
+	}
+	if err := auth.Impersonate(rw, requestWithCookies("GET", "/", adminCookies), "nobody"); err != ErrMissingUser {
+		t.Fatalf("Impersonate: expected ErrMissingUser, got %v", err)
+	}
+
+	rw = httptest.NewRecorder()
+	if err := auth.Impersonate(rw, requestWithCookies("GET", "/", adminCookies), "customer"); err != nil {
+		t.Fatalf("Impersonate: %v", err)
+	}
+	impersonating := responseCookies(rw)
+	req := requestWithCookies("GET", "/", impersonating)
+	user, actor, err := auth.CurrentIdentities(rw, req)
+	if err != nil {
+		t.Fatalf("CurrentIdentities: %v", err)
+	}
+	if user.Username != "customer" || actor.Username != "support" {
+		t.Fatalf("CurrentIdentities: got user %s, actor %s", user.Username, actor.Username)
+	}
+	if err := auth.AuthorizeRole(rw, req, "admin", false); err == nil {
+		t.Fatal("AuthorizeRole: impersonated user kept admin role")
+	}
+	if err := auth.Impersonate(rw, req, "customer"); err == nil {
+		t.Fatal("Impersonate: allowed nested impersonation")
+	}
+	authSession, _ := auth.cookiejar.Get(req, "auth")
+	if _, ok := authSession.Values["authenticated_at"]; ok {
+		t.Error("Impersonate: kept the impersonator's authentication time")
+	}
+	if err := auth.Reauthenticate(rw, req, "password"); err != ErrImpersonating {
+		t.Fatalf("Reauthenticate: expected ErrImpersonating, got %v", err)
+	}
+	if err := auth.RequireRecentAuth(rw, req, time.Hour); err != ErrImpersonating {
+		t.Fatalf("RequireRecentAuth: expected ErrImpersonating, got %v", err)
+	}
+	if err := auth.Update(rw, req, "", "newpassword", ""); err != ErrImpersonating {
+		t.Fatalf("Update: expected ErrImpersonating, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "support started impersonating customer") {
+		t.Errorf("Impersonation not logged: %s", logs.String())
+	}
+
+	rw = httptest.NewRecorder()
+	if err := auth.StopImpersonating(rw, req); err != nil {
+		t.Fatalf("StopImpersonating: %v", err)
+	}
+	req = requestWithCookies("GET", "/", responseCookies(rw))
+	user, actor, err = auth.CurrentIdentities(rw, req)
+	if err != nil || user.Username != "support" || actor.Username != "support" {
+		t.Fatalf("CurrentIdentities after StopImpersonating: got user %s, actor %s, %v", user.Username, actor.Username, err)
+	}
+	if err := auth.RequireRecentAuth(rw, req, time.Hour); err != ErrReauthRequired {
+		t.Fatalf("RequireRecentAuth after StopImpersonating: expected ErrReauthRequired, got %v", err)
+	}
+	if err := auth.StopImpersonating(rw, req); err == nil {
+		t.Fatal("StopImpersonating: no error when not impersonating")
+	}
+
+	// sessions impersonating on behalf of a deleted user end
+	if err := auth.DeleteUser("support"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.Authorize(httptest.NewRecorder(), requestWithCookies("GET", "/", impersonating), false); err == nil {
+		t.Fatal("Authorize: impersonation outlived the impersonator")
+	}
+}
@@ -1,11 +1,14 @@
 package httpauth
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/syndtr/goleveldb/leveldb"
 	"os"
+	"sync"
+	"time"
 )
 
 // ErrMissingLeveldbBackend is returned by NewLeveldbAuthBackend when the file
@@ -18,10 +21,24 @@ var (
 // LeveldbAuthBackend stores user data and the location of a leveldb file.
 //
 // Current implementation holds all user data in memory, flushing to leveldb
-// as a single value to the key "httpauth::userdata" on saves.
+// as a single value to the key "httpauth::userdata" on saves. Groups, tenants,
+// tenant memberships, login attempts and webhook deliveries are stored the
+// same way under "httpauth::groups", "httpauth::tenants",
+// "httpauth::memberships", "httpauth::logins" and "httpauth::webhooks".
 type LeveldbAuthBackend struct {
 	filepath string
 	users    map[string]UserData
+	groups   map[string]Group
+
+	tenants     map[string]Tenant
+	memberships map[string]Membership
+	logins      map[string][]LoginAttempt
+	webhooks    map[string]WebhookDelivery
+
+	// mu guards the maps and uniqueEmails, which are shared by copies of
+	// the backend.
+	mu           *sync.RWMutex
+	uniqueEmails *bool
 }
 
 // NewLeveldbAuthBackend initializes a new backend by loading a map of users
@@ -29,6 +46,8 @@ type LeveldbAuthBackend struct {
 // If the file doesn't exist, returns an error.
 func NewLeveldbAuthBackend(filepath string) (b LeveldbAuthBackend, e error) {
 	b.filepath = filepath
+	b.mu = new(sync.RWMutex)
+	b.uniqueEmails = new(bool)
 	if _, err := os.Stat(b.filepath); err == nil {
 		db, err := leveldb.OpenFile(b.filepath, nil)
 		defer db.Close()
@@ -40,69 +59,420 @@ func NewLeveldbAuthBackend(filepath string) (b LeveldbAuthBackend, e error) {
 		if err != nil {
 			b.users = make(map[string]UserData)
 		}
+		data, err = db.Get([]byte("httpauth::groups"), nil)
+		err = json.Unmarshal(data, &b.groups)
+		if err != nil {
+			b.groups = make(map[string]Group)
+		}
+		data, err = db.Get([]byte("httpauth::tenants"), nil)
+		err = json.Unmarshal(data, &b.tenants)
+		if err != nil {
+			b.tenants = make(map[string]Tenant)
+		}
+		data, err = db.Get([]byte("httpauth::memberships"), nil)
+		err = json.Unmarshal(data, &b.memberships)
+		if err != nil {
+			b.memberships = make(map[string]Membership)
+		}
+		data, err = db.Get([]byte("httpauth::logins"), nil)
+		err = json.Unmarshal(data, &b.logins)
+		if err != nil {
+			b.logins = make(map[string][]LoginAttempt)
+		}
+		data, err = db.Get([]byte("httpauth::webhooks"), nil)
+		err = json.Unmarshal(data, &b.webhooks)
+		if err != nil {
+			b.webhooks = make(map[string]WebhookDelivery)
+		}
 	} else {
 		return b, ErrMissingLeveldbBackend
 	}
 	if b.users == nil {
 		b.users = make(map[string]UserData)
 	}
+	if b.groups == nil {
+		b.groups = make(map[string]Group)
+	}
+	if b.tenants == nil {
+		b.tenants = make(map[string]Tenant)
+	}
+	if b.memberships == nil {
+		b.memberships = make(map[string]Membership)
+	}
+	if b.logins == nil {
+		b.logins = make(map[string][]LoginAttempt)
+	}
+	if b.webhooks == nil {
+		b.webhooks = make(map[string]WebhookDelivery)
+	}
 	return b, nil
 }
 
 // User returns the user with the given username. Error is set to
 // ErrMissingUser if user is not found.
 func (b LeveldbAuthBackend) User(username string) (user UserData, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	if user, ok := b.users[username]; ok {
 		return user, nil
 	}
 	return user, ErrMissingUser
 }
 
+// UserByEmail returns the user with the given email. Error is set to
+// ErrMissingUser if no user has it.
+func (b LeveldbAuthBackend) UserByEmail(email string) (UserData, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return userByEmail(b.users, email)
+}
+
 // Users returns a slice of all users.
 func (b LeveldbAuthBackend) Users() (us []UserData, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	for _, user := range b.users {
 		us = append(us, user)
 	}
 	return
 }
 
+// QueryUsers returns a page of the users matching a query.
+func (b LeveldbAuthBackend) QueryUsers(q UserQuery) (UserPage, error) {
+	us, _ := b.Users()
+	return queryUsers(us, q)
+}
+
+// CountUsers returns the number of users matching a query's filters.
+func (b LeveldbAuthBackend) CountUsers(q UserQuery) (int, error) {
+	us, _ := b.Users()
+	return countUsers(us, q)
+}
+
+// ForEachUser calls fn with each user, in username order.
+func (b LeveldbAuthBackend) ForEachUser(ctx context.Context, fn func(user UserData) error) error {
+	us, _ := b.Users()
+	return forEachUser(ctx, us, fn)
+}
+
 // SaveUser adds a new user, replacing one with the same username, and flushes
 // to the db.
 func (b LeveldbAuthBackend) SaveUser(user UserData) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if *b.uniqueEmails && emailTaken(b.users, user) {
+		return ErrEmailTaken
+	}
 	b.users[user.Username] = user
 	err := b.save()
 	return err
 }
 
+// RequireUniqueEmails makes SaveUser fail with ErrEmailTaken when another user
+// has the email of the user saved, until the backend is reopened.
+func (b LeveldbAuthBackend) RequireUniqueEmails() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := sharedEmail(b.users); err != nil {
+		return fmt.Errorf("leveldbauthbackend: %v", err)
+	}
+	*b.uniqueEmails = true
+	return nil
+}
+
 func (b LeveldbAuthBackend) save() error {
 	db, err := leveldb.OpenFile(b.filepath, nil)
 	defer db.Close()
 	if err != nil {
 		return errors.New("leveldbauthbackend: failed to edit auth file")
 	}
-	data, err := json.Marshal(b.users)
-	if err != nil {
-		return errors.New(fmt.Sprintf("leveldbauthbackend: save: %v", err))
+	values := map[string]interface{}{
+		"httpauth::userdata":    b.users,
+		"httpauth::groups":      b.groups,
+		"httpauth::tenants":     b.tenants,
+		"httpauth::memberships": b.memberships,
+		"httpauth::logins":      b.logins,
+		"httpauth::webhooks":    b.webhooks,
 	}
-	err = db.Put([]byte("httpauth::userdata"), data, nil)
-	if err != nil {
-		return errors.New(fmt.Sprintf("leveldbauthbackend: save: %v", err))
+	for key, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return errors.New(fmt.Sprintf("leveldbauthbackend: save: %v", err))
+		}
+		err = db.Put([]byte(key), data, nil)
+		if err != nil {
+			return errors.New(fmt.Sprintf("leveldbauthbackend: save: %v", err))
+		}
 	}
 	return nil
 }
 
 // DeleteUser removes a user, raising ErrDeleteNull if that user was missing.
 func (b LeveldbAuthBackend) DeleteUser(username string) error {
-	_, err := b.User(username)
-	if err == ErrMissingUser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.users[username]; !ok {
 		return ErrDeleteNull
-	} else if err != nil {
-		return fmt.Errorf("leveldbauthbackend: %v", err)
 	}
 	delete(b.users, username)
 	return b.save()
 }
 
+// Group returns the group with the given name. Error is set to
+// ErrMissingGroup if the group is not found.
+func (b LeveldbAuthBackend) Group(name string) (group Group, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if group, ok := b.groups[name]; ok {
+		return group, nil
+	}
+	return group, ErrMissingGroup
+}
+
+// Groups returns a slice of all groups.
+func (b LeveldbAuthBackend) Groups() (groups []Group, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, group := range b.groups {
+		groups = append(groups, group)
+	}
+	return
+}
+
+// UserGroupNames returns the names of the groups the user is a direct member
+// of.
+func (b LeveldbAuthBackend) UserGroupNames(username string) (names []string, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, group := range b.groups {
+		if containsString(group.Users, username) {
+			names = append(names, group.Name)
+		}
+	}
+	return
+}
+
+// ParentGroupNames returns the names of the groups the named group is directly
+// nested in.
+func (b LeveldbAuthBackend) ParentGroupNames(name string) (names []string, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, group := range b.groups {
+		if containsString(group.Groups, name) {
+			names = append(names, group.Name)
+		}
+	}
+	return
+}
+
+// SaveGroup adds a new group, replacing one with the same name, and flushes
+// to the db.
+func (b LeveldbAuthBackend) SaveGroup(group Group) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.groups[group.Name] = group
+	return b.save()
+}
+
+// DeleteGroup removes a group, raising ErrMissingGroup if it was missing.
+func (b LeveldbAuthBackend) DeleteGroup(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.groups[name]; !ok {
+		return ErrMissingGroup
+	}
+	delete(b.groups, name)
+	return b.save()
+}
+
+// Tenant returns the tenant with the given name. Error is set to
+// ErrMissingTenant if the tenant is not found.
+func (b LeveldbAuthBackend) Tenant(name string) (tenant Tenant, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if tenant, ok := b.tenants[name]; ok {
+		return tenant, nil
+	}
+	return tenant, ErrMissingTenant
+}
+
+// Tenants returns a slice of all tenants.
+func (b LeveldbAuthBackend) Tenants() (tenants []Tenant, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, tenant := range b.tenants {
+		tenants = append(tenants, tenant)
+	}
+	return
+}
+
+// SaveTenant adds a new tenant, replacing one with the same name, and flushes to
+// the db.
+func (b LeveldbAuthBackend) SaveTenant(tenant Tenant) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tenants[tenant.Name] = tenant
+	return b.save()
+}
+
+// DeleteTenant removes a tenant and its memberships, raising ErrMissingTenant
+// if it was missing.
+func (b LeveldbAuthBackend) DeleteTenant(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.tenants[name]; !ok {
+		return ErrMissingTenant
+	}
+	delete(b.tenants, name)
+	for key, m := range b.memberships {
+		if m.Tenant == name {
+			delete(b.memberships, key)
+		}
+	}
+	return b.save()
+}
+
+// SaveMembership adds a user to a tenant, replacing their previous role.
+func (b LeveldbAuthBackend) SaveMembership(m Membership) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.memberships[membershipKey(m.Tenant, m.Username)] = m
+	return b.save()
+}
+
+// DeleteMembership removes a user from a tenant, raising ErrMissingMembership
+// if they weren't a member.
+func (b LeveldbAuthBackend) DeleteMembership(tenant string, username string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := membershipKey(tenant, username)
+	if _, ok := b.memberships[key]; !ok {
+		return ErrMissingMembership
+	}
+	delete(b.memberships, key)
+	return b.save()
+}
+
+// Memberships returns a user's tenant memberships, sorted by tenant.
+func (b LeveldbAuthBackend) Memberships(username string) (memberships []Membership, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, m := range b.memberships {
+		if m.Username == username {
+			memberships = append(memberships, m)
+		}
+	}
+	sortMemberships(memberships)
+	return
+}
+
+// TenantMembers returns a tenant's memberships, sorted by username.
+func (b LeveldbAuthBackend) TenantMembers(tenant string) (memberships []Membership, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, m := range b.memberships {
+		if m.Tenant == tenant {
+			memberships = append(memberships, m)
+		}
+	}
+	sortMemberships(memberships)
+	return
+}
+
+// SaveLoginAttempt records a login attempt, and flushes to the db.
+func (b LeveldbAuthBackend) SaveLoginAttempt(attempt LoginAttempt) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.logins[attempt.Username] = append(b.logins[attempt.Username], attempt)
+	return b.save()
+}
+
+// LoginAttempts returns a user's login attempts, newest first.
+func (b LeveldbAuthBackend) LoginAttempts(username string, offset, limit int) (attempts []LoginAttempt, total int, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	attempts, total = pageLoginAttempts(b.logins[username], offset, limit)
+	return
+}
+
+// KnownDevice reports whether a user has logged in successfully from an IP
+// address with a user agent before.
+func (b LeveldbAuthBackend) KnownDevice(username, ip, userAgent string) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return knownDevice(b.logins[username], ip, userAgent), nil
+}
+
+// PruneLoginAttempts removes old login attempts.
+func (b LeveldbAuthBackend) PruneLoginAttempts(username string, before time.Time, keep int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if username == "" {
+		for username, attempts := range b.logins {
+			b.logins[username] = pruneLoginAttempts(attempts, before, 0)
+		}
+	} else {
+		b.logins[username] = pruneLoginAttempts(b.logins[username], before, keep)
+	}
+	return b.save()
+}
+
+// DeleteLoginAttempts removes all of a user's login attempts.
+func (b LeveldbAuthBackend) DeleteLoginAttempts(username string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.logins[username]; !ok {
+		return nil
+	}
+	delete(b.logins, username)
+	return b.save()
+}
+
+// SaveWebhookDelivery queues a webhook delivery, replacing the one with the
+// same ID, and flushes to the db.
+func (b LeveldbAuthBackend) SaveWebhookDelivery(d WebhookDelivery) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.webhooks[d.ID] = d
+	return b.save()
+}
+
+// WebhookDelivery returns the webhook delivery with the given ID. Error is set
+// to ErrMissingDelivery if it is not found.
+func (b LeveldbAuthBackend) WebhookDelivery(id string) (d WebhookDelivery, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if d, ok := b.webhooks[id]; ok {
+		return d, nil
+	}
+	return d, ErrMissingDelivery
+}
+
+// WebhookDeliveries returns pending or dead webhook deliveries, oldest first.
+func (b LeveldbAuthBackend) WebhookDeliveries(dead bool) (deliveries []WebhookDelivery, e error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, d := range b.webhooks {
+		if d.Dead == dead {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sortDeliveries(deliveries)
+	return
+}
+
+// DeleteWebhookDelivery removes a webhook delivery, raising ErrMissingDelivery
+// if it was missing.
+func (b LeveldbAuthBackend) DeleteWebhookDelivery(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.webhooks[id]; !ok {
+		return ErrMissingDelivery
+	}
+	delete(b.webhooks, id)
+	return b.save()
+}
+
 // Close cleans up the backend. Currently a no-op for gobfiles.
 func (b LeveldbAuthBackend) Close() {
 
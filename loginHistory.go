@@ -0,0 +1,251 @@
+package httpauth
+
+import (
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Login attempt outcomes.
+const (
+	LoginSuccess     = "success"
+	LoginBadPassword = "bad_password"
+	LoginUnknownUser = "unknown_user"
+	LoginDisabled    = StatusDisabled
+	LoginLocked      = StatusLocked
+	LoginExpired     = StatusExpired
+	LoginVetoed      = "vetoed" // by a before hook
+)
+
+// LoginAttempt records a call to Login.
+type LoginAttempt struct {
+	Username  string    `bson:"Username"`
+	Time      time.Time `bson:"Time"`
+	IP        string    `bson:"IP"`
+	UserAgent string    `bson:"UserAgent"`
+	Outcome   string    `bson:"Outcome"`
+}
+
+// The LoginHistoryBackend interface is implemented by AuthBackends able to
+// store login attempts. All backends in this package implement it.
+type LoginHistoryBackend interface {
+	SaveLoginAttempt(attempt LoginAttempt) error
+	// LoginAttempts returns a user's attempts, newest first, skipping offset
+	// attempts and returning at most limit (all if limit <= 0). The total
+	// number stored for the user is also returned.
+	LoginAttempts(username string, offset, limit int) (attempts []LoginAttempt, total int, e error)
+	// KnownDevice reports whether a user has logged in successfully from an
+	// IP address with a user agent before.
+	KnownDevice(username, ip, userAgent string) (bool, error)
+	// PruneLoginAttempts removes a user's attempts made before a time (unless
+	// it's zero), then all but their newest keep (if keep > 0). An empty
+	// username prunes every user's attempts by time only.
+	PruneLoginAttempts(username string, before time.Time, keep int) error
+	DeleteLoginAttempts(username string) error
+}
+
+// NewDeviceFunc is called by Login when a user logs in from an IP address and
+// user agent they haven't successfully logged in with before.
+type NewDeviceFunc func(user UserData, attempt LoginAttempt) error
+
+// Mailer sends plain text email.
+type Mailer interface {
+	SendMail(to, subject, body string) error
+}
+
+// SMTPMailer is a Mailer sending mail through an SMTP server with
+// net/smtp.SendMail.
+type SMTPMailer struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+// SendMail sends a message.
+func (m SMTPMailer) SendMail(to, subject, body string) error {
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.Replace(body, "\n", "\r\n", -1)
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg))
+}
+
+// NewDeviceMailer returns a NewDeviceFunc emailing users about sign-ins from
+// new devices, for use with OnNewDevice.
+func NewDeviceMailer(m Mailer, siteName string) NewDeviceFunc {
+	return func(user UserData, attempt LoginAttempt) error {
+		body := fmt.Sprintf("Hi %s,\n\n"+
+			"Your %s account was just signed in to from a new device.\n\n"+
+			"Time: %s\nIP address: %s\nBrowser: %s\n\n"+
+			"If this wasn't you, please change your password.\n",
+			user.Username, siteName, attempt.Time.Format(time.RFC1123), attempt.IP, attempt.UserAgent)
+		return m.SendMail(user.Email, "New sign-in to your "+siteName+" account", body)
+	}
+}
+
+func (a Authorizer) loginHistoryBackend() (LoginHistoryBackend, error) {
+	hb, ok := asLoginHistoryBackend(a.backend)
+	if !ok {
+		return nil, mkerror("backend doesn't support login history")
+	}
+	return hb, nil
+}
+
+// EnableLoginHistory makes Login record every attempt by an existing user.
+// Attempts with unknown usernames are only counted by Metrics and audited, so
+// trying made up usernames can't grow the history. All but the newest
+// maxPerUser of a user's attempts are removed as new ones are recorded, and
+// every user's attempts older than maxAge are removed from time to time;
+// zero means no limit.
+func (a Authorizer) EnableLoginHistory(maxAge time.Duration, maxPerUser int) error {
+	if _, err := a.loginHistoryBackend(); err != nil {
+		return err
+	}
+	a.ext.loginHistory = true
+	a.ext.loginHistoryMaxAge = maxAge
+	a.ext.loginHistoryMaxPerUser = maxPerUser
+	return nil
+}
+
+// OnNewDevice sets a function called when a user who has logged in before
+// does so from a new IP address and user agent combination. Requires
+// EnableLoginHistory. The function is called before Login returns; errors it
+// returns are logged.
+func (a Authorizer) OnNewDevice(f NewDeviceFunc) {
+	a.ext.newDevice = f
+}
+
+// LoginHistory returns a user's login attempts, newest first, skipping offset
+// attempts and returning at most limit, as well as the total number recorded.
+func (a Authorizer) LoginHistory(username string, offset, limit int) ([]LoginAttempt, int, error) {
+	hb, err := a.loginHistoryBackend()
+	if err != nil {
+		return nil, 0, err
+	}
+	attempts, total, err := hb.LoginAttempts(username, offset, limit)
+	if err != nil {
+		return nil, 0, mkerror(err.Error())
+	}
+	return attempts, total, nil
+}
+
+// PruneLoginHistory removes every attempt older than the maximum age set
+// with EnableLoginHistory. Login does so at most every tenth of the maximum
+// age, or hour if that's shorter.
+func (a Authorizer) PruneLoginHistory() error {
+	hb, err := a.loginHistoryBackend()
+	if err != nil {
+		return err
+	}
+	if a.ext.loginHistoryMaxAge <= 0 {
+		return nil
+	}
+	if err := hb.PruneLoginAttempts("", time.Now().Add(-a.ext.loginHistoryMaxAge), 0); err != nil {
+		return mkerror(err.Error())
+	}
+	return nil
+}
+
+// loginHistoryPruning spaces out the pruning of every user's login history
+// by Login.
+type loginHistoryPruning struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// due reports whether pruning is due at now, scheduling the next one after
+// interval if it is.
+func (p *loginHistoryPruning) due(now time.Time, interval time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Before(p.next) {
+		return false
+	}
+	p.next = now.Add(interval)
+	return true
+}
+
+// recordLogin counts a login attempt and saves it, if login history is
+// enabled and the user exists, checking successful logins for new devices.
+// Failures are logged rather than failing the login.
+func (a Authorizer) recordLogin(req *http.Request, user UserData, outcome string) {
+	a.ext.metrics.login(outcome)
+	if !a.ext.loginHistory || outcome == LoginUnknownUser {
+		return
+	}
+	hb, _ := a.loginHistoryBackend()
+	attempt := LoginAttempt{
+		Username:  user.Username,
+		Time:      time.Now(),
+		IP:        remoteIP(req),
+		UserAgent: req.UserAgent(),
+		Outcome:   outcome,
+	}
+	if outcome == LoginSuccess && a.ext.newDevice != nil && !user.LastLoginAt.IsZero() {
+		known, err := hb.KnownDevice(attempt.Username, attempt.IP, attempt.UserAgent)
+		if err != nil {
+			a.ext.logger.Printf("login history: %v", err)
+		} else if !known {
+			if err := a.ext.newDevice(user, attempt); err != nil {
+				a.ext.logger.Printf("new device notification for %s: %v", user.Username, err)
+			}
+		}
+	}
+	if err := hb.SaveLoginAttempt(attempt); err != nil {
+		a.ext.logger.Printf("login history: %v", err)
+		return
+	}
+	if a.ext.loginHistoryMaxPerUser > 0 {
+		if err := hb.PruneLoginAttempts(attempt.Username, time.Time{}, a.ext.loginHistoryMaxPerUser); err != nil {
+			a.ext.logger.Printf("login history: %v", err)
+		}
+	}
+	if maxAge := a.ext.loginHistoryMaxAge; maxAge > 0 {
+		interval := maxAge / 10
+		if interval > time.Hour {
+			interval = time.Hour
+		}
+		if a.ext.loginHistoryPruning.due(attempt.Time, interval) {
+			if err := hb.PruneLoginAttempts("", attempt.Time.Add(-maxAge), 0); err != nil {
+				a.ext.logger.Printf("login history: %v", err)
+			}
+		}
+	}
+}
+
+// The following helpers implement LoginHistoryBackend for backends keeping
+// each user's attempts in memory, oldest first.
+
+func pageLoginAttempts(attempts []LoginAttempt, offset, limit int) ([]LoginAttempt, int) {
+	total := len(attempts)
+	var page []LoginAttempt
+	for i := total - 1 - offset; i >= 0 && (limit <= 0 || len(page) < limit); i-- {
+		page = append(page, attempts[i])
+	}
+	return page, total
+}
+
+func knownDevice(attempts []LoginAttempt, ip, userAgent string) bool {
+	for _, attempt := range attempts {
+		if attempt.Outcome == LoginSuccess && attempt.IP == ip && attempt.UserAgent == userAgent {
+			return true
+		}
+	}
+	return false
+}
+
+func pruneLoginAttempts(attempts []LoginAttempt, before time.Time, keep int) []LoginAttempt {
+	if !before.IsZero() {
+		i := sort.Search(len(attempts), func(i int) bool { return !attempts[i].Time.Before(before) })
+		attempts = attempts[i:]
+	}
+	if keep > 0 && len(attempts) > keep {
+		attempts = attempts[len(attempts)-keep:]
+	}
+	return append([]LoginAttempt(nil), attempts...)
+}
@@ -0,0 +1,89 @@
+package httpauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testMailer struct {
+	to, subject, body []string
+}
+
+func (m *testMailer) SendMail(to, subject, body string) error {
+	m.to = append(m.to, to)
+	m.subject = append(m.subject, subject)
+	m.body = append(m.body, body)
+	return nil
+}
+
+func TestLoginHistory(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "loginHistory_test.gob")
+	defer done()
+	if err := auth.EnableLoginHistory(time.Hour, 3); err != nil {
+		t.Fatalf("EnableLoginHistory: %v", err)
+	}
+	mailer := &testMailer{}
+	auth.OnNewDevice(NewDeviceMailer(mailer, "Example"))
+
+	login := func(ip, agent, password string) error {
+		req, _ := http.NewRequest("POST", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("User-Agent", agent)
+		return auth.Login(httptest.NewRecorder(), req, "history", password, "/")
+	}
+	testLogin(t, auth, "history", "user")
+	if len(mailer.to) != 0 {
+		t.Fatal("OnNewDevice: called for first login")
+	}
+	login("192.0.2.1", "phone", "wrong")
+	if err := login("192.0.2.1", "laptop", "password"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if len(mailer.to) != 1 || mailer.to[0] != "history@example.com" || !strings.Contains(mailer.body[0], "192.0.2.1") {
+		t.Fatalf("OnNewDevice: mail not sent: %v %v", mailer.to, mailer.body)
+	}
+	login("192.0.2.1", "laptop", "password")
+	if len(mailer.to) != 1 {
+		t.Fatal("OnNewDevice: called for known device")
+	}
+	auth.Login(httptest.NewRecorder(), requestWithCookies("POST", "/", nil), "nobody", "password", "/")
+	if _, total, _ := auth.LoginHistory("nobody", 0, 0); total != 0 {
+		t.Errorf("LoginHistory: unknown user attempt recorded")
+	}
+
+	attempts, total, err := auth.LoginHistory("history", 0, 2)
+	if err != nil {
+		t.Fatalf("LoginHistory: %v", err)
+	}
+	if total != 3 || len(attempts) != 2 {
+		t.Fatalf("LoginHistory: expected 2 of 3 attempts, got %d of %d", len(attempts), total)
+	}
+	if attempts[0].Outcome != LoginSuccess || attempts[0].IP != "192.0.2.1" || attempts[0].UserAgent != "laptop" {
+		t.Errorf("LoginHistory: newest attempt not correct: %v", attempts[0])
+	}
+	if attempts, _, _ := auth.LoginHistory("history", 2, 10); len(attempts) != 1 || attempts[0].Outcome != LoginBadPassword {
+		t.Errorf("LoginHistory: second page not correct: %v", attempts)
+	}
+	if err := auth.PruneLoginHistory(); err != nil {
+		t.Fatalf("PruneLoginHistory: %v", err)
+	}
+
+	// another user's old attempts are pruned by the next login
+	hb := auth.backend.(LoginHistoryBackend)
+	hb.SaveLoginAttempt(LoginAttempt{Username: "idle", Time: time.Now().Add(-2 * time.Hour), Outcome: LoginSuccess})
+	auth.ext.loginHistoryPruning.next = time.Time{}
+	login("192.0.2.1", "laptop", "password")
+	if _, total, _ := hb.LoginAttempts("idle", 0, 0); total != 0 {
+		t.Errorf("Login: expected other users' old attempts to be pruned, %d left", total)
+	}
+
+	if err := auth.DeleteUser("history"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, total, _ := auth.LoginHistory("history", 0, 0); total != 0 {
+		t.Errorf("DeleteUser: login history kept")
+	}
+}
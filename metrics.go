@@ -0,0 +1,204 @@
+package httpauth
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the backend
+// latency histogram buckets, as used by Prometheus client libraries.
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics counts authentication events and times backend calls, and serves
+// them in the Prometheus text exposition format:
+//
+//     httpauth_logins_total{outcome}                      login attempts, by LoginAttempt outcome
+//     httpauth_registrations_total{outcome}               Register calls, "success" or "failure"
+//     httpauth_authorization_denials_total{role}          AuthorizeRole denials, by required role
+//     httpauth_backend_duration_seconds{method}           histogram of AuthBackend call latency
+//
+// Counters are recorded once an Authorizer is given the Metrics with
+// SetMetrics, and latencies once its backend is wrapped with
+// InstrumentBackend. A Metrics is safe for concurrent use.
+type Metrics struct {
+	buckets []float64 // latency bucket upper bounds, sorted
+
+	mu            sync.Mutex
+	logins        map[string]uint64
+	registrations map[string]uint64
+	denials       map[string]uint64
+	latencies     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewMetrics returns an empty Metrics whose latency histograms use the given
+// bucket upper bounds, in seconds, or DefaultLatencyBuckets if none are given.
+// The buckets can't be changed afterwards.
+func NewMetrics(buckets ...float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Metrics{
+		buckets:       buckets,
+		logins:        make(map[string]uint64),
+		registrations: make(map[string]uint64),
+		denials:       make(map[string]uint64),
+		latencies:     make(map[string]*histogram),
+	}
+}
+
+// SetMetrics makes the Authorizer count logins, registrations and
+// authorization denials in m. Pass nil to stop.
+func (a Authorizer) SetMetrics(m *Metrics) {
+	a.ext.metrics = m
+}
+
+func (m *Metrics) inc(counter map[string]uint64, label string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	counter[label]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) login(outcome string) {
+	if m != nil {
+		m.inc(m.logins, outcome)
+	}
+}
+
+func (m *Metrics) registration(err error) {
+	if m == nil {
+		return
+	}
+	outcome := OutcomeSuccess
+	if err != nil {
+		outcome = OutcomeFailure
+	}
+	m.inc(m.registrations, outcome)
+}
+
+func (m *Metrics) denial(role string) {
+	if m != nil {
+		m.inc(m.denials, role)
+	}
+}
+
+// observe records how long a backend method took since start.
+func (m *Metrics) observe(method string, start time.Time) {
+	seconds := time.Since(start).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.latencies[method]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.latencies[method] = h
+	}
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(rw)
+}
+
+// WriteTo writes the metrics in the Prometheus text format to w.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	writeCounter(&b, "httpauth_logins_total", "Login attempts by outcome.", "outcome", m.logins)
+	writeCounter(&b, "httpauth_registrations_total", "Registrations by outcome.", "outcome", m.registrations)
+	writeCounter(&b, "httpauth_authorization_denials_total", "AuthorizeRole denials by required role.", "role", m.denials)
+
+	name := "httpauth_backend_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Latency of AuthBackend calls by method.\n", name)
+	fmt.Fprintf(&b, "# TYPE %s histogram\n", name)
+	for _, method := range sortedKeys(m.latencies) {
+		h := m.latencies[method]
+		label := labelValue(method)
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "%s_bucket{method=%s,le=\"%s\"} %d\n", name, label, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(&b, "%s_bucket{method=%s,le=\"+Inf\"} %d\n", name, label, h.count)
+		fmt.Fprintf(&b, "%s_sum{method=%s} %s\n", name, label, formatFloat(h.sum))
+		fmt.Fprintf(&b, "%s_count{method=%s} %d\n", name, label, h.count)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeCounter(b *strings.Builder, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s counter\n", name)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(b, "%s{%s=%s} %d\n", name, label, labelValue(key), values[key])
+	}
+}
+
+// sortedKeys returns the keys of a map[string]uint64 or map[string]*histogram
+// in order, so output is stable.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]uint64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*histogram:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// InstrumentBackend wraps a backend so the latency of every call is recorded
+// in m. Optional interfaces, such as GroupBackend, are passed through, and an
+// Authorizer only uses those the wrapped backend implements.
+//
+//     backend = httpauth.InstrumentBackend(backend, metrics)
+//     aaa, err := httpauth.NewAuthorizer(backend, key, "user", roles)
+//     aaa.SetMetrics(metrics)
+//     http.Handle("/metrics", metrics)
+func InstrumentBackend(backend AuthBackend, m *Metrics) AuthBackend {
+	return wrappedBackend{backend, func(method string) backendCall {
+		start := time.Now()
+		return func(err error) { m.observe(method, start) }
+	}}
+}
@@ -0,0 +1,102 @@
+package httpauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	file := "metrics_test.gob"
+	os.Remove(file)
+	if _, err := os.Create(file); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(file)
+	gob, err := NewGobFileAuthBackend(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	metrics := NewMetrics()
+	backend := InstrumentBackend(gob, metrics)
+	defer backend.Close()
+	roles := map[string]Role{"user": 40, "admin": 80}
+	auth, err := NewAuthorizer(backend, []byte("testkey"), "user", roles)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	auth.SetMetrics(metrics)
+
+	cookies := testLogin(t, auth, "measured", "user")
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", nil)
+	auth.Register(rw, req, UserData{Username: "measured", Email: "measured@example.com"}, "password")
+	auth.Login(httptest.NewRecorder(), req, "measured", "wrong", "/")
+	auth.Login(httptest.NewRecorder(), req, "nobody", "password", "/")
+	if err := auth.AuthorizeRole(rw, requestWithCookies("GET", "/", cookies), "admin", false); err == nil {
+		t.Fatal("AuthorizeRole: expected denial")
+	}
+	if err := auth.SaveGroup(Group{Name: "staff"}); err != nil {
+		t.Fatalf("SaveGroup through instrumented backend: %v", err)
+	}
+
+	rw = httptest.NewRecorder()
+	metrics.ServeHTTP(rw, req)
+	if !strings.HasPrefix(rw.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", rw.Header().Get("Content-Type"))
+	}
+	body := rw.Body.String()
+	for _, line := range []string{
+		"# TYPE httpauth_logins_total counter",
+		`httpauth_logins_total{outcome="success"} 1`,
+		`httpauth_logins_total{outcome="bad_password"} 1`,
+		`httpauth_logins_total{outcome="unknown_user"} 1`,
+		`httpauth_registrations_total{outcome="success"} 1`,
+		`httpauth_registrations_total{outcome="failure"} 1`,
+		`httpauth_authorization_denials_total{role="admin"} 1`,
+		"# TYPE httpauth_backend_duration_seconds histogram",
+		`httpauth_backend_duration_seconds_bucket{method="SaveGroup",le="+Inf"} 1`,
+		`httpauth_backend_duration_seconds_count{method="SaveGroup"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing %q:\n%s", line, body)
+		}
+	}
+	if !strings.Contains(body, `httpauth_backend_duration_seconds_bucket{method="User",le="0.005"}`) {
+		t.Errorf("metrics missing User latency buckets:\n%s", body)
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	m := NewMetrics()
+	m.denial("a \"quoted\"\\role\n")
+	var b strings.Builder
+	m.WriteTo(&b)
+	expected := `httpauth_authorization_denials_total{role="a \"quoted\"\\role\n"} 1`
+	if !strings.Contains(b.String(), expected) {
+		t.Errorf("expected %s in:\n%s", expected, b.String())
+	}
+}
+
+func TestMetricsBuckets(t *testing.T) {
+	buckets := []float64{2, 1}
+	m := NewMetrics(buckets...)
+	buckets[0] = 0
+	m.observe("User", time.Now())
+	var b strings.Builder
+	m.WriteTo(&b)
+	for _, line := range []string{
+		`httpauth_backend_duration_seconds_bucket{method="User",le="1"} 1`,
+		`httpauth_backend_duration_seconds_bucket{method="User",le="2"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("metrics missing %q:\n%s", line, b.String())
+		}
+	}
+	if &NewMetrics().buckets[0] == &DefaultLatencyBuckets[0] {
+		t.Error("NewMetrics shares DefaultLatencyBuckets")
+	}
+}
@@ -1,9 +1,13 @@
 package httpauth
 
 import (
+	"context"
 	"errors"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"strings"
+	"time"
 )
 
 // MongodbAuthBackend stores database connection information.
@@ -18,6 +22,31 @@ func (b MongodbAuthBackend) connect() *mgo.Collection {
 	return session.DB(b.database).C("goauth")
 }
 
+func (b MongodbAuthBackend) connectGroups() *mgo.Collection {
+	session := b.session.Copy()
+	return session.DB(b.database).C("goauth_groups")
+}
+
+func (b MongodbAuthBackend) connectTenants() *mgo.Collection {
+	session := b.session.Copy()
+	return session.DB(b.database).C("goauth_tenants")
+}
+
+func (b MongodbAuthBackend) connectMemberships() *mgo.Collection {
+	session := b.session.Copy()
+	return session.DB(b.database).C("goauth_tenant_members")
+}
+
+func (b MongodbAuthBackend) connectLogins() *mgo.Collection {
+	session := b.session.Copy()
+	return session.DB(b.database).C("goauth_logins")
+}
+
+func (b MongodbAuthBackend) connectWebhooks() *mgo.Collection {
+	session := b.session.Copy()
+	return session.DB(b.database).C("goauth_webhooks")
+}
+
 func mkmgoerror(msg string) error {
 	return errors.New("mongobackend: " + msg)
 }
@@ -49,6 +78,73 @@ func NewMongodbBackend(mongoURL string, database string) (b MongodbAuthBackend,
 	if err != nil {
 		return b, mkmgoerror(err.Error())
 	}
+	// Users are listed by role, looked up and sorted by email, and sorted by
+	// creation time.
+	for _, key := range [][]string{{"Role", "Username"}, {"Email", "Username"}, {"CreatedAt", "Username"}} {
+		err = session.DB(b.database).C("goauth").EnsureIndexKey(key...)
+		if err != nil {
+			return b, mkmgoerror(err.Error())
+		}
+	}
+	// Groups are stored in their own collection, with the names of member
+	// users and groups as arrays. Index members for looking up a user's
+	// groups and a group's parents.
+	err = session.DB(b.database).C("goauth_groups").EnsureIndex(mgo.Index{
+		Key:    []string{"Name"},
+		Unique: true,
+	})
+	if err != nil {
+		return b, mkmgoerror(err.Error())
+	}
+	err = session.DB(b.database).C("goauth_groups").EnsureIndexKey("Users")
+	if err != nil {
+		return b, mkmgoerror(err.Error())
+	}
+	err = session.DB(b.database).C("goauth_groups").EnsureIndexKey("Groups")
+	if err != nil {
+		return b, mkmgoerror(err.Error())
+	}
+	// Tenant memberships are documents of their own, unique per tenant and
+	// user.
+	err = session.DB(b.database).C("goauth_tenants").EnsureIndex(mgo.Index{
+		Key:    []string{"Name"},
+		Unique: true,
+	})
+	if err != nil {
+		return b, mkmgoerror(err.Error())
+	}
+	err = session.DB(b.database).C("goauth_tenant_members").EnsureIndex(mgo.Index{
+		Key:    []string{"Username", "Tenant"},
+		Unique: true,
+	})
+	if err != nil {
+		return b, mkmgoerror(err.Error())
+	}
+	err = session.DB(b.database).C("goauth_tenant_members").EnsureIndexKey("Tenant")
+	if err != nil {
+		return b, mkmgoerror(err.Error())
+	}
+	// Login attempts are listed newest first, and searched for devices a
+	// user has logged in with.
+	err = session.DB(b.database).C("goauth_logins").EnsureIndexKey("Username", "-Time")
+	if err != nil {
+		return b, mkmgoerror(err.Error())
+	}
+	err = session.DB(b.database).C("goauth_logins").EnsureIndexKey("Username", "IP", "UserAgent")
+	if err != nil {
+		return b, mkmgoerror(err.Error())
+	}
+	err = session.DB(b.database).C("goauth_webhooks").EnsureIndex(mgo.Index{
+		Key:    []string{"ID"},
+		Unique: true,
+	})
+	if err != nil {
+		return b, mkmgoerror(err.Error())
+	}
+	err = session.DB(b.database).C("goauth_webhooks").EnsureIndexKey("Dead", "CreatedAt")
+	if err != nil {
+		return b, mkmgoerror(err.Error())
+	}
 	b.session = session
 	return
 }
@@ -68,6 +164,21 @@ func (b MongodbAuthBackend) User(username string) (user UserData, e error) {
 	return result, nil
 }
 
+// UserByEmail returns the user with the given email. Error is set to
+// ErrMissingUser if no user has it.
+func (b MongodbAuthBackend) UserByEmail(email string) (user UserData, e error) {
+	c := b.connect()
+	defer c.Database.Session.Close()
+
+	err := c.Find(bson.M{"Email": NormalizeEmail(email)}).Sort("Username").One(&user)
+	if err == mgo.ErrNotFound {
+		return user, ErrMissingUser
+	} else if err != nil {
+		return user, mkmgoerror(err.Error())
+	}
+	return user, nil
+}
+
 // Users returns a slice of all users.
 func (b MongodbAuthBackend) Users() (us []UserData, e error) {
 	c := b.connect()
@@ -80,15 +191,143 @@ func (b MongodbAuthBackend) Users() (us []UserData, e error) {
 	return
 }
 
+// ForEachUser calls fn with each user, in username order, as they're read
+// from a cursor.
+func (b MongodbAuthBackend) ForEachUser(ctx context.Context, fn func(user UserData) error) error {
+	c := b.connect()
+	defer c.Database.Session.Close()
+
+	iter := c.Find(bson.M{}).Sort("Username").Iter()
+	defer iter.Close()
+	var user UserData
+	for iter.Next(&user) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return stopIteration(err)
+		}
+		user = UserData{}
+	}
+	if err := iter.Close(); err != nil {
+		return mkmgoerror(err.Error())
+	}
+	return nil
+}
+
+// userSortFields are the fields users are sorted by for each sort order,
+// followed by Username.
+var userSortFields = map[string]string{
+	SortByUsername:  "Username",
+	SortByEmail:     "Email",
+	SortByCreated:   "CreatedAt",
+	SortByLastLogin: "LastLoginAt",
+}
+
+// userQuerySelector returns the selector for the users matching a query's
+// filters, and, if after is set, following its cursor.
+func userQuerySelector(p userQueryPlan, after bool) bson.M {
+	selector := bson.M{}
+	if p.Role != "" {
+		selector["Role"] = p.Role
+	}
+	if p.UsernamePrefix != "" {
+		selector["Username"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(p.UsernamePrefix), Options: "i"}
+	}
+	if p.EmailPrefix != "" {
+		selector["Email"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(p.EmailPrefix), Options: "i"}
+	}
+	if after && p.after != nil {
+		op := "$gt"
+		if p.desc {
+			op = "$lt"
+		}
+		var key interface{} = p.after.Key
+		if p.field == SortByCreated || p.field == SortByLastLogin {
+			key = p.after.Time
+		}
+		position := bson.M{"Username": bson.M{op: p.after.Username}}
+		if field := userSortFields[p.field]; field != "Username" {
+			position = bson.M{"$or": []bson.M{
+				{field: bson.M{op: key}},
+				{field: key, "Username": bson.M{op: p.after.Username}},
+			}}
+		}
+		selector = bson.M{"$and": []bson.M{selector, position}}
+	}
+	return selector
+}
+
+// QueryUsers returns a page of the users matching a query, using the last
+// user of the previous page to find the first of the next.
+func (b MongodbAuthBackend) QueryUsers(q UserQuery) (page UserPage, e error) {
+	p, err := q.plan()
+	if err != nil {
+		return page, err
+	}
+	c := b.connect()
+	defer c.Database.Session.Close()
+
+	fields := []string{userSortFields[p.field]}
+	if p.field != SortByUsername {
+		fields = append(fields, "Username")
+	}
+	if p.desc {
+		for i := range fields {
+			fields[i] = "-" + fields[i]
+		}
+	}
+	var us []UserData
+	err = c.Find(userQuerySelector(p, true)).Sort(fields...).Limit(p.Limit + 1).All(&us)
+	if err != nil {
+		return page, mkmgoerror(err.Error())
+	}
+	return p.page(us), nil
+}
+
+// CountUsers returns the number of users matching a query's filters.
+func (b MongodbAuthBackend) CountUsers(q UserQuery) (int, error) {
+	p, err := q.filters()
+	if err != nil {
+		return 0, err
+	}
+	c := b.connect()
+	defer c.Database.Session.Close()
+
+	n, err := c.Find(userQuerySelector(p, false)).Count()
+	if err != nil {
+		return 0, mkmgoerror(err.Error())
+	}
+	return n, nil
+}
+
 // SaveUser adds a new user, replacing if the same username is in use.
 func (b MongodbAuthBackend) SaveUser(user UserData) error {
 	c := b.connect()
 	defer c.Database.Session.Close()
 
 	_, err := c.Upsert(bson.M{"Username": user.Username}, bson.M{"$set": user})
+	if mgo.IsDup(err) && strings.Contains(err.Error(), "goauth_email_unique") {
+		return ErrEmailTaken
+	}
 	return err
 }
 
+// RequireUniqueEmails adds a unique index on emails, so SaveUser fails with
+// ErrEmailTaken when another user has the email of the user saved.
+func (b MongodbAuthBackend) RequireUniqueEmails() error {
+	c := b.connect()
+	defer c.Database.Session.Close()
+
+	err := c.EnsureIndex(mgo.Index{Key: []string{"Email"}, Unique: true, Name: "goauth_email_unique"})
+	if mgo.IsDup(err) {
+		return mkmgoerror("several users have the same email")
+	} else if err != nil {
+		return mkmgoerror(err.Error())
+	}
+	return nil
+}
+
 // DeleteUser removes a user. ErrNotFound is returned if the user isn't found.
 func (b MongodbAuthBackend) DeleteUser(username string) error {
 	c := b.connect()
@@ -102,6 +341,313 @@ func (b MongodbAuthBackend) DeleteUser(username string) error {
 	return err
 }
 
+// Group returns the group with the given name. Error is set to
+// ErrMissingGroup if the group is not found.
+func (b MongodbAuthBackend) Group(name string) (group Group, e error) {
+	c := b.connectGroups()
+	defer c.Database.Session.Close()
+
+	err := c.Find(bson.M{"Name": name}).One(&group)
+	if err == mgo.ErrNotFound {
+		return group, ErrMissingGroup
+	} else if err != nil {
+		return group, mkmgoerror(err.Error())
+	}
+	return group, nil
+}
+
+// Groups returns a slice of all groups.
+func (b MongodbAuthBackend) Groups() (groups []Group, e error) {
+	c := b.connectGroups()
+	defer c.Database.Session.Close()
+
+	err := c.Find(bson.M{}).All(&groups)
+	if err != nil {
+		return groups, mkmgoerror(err.Error())
+	}
+	return
+}
+
+// UserGroupNames returns the names of the groups the user is a direct member
+// of.
+func (b MongodbAuthBackend) UserGroupNames(username string) ([]string, error) {
+	return b.groupNames(bson.M{"Users": username})
+}
+
+// ParentGroupNames returns the names of the groups the named group is directly
+// nested in.
+func (b MongodbAuthBackend) ParentGroupNames(name string) ([]string, error) {
+	return b.groupNames(bson.M{"Groups": name})
+}
+
+func (b MongodbAuthBackend) groupNames(query bson.M) ([]string, error) {
+	c := b.connectGroups()
+	defer c.Database.Session.Close()
+
+	var groups []Group
+	err := c.Find(query).Select(bson.M{"Name": 1}).All(&groups)
+	if err != nil {
+		return nil, mkmgoerror(err.Error())
+	}
+	names := make([]string, len(groups))
+	for i, group := range groups {
+		names[i] = group.Name
+	}
+	return names, nil
+}
+
+// SaveGroup adds a new group, replacing if the same name is in use.
+func (b MongodbAuthBackend) SaveGroup(group Group) error {
+	c := b.connectGroups()
+	defer c.Database.Session.Close()
+
+	_, err := c.Upsert(bson.M{"Name": group.Name}, bson.M{"$set": group})
+	return err
+}
+
+// DeleteGroup removes a group. ErrMissingGroup is returned if the group isn't
+// found.
+func (b MongodbAuthBackend) DeleteGroup(name string) error {
+	c := b.connectGroups()
+	defer c.Database.Session.Close()
+
+	err := c.Remove(bson.M{"Name": name})
+	if err == mgo.ErrNotFound {
+		return ErrMissingGroup
+	}
+	return err
+}
+
+// Tenant returns the tenant with the given name. Error is set to
+// ErrMissingTenant if the tenant is not found.
+func (b MongodbAuthBackend) Tenant(name string) (tenant Tenant, e error) {
+	c := b.connectTenants()
+	defer c.Database.Session.Close()
+
+	err := c.Find(bson.M{"Name": name}).One(&tenant)
+	if err == mgo.ErrNotFound {
+		return tenant, ErrMissingTenant
+	} else if err != nil {
+		return tenant, mkmgoerror(err.Error())
+	}
+	return tenant, nil
+}
+
+// Tenants returns a slice of all tenants.
+func (b MongodbAuthBackend) Tenants() (tenants []Tenant, e error) {
+	c := b.connectTenants()
+	defer c.Database.Session.Close()
+
+	err := c.Find(bson.M{}).All(&tenants)
+	if err != nil {
+		return tenants, mkmgoerror(err.Error())
+	}
+	return
+}
+
+// SaveTenant adds a new tenant, replacing if the same name is in use.
+func (b MongodbAuthBackend) SaveTenant(tenant Tenant) error {
+	c := b.connectTenants()
+	defer c.Database.Session.Close()
+
+	_, err := c.Upsert(bson.M{"Name": tenant.Name}, bson.M{"$set": tenant})
+	return err
+}
+
+// DeleteTenant removes a tenant and its memberships. ErrMissingTenant is
+// returned if the tenant isn't found.
+func (b MongodbAuthBackend) DeleteTenant(name string) error {
+	c := b.connectTenants()
+	defer c.Database.Session.Close()
+
+	err := c.Remove(bson.M{"Name": name})
+	if err == mgo.ErrNotFound {
+		return ErrMissingTenant
+	} else if err != nil {
+		return err
+	}
+	_, err = c.Database.C("goauth_tenant_members").RemoveAll(bson.M{"Tenant": name})
+	return err
+}
+
+// SaveMembership adds a user to a tenant, replacing their previous role.
+func (b MongodbAuthBackend) SaveMembership(m Membership) error {
+	c := b.connectMemberships()
+	defer c.Database.Session.Close()
+
+	_, err := c.Upsert(bson.M{"Tenant": m.Tenant, "Username": m.Username}, bson.M{"$set": m})
+	return err
+}
+
+// DeleteMembership removes a user from a tenant. ErrMissingMembership is
+// returned if they weren't a member.
+func (b MongodbAuthBackend) DeleteMembership(tenant string, username string) error {
+	c := b.connectMemberships()
+	defer c.Database.Session.Close()
+
+	err := c.Remove(bson.M{"Tenant": tenant, "Username": username})
+	if err == mgo.ErrNotFound {
+		return ErrMissingMembership
+	}
+	return err
+}
+
+// Memberships returns a user's tenant memberships, sorted by tenant.
+func (b MongodbAuthBackend) Memberships(username string) (memberships []Membership, e error) {
+	c := b.connectMemberships()
+	defer c.Database.Session.Close()
+
+	err := c.Find(bson.M{"Username": username}).Sort("Tenant").All(&memberships)
+	if err != nil {
+		return memberships, mkmgoerror(err.Error())
+	}
+	return
+}
+
+// TenantMembers returns a tenant's memberships, sorted by username.
+func (b MongodbAuthBackend) TenantMembers(tenant string) (memberships []Membership, e error) {
+	c := b.connectMemberships()
+	defer c.Database.Session.Close()
+
+	err := c.Find(bson.M{"Tenant": tenant}).Sort("Username").All(&memberships)
+	if err != nil {
+		return memberships, mkmgoerror(err.Error())
+	}
+	return
+}
+
+// SaveLoginAttempt records a login attempt.
+func (b MongodbAuthBackend) SaveLoginAttempt(attempt LoginAttempt) error {
+	c := b.connectLogins()
+	defer c.Database.Session.Close()
+
+	return c.Insert(attempt)
+}
+
+// LoginAttempts returns a user's login attempts, newest first.
+func (b MongodbAuthBackend) LoginAttempts(username string, offset, limit int) (attempts []LoginAttempt, total int, e error) {
+	c := b.connectLogins()
+	defer c.Database.Session.Close()
+
+	total, err := c.Find(bson.M{"Username": username}).Count()
+	if err != nil {
+		return nil, 0, mkmgoerror(err.Error())
+	}
+	q := c.Find(bson.M{"Username": username}).Sort("-Time").Skip(offset)
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	if err := q.All(&attempts); err != nil {
+		return nil, 0, mkmgoerror(err.Error())
+	}
+	return attempts, total, nil
+}
+
+// KnownDevice reports whether a user has logged in successfully from an IP
+// address with a user agent before.
+func (b MongodbAuthBackend) KnownDevice(username, ip, userAgent string) (bool, error) {
+	c := b.connectLogins()
+	defer c.Database.Session.Close()
+
+	n, err := c.Find(bson.M{"Username": username, "IP": ip, "UserAgent": userAgent, "Outcome": LoginSuccess}).Count()
+	if err != nil {
+		return false, mkmgoerror(err.Error())
+	}
+	return n > 0, nil
+}
+
+// PruneLoginAttempts removes old login attempts.
+func (b MongodbAuthBackend) PruneLoginAttempts(username string, before time.Time, keep int) error {
+	c := b.connectLogins()
+	defer c.Database.Session.Close()
+
+	if !before.IsZero() {
+		selector := bson.M{"Time": bson.M{"$lt": before}}
+		if username != "" {
+			selector["Username"] = username
+		}
+		if _, err := c.RemoveAll(selector); err != nil {
+			return mkmgoerror(err.Error())
+		}
+	}
+	if username == "" || keep <= 0 {
+		return nil
+	}
+	var oldest LoginAttempt
+	err := c.Find(bson.M{"Username": username}).Sort("-Time").Skip(keep - 1).One(&oldest)
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return mkmgoerror(err.Error())
+	}
+	_, err = c.RemoveAll(bson.M{"Username": username, "Time": bson.M{"$lt": oldest.Time}})
+	if err != nil {
+		return mkmgoerror(err.Error())
+	}
+	return nil
+}
+
+// DeleteLoginAttempts removes all of a user's login attempts.
+func (b MongodbAuthBackend) DeleteLoginAttempts(username string) error {
+	c := b.connectLogins()
+	defer c.Database.Session.Close()
+
+	if _, err := c.RemoveAll(bson.M{"Username": username}); err != nil {
+		return mkmgoerror(err.Error())
+	}
+	return nil
+}
+
+// SaveWebhookDelivery queues a webhook delivery, replacing the one with the
+// same ID.
+func (b MongodbAuthBackend) SaveWebhookDelivery(d WebhookDelivery) error {
+	c := b.connectWebhooks()
+	defer c.Database.Session.Close()
+
+	_, err := c.Upsert(bson.M{"ID": d.ID}, bson.M{"$set": d})
+	return err
+}
+
+// WebhookDelivery returns the webhook delivery with the given ID. Error is set
+// to ErrMissingDelivery if it is not found.
+func (b MongodbAuthBackend) WebhookDelivery(id string) (d WebhookDelivery, e error) {
+	c := b.connectWebhooks()
+	defer c.Database.Session.Close()
+
+	err := c.Find(bson.M{"ID": id}).One(&d)
+	if err == mgo.ErrNotFound {
+		return d, ErrMissingDelivery
+	} else if err != nil {
+		return d, mkmgoerror(err.Error())
+	}
+	return d, nil
+}
+
+// WebhookDeliveries returns pending or dead webhook deliveries, oldest first.
+func (b MongodbAuthBackend) WebhookDeliveries(dead bool) (deliveries []WebhookDelivery, e error) {
+	c := b.connectWebhooks()
+	defer c.Database.Session.Close()
+
+	err := c.Find(bson.M{"Dead": dead}).Sort("CreatedAt", "ID").All(&deliveries)
+	if err != nil {
+		return deliveries, mkmgoerror(err.Error())
+	}
+	return
+}
+
+// DeleteWebhookDelivery removes a webhook delivery, raising ErrMissingDelivery
+// if it was missing.
+func (b MongodbAuthBackend) DeleteWebhookDelivery(id string) error {
+	c := b.connectWebhooks()
+	defer c.Database.Session.Close()
+
+	err := c.Remove(bson.M{"ID": id})
+	if err == mgo.ErrNotFound {
+		return ErrMissingDelivery
+	}
+	return err
+}
+
 // Close cleans up the backend once done with. This should be called before
 // program exit.
 func (b MongodbAuthBackend) Close() {
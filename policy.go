@@ -0,0 +1,310 @@
+package httpauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Policy defaults, used when no rule matches a request.
+const (
+	PolicyAllow = "allow"
+	PolicyLogin = "login"
+	PolicyDeny  = "deny"
+)
+
+// PolicyRule maps a URL path pattern and a set of HTTP methods to the access
+// required to reach them.
+//
+// Path is matched with path.Match, unless it ends in a slash, in which case it
+// matches the whole subtree (like http.ServeMux). An empty Methods list
+// matches every method, and rules listing GET also match HEAD. Specifying a
+// Role or Permission implies Login.
+type PolicyRule struct {
+	Path       string   `json:"path" yaml:"path"`
+	Methods    []string `json:"methods,omitempty" yaml:"methods,omitempty"`
+	Login      bool     `json:"login,omitempty" yaml:"login,omitempty"`
+	Role       string   `json:"role,omitempty" yaml:"role,omitempty"`
+	Permission string   `json:"permission,omitempty" yaml:"permission,omitempty"`
+}
+
+// Policy is an ordered list of rules; the first rule matching a request
+// decides it. Default is one of PolicyAllow (the default), PolicyLogin or
+// PolicyDeny and applies to requests no rule matches. If LoginURL is set,
+// users who aren't logged in are redirected there instead of getting a 401.
+type Policy struct {
+	LoginURL string       `json:"login_url,omitempty" yaml:"login_url,omitempty"`
+	Default  string       `json:"default,omitempty" yaml:"default,omitempty"`
+	Rules    []PolicyRule `json:"rules" yaml:"rules"`
+}
+
+// LoadPolicy reads a policy file. Files ending in .yaml or .yml are parsed as
+// YAML, everything else as JSON.
+//
+// Example:
+//
+//     login_url: /login
+//     rules:
+//       - path: /admin/
+//         role: admin
+//       - path: /reports/*.csv
+//         methods: [GET]
+//         permission: reports.export
+//       - path: /account/
+//         login: true
+func LoadPolicy(filename string) (p Policy, e error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return p, mkerror("policy: " + err.Error())
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &p)
+	default:
+		err = json.Unmarshal(data, &p)
+	}
+	if err != nil {
+		return p, mkerror(fmt.Sprintf("policy: %s: %v", filename, err))
+	}
+	if err := p.validate(); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+func (p Policy) validate() error {
+	switch p.Default {
+	case "", PolicyAllow, PolicyLogin, PolicyDeny:
+	default:
+		return mkerror(fmt.Sprintf("policy: unknown default %q", p.Default))
+	}
+	for i, rule := range p.Rules {
+		if rule.Path == "" {
+			return mkerror(fmt.Sprintf("policy: rule %d has no path", i))
+		}
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return mkerror(fmt.Sprintf("policy: rule %d: %v", i, err))
+		}
+	}
+	return nil
+}
+
+func (rule PolicyRule) matches(method string, urlPath string) bool {
+	if len(rule.Methods) > 0 {
+		found := false
+		for _, m := range rule.Methods {
+			if strings.EqualFold(m, method) || (strings.EqualFold(method, "HEAD") && strings.EqualFold(m, "GET")) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if strings.HasSuffix(rule.Path, "/") {
+		return strings.HasPrefix(urlPath, rule.Path)
+	}
+	matched, _ := path.Match(rule.Path, urlPath)
+	return matched
+}
+
+// Match returns the first rule matching a method and path. If none match, a
+// rule built from the policy's default is returned and matched is false.
+func (p Policy) Match(method string, urlPath string) (rule PolicyRule, matched bool) {
+	for _, rule := range p.Rules {
+		if rule.matches(method, urlPath) {
+			return rule, true
+		}
+	}
+	return PolicyRule{Path: urlPath, Login: p.Default == PolicyLogin}, false
+}
+
+// PolicyHandler enforces a Policy loaded from a file in front of another
+// handler, typically a mux.
+//
+// In DryRun mode decisions are logged but never enforced, and no messages are
+// added to the session. Denials are also logged when enforcing.
+type PolicyHandler struct {
+	DryRun bool
+	Logger *log.Logger
+
+	auth     Authorizer
+	next     http.Handler
+	filename string
+
+	mu      sync.RWMutex
+	policy  Policy
+	modTime time.Time
+	stop    chan struct{}
+}
+
+// NewPolicyHandler loads a policy file and returns a handler enforcing it
+// before passing requests to next. Every role named in the policy must be
+// known to the Authorizer.
+func (a Authorizer) NewPolicyHandler(filename string, next http.Handler) (*PolicyHandler, error) {
+	h := &PolicyHandler{
+		Logger:   log.New(os.Stderr, "httpauth: ", log.LstdFlags),
+		auth:     a,
+		next:     next,
+		filename: filename,
+	}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reads the policy file again. The current policy is kept if the file
+// can't be loaded.
+func (h *PolicyHandler) Reload() error {
+	info, err := os.Stat(h.filename)
+	if err != nil {
+		return mkerror("policy: " + err.Error())
+	}
+	p, err := LoadPolicy(h.filename)
+	if err != nil {
+		return err
+	}
+	for i, rule := range p.Rules {
+		if _, ok := h.auth.roles[rule.Role]; rule.Role != "" && !ok {
+			return mkerror(fmt.Sprintf("policy: rule %d: role %q not found", i, rule.Role))
+		}
+	}
+	h.mu.Lock()
+	h.policy = p
+	h.modTime = info.ModTime()
+	h.mu.Unlock()
+	return nil
+}
+
+// Watch polls the policy file every interval and reloads it when its
+// modification time changes. Call Close to stop watching.
+func (h *PolicyHandler) Watch(interval time.Duration) {
+	h.mu.Lock()
+	if h.stop != nil {
+		h.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	h.stop = stop
+	h.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				info, err := os.Stat(h.filename)
+				if err != nil {
+					h.Logger.Printf("policy: %v", err)
+					continue
+				}
+				h.mu.RLock()
+				changed := !info.ModTime().Equal(h.modTime)
+				h.mu.RUnlock()
+				if !changed {
+					continue
+				}
+				if err := h.Reload(); err != nil {
+					h.Logger.Printf("policy: reload failed, keeping previous policy: %v", err)
+				} else {
+					h.Logger.Printf("policy: reloaded %s", h.filename)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops watching the policy file.
+func (h *PolicyHandler) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+}
+
+// Policy returns the policy currently being enforced.
+func (h *PolicyHandler) Policy() Policy {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.policy
+}
+
+// cleanPath returns the canonical form of a URL path, as http.ServeMux
+// routes it, so paths such as "/public/../admin" can't slip past rules.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func (h *PolicyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p := h.Policy()
+	rule, matched := p.Match(req.Method, cleanPath(req.URL.Path))
+	redirect := p.LoginURL != "" && !h.DryRun
+	auth := h.auth
+	if h.DryRun {
+		// only log decisions, without adding messages to the session
+		auth = auth.apiCopy()
+	}
+
+	var err error
+	status := http.StatusForbidden
+	denied := !matched && p.Default == PolicyDeny
+	switch {
+	case denied:
+		err = mkerror("no policy rule matched")
+	case rule.Role != "":
+		err = auth.AuthorizeRole(rw, req, rule.Role, redirect)
+	case rule.Permission != "":
+		err = auth.AuthorizePermission(rw, req, rule.Permission, redirect)
+	case rule.Login:
+		err = auth.Authorize(rw, req, redirect)
+	}
+	if err == nil {
+		if h.DryRun && (rule.Login || rule.Role != "" || rule.Permission != "") {
+			h.Logger.Printf("policy: dry run: would allow %s %s (rule %q)", req.Method, req.URL.Path, rule.Path)
+		}
+		h.next.ServeHTTP(rw, req)
+		return
+	}
+	if !denied && auth.Authorize(rw, req, false) != nil {
+		status = http.StatusUnauthorized
+	}
+
+	if h.DryRun {
+		h.Logger.Printf("policy: dry run: would deny %s %s (rule %q): %v", req.Method, req.URL.Path, rule.Path, err)
+		h.next.ServeHTTP(rw, req)
+		return
+	}
+	h.Logger.Printf("policy: denied %s %s (rule %q): %v", req.Method, req.URL.Path, rule.Path, err)
+	if status == http.StatusUnauthorized && redirect {
+		http.Redirect(rw, req, p.LoginURL, http.StatusSeeOther)
+		return
+	}
+	http.Error(rw, http.StatusText(status), status)
+}
@@ -0,0 +1,183 @@
+package httpauth
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	policyFile = "policy_test.yaml"
+	policyYAML = `
+rules:
+  - path: /admin/
+    role: admin
+  - path: /reports/*.csv
+    methods: [GET]
+    permission: reports.export
+  - path: /account/
+    login: true
+`
+)
+
+func TestLoadPolicy(t *testing.T) {
+	defer os.Remove(policyFile)
+	if err := ioutil.WriteFile(policyFile, []byte(policyYAML), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	p, err := LoadPolicy(policyFile)
+	if err != nil {
+		t.Fatalf("LoadPolicy: %v", err)
+	}
+	if len(p.Rules) != 3 {
+		t.Fatalf("LoadPolicy: expected 3 rules, got %d", len(p.Rules))
+	}
+
+	jsonFile := "policy_test.json"
+	defer os.Remove(jsonFile)
+	if err := ioutil.WriteFile(jsonFile, []byte(`{"default": "deny", "rules": [{"path": "/", "login": true}]}`), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	p, err = LoadPolicy(jsonFile)
+	if err != nil {
+		t.Fatalf("LoadPolicy: %v", err)
+	}
+	if p.Default != PolicyDeny || len(p.Rules) != 1 || !p.Rules[0].Login {
+		t.Fatalf("LoadPolicy: json policy not parsed: %+v", p)
+	}
+
+	if err := ioutil.WriteFile(jsonFile, []byte(`{"default": "sometimes"}`), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := LoadPolicy(jsonFile); err == nil {
+		t.Fatal("LoadPolicy: didn't reject unknown default")
+	}
+}
+
+func TestPolicyMatch(t *testing.T) {
+	p := Policy{Rules: []PolicyRule{
+		{Path: "/admin/", Role: "admin"},
+		{Path: "/reports/*.csv", Methods: []string{"GET"}, Permission: "reports.export"},
+	}}
+	tests := []struct {
+		method, path string
+		matched      bool
+		rule         string
+	}{
+		{"GET", "/admin/", true, "/admin/"},
+		{"POST", "/admin/users/1", true, "/admin/"},
+		{"GET", "/admin", false, ""},
+		{"get", "/reports/2016.csv", true, "/reports/*.csv"},
+		{"POST", "/reports/2016.csv", false, ""},
+		{"HEAD", "/reports/2016.csv", true, "/reports/*.csv"},
+		{"GET", "/reports/2016/q1.csv", false, ""},
+	}
+	for _, test := range tests {
+		rule, matched := p.Match(test.method, test.path)
+		if matched != test.matched {
+			t.Errorf("Match(%s, %s): matched = %v, expected %v", test.method, test.path, matched, test.matched)
+		} else if matched && rule.Path != test.rule {
+			t.Errorf("Match(%s, %s): matched rule %s, expected %s", test.method, test.path, rule.Path, test.rule)
+		}
+	}
+}
+
+func TestPolicyHandler(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "policy_test.gob")
+	defer done()
+	defer os.Remove(policyFile)
+	if err := ioutil.WriteFile(policyFile, []byte(policyYAML), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.SetRolePermissions("admin", "reports.export"); err != nil {
+		t.Fatal(err.Error())
+	}
+	userCookies := testLogin(t, auth, "policyuser", "user")
+	adminCookies := testLogin(t, auth, "policyadmin", "admin")
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+	})
+	h, err := auth.NewPolicyHandler(policyFile, next)
+	if err != nil {
+		t.Fatalf("NewPolicyHandler: %v", err)
+	}
+	var logs bytes.Buffer
+	h.Logger = log.New(&logs, "", 0)
+
+	tests := []struct {
+		method, path string
+		cookies      []*http.Cookie
+		code         int
+	}{
+		{"GET", "/", nil, http.StatusTeapot},
+		{"GET", "/account/", nil, http.StatusUnauthorized},
+		{"GET", "/account/", userCookies, http.StatusTeapot},
+		{"GET", "/admin/", userCookies, http.StatusForbidden},
+		{"GET", "/admin/", adminCookies, http.StatusTeapot},
+		{"GET", "/reports/1.csv", userCookies, http.StatusForbidden},
+		{"GET", "/reports/1.csv", adminCookies, http.StatusTeapot},
+		{"HEAD", "/reports/1.csv", userCookies, http.StatusForbidden},
+		{"HEAD", "/reports/1.csv", adminCookies, http.StatusTeapot},
+		{"GET", "/account/../admin/", userCookies, http.StatusForbidden},
+		{"GET", "/reports/./1.csv", userCookies, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, requestWithCookies(test.method, test.path, test.cookies))
+		if rw.Code != test.code {
+			t.Errorf("%s %s: got status %d, expected %d", test.method, test.path, rw.Code, test.code)
+		}
+	}
+	if !strings.Contains(logs.String(), "denied GET /admin/") {
+		t.Errorf("Denial not logged: %s", logs.String())
+	}
+
+	h.DryRun = true
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, requestWithCookies("GET", "/admin/", userCookies))
+	if rw.Code != http.StatusTeapot {
+		t.Errorf("Dry run enforced policy: got status %d", rw.Code)
+	}
+	for _, cookie := range responseCookies(rw) {
+		if cookie.Name == "messages" {
+			t.Error("Dry run added a message to the session")
+		}
+	}
+	if !strings.Contains(logs.String(), "would deny GET /admin/") {
+		t.Errorf("Dry run decision not logged: %s", logs.String())
+	}
+	h.DryRun = false
+
+	// rewrite the policy with a later modification time and wait for the
+	// watcher to pick it up
+	if err := ioutil.WriteFile(policyFile, []byte("login_url: /login\nrules:\n  - path: /admin/\n    login: true\n"), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(policyFile, later, later)
+	h.Watch(10 * time.Millisecond)
+	defer h.Close()
+	for i := 0; i < 100 && h.Policy().LoginURL == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h.Policy().LoginURL != "/login" {
+		t.Fatal("Policy not reloaded")
+	}
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, requestWithCookies("GET", "/admin/", userCookies))
+	if rw.Code != http.StatusTeapot {
+		t.Errorf("Reloaded policy not enforced: got status %d", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, requestWithCookies("GET", "/admin/", nil))
+	if rw.Code != http.StatusSeeOther || rw.Header().Get("Location") != "/login" {
+		t.Errorf("Not redirected to login: got status %d", rw.Code)
+	}
+}
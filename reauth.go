@@ -0,0 +1,82 @@
+package httpauth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrReauthRequired is returned by RequireRecentAuth when the user hasn't
+// entered their password recently enough.
+var ErrReauthRequired = mkerror("reauthentication required")
+
+// ErrImpersonating is returned when an impersonating session tries to
+// reauthenticate or change the impersonated user's credentials.
+var ErrImpersonating = mkerror("not allowed while impersonating")
+
+// Reauthenticate checks the current user's password again and, if it
+// matches, stamps their session as freshly authenticated. Impersonating
+// sessions can't be reauthenticated, so they can't pass RequireRecentAuth.
+func (a Authorizer) Reauthenticate(rw http.ResponseWriter, req *http.Request, password string) error {
+	if err := a.Authorize(rw, req, false); err != nil {
+		return err
+	}
+	authSession, _ := a.cookiejar.Get(req, "auth")
+	if err := a.refuseImpersonating(rw, req, authSession); err != nil {
+		return err
+	}
+	username, _ := authSession.Values["username"].(string)
+	user, err := a.backend.User(username)
+	if err != nil {
+		return mkerror(err.Error())
+	}
+	if err := bcrypt.CompareHashAndPassword(user.Hash, []byte(password)); err != nil {
+		a.addMessage(rw, req, "Invalid password.")
+		return ErrWrongPassword
+	}
+	authSession.Values["authenticated_at"] = time.Now().Unix()
+	if err := authSession.Save(req, rw); err != nil {
+		return mkerror(err.Error())
+	}
+	return nil
+}
+
+// RequireRecentAuth runs Authorize on a user, then makes sure they logged in
+// or called Reauthenticate within maxAge. Use it to guard sensitive operations
+// such as changing credentials or deleting an account. ErrReauthRequired is
+// returned, and a message added, if the check is too old, and
+// ErrImpersonating while impersonating.
+func (a Authorizer) RequireRecentAuth(rw http.ResponseWriter, req *http.Request, maxAge time.Duration) error {
+	if err := a.Authorize(rw, req, false); err != nil {
+		return err
+	}
+	authSession, _ := a.cookiejar.Get(req, "auth")
+	if err := a.refuseImpersonating(rw, req, authSession); err != nil {
+		return err
+	}
+	stamp, ok := authSession.Values["authenticated_at"].(int64)
+	if !ok || time.Since(time.Unix(stamp, 0)) > maxAge {
+		a.addMessage(rw, req, "Please confirm your password to do that.")
+		return ErrReauthRequired
+	}
+	return nil
+}
+
+// RequireReauthForUpdates makes Update require a password check within maxAge
+// (see RequireRecentAuth) before users change their own password or email.
+// Zero disables the requirement, which is the default.
+func (a Authorizer) RequireReauthForUpdates(maxAge time.Duration) {
+	a.ext.reauthMaxAge = maxAge
+}
+
+// refuseImpersonating returns ErrImpersonating, and adds a message, if the
+// session is impersonating another user.
+func (a Authorizer) refuseImpersonating(rw http.ResponseWriter, req *http.Request, authSession *sessions.Session) error {
+	if _, ok := authSession.Values["impersonator"]; ok {
+		a.addMessage(rw, req, "You can't do that while impersonating.")
+		return ErrImpersonating
+	}
+	return nil
+}
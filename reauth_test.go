@@ -0,0 +1,52 @@
+package httpauth
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReauthenticate(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "reauth_test.gob")
+	defer done()
+	cookies := testLogin(t, auth, "reauthuser", "user")
+
+	rw := httptest.NewRecorder()
+	req := requestWithCookies("POST", "/", cookies)
+	if err := auth.RequireRecentAuth(rw, req, time.Minute); err != nil {
+		t.Fatalf("RequireRecentAuth: fresh login not accepted: %v", err)
+	}
+
+	auth.RequireReauthForUpdates(time.Minute)
+	if err := auth.Update(rw, req, "", "", "new@example.com"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	// age the session's stamp
+	authSession, _ := auth.cookiejar.Get(req, "auth")
+	authSession.Values["authenticated_at"] = time.Now().Add(-time.Hour).Unix()
+	if err := auth.RequireRecentAuth(rw, req, time.Minute); err != ErrReauthRequired {
+		t.Fatalf("RequireRecentAuth: expected ErrReauthRequired, got %v", err)
+	}
+	if err := auth.Update(rw, req, "", "newpassword", ""); err != ErrReauthRequired {
+		t.Fatalf("Update: expected ErrReauthRequired, got %v", err)
+	}
+	if err := auth.Update(rw, req, "reauthuser", "", "admin@example.com"); err != nil {
+		t.Fatalf("Update: admin updates shouldn't need reauthentication: %v", err)
+	}
+
+	if err := auth.Reauthenticate(rw, req, "wrongpassword"); err == nil {
+		t.Fatal("Reauthenticate: accepted wrong password")
+	}
+	rw = httptest.NewRecorder()
+	if err := auth.Reauthenticate(rw, req, "password"); err != nil {
+		t.Fatalf("Reauthenticate: %v", err)
+	}
+	req = requestWithCookies("POST", "/", responseCookies(rw))
+	if err := auth.RequireRecentAuth(rw, req, time.Minute); err != nil {
+		t.Fatalf("RequireRecentAuth: reauthentication not accepted: %v", err)
+	}
+	if err := auth.Update(rw, req, "", "newpassword", ""); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+}
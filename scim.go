@@ -0,0 +1,891 @@
+package httpauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCIM schema and message URNs.
+const (
+	SCIMUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SCIMGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSPCSchema   = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+)
+
+// Page sizes of SCIM list responses.
+const (
+	defaultSCIMCount = 100
+	maxSCIMCount     = 1000
+)
+
+// scimAttributes are the SCIM user attributes kept in a user's Attributes,
+// and their keys there.
+var scimAttributes = []struct{ path, key string }{
+	{"externalId", "externalId"},
+	{"displayName", "displayName"},
+	{"name.givenName", "givenName"},
+	{"name.familyName", "familyName"},
+	{"name.formatted", "formattedName"},
+}
+
+// SCIMServer is a SCIM 2.0 (RFC 7643 and 7644) service provider, letting an
+// identity provider create, update, deactivate and delete users. It serves,
+// under a path prefix:
+//
+//     prefix+"Users"                  list (with filter, startIndex and count)
+//                                     and create users
+//     prefix+"Users/{id}"             get, replace (PUT), PATCH and delete a user
+//     prefix+"Groups"                 list groups
+//     prefix+"Groups/{id}"            get, replace (PUT) and PATCH a group
+//     prefix+"ServiceProviderConfig"  the features supported
+//
+// A user's id and userName are their username, which can't be changed.
+// emails map to Email, active to whether their Status is disabled, and roles
+// to their Role. externalId, displayName and name.givenName, familyName and
+// formatted are kept in Attributes, as externalId, displayName, givenName,
+// familyName and formattedName. Users created without a password get a
+// random one.
+//
+// Groups are the roles defined; they can't be created or deleted. Adding a
+// user to a group sets their role to it, and removing them sets them back to
+// the default role.
+//
+// Requests must bear a token added with AddToken, as
+// "Authorization: Bearer <token>". Changes are audited with "scim-token:"
+// followed by the first 8 hex digits of the token's SHA-256 as actor.
+type SCIMServer struct {
+	a      Authorizer
+	prefix string
+	tokens map[[sha256.Size]byte]bool
+}
+
+// SCIMHandler returns a SCIM service provider to be mounted at prefix, which
+// should end with a slash:
+//
+//     scim := aaa.SCIMHandler("/scim/v2/")
+//     scim.AddToken(os.Getenv("SCIM_TOKEN"))
+//     http.Handle("/scim/v2/", scim)
+func (a Authorizer) SCIMHandler(prefix string) *SCIMServer {
+	return &SCIMServer{a: a, prefix: prefix, tokens: make(map[[sha256.Size]byte]bool)}
+}
+
+// AddToken allows requests bearing token. Only its hash is kept. Tokens
+// should be added before the server starts handling requests.
+func (s *SCIMServer) AddToken(token string) {
+	s.tokens[sha256.Sum256([]byte(token))] = true
+}
+
+func (s *SCIMServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	auth := req.Header.Get("Authorization")
+	sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+	if !strings.HasPrefix(auth, "Bearer ") || !s.tokens[sum] {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="SCIM"`)
+		writeSCIMError(rw, http.StatusUnauthorized, "", "invalid or missing bearer token")
+		return
+	}
+	a := s.a.apiCopy().actingAs(req, "scim-token:"+hex.EncodeToString(sum[:4]))
+	path := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, s.prefix), "/"), "/")
+	var allowed string
+	switch {
+	case len(path) == 1 && path[0] == "Users":
+		switch req.Method {
+		case "GET":
+			s.listUsers(a, rw, req)
+		case "POST":
+			s.createUser(a, rw, req)
+		default:
+			allowed = "GET, POST"
+		}
+	case len(path) == 2 && path[0] == "Users":
+		switch req.Method {
+		case "GET":
+			if user, ok := s.loadUser(a, rw, path[1]); ok {
+				writeSCIM(rw, http.StatusOK, project(s.userResource(user), req))
+			}
+		case "PUT", "PATCH":
+			s.updateUser(a, rw, req, path[1])
+		case "DELETE":
+			if _, ok := s.loadUser(a, rw, path[1]); !ok {
+				return
+			}
+			if err := a.DeleteUser(path[1]); err != nil {
+				s.writeError(a, rw, err)
+				return
+			}
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			allowed = "GET, PUT, PATCH, DELETE"
+		}
+	case len(path) == 1 && path[0] == "Groups":
+		switch req.Method {
+		case "GET":
+			s.listGroups(a, rw, req)
+		case "POST":
+			writeSCIMError(rw, http.StatusForbidden, "mutability", "groups are the roles defined by the application")
+		default:
+			allowed = "GET"
+		}
+	case len(path) == 2 && path[0] == "Groups":
+		switch req.Method {
+		case "GET":
+			if group, ok := s.loadGroup(a, rw, req, path[1]); ok {
+				writeSCIM(rw, http.StatusOK, project(group, req))
+			}
+		case "PUT", "PATCH":
+			s.updateGroup(a, rw, req, path[1])
+		case "DELETE":
+			writeSCIMError(rw, http.StatusForbidden, "mutability", "groups are the roles defined by the application")
+		default:
+			allowed = "GET, PUT, PATCH"
+		}
+	case len(path) == 1 && path[0] == "ServiceProviderConfig" && req.Method == "GET":
+		writeSCIM(rw, http.StatusOK, serviceProviderConfig)
+	default:
+		writeSCIMError(rw, http.StatusNotFound, "", "no such endpoint")
+	}
+	if allowed != "" {
+		rw.Header().Set("Allow", allowed)
+		writeSCIMError(rw, http.StatusMethodNotAllowed, "", "method not allowed")
+	}
+}
+
+var serviceProviderConfig = map[string]interface{}{
+	"schemas":        []interface{}{scimSPCSchema},
+	"patch":          map[string]interface{}{"supported": true},
+	"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+	"filter":         map[string]interface{}{"supported": true, "maxResults": maxSCIMCount},
+	"changePassword": map[string]interface{}{"supported": true},
+	"sort":           map[string]interface{}{"supported": false},
+	"etag":           map[string]interface{}{"supported": false},
+	"authenticationSchemes": []interface{}{map[string]interface{}{
+		"type": "oauthbearertoken", "name": "Bearer token", "description": "Authentication with a bearer token",
+	}},
+}
+
+func (s *SCIMServer) listUsers(a Authorizer, rw http.ResponseWriter, req *http.Request) {
+	list, ok := newSCIMList(rw, req)
+	if !ok {
+		return
+	}
+	q, exact := scimUserQuery(list.filter)
+	if exact {
+		q.Limit = list.start - 1 + list.count
+	} else {
+		q.Limit = MaxUserQueryLimit
+	}
+	for {
+		if err := req.Context().Err(); err != nil {
+			s.writeError(a, rw, mkerror(err.Error()))
+			return
+		}
+		page, err := a.QueryUsers(q)
+		if err != nil {
+			s.writeError(a, rw, err)
+			return
+		}
+		for _, user := range page.Users {
+			list.add(s.userResource(user))
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		if exact && list.full() {
+			// the rest only adds to totalResults
+			if list.total, err = a.CountUsers(q); err != nil {
+				s.writeError(a, rw, err)
+				return
+			}
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	list.write(rw)
+}
+
+// scimUserQuery returns a query for the users a filter can match, built from
+// the userName and emails conditions every match must meet. exact reports
+// whether the query selects exactly the users the filter matches.
+func scimUserQuery(filter scimFilter) (q UserQuery, exact bool) {
+	switch f := filter.(type) {
+	case nil:
+		return q, true
+	case scimCompare:
+		value, ok := f.value.(string)
+		if !ok || value == "" || (f.op != "eq" && f.op != "sw") {
+			return q, false
+		}
+		switch path := strings.ToLower(strings.Join(f.path, ".")); path {
+		case "username":
+			q.UsernamePrefix = value
+		case "emails", "emails.value":
+			q.EmailPrefix = value
+		default:
+			return q, false
+		}
+		return q, f.op == "sw"
+	case scimLogical:
+		if f.op != "and" {
+			return q, false
+		}
+		left, leftExact := scimUserQuery(f.left)
+		right, rightExact := scimUserQuery(f.right)
+		q, exact = left, leftExact && rightExact
+		if right.UsernamePrefix != "" {
+			q.UsernamePrefix, exact = right.UsernamePrefix, exact && left.UsernamePrefix == ""
+		}
+		if right.EmailPrefix != "" {
+			q.EmailPrefix, exact = right.EmailPrefix, exact && left.EmailPrefix == ""
+		}
+		return q, exact
+	}
+	return q, false
+}
+
+func (s *SCIMServer) listGroups(a Authorizer, rw http.ResponseWriter, req *http.Request) {
+	list, ok := newSCIMList(rw, req)
+	if !ok {
+		return
+	}
+	members, err := roleMembers(a, req, "")
+	if err != nil {
+		s.writeError(a, rw, mkerror(err.Error()))
+		return
+	}
+	for _, role := range a.Roles() {
+		list.add(s.groupResource(role.Name, members[role.Name]))
+	}
+	list.write(rw)
+}
+
+// scimList collects the page of resources matching a list request's filter,
+// startIndex and count.
+type scimList struct {
+	req          *http.Request
+	filter       scimFilter
+	start, count int
+	total        int
+	page         []interface{}
+}
+
+// newSCIMList reads a list request's parameters, responding with an error if
+// they're invalid.
+func newSCIMList(rw http.ResponseWriter, req *http.Request) (*scimList, bool) {
+	query := req.URL.Query()
+	list := &scimList{req: req, start: 1, count: defaultSCIMCount, page: []interface{}{}}
+	if f := query.Get("filter"); f != "" {
+		var err error
+		if list.filter, err = parseSCIMFilter(f); err != nil {
+			writeSCIMError(rw, http.StatusBadRequest, "invalidFilter", errorMessage(err))
+			return nil, false
+		}
+	}
+	if n, err := strconv.Atoi(query.Get("startIndex")); err == nil && n > 1 {
+		list.start = n
+	}
+	if n, err := strconv.Atoi(query.Get("count")); err == nil {
+		list.count = n
+		if list.count < 0 {
+			list.count = 0
+		} else if list.count > maxSCIMCount {
+			list.count = maxSCIMCount
+		}
+	}
+	return list, true
+}
+
+// add counts a resource if it matches the filter, keeping it if it's on the
+// page requested.
+func (l *scimList) add(resource map[string]interface{}) {
+	if l.filter != nil && !l.filter.match(resource) {
+		return
+	}
+	l.total++
+	if l.total >= l.start && len(l.page) < l.count {
+		l.page = append(l.page, project(resource, l.req))
+	}
+}
+
+// full reports whether the page requested is complete.
+func (l *scimList) full() bool {
+	return l.total >= l.start-1+l.count
+}
+
+func (l *scimList) write(rw http.ResponseWriter) {
+	writeSCIM(rw, http.StatusOK, map[string]interface{}{
+		"schemas":      []interface{}{scimListSchema},
+		"totalResults": l.total,
+		"startIndex":   l.start,
+		"itemsPerPage": len(l.page),
+		"Resources":    l.page,
+	})
+}
+
+func (s *SCIMServer) createUser(a Authorizer, rw http.ResponseWriter, req *http.Request) {
+	var resource map[string]interface{}
+	if !decodeJSON(rw, req, &resource) {
+		return
+	}
+	username, _ := scimAttribute(resource, []string{"userName"}).(string)
+	if username == "" {
+		writeSCIMError(rw, http.StatusBadRequest, "invalidValue", "userName is required")
+		return
+	}
+	patch, err := s.userPatch(UserData{Username: username}, resource)
+	if err != nil {
+		writeSCIMError(rw, http.StatusBadRequest, "invalidValue", errorMessage(err))
+		return
+	}
+	if msg := patch.validate(a); msg != "" {
+		writeSCIMError(rw, http.StatusBadRequest, "invalidValue", msg)
+		return
+	}
+	user := UserData{Username: username}
+	if patch.Email != nil {
+		user.Email = *patch.Email
+	}
+	if patch.Role != nil {
+		user.Role = *patch.Role
+	}
+	if patch.Status != nil && *patch.Status == StatusDisabled {
+		user.Status, user.StatusReason = StatusDisabled, patch.StatusReason
+	}
+	for key, value := range patch.Attributes {
+		if value != "" {
+			if user.Attributes == nil {
+				user.Attributes = make(Attributes)
+			}
+			user.Attributes[key] = value
+		}
+	}
+	var password string
+	if patch.Password != nil {
+		password = *patch.Password
+	} else {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			s.writeError(a, rw, mkerror(err.Error()))
+			return
+		}
+		password = base64.RawURLEncoding.EncodeToString(b)
+	}
+	if err := a.Register(rw, req, user, password); err != nil {
+		s.writeError(a, rw, err)
+		return
+	}
+	if user, ok := s.loadUser(a, rw, username); ok {
+		rw.Header().Set("Location", s.location("Users", username))
+		writeSCIM(rw, http.StatusCreated, s.userResource(user))
+	}
+}
+
+// updateUser handles PUT, replacing a user, and PATCH.
+func (s *SCIMServer) updateUser(a Authorizer, rw http.ResponseWriter, req *http.Request, id string) {
+	var body map[string]interface{}
+	if !decodeJSON(rw, req, &body) {
+		return
+	}
+	user, ok := s.loadUser(a, rw, id)
+	if !ok {
+		return
+	}
+	resource := body
+	if req.Method == "PATCH" {
+		resource = s.userResource(user)
+		if err := applySCIMPatch(resource, body); err != nil {
+			writeSCIMError(rw, http.StatusBadRequest, "invalidValue", errorMessage(err))
+			return
+		}
+	}
+	patch, err := s.userPatch(user, resource)
+	if err != nil {
+		writeSCIMError(rw, http.StatusBadRequest, "mutability", errorMessage(err))
+		return
+	}
+	if msg := patch.validate(a); msg != "" {
+		writeSCIMError(rw, http.StatusBadRequest, "invalidValue", msg)
+		return
+	}
+	if err := a.applyPatch(rw, req, user, patch); err != nil {
+		s.writeError(a, rw, err)
+		return
+	}
+	if user, ok := s.loadUser(a, rw, id); ok {
+		writeSCIM(rw, http.StatusOK, s.userResource(user))
+	}
+}
+
+// userPatch returns the changes making a user match a SCIM resource. Left
+// out emails, passwords, active and roles are unchanged.
+func (s *SCIMServer) userPatch(user UserData, resource map[string]interface{}) (APIUserPatch, error) {
+	var patch APIUserPatch
+	if name, _ := scimAttribute(resource, []string{"userName"}).(string); name != "" && name != user.Username {
+		return patch, mkerror("userName can't be changed")
+	}
+	if email := scimPrimaryValue(resource, "emails"); email != "" && email != user.Email {
+		patch.Email = &email
+	}
+	if password, _ := scimAttribute(resource, []string{"password"}).(string); password != "" {
+		patch.Password = &password
+	}
+	active := true
+	switch v := scimAttribute(resource, []string{"active"}).(type) {
+	case bool:
+		active = v
+	case string:
+		// some providers send "True" and "False"
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return patch, mkerror("active must be a boolean")
+		}
+		active = b
+	case nil:
+		active = user.Status != StatusDisabled
+	}
+	if active != (user.Status != StatusDisabled) {
+		status := StatusActive
+		if !active {
+			status = StatusDisabled
+			patch.StatusReason = "deactivated through SCIM"
+		}
+		patch.Status = &status
+	}
+	if role := scimPrimaryValue(resource, "roles"); role != "" && role != user.Role {
+		patch.Role = &role
+	}
+	for _, attr := range scimAttributes {
+		// attributes left out are cleared
+		v := scimAttribute(resource, scimPath(attr.path))
+		value, ok := v.(string)
+		if v != nil && !ok {
+			return patch, mkerror(attr.path + " must be a string")
+		}
+		if current := user.Attributes[attr.key]; value != current {
+			if patch.Attributes == nil {
+				patch.Attributes = make(Attributes)
+			}
+			patch.Attributes[attr.key] = value
+		}
+	}
+	return patch, nil
+}
+
+func (s *SCIMServer) updateGroup(a Authorizer, rw http.ResponseWriter, req *http.Request, id string) {
+	var body map[string]interface{}
+	if !decodeJSON(rw, req, &body) {
+		return
+	}
+	group, ok := s.loadGroup(a, rw, req, id)
+	if !ok {
+		return
+	}
+	before := scimValues(group, []string{"members", "value"})
+	resource := body
+	if req.Method == "PATCH" {
+		resource = group
+		if err := applySCIMPatch(resource, body); err != nil {
+			writeSCIMError(rw, http.StatusBadRequest, "invalidValue", errorMessage(err))
+			return
+		}
+	}
+	if name, _ := scimAttribute(resource, []string{"displayName"}).(string); name != "" && name != id {
+		writeSCIMError(rw, http.StatusBadRequest, "mutability", "groups can't be renamed")
+		return
+	}
+	after := scimValues(resource, []string{"members", "value"})
+
+	members := make(map[string]bool)
+	for _, v := range after {
+		username, _ := v.(string)
+		if _, err := a.backend.User(username); err != nil {
+			writeSCIMError(rw, http.StatusBadRequest, "invalidValue", "no such user "+strconv.Quote(username))
+			return
+		}
+		members[username] = true
+	}
+	current := make(map[string]bool)
+	for _, v := range before {
+		username, _ := v.(string)
+		current[username] = true
+		if !members[username] && id != a.defaultRole {
+			if err := a.SetUserRole(username, a.defaultRole); err != nil {
+				s.writeError(a, rw, err)
+				return
+			}
+		}
+	}
+	for username := range members {
+		if !current[username] {
+			if err := a.SetUserRole(username, id); err != nil {
+				s.writeError(a, rw, err)
+				return
+			}
+		}
+	}
+	if group, ok := s.loadGroup(a, rw, req, id); ok {
+		writeSCIM(rw, http.StatusOK, group)
+	}
+}
+
+func (s *SCIMServer) loadUser(a Authorizer, rw http.ResponseWriter, id string) (UserData, bool) {
+	user, err := a.backend.User(id)
+	if err == ErrMissingUser {
+		writeSCIMError(rw, http.StatusNotFound, "", "no such user")
+		return user, false
+	} else if err != nil {
+		s.writeError(a, rw, mkerror(err.Error()))
+		return user, false
+	}
+	return user, true
+}
+
+func (s *SCIMServer) loadGroup(a Authorizer, rw http.ResponseWriter, req *http.Request, id string) (map[string]interface{}, bool) {
+	if _, ok := a.roles[id]; !ok {
+		writeSCIMError(rw, http.StatusNotFound, "", "no such group")
+		return nil, false
+	}
+	members, err := roleMembers(a, req, id)
+	if err != nil {
+		s.writeError(a, rw, mkerror(err.Error()))
+		return nil, false
+	}
+	return s.groupResource(id, members[id]), true
+}
+
+// roleMembers returns the usernames of the users holding each role defined,
+// or only role if it isn't empty.
+func roleMembers(a Authorizer, req *http.Request, role string) (map[string][]string, error) {
+	roles := []string{role}
+	if role == "" {
+		roles = roles[:0]
+		for name := range a.roles {
+			roles = append(roles, name)
+		}
+	}
+	members := make(map[string][]string)
+	for _, role := range roles {
+		q := UserQuery{Role: role, Limit: MaxUserQueryLimit}
+		for {
+			if err := req.Context().Err(); err != nil {
+				return nil, err
+			}
+			page, err := a.QueryUsers(q)
+			if err != nil {
+				return nil, err
+			}
+			for _, user := range page.Users {
+				members[role] = append(members[role], user.Username)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+	}
+	return members, nil
+}
+
+func (s *SCIMServer) location(kind string, id string) string {
+	return s.prefix + kind + "/" + url.PathEscape(id)
+}
+
+// userResource returns the SCIM representation of a user, as it would be
+// decoded from JSON.
+func (s *SCIMServer) userResource(user UserData) map[string]interface{} {
+	resource := map[string]interface{}{
+		"schemas":  []interface{}{SCIMUserSchema},
+		"id":       user.Username,
+		"userName": user.Username,
+		"active":   user.Status != StatusDisabled,
+		"roles":    []interface{}{map[string]interface{}{"value": user.Role, "primary": true}},
+		"groups": []interface{}{map[string]interface{}{
+			"value": user.Role, "display": user.Role, "$ref": s.location("Groups", user.Role),
+		}},
+		"meta": map[string]interface{}{
+			"resourceType": "User",
+			"created":      user.CreatedAt.UTC().Format(time.RFC3339),
+			"lastModified": user.UpdatedAt.UTC().Format(time.RFC3339),
+			"location":     s.location("Users", user.Username),
+			"version":      "W/" + userETag(user),
+		},
+	}
+	if user.Email != "" {
+		resource["emails"] = []interface{}{map[string]interface{}{"value": user.Email, "type": "work", "primary": true}}
+	}
+	for _, attr := range scimAttributes {
+		if value, ok := user.Attributes[attr.key]; ok {
+			setSCIMAttribute(resource, scimPath(attr.path), value)
+		}
+	}
+	return resource
+}
+
+// groupResource returns the SCIM representation of a role.
+func (s *SCIMServer) groupResource(role string, usernames []string) map[string]interface{} {
+	members := []interface{}{}
+	for _, username := range usernames {
+		members = append(members, map[string]interface{}{
+			"value": username, "display": username, "$ref": s.location("Users", username),
+		})
+	}
+	return map[string]interface{}{
+		"schemas":     []interface{}{SCIMGroupSchema},
+		"id":          role,
+		"displayName": role,
+		"members":     members,
+		"meta":        map[string]interface{}{"resourceType": "Group", "location": s.location("Groups", role)},
+	}
+}
+
+// project applies a request's attributes and excludedAttributes parameters to
+// a resource. id, schemas and meta are always kept.
+func project(resource map[string]interface{}, req *http.Request) map[string]interface{} {
+	include, exclude := req.URL.Query().Get("attributes"), req.URL.Query().Get("excludedAttributes")
+	if include == "" && exclude == "" {
+		return resource
+	}
+	listed := func(list string, key string) bool {
+		for _, attr := range strings.Split(list, ",") {
+			if strings.EqualFold(scimPath(strings.TrimSpace(attr))[0], key) {
+				return true
+			}
+		}
+		return false
+	}
+	projected := make(map[string]interface{})
+	for key, value := range resource {
+		always := key == "id" || key == "schemas" || key == "meta"
+		if always || ((include == "" || listed(include, key)) && !listed(exclude, key)) {
+			projected[key] = value
+		}
+	}
+	return projected
+}
+
+// scimPrimaryValue returns the value of the primary, or else first, item of a
+// multi-valued attribute. Items may be plain values.
+func scimPrimaryValue(resource map[string]interface{}, attr string) string {
+	items, _ := scimAttribute(resource, []string{attr}).([]interface{})
+	var first string
+	for i, item := range items {
+		var value string
+		primary := false
+		switch item := item.(type) {
+		case string:
+			value = item
+		case map[string]interface{}:
+			value, _ = scimAttribute(item, []string{"value"}).(string)
+			primary, _ = scimAttribute(item, []string{"primary"}).(bool)
+		}
+		if primary {
+			return value
+		}
+		if i == 0 {
+			first = value
+		}
+	}
+	return first
+}
+
+// setSCIMAttribute sets the attribute at a path, creating complex attributes
+// along the way. Names are matched ignoring case.
+func setSCIMAttribute(resource map[string]interface{}, path []string, value interface{}) {
+	for _, name := range path[:len(path)-1] {
+		next, ok := resource[scimKey(resource, name)].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			resource[scimKey(resource, name)] = next
+		}
+		resource = next
+	}
+	resource[scimKey(resource, path[len(path)-1])] = value
+}
+
+// scimKey returns the key of a resource matching name ignoring case, or name.
+func scimKey(resource map[string]interface{}, name string) string {
+	for key := range resource {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
+// applySCIMPatch applies the operations of a PatchOp request to a resource.
+func applySCIMPatch(resource map[string]interface{}, body map[string]interface{}) error {
+	ops, ok := scimAttribute(body, []string{"Operations"}).([]interface{})
+	if !ok {
+		return mkerror("Operations missing")
+	}
+	for _, o := range ops {
+		op, ok := o.(map[string]interface{})
+		if !ok {
+			return mkerror("invalid operation")
+		}
+		name, _ := scimAttribute(op, []string{"op"}).(string)
+		path, _ := scimAttribute(op, []string{"path"}).(string)
+		value := scimAttribute(op, []string{"value"})
+		name = strings.ToLower(name)
+		if name != "add" && name != "replace" && name != "remove" {
+			return mkerror("unknown operation " + strconv.Quote(name))
+		}
+		if path == "" {
+			values, ok := value.(map[string]interface{})
+			if !ok || name == "remove" {
+				return mkerror("operations without a path need an object value")
+			}
+			for key, v := range values {
+				if err := patchSCIMAttribute(resource, name, key, v); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := patchSCIMAttribute(resource, name, path, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchSCIMAttribute applies one operation to the attribute at a path, which
+// may select values of a multi-valued attribute with a filter, as in
+// emails[type eq "work"].value.
+func patchSCIMAttribute(resource map[string]interface{}, op string, path string, value interface{}) error {
+	var filter scimFilter
+	var sub string
+	if i := strings.Index(path, "["); i >= 0 {
+		j := strings.LastIndex(path, "]")
+		if j < i {
+			return mkerror("invalid path " + strconv.Quote(path))
+		}
+		var err error
+		if filter, err = parseSCIMFilter(path[i+1 : j]); err != nil {
+			return err
+		}
+		sub = strings.TrimPrefix(path[j+1:], ".")
+		path = path[:i]
+	}
+	attr := scimPath(path)
+	current := scimAttribute(resource, attr)
+	items, multi := current.([]interface{})
+	if filter == nil {
+		switch {
+		case op == "remove" && multi && value != nil:
+			// remove the values given
+			removed := make(map[interface{}]bool)
+			for _, v := range scimValues(value, nil) {
+				removed[v] = true
+			}
+			kept := []interface{}{}
+			for _, item := range items {
+				if values := scimValues(item, nil); len(values) != 1 || !removed[values[0]] {
+					kept = append(kept, item)
+				}
+			}
+			setSCIMAttribute(resource, attr, kept)
+		case op == "remove":
+			removeSCIMAttribute(resource, attr)
+		case op == "add" && multi:
+			added, ok := value.([]interface{})
+			if !ok {
+				added = []interface{}{value}
+			}
+			setSCIMAttribute(resource, attr, append(items, added...))
+		default:
+			setSCIMAttribute(resource, attr, value)
+		}
+		return nil
+	}
+	if !multi {
+		return mkerror(path + " isn't multi-valued")
+	}
+	var kept []interface{}
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok || !filter.match(item) {
+			kept = append(kept, item)
+			continue
+		}
+		switch {
+		case op == "remove" && sub == "":
+			// dropped
+		case op == "remove":
+			delete(m, scimKey(m, sub))
+			kept = append(kept, m)
+		case sub == "":
+			if replacement, ok := value.(map[string]interface{}); ok {
+				for key, v := range replacement {
+					m[scimKey(m, key)] = v
+				}
+			}
+			kept = append(kept, m)
+		default:
+			m[scimKey(m, sub)] = value
+			kept = append(kept, m)
+		}
+	}
+	if kept == nil {
+		kept = []interface{}{}
+	}
+	setSCIMAttribute(resource, attr, kept)
+	return nil
+}
+
+// removeSCIMAttribute removes the attribute at a path.
+func removeSCIMAttribute(resource map[string]interface{}, path []string) {
+	for _, name := range path[:len(path)-1] {
+		next, ok := resource[scimKey(resource, name)].(map[string]interface{})
+		if !ok {
+			return
+		}
+		resource = next
+	}
+	delete(resource, scimKey(resource, path[len(path)-1]))
+}
+
+// writeError responds with the SCIM error describing an error returned by an
+// Authorizer method.
+func (s *SCIMServer) writeError(a Authorizer, rw http.ResponseWriter, err error) {
+	state := apiState{}
+	if a.api != nil {
+		state = *a.api
+	}
+	status, e := apiError(err, state)
+	scimType := ""
+	switch status {
+	case http.StatusConflict:
+		scimType = "uniqueness"
+	case http.StatusBadRequest:
+		scimType = "invalidValue"
+	}
+	writeSCIMError(rw, status, scimType, e.Message)
+}
+
+func writeSCIM(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/scim+json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func writeSCIMError(rw http.ResponseWriter, status int, scimType string, detail string) {
+	body := map[string]interface{}{
+		"schemas": []interface{}{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	writeSCIM(rw, status, body)
+}
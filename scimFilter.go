@@ -0,0 +1,393 @@
+package httpauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// scimFilter is a parsed SCIM filter (RFC 7644, section 3.4.2.2), matched
+// against resources decoded from JSON.
+type scimFilter interface {
+	match(resource interface{}) bool
+}
+
+type (
+	scimCompare struct {
+		path  []string
+		op    string // eq, ne, co, sw, ew, gt, ge, lt, le or pr
+		value interface{}
+	}
+	scimLogical struct {
+		op          string // and or or
+		left, right scimFilter
+	}
+	scimNot       struct{ operand scimFilter }
+	scimValuePath struct {
+		path   []string
+		filter scimFilter // matched against each value
+	}
+)
+
+// SCIM filter token kinds
+const (
+	scimTokEOF = iota
+	scimTokWord
+	scimTokValue
+	scimTokPunct
+)
+
+type scimToken struct {
+	kind  int
+	text  string
+	value interface{}
+	pos   int
+}
+
+func mkscimfiltererror(source string, pos int, msg string) error {
+	return mkerror(fmt.Sprintf("filter %q: %s at %d", source, msg, pos))
+}
+
+func lexSCIMFilter(source string) ([]scimToken, error) {
+	var tokens []scimToken
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, scimToken{scimTokPunct, string(c), nil, i})
+			i++
+		case c == '"':
+			start := i
+			j := i + 1
+			for ; j < len(source) && source[j] != '"'; j++ {
+				if source[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(source) {
+				return nil, mkscimfiltererror(source, start, "unterminated string")
+			}
+			var value string
+			if err := json.Unmarshal([]byte(source[start:j+1]), &value); err != nil {
+				return nil, mkscimfiltererror(source, start, "invalid string")
+			}
+			tokens = append(tokens, scimToken{scimTokValue, source[start : j+1], value, start})
+			i = j + 1
+		default:
+			start := i
+			for i < len(source) && !unicode.IsSpace(rune(source[i])) && !strings.ContainsRune("()[]\"", rune(source[i])) {
+				i++
+			}
+			word := source[start:i]
+			var value interface{}
+			if json.Unmarshal([]byte(word), &value) == nil {
+				// true, false, null or a number
+				tokens = append(tokens, scimToken{scimTokValue, word, value, start})
+			} else {
+				tokens = append(tokens, scimToken{scimTokWord, word, nil, start})
+			}
+		}
+	}
+	return append(tokens, scimToken{scimTokEOF, "", nil, len(source)}), nil
+}
+
+type scimParser struct {
+	source string
+	tokens []scimToken
+	pos    int
+}
+
+func (p *scimParser) peek() scimToken {
+	return p.tokens[p.pos]
+}
+
+func (p *scimParser) next() scimToken {
+	t := p.tokens[p.pos]
+	if t.kind != scimTokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes a keyword, compared ignoring case, or punctuation.
+func (p *scimParser) accept(text string) bool {
+	if t := p.peek(); (t.kind == scimTokWord || t.kind == scimTokPunct) && strings.EqualFold(t.text, text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *scimParser) expect(text string) error {
+	if !p.accept(text) {
+		t := p.peek()
+		return mkscimfiltererror(p.source, t.pos, fmt.Sprintf("expected %q", text))
+	}
+	return nil
+}
+
+// parseSCIMFilter parses a SCIM filter expression.
+func parseSCIMFilter(source string) (scimFilter, error) {
+	tokens, err := lexSCIMFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimParser{source: source, tokens: tokens}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != scimTokEOF {
+		return nil, mkscimfiltererror(source, t.pos, fmt.Sprintf("unexpected %q", t.text))
+	}
+	return filter, nil
+}
+
+func (p *scimParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = scimLogical{"or", left, right}
+	}
+	return left, nil
+}
+
+func (p *scimParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = scimLogical{"and", left, right}
+	}
+	return left, nil
+}
+
+func (p *scimParser) parseNot() (scimFilter, error) {
+	if p.accept("not") {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return scimNot{operand}, p.expect(")")
+	}
+	return p.parsePrimary()
+}
+
+func (p *scimParser) parsePrimary() (scimFilter, error) {
+	if p.accept("(") {
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return filter, p.expect(")")
+	}
+	t := p.next()
+	if t.kind != scimTokWord {
+		if t.kind == scimTokEOF {
+			return nil, mkscimfiltererror(p.source, t.pos, "unexpected end")
+		}
+		return nil, mkscimfiltererror(p.source, t.pos, fmt.Sprintf("expected an attribute, got %q", t.text))
+	}
+	path := scimPath(t.text)
+	if p.accept("[") {
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return scimValuePath{path, filter}, p.expect("]")
+	}
+	op := p.next()
+	if op.kind != scimTokWord {
+		return nil, mkscimfiltererror(p.source, op.pos, "expected an operator")
+	}
+	switch strings.ToLower(op.text) {
+	case "pr":
+		return scimCompare{path, "pr", nil}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+		value := p.next()
+		if value.kind != scimTokValue {
+			return nil, mkscimfiltererror(p.source, value.pos, "expected a value")
+		}
+		return scimCompare{path, strings.ToLower(op.text), value.value}, nil
+	}
+	return nil, mkscimfiltererror(p.source, op.pos, fmt.Sprintf("unknown operator %q", op.text))
+}
+
+// scimPath splits an attribute path, dropping any schema URN prefix, such as
+// "urn:ietf:params:scim:schemas:core:2.0:User:".
+func scimPath(attr string) []string {
+	if i := strings.LastIndex(attr, ":"); i >= 0 {
+		attr = attr[i+1:]
+	}
+	return strings.Split(attr, ".")
+}
+
+// scimValues returns the values at a path in a resource, flattening
+// multi-valued attributes. Attribute names are matched ignoring case, and a
+// multi-valued complex attribute without a sub-attribute stands for its
+// "value"s.
+func scimValues(v interface{}, path []string) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		var values []interface{}
+		for _, item := range list {
+			values = append(values, scimValues(item, path)...)
+		}
+		return values
+	}
+	if len(path) == 0 {
+		if m, ok := v.(map[string]interface{}); ok {
+			if value, ok := m["value"]; ok {
+				return []interface{}{value}
+			}
+		}
+		if v == nil {
+			return nil
+		}
+		return []interface{}{v}
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for key, value := range m {
+		if strings.EqualFold(key, path[0]) {
+			return scimValues(value, path[1:])
+		}
+	}
+	return nil
+}
+
+// scimAttribute returns the attribute at a path, without flattening it.
+func scimAttribute(v interface{}, path []string) interface{} {
+	for _, name := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = nil
+		for key, value := range m {
+			if strings.EqualFold(key, name) {
+				v = value
+			}
+		}
+	}
+	return v
+}
+
+func (f scimCompare) match(resource interface{}) bool {
+	values := scimValues(resource, f.path)
+	if f.op == "pr" {
+		for _, v := range values {
+			if s, ok := v.(string); !ok || s != "" {
+				return true
+			}
+		}
+		return false
+	}
+	if f.value == nil {
+		// eq null means not present
+		return (f.op == "eq") == (len(values) == 0)
+	}
+	if f.op == "ne" {
+		return !(scimCompare{f.path, "eq", f.value}).match(resource)
+	}
+	for _, v := range values {
+		if scimCompareValues(v, f.op, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimCompareValues compares an attribute value with a filter's. Strings are
+// compared ignoring case.
+func scimCompareValues(v interface{}, op string, want interface{}) bool {
+	switch want := want.(type) {
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		s, want = strings.ToLower(s), strings.ToLower(want)
+		switch op {
+		case "eq":
+			return s == want
+		case "co":
+			return strings.Contains(s, want)
+		case "sw":
+			return strings.HasPrefix(s, want)
+		case "ew":
+			return strings.HasSuffix(s, want)
+		case "gt":
+			return s > want
+		case "ge":
+			return s >= want
+		case "lt":
+			return s < want
+		case "le":
+			return s <= want
+		}
+	case float64:
+		n, ok := v.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return n == want
+		case "gt":
+			return n > want
+		case "ge":
+			return n >= want
+		case "lt":
+			return n < want
+		case "le":
+			return n <= want
+		}
+	case bool:
+		return op == "eq" && v == want
+	}
+	return false
+}
+
+func (f scimLogical) match(resource interface{}) bool {
+	if f.op == "and" {
+		return f.left.match(resource) && f.right.match(resource)
+	}
+	return f.left.match(resource) || f.right.match(resource)
+}
+
+func (f scimNot) match(resource interface{}) bool {
+	return !f.operand.match(resource)
+}
+
+func (f scimValuePath) match(resource interface{}) bool {
+	v := scimAttribute(resource, f.path)
+	items, ok := v.([]interface{})
+	if !ok {
+		items = []interface{}{v}
+	}
+	for _, item := range items {
+		if item != nil && f.filter.match(item) {
+			return true
+		}
+	}
+	return false
+}
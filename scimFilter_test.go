@@ -0,0 +1,69 @@
+package httpauth
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSCIMFilter(t *testing.T) {
+	var resource interface{}
+	json.Unmarshal([]byte(`{
+		"userName": "Bjensen",
+		"active": true,
+		"name": {"familyName": "Jensen", "givenName": "Barbara"},
+		"emails": [
+			{"value": "bjensen@example.com", "type": "work", "primary": true},
+			{"value": "babs@jensen.org", "type": "home"}
+		],
+		"meta": {"created": "2011-08-01T18:29:49Z", "lastModified": "2011-08-01T21:32:44Z"},
+		"score": 7
+	}`), &resource)
+	for filter, want := range map[string]bool{
+		`userName eq "bjensen"`: true,
+		`username Eq "BJENSEN"`: true,
+		`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "bj"`: true,
+		`userName ne "bjensen"`:                              false,
+		`name.familyName co "ens"`:                           true,
+		`name.givenName ew "ara"`:                            true,
+		`emails co "jensen.org"`:                             true,
+		`emails.type eq "home"`:                              true,
+		`emails[type eq "work" and value co "@example.com"]`: true,
+		`emails[type eq "home" and value co "@example.com"]`: false,
+		`title pr`:                      false,
+		`name pr and active eq true`:    true,
+		`active eq false or score gt 5`: true,
+		`score ge 8`:                    false,
+		`meta.lastModified gt "2011-05-13T04:42:34Z"`:              true,
+		`meta.created lt "2011-01-01T00:00:00Z"`:                   false,
+		`title eq null`:                                            true,
+		`not (userName eq "bjensen")`:                              false,
+		`userName eq "x" or (active eq true and not (score lt 3))`: true,
+		`userName eq "x" or userName eq "y" and active eq true`:    false,
+	} {
+		f, err := parseSCIMFilter(filter)
+		if err != nil {
+			t.Errorf("%s: %v", filter, err)
+			continue
+		}
+		if got := f.match(resource); got != want {
+			t.Errorf("%s: expected %v, got %v", filter, want, got)
+		}
+	}
+
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName foo "x"`,
+		`userName eq "unterminated`,
+		`(userName eq "x"`,
+		`emails[type eq "work"`,
+		`userName eq "x" and`,
+		`"x" eq userName`,
+		`not userName eq "x"`,
+	} {
+		if _, err := parseSCIMFilter(filter); err == nil {
+			t.Errorf("%q: expected an error", filter)
+		}
+	}
+}
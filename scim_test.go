@@ -0,0 +1,202 @@
+package httpauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSCIMServer(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "scim_test.gob")
+	defer done()
+	scim := auth.SCIMHandler("/scim/v2/")
+	scim.AddToken("directory-token")
+
+	call := func(method string, path string, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(method, "/scim/v2/"+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer directory-token")
+		rw := httptest.NewRecorder()
+		scim.ServeHTTP(rw, req)
+		if ct := rw.Header().Get("Content-Type"); rw.Body.Len() > 0 && ct != "application/scim+json" {
+			t.Errorf("%s %s: Content-Type %s", method, path, ct)
+		}
+		var resource map[string]interface{}
+		json.Unmarshal(rw.Body.Bytes(), &resource)
+		return rw.Code, resource
+	}
+	get := func(resource map[string]interface{}, path string) interface{} {
+		return scimAttribute(resource, scimPath(path))
+	}
+
+	req, _ := http.NewRequest("GET", "/scim/v2/Users", nil)
+	rw := httptest.NewRecorder()
+	scim.ServeHTTP(rw, req)
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("request without token: %d", rw.Code)
+	}
+
+	status, user := call("POST", "Users", `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "bjensen",
+		"externalId": "701984",
+		"name": {"givenName": "Barbara", "familyName": "Jensen"},
+		"emails": [{"value": "babs@home.example", "type": "home"}, {"value": "bjensen@example.com", "type": "work", "primary": true}],
+		"active": true
+	}`)
+	if status != http.StatusCreated || get(user, "id") != "bjensen" || get(user, "name.givenName") != "Barbara" {
+		t.Fatalf("create: %d %v", status, user)
+	}
+	stored, _ := auth.backend.User("bjensen")
+	if stored.Email != "bjensen@example.com" || stored.Attributes["externalId"] != "701984" || stored.Role != "user" || len(stored.Hash) == 0 {
+		t.Errorf("stored user: %+v", stored)
+	}
+	if status, body := call("POST", "Users", `{"userName": "bjensen", "emails": [{"value": "x@example.com"}]}`); status != http.StatusConflict || body["scimType"] != "uniqueness" {
+		t.Errorf("duplicate: %d %v", status, body)
+	}
+	if status, _ := call("POST", "Users", `{"userName": "noemail"}`); status != http.StatusBadRequest {
+		t.Errorf("user without email created: %d", status)
+	}
+	call("POST", "Users", `{"userName": "jsmith", "emails": [{"value": "jsmith@example.com"}], "password": "secret", "roles": [{"value": "admin"}]}`)
+	if err := auth.Login(httptest.NewRecorder(), requestWithCookies("POST", "/", nil), "jsmith", "secret", "/"); err != nil {
+		t.Errorf("password not set: %v", err)
+	}
+
+	status, list := call("GET", "Users?filter="+url.QueryEscape(`emails[type eq "work" and value ew "@example.com"] and name.familyName eq "jensen"`), "")
+	if status != http.StatusOK || list["totalResults"] != 1.0 {
+		t.Errorf("filtered list: %d %v", status, list)
+	}
+	if _, list = call("GET", "Users?startIndex=2&count=1&attributes=userName", ""); list["totalResults"] != 2.0 || list["itemsPerPage"] != 1.0 {
+		t.Errorf("paged list: %v", list)
+	} else if r := list["Resources"].([]interface{})[0].(map[string]interface{}); r["userName"] != "jsmith" || r["emails"] != nil || r["id"] != "jsmith" {
+		t.Errorf("projected resource: %v", r)
+	}
+	if _, list = call("GET", "Users?filter="+url.QueryEscape(`userName sw "BJ" and emails eq "bjensen@example.com"`), ""); list["totalResults"] != 1.0 {
+		t.Errorf("list filtered by userName: %v", list)
+	}
+	if _, list = call("GET", "Users?count=1", ""); list["totalResults"] != 2.0 || list["itemsPerPage"] != 1.0 {
+		t.Errorf("counted list: %v", list)
+	}
+	if status, body := call("GET", "Users?filter="+url.QueryEscape(`userName eq`), ""); status != http.StatusBadRequest || body["scimType"] != "invalidFilter" {
+		t.Errorf("bad filter: %d %v", status, body)
+	}
+
+	status, user = call("PATCH", "Users/bjensen", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [
+			{"op": "Replace", "path": "emails[type eq \"work\"].value", "value": "barbara@example.com"},
+			{"op": "remove", "path": "externalId"},
+			{"op": "add", "value": {"displayName": "Babs", "name.familyName": "Jensen-Smith"}},
+			{"op": "replace", "path": "active", "value": "False"}
+		]
+	}`)
+	stored, _ = auth.backend.User("bjensen")
+	if status != http.StatusOK || stored.Email != "barbara@example.com" || stored.Status != StatusDisabled || get(user, "active") != false {
+		t.Errorf("patch: %d %+v", status, stored)
+	}
+	if _, ok := stored.Attributes["externalId"]; ok || stored.Attributes["displayName"] != "Babs" || stored.Attributes["familyName"] != "Jensen-Smith" || stored.Attributes["givenName"] != "Barbara" {
+		t.Errorf("patched attributes: %v", stored.Attributes)
+	}
+	if status, _ := call("PATCH", "Users/bjensen", `{"Operations": [{"op": "replace", "path": "userName", "value": "other"}]}`); status != http.StatusBadRequest {
+		t.Errorf("userName changed: %d", status)
+	}
+
+	status, _ = call("PUT", "Users/bjensen", `{"userName": "bjensen", "emails": [{"value": "barbara@example.com"}], "active": true, "name": {"givenName": "Barbara"}}`)
+	stored, _ = auth.backend.User("bjensen")
+	if status != http.StatusOK || stored.Status != StatusActive || stored.Attributes["displayName"] != "" || stored.Attributes["givenName"] != "Barbara" {
+		t.Errorf("put: %d %+v", status, stored)
+	}
+
+	status, group := call("GET", "Groups/admin", "")
+	if status != http.StatusOK || len(get(group, "members").([]interface{})) != 1 {
+		t.Errorf("admin group: %d %v", status, group)
+	}
+	status, group = call("PATCH", "Groups/admin", `{"Operations": [
+		{"op": "add", "path": "members", "value": [{"value": "bjensen"}]},
+		{"op": "remove", "path": "members[value eq \"jsmith\"]"}
+	]}`)
+	if status != http.StatusOK {
+		t.Errorf("patch group: %d %v", status, group)
+	}
+	if u, _ := auth.backend.User("bjensen"); u.Role != "admin" {
+		t.Errorf("member not added: %s", u.Role)
+	}
+	if u, _ := auth.backend.User("jsmith"); u.Role != "user" {
+		t.Errorf("member not removed: %s", u.Role)
+	}
+	if _, list = call("GET", "Groups?filter="+url.QueryEscape(`members.value eq "bjensen"`)+"&excludedAttributes=members", ""); list["totalResults"] != 1.0 {
+		t.Errorf("group filter: %v", list)
+	} else if g := list["Resources"].([]interface{})[0].(map[string]interface{}); g["id"] != "admin" || g["members"] != nil {
+		t.Errorf("group resource: %v", g)
+	}
+	if status, _ = call("PATCH", "Groups/admin", `{"Operations": [{"op": "add", "path": "members", "value": [{"value": "nobody"}]}]}`); status != http.StatusBadRequest {
+		t.Errorf("missing member added: %d", status)
+	}
+	if status, _ = call("DELETE", "Groups/admin", ""); status != http.StatusForbidden {
+		t.Errorf("group deleted: %d", status)
+	}
+
+	if status, _ = call("DELETE", "Users/bjensen", ""); status != http.StatusNoContent {
+		t.Errorf("delete: %d", status)
+	}
+	if status, _ = call("GET", "Users/bjensen", ""); status != http.StatusNotFound {
+		t.Errorf("deleted user found: %d", status)
+	}
+	if status, config := call("GET", "ServiceProviderConfig", ""); status != http.StatusOK || get(config, "patch.supported") != true {
+		t.Errorf("ServiceProviderConfig: %d %v", status, config)
+	}
+}
+
+func TestSCIMAuditActor(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "scim_test.gob")
+	defer done()
+	scim := auth.SCIMHandler("/scim/v2/")
+	scim.AddToken("directory-token")
+	sink := &memoryAuditSink{}
+	auth.AddAuditSink(sink)
+
+	req, _ := http.NewRequest("POST", "/scim/v2/Users", strings.NewReader(`{"userName": "provisioned", "emails": [{"value": "provisioned@example.com"}]}`))
+	req.Header.Set("Authorization", "Bearer directory-token")
+	rw := httptest.NewRecorder()
+	scim.ServeHTTP(rw, req)
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rw.Code, rw.Body.String())
+	}
+	sum := sha256.Sum256([]byte("directory-token"))
+	if actor := "scim-token:" + hex.EncodeToString(sum[:4]); len(sink.events) != 1 || sink.events[0].Actor != actor {
+		t.Errorf("expected %s to be audited as the actor, got %v", actor, sink.events)
+	}
+}
+
+func TestSCIMUserQuery(t *testing.T) {
+	tests := []struct {
+		filter string
+		query  UserQuery
+		exact  bool
+	}{
+		{"", UserQuery{}, true},
+		{`userName sw "bj"`, UserQuery{UsernamePrefix: "bj"}, true},
+		{`userName eq "bjensen"`, UserQuery{UsernamePrefix: "bjensen"}, false},
+		{`emails.value sw "b" and userName sw "bj"`, UserQuery{UsernamePrefix: "bj", EmailPrefix: "b"}, true},
+		{`userName sw "b" and userName sw "bj"`, UserQuery{UsernamePrefix: "bj"}, false},
+		{`userName sw "bj" or userName sw "js"`, UserQuery{}, false},
+		{`emails sw ""`, UserQuery{}, false},
+		{`active eq true`, UserQuery{}, false},
+	}
+	for _, test := range tests {
+		var filter scimFilter
+		if test.filter != "" {
+			var err error
+			if filter, err = parseSCIMFilter(test.filter); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if q, exact := scimUserQuery(filter); q != test.query || exact != test.exact {
+			t.Errorf("scimUserQuery(%s): expected %+v, %v, got %+v, %v", test.filter, test.query, test.exact, q, exact)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+//go:build go1.21
+// +build go1.21
+
+package httpauth
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogAuditSink logs audit events with log/slog. Failures are logged at
+// LevelWarn and everything else at LevelInfo.
+type SlogAuditSink struct {
+	Logger *slog.Logger
+}
+
+// Audit logs an event with the message "audit" and each field as an
+// attribute.
+func (s SlogAuditSink) Audit(e AuditEvent) error {
+	level := slog.LevelInfo
+	if e.Outcome == OutcomeFailure {
+		level = slog.LevelWarn
+	}
+	attrs := []slog.Attr{
+		slog.Time("time", e.Time),
+		slog.String("actor", e.Actor),
+		slog.String("target", e.Target),
+		slog.String("action", e.Action),
+		slog.String("outcome", e.Outcome),
+	}
+	if e.Reason != "" {
+		attrs = append(attrs, slog.String("reason", e.Reason))
+	}
+	if e.IP != "" {
+		attrs = append(attrs, slog.String("ip", e.IP))
+	}
+	s.Logger.LogAttrs(context.Background(), level, "audit", attrs...)
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build go1.21
+// +build go1.21
+
+package httpauth
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlogAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := SlogAuditSink{slog.New(slog.NewTextHandler(&buf, nil))}
+	sink.Audit(AuditEvent{Time: time.Now(), Actor: "actor", Target: "target", Action: ActionLogin, Outcome: OutcomeFailure, Reason: "bad password"})
+	out := buf.String()
+	for _, s := range []string{"level=WARN", "msg=audit", "actor=actor", "action=login", `reason="bad password"`} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Log output missing %s: %s", s, out)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package httpauth
+
+import (
+	"database/sql"
+)
+
+// SqlAuditSink stores audit events in a table called goauth_audit.
+type SqlAuditSink struct {
+	insertStmt *sql.Stmt
+}
+
+// NewSqlAuditSink creates the goauth_audit table in a database if it doesn't
+// exist. driverName is the name db was opened with, as for NewSqlAuthBackend;
+// the database can be the same one users are stored in.
+func NewSqlAuditSink(db *sql.DB, driverName string) (s SqlAuditSink, e error) {
+	_, err := db.Exec(`create table if not exists goauth_audit (Time bigint, Actor varchar(255), Target varchar(255), Action varchar(255), Outcome varchar(255), Reason text, IP varchar(255))`)
+	if err != nil {
+		return s, mksqlerror(err.Error())
+	}
+	s.insertStmt, err = db.Prepare(rebind(driverName, `insert into goauth_audit (Time, Actor, Target, Action, Outcome, Reason, IP) values (?, ?, ?, ?, ?, ?, ?)`))
+	if err != nil {
+		return s, mksqlerror(err.Error())
+	}
+	return s, nil
+}
+
+// Audit inserts an event. Times are stored in nanoseconds since the epoch.
+func (s SqlAuditSink) Audit(e AuditEvent) error {
+	_, err := s.insertStmt.Exec(e.Time.UnixNano(), e.Actor, e.Target, e.Action, e.Outcome, e.Reason, e.IP)
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// Close releases the sink's prepared statement. The database isn't closed.
+func (s SqlAuditSink) Close() {
+	s.insertStmt.Close()
+}
@@ -0,0 +1,39 @@
+package httpauth
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSqlAuditSink(t *testing.T) {
+	os.Create("./httpauth_test_audit.db")
+	defer os.Remove("./httpauth_test_audit.db")
+	db, err := sql.Open("sqlite3", "./httpauth_test_audit.db")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	sink, err := NewSqlAuditSink(db, "sqlite3")
+	if err != nil {
+		t.Fatalf("NewSqlAuditSink: %v", err)
+	}
+	defer sink.Close()
+	now := time.Now()
+	if err := sink.Audit(AuditEvent{now, "actor", "target", ActionLogin, OutcomeFailure, "bad password", "192.0.2.1"}); err != nil {
+		t.Fatalf("Audit: %v", err)
+	}
+
+	var (
+		e  AuditEvent
+		t0 int64
+	)
+	err = db.QueryRow(`select Time, Actor, Target, Action, Outcome, Reason, IP from goauth_audit`).Scan(&t0, &e.Actor, &e.Target, &e.Action, &e.Outcome, &e.Reason, &e.IP)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if t0 != now.UnixNano() || e.Actor != "actor" || e.Target != "target" || e.Action != ActionLogin || e.Outcome != OutcomeFailure || e.Reason != "bad password" || e.IP != "192.0.2.1" {
+		t.Fatalf("Event not stored properly: %d %v", t0, e)
+	}
+}
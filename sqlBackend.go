@@ -1,10 +1,15 @@
 package httpauth
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"strings"
+	"time"
 )
 
 // SqlAuthBackend database and database connection information.
@@ -15,19 +20,189 @@ type SqlAuthBackend struct {
 
 	// prepared statements
 	userStmt   *sql.Stmt
+	emailStmt  *sql.Stmt
 	usersStmt  *sql.Stmt
 	insertStmt *sql.Stmt
 	updateStmt *sql.Stmt
 	deleteStmt *sql.Stmt
+
+	groupStmt         *sql.Stmt
+	groupsStmt        *sql.Stmt
+	membersStmt       *sql.Stmt
+	allMembersStmt    *sql.Stmt
+	memberOfStmt      *sql.Stmt
+	insertGroupStmt   *sql.Stmt
+	updateGroupStmt   *sql.Stmt
+	deleteGroupStmt   *sql.Stmt
+	insertMemberStmt  *sql.Stmt
+	deleteMembersStmt *sql.Stmt
+
+	tenantStmt            *sql.Stmt
+	tenantsStmt           *sql.Stmt
+	insertTenantStmt      *sql.Stmt
+	updateTenantStmt      *sql.Stmt
+	deleteTenantStmt      *sql.Stmt
+	membershipStmt        *sql.Stmt
+	membershipsStmt       *sql.Stmt
+	tenantMembersStmt     *sql.Stmt
+	insertMembershipStmt  *sql.Stmt
+	updateMembershipStmt  *sql.Stmt
+	deleteMembershipStmt  *sql.Stmt
+	deleteMembershipsStmt *sql.Stmt
+
+	insertLoginStmt    *sql.Stmt
+	loginsStmt         *sql.Stmt
+	countLoginsStmt    *sql.Stmt
+	knownDeviceStmt    *sql.Stmt
+	nthLoginStmt       *sql.Stmt
+	pruneLoginsStmt    *sql.Stmt
+	pruneAllLoginsStmt *sql.Stmt
+	deleteLoginsStmt   *sql.Stmt
+
+	webhookStmt       *sql.Stmt
+	webhooksStmt      *sql.Stmt
+	insertWebhookStmt *sql.Stmt
+	updateWebhookStmt *sql.Stmt
+	deleteWebhookStmt *sql.Stmt
 }
 
 func mksqlerror(msg string) error {
 	return errors.New("sqlbackend: " + msg)
 }
 
+// userColumns are the goauth columns added after the original Username, Email,
+// Hash and Role. They're added to existing tables when a backend is opened.
+var userColumns = []struct{ name, definition string }{
+	{"Status", "varchar(255) not null default ''"},
+	{"StatusReason", "varchar(255) not null default ''"},
+	{"LockedUntil", "bigint not null default 0"},
+	{"ExpiresAt", "bigint not null default 0"},
+	{"Attributes", "text"}, // JSON object
+	{"CreatedAt", "bigint not null default 0"},
+	{"UpdatedAt", "bigint not null default 0"},
+	{"LastLoginAt", "bigint not null default 0"},
+	{"LastLoginIP", "varchar(255) not null default ''"},
+	{"PasswordChangedAt", "bigint not null default 0"},
+	{"FailedLoginCount", "int not null default 0"},
+	{"Version", "int not null default 0"},
+}
+
+// userFields lists the goauth columns in the order scanUser reads them and
+// userValues returns them.
+var userFields = []string{"Username", "Email", "Hash", "Role",
+	"Status", "StatusReason", "LockedUntil", "ExpiresAt", "Attributes",
+	"CreatedAt", "UpdatedAt", "LastLoginAt", "LastLoginIP", "PasswordChangedAt", "FailedLoginCount",
+	"Version"}
+
+// addMissingColumns adds columns a table created by an older version of this
+// package doesn't have.
+func (b SqlAuthBackend) addMissingColumns(table string, columns []struct{ name, definition string }) error {
+	for _, column := range columns {
+		rows, err := b.db.Query(fmt.Sprintf(`select %s from %s where 1 = 0`, column.name, table))
+		if err == nil {
+			rows.Close()
+			continue
+		}
+		_, err = b.db.Exec(fmt.Sprintf(`alter table %s add column %s %s`, table, column.name, column.definition))
+		if err != nil {
+			return fmt.Errorf("adding column %s to %s: %v", column.name, table, err)
+		}
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser reads a user selected with userFields.
+func scanUser(row rowScanner) (user UserData, e error) {
+	var (
+		lockedUntil, expiresAt, created, updated, lastLogin, passwordChanged int64
+		attributes                                                           sql.NullString
+	)
+	err := row.Scan(&user.Username, &user.Email, &user.Hash, &user.Role,
+		&user.Status, &user.StatusReason, &lockedUntil, &expiresAt, &attributes,
+		&created, &updated, &lastLogin, &user.LastLoginIP, &passwordChanged, &user.FailedLoginCount,
+		&user.Version)
+	if err != nil {
+		return user, err
+	}
+	user.LockedUntil = fromUnix(lockedUntil)
+	user.ExpiresAt = fromUnix(expiresAt)
+	user.CreatedAt = fromUnix(created)
+	user.UpdatedAt = fromUnix(updated)
+	user.LastLoginAt = fromUnix(lastLogin)
+	user.PasswordChangedAt = fromUnix(passwordChanged)
+	if attributes.Valid && attributes.String != "" {
+		if err := json.Unmarshal([]byte(attributes.String), &user.Attributes); err != nil {
+			return user, err
+		}
+	}
+	return user, nil
+}
+
+// userValues returns the values of a user's userFields columns.
+func userValues(user UserData) ([]interface{}, error) {
+	var attributes sql.NullString
+	if len(user.Attributes) > 0 {
+		data, err := json.Marshal(user.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		attributes = sql.NullString{String: string(data), Valid: true}
+	}
+	return []interface{}{user.Username, user.Email, user.Hash, user.Role,
+		user.Status, user.StatusReason, toUnix(user.LockedUntil), toUnix(user.ExpiresAt), attributes,
+		toUnix(user.CreatedAt), toUnix(user.UpdatedAt), toUnix(user.LastLoginAt), user.LastLoginIP,
+		toUnix(user.PasswordChangedAt), user.FailedLoginCount, user.Version}, nil
+}
+
+// toUnix converts a time to seconds since the epoch, storing the zero time as
+// zero.
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// prepare prepares a statement written with ? placeholders.
+//
+// NOTE:
+// I don't want to have to check if it's postgres, but postgres uses
+// different tokens for placeholders. :( Also be aware that postgres
+// lowercases all these column names.
+//
+// Thanks to mjhall for letting me know about this.
+func (b SqlAuthBackend) prepare(query string) (*sql.Stmt, error) {
+	return b.db.Prepare(rebind(b.driverName, query))
+}
+
+// rebind rewrites ? placeholders for drivers using other tokens.
+func rebind(driverName string, query string) string {
+	if driverName == "postgres" {
+		parts := strings.Split(query, "?")
+		query = parts[0]
+		for i, part := range parts[1:] {
+			query += fmt.Sprintf("$%d", i+1) + part
+		}
+	}
+	return query
+}
+
 // NewSqlAuthBackend initializes a new backend by testing the database
-// connection and making sure the storage table exists. The table is called
-// goauth.
+// connection and making sure the storage tables exist. Users are stored in a
+// table called goauth, groups in goauth_groups and goauth_group_members,
+// tenants in goauth_tenants and goauth_tenant_members, login attempts in
+// goauth_logins, and queued webhooks in goauth_webhooks.
 //
 // Returns an error if connecting to the database fails, pinging the database
 // fails, or creating the table fails.
@@ -60,57 +235,215 @@ func NewSqlAuthBackend(driverName, dataSourceName string) (b SqlAuthBackend, e e
 	if err != nil {
 		return b, mksqlerror(err.Error())
 	}
+	if err = b.addMissingColumns("goauth", userColumns); err != nil {
+		return b, mksqlerror(err.Error())
+	}
+
+	// Users are listed by role, looked up and sorted by email, and sorted by
+	// creation time. Not every database supports "if not exists" for
+	// indexes, so failing to create one is taken to mean it exists.
+	for _, index := range []string{"Role, Username", "Email, Username", "CreatedAt, Username"} {
+		name := "goauth_" + strings.ToLower(index[:strings.Index(index, ",")])
+		db.Exec(`create index ` + name + ` on goauth (` + index + `)`)
+	}
+
+	_, err = db.Exec(`create table if not exists goauth_groups (Name varchar(255), Roles text, Permissions text, primary key (Name))`)
+	if err != nil {
+		return b, mksqlerror(err.Error())
+	}
+	_, err = db.Exec(`create table if not exists goauth_group_members (GroupName varchar(255), Member varchar(255), IsGroup int, primary key (GroupName, Member, IsGroup))`)
+	if err != nil {
+		return b, mksqlerror(err.Error())
+	}
+	// for looking up the groups a user or group is in
+	db.Exec(`create index goauth_group_members_member on goauth_group_members (Member, IsGroup)`)
+	_, err = db.Exec(`create table if not exists goauth_tenants (Name varchar(255), DisplayName varchar(255), primary key (Name))`)
+	if err != nil {
+		return b, mksqlerror(err.Error())
+	}
+	// keyed by username first, since memberships are mostly looked up by user
+	_, err = db.Exec(`create table if not exists goauth_tenant_members (Username varchar(255), Tenant varchar(255), Role varchar(255), primary key (Username, Tenant))`)
+	if err != nil {
+		return b, mksqlerror(err.Error())
+	}
+
+	// times are in nanoseconds, so attempts sort in order and are unique per user
+	_, err = db.Exec(`create table if not exists goauth_logins (Username varchar(255), Time bigint, IP varchar(255), UserAgent text, Outcome varchar(255), primary key (Username, Time))`)
+	if err != nil {
+		return b, mksqlerror(err.Error())
+	}
+
+	_, err = db.Exec(`create table if not exists goauth_webhooks (ID varchar(255), URL text, Event varchar(255), Payload text, Attempts int, NextAttempt bigint, LastError text, Dead int, CreatedAt bigint, primary key (ID))`)
+	if err != nil {
+		return b, mksqlerror(err.Error())
+	}
 
 	// prepare statements for concurrent use and better preformance
-	//
-	// NOTE:
-	// I don't want to have to check if it's postgres, but postgres uses
-	// different tokens for placeholders. :( Also be aware that postgres
-	// lowercases all these column names.
-	//
-	// Thanks to mjhall for letting me know about this.
-	if driverName == "postgres" {
-		b.userStmt, err = db.Prepare(`select Email, Hash, Role from goauth where Username = $1`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("userstmt: %v", err))
-		}
-		b.usersStmt, err = db.Prepare(`select Username, Email, Hash, Role from goauth`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("usersstmt: %v", err))
-		}
-		b.insertStmt, err = db.Prepare(`insert into goauth (Username, Email, Hash, Role) values ($1, $2, $3, $4)`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("insertstmt: %v", err))
-		}
-		b.updateStmt, err = db.Prepare(`update goauth set Email = $1, Hash = $2, Role = $3 where Username = $4`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("updatestmt: %v", err))
-		}
-		b.deleteStmt, err = db.Prepare(`delete from goauth where Username = $1`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("deletestmt: %v", err))
-		}
-	} else {
-		b.userStmt, err = db.Prepare(`select Email, Hash, Role from goauth where Username = ?`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("userstmt: %v", err))
-		}
-		b.usersStmt, err = db.Prepare(`select Username, Email, Hash, Role from goauth`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("usersstmt: %v", err))
-		}
-		b.insertStmt, err = db.Prepare(`insert into goauth (Username, Email, Hash, Role) values (?, ?, ?, ?)`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("insertstmt: %v", err))
-		}
-		b.updateStmt, err = db.Prepare(`update goauth set Email = ?, Hash = ?, Role = ? where Username = ?`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("updatestmt: %v", err))
-		}
-		b.deleteStmt, err = db.Prepare(`delete from goauth where Username = ?`)
-		if err != nil {
-			return b, mksqlerror(fmt.Sprintf("deletestmt: %v", err))
-		}
+	fields := strings.Join(userFields, ", ")
+	b.userStmt, err = b.prepare(`select ` + fields + ` from goauth where Username = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("userstmt: %v", err))
+	}
+	b.emailStmt, err = b.prepare(`select ` + fields + ` from goauth where Email = ? order by Username limit 1`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("emailstmt: %v", err))
+	}
+	b.usersStmt, err = b.prepare(`select ` + fields + ` from goauth order by Username`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("usersstmt: %v", err))
+	}
+	b.insertStmt, err = b.prepare(`insert into goauth (` + fields + `) values (?` + strings.Repeat(", ?", len(userFields)-1) + `)`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("insertstmt: %v", err))
+	}
+	b.updateStmt, err = b.prepare(`update goauth set ` + strings.Join(userFields[1:], " = ?, ") + ` = ? where Username = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("updatestmt: %v", err))
+	}
+	b.deleteStmt, err = b.prepare(`delete from goauth where Username = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("deletestmt: %v", err))
+	}
+
+	b.groupStmt, err = b.prepare(`select Roles, Permissions from goauth_groups where Name = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("groupstmt: %v", err))
+	}
+	b.groupsStmt, err = b.prepare(`select Name, Roles, Permissions from goauth_groups`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("groupsstmt: %v", err))
+	}
+	b.membersStmt, err = b.prepare(`select GroupName, Member, IsGroup from goauth_group_members where GroupName = ? order by Member`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("membersstmt: %v", err))
+	}
+	b.allMembersStmt, err = b.prepare(`select GroupName, Member, IsGroup from goauth_group_members order by Member`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("allmembersstmt: %v", err))
+	}
+	b.memberOfStmt, err = b.prepare(`select GroupName from goauth_group_members where Member = ? and IsGroup = ? order by GroupName`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("memberofstmt: %v", err))
+	}
+	b.insertGroupStmt, err = b.prepare(`insert into goauth_groups (Name, Roles, Permissions) values (?, ?, ?)`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("insertgroupstmt: %v", err))
+	}
+	b.updateGroupStmt, err = b.prepare(`update goauth_groups set Roles = ?, Permissions = ? where Name = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("updategroupstmt: %v", err))
+	}
+	b.deleteGroupStmt, err = b.prepare(`delete from goauth_groups where Name = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("deletegroupstmt: %v", err))
+	}
+	b.insertMemberStmt, err = b.prepare(`insert into goauth_group_members (GroupName, Member, IsGroup) values (?, ?, ?)`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("insertmemberstmt: %v", err))
+	}
+	b.deleteMembersStmt, err = b.prepare(`delete from goauth_group_members where GroupName = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("deletememberstmt: %v", err))
+	}
+	b.tenantStmt, err = b.prepare(`select DisplayName from goauth_tenants where Name = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("tenantstmt: %v", err))
+	}
+	b.tenantsStmt, err = b.prepare(`select Name, DisplayName from goauth_tenants order by Name`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("tenantsstmt: %v", err))
+	}
+	b.insertTenantStmt, err = b.prepare(`insert into goauth_tenants (Name, DisplayName) values (?, ?)`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("inserttenantstmt: %v", err))
+	}
+	b.updateTenantStmt, err = b.prepare(`update goauth_tenants set DisplayName = ? where Name = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("updatetenantstmt: %v", err))
+	}
+	b.deleteTenantStmt, err = b.prepare(`delete from goauth_tenants where Name = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("deletetenantstmt: %v", err))
+	}
+	b.membershipStmt, err = b.prepare(`select Role from goauth_tenant_members where Tenant = ? and Username = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("membershipstmt: %v", err))
+	}
+	b.membershipsStmt, err = b.prepare(`select Tenant, Username, Role from goauth_tenant_members where Username = ? order by Tenant`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("membershipsstmt: %v", err))
+	}
+	b.tenantMembersStmt, err = b.prepare(`select Tenant, Username, Role from goauth_tenant_members where Tenant = ? order by Username`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("tenantmembersstmt: %v", err))
+	}
+	b.insertMembershipStmt, err = b.prepare(`insert into goauth_tenant_members (Tenant, Username, Role) values (?, ?, ?)`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("insertmembershipstmt: %v", err))
+	}
+	b.updateMembershipStmt, err = b.prepare(`update goauth_tenant_members set Role = ? where Tenant = ? and Username = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("updatemembershipstmt: %v", err))
+	}
+	b.deleteMembershipStmt, err = b.prepare(`delete from goauth_tenant_members where Tenant = ? and Username = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("deletemembershipstmt: %v", err))
+	}
+	b.deleteMembershipsStmt, err = b.prepare(`delete from goauth_tenant_members where Tenant = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("deletemembershipsstmt: %v", err))
+	}
+	b.insertLoginStmt, err = b.prepare(`insert into goauth_logins (Username, Time, IP, UserAgent, Outcome) values (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("insertloginstmt: %v", err))
+	}
+	b.loginsStmt, err = b.prepare(`select Username, Time, IP, UserAgent, Outcome from goauth_logins where Username = ? order by Time desc limit ? offset ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("loginsstmt: %v", err))
+	}
+	b.countLoginsStmt, err = b.prepare(`select count(*) from goauth_logins where Username = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("countloginsstmt: %v", err))
+	}
+	b.knownDeviceStmt, err = b.prepare(`select count(*) from goauth_logins where Username = ? and IP = ? and UserAgent = ? and Outcome = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("knowndevicestmt: %v", err))
+	}
+	b.nthLoginStmt, err = b.prepare(`select Time from goauth_logins where Username = ? order by Time desc limit 1 offset ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("nthloginstmt: %v", err))
+	}
+	b.pruneLoginsStmt, err = b.prepare(`delete from goauth_logins where Username = ? and Time < ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("pruneloginsstmt: %v", err))
+	}
+	b.pruneAllLoginsStmt, err = b.prepare(`delete from goauth_logins where Time < ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("pruneallloginsstmt: %v", err))
+	}
+	b.deleteLoginsStmt, err = b.prepare(`delete from goauth_logins where Username = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("deleteloginsstmt: %v", err))
+	}
+	b.webhookStmt, err = b.prepare(`select ` + webhookFields + ` from goauth_webhooks where ID = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("webhookstmt: %v", err))
+	}
+	b.webhooksStmt, err = b.prepare(`select ` + webhookFields + ` from goauth_webhooks where Dead = ? order by CreatedAt, ID`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("webhooksstmt: %v", err))
+	}
+	b.insertWebhookStmt, err = b.prepare(`insert into goauth_webhooks (URL, Event, Payload, Attempts, NextAttempt, LastError, Dead, CreatedAt, ID) values (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("insertwebhookstmt: %v", err))
+	}
+	b.updateWebhookStmt, err = b.prepare(`update goauth_webhooks set URL = ?, Event = ?, Payload = ?, Attempts = ?, NextAttempt = ?, LastError = ?, Dead = ?, CreatedAt = ? where ID = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("updatewebhookstmt: %v", err))
+	}
+	b.deleteWebhookStmt, err = b.prepare(`delete from goauth_webhooks where ID = ?`)
+	if err != nil {
+		return b, mksqlerror(fmt.Sprintf("deletewebhookstmt: %v", err))
 	}
 
 	return b, nil
@@ -119,15 +452,26 @@ func NewSqlAuthBackend(driverName, dataSourceName string) (b SqlAuthBackend, e e
 // User returns the user with the given username. Error is set to
 // ErrMissingUser if user is not found.
 func (b SqlAuthBackend) User(username string) (user UserData, e error) {
-	row := b.userStmt.QueryRow(username)
-	err := row.Scan(&user.Email, &user.Hash, &user.Role)
+	user, err := scanUser(b.userStmt.QueryRow(username))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return user, ErrMissingUser
+		}
+		return user, mksqlerror(err.Error())
+	}
+	return user, nil
+}
+
+// UserByEmail returns the user with the given email. Error is set to
+// ErrMissingUser if no user has it.
+func (b SqlAuthBackend) UserByEmail(email string) (user UserData, e error) {
+	user, err := scanUser(b.emailStmt.QueryRow(NormalizeEmail(email)))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return user, ErrMissingUser
 		}
 		return user, mksqlerror(err.Error())
 	}
-	user.Username = username
 	return user, nil
 }
 
@@ -137,30 +481,197 @@ func (b SqlAuthBackend) Users() (us []UserData, e error) {
 	if err != nil {
 		return us, mksqlerror(err.Error())
 	}
-	var (
-		username, email, role string
-		hash                  []byte
-	)
+	defer rows.Close()
 	for rows.Next() {
-		err = rows.Scan(&username, &email, &hash, &role)
+		user, err := scanUser(rows)
 		if err != nil {
 			return us, mksqlerror(err.Error())
 		}
-		us = append(us, UserData{username, email, hash, role})
+		us = append(us, user)
 	}
 	return us, nil
 }
 
+// ForEachUser calls fn with each user, in username order, as they're read
+// from the database.
+func (b SqlAuthBackend) ForEachUser(ctx context.Context, fn func(user UserData) error) error {
+	rows, err := b.usersStmt.QueryContext(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return mksqlerror(err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		user, err := scanUser(rows)
+		if err != nil {
+			return mksqlerror(err.Error())
+		}
+		if err := fn(user); err != nil {
+			return stopIteration(err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// userSortColumns are the goauth columns users are sorted by for each sort
+// order, followed by Username.
+var userSortColumns = map[string]string{
+	SortByUsername:  "Username",
+	SortByEmail:     "Email",
+	SortByCreated:   "CreatedAt",
+	SortByLastLogin: "LastLoginAt",
+}
+
+// likePrefix returns a like pattern, escaped with !, matching strings
+// starting with prefix in lower case.
+func likePrefix(prefix string) string {
+	prefix = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(strings.ToLower(prefix))
+	return prefix + "%"
+}
+
+// userQueryWhere returns the where clause selecting the users matching a
+// query's filters, and, if after is set, following its cursor.
+func userQueryWhere(p userQueryPlan, after bool) (string, []interface{}) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	if p.Role != "" {
+		conditions = append(conditions, `Role = ?`)
+		args = append(args, p.Role)
+	}
+	if p.UsernamePrefix != "" {
+		conditions = append(conditions, `lower(Username) like ? escape '!'`)
+		args = append(args, likePrefix(p.UsernamePrefix))
+	}
+	if p.EmailPrefix != "" {
+		conditions = append(conditions, `lower(Email) like ? escape '!'`)
+		args = append(args, likePrefix(p.EmailPrefix))
+	}
+	if after && p.after != nil {
+		op := ">"
+		if p.desc {
+			op = "<"
+		}
+		if p.field == SortByUsername {
+			conditions = append(conditions, `Username `+op+` ?`)
+			args = append(args, p.after.Username)
+		} else {
+			var key interface{} = p.after.Key
+			if p.field != SortByEmail {
+				key = toUnix(p.after.Time)
+			}
+			column := userSortColumns[p.field]
+			conditions = append(conditions, fmt.Sprintf(`(%s %s ? or (%s = ? and Username %s ?))`, column, op, column, op))
+			args = append(args, key, key, p.after.Username)
+		}
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return ` where ` + strings.Join(conditions, ` and `), args
+}
+
+// QueryUsers returns a page of the users matching a query, using the last
+// user of the previous page to find the first of the next.
+func (b SqlAuthBackend) QueryUsers(q UserQuery) (page UserPage, e error) {
+	p, err := q.plan()
+	if err != nil {
+		return page, err
+	}
+	where, args := userQueryWhere(p, true)
+	order := userSortColumns[p.field]
+	if p.field != SortByUsername {
+		order += ", Username"
+	}
+	if p.desc {
+		order = strings.Replace(order, ",", " desc,", 1) + " desc"
+	}
+	query := `select ` + strings.Join(userFields, ", ") + ` from goauth` + where + ` order by ` + order + ` limit ?`
+	rows, err := b.db.Query(rebind(b.driverName, query), append(args, p.Limit+1)...)
+	if err != nil {
+		return page, mksqlerror(err.Error())
+	}
+	defer rows.Close()
+	var us []UserData
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return page, mksqlerror(err.Error())
+		}
+		us = append(us, user)
+	}
+	if err := rows.Err(); err != nil {
+		return page, mksqlerror(err.Error())
+	}
+	return p.page(us), nil
+}
+
+// CountUsers returns the number of users matching a query's filters.
+func (b SqlAuthBackend) CountUsers(q UserQuery) (n int, e error) {
+	p, err := q.filters()
+	if err != nil {
+		return 0, err
+	}
+	where, args := userQueryWhere(p, false)
+	err = b.db.QueryRow(rebind(b.driverName, `select count(*) from goauth`+where), args...).Scan(&n)
+	if err != nil {
+		return 0, mksqlerror(err.Error())
+	}
+	return n, nil
+}
+
 // SaveUser adds a new user, replacing one with the same username.
 func (b SqlAuthBackend) SaveUser(user UserData) (err error) {
-	if _, err := b.User(user.Username); err == nil {
-		_, err = b.updateStmt.Exec(user.Email, user.Hash, user.Role, user.Username)
+	values, err := userValues(user)
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	if _, uerr := b.User(user.Username); uerr == nil {
+		_, err = b.updateStmt.Exec(append(values[1:], user.Username)...)
 	} else {
-		_, err = b.insertStmt.Exec(user.Username, user.Email, user.Hash, user.Role)
+		_, err = b.insertStmt.Exec(values...)
+	}
+	if err != nil && isEmailTaken(err) {
+		return ErrEmailTaken
 	}
 	return
 }
 
+// RequireUniqueEmails adds a unique index on emails, so SaveUser fails with
+// ErrEmailTaken when another user has the email of the user saved.
+func (b SqlAuthBackend) RequireUniqueEmails() error {
+	var email string
+	err := b.db.QueryRow(`select Email from goauth group by Email having count(*) > 1`).Scan(&email)
+	if err == nil {
+		return mksqlerror(fmt.Sprintf("several users have the email %q", email))
+	} else if err != sql.ErrNoRows {
+		return mksqlerror(err.Error())
+	}
+	// as above, failing to create the index is taken to mean it exists
+	b.db.Exec(`create unique index goauth_email_unique on goauth (Email)`)
+	return nil
+}
+
+// isEmailTaken reports whether an error is a violation of the index added by
+// RequireUniqueEmails. MySQL and PostgreSQL name the index, SQLite the
+// column.
+func isEmailTaken(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "goauth_email_unique") || strings.Contains(msg, "goauth.Email")
+}
+
 // DeleteUser removes a user, raising ErrDeleteNull if that user was missing.
 func (b SqlAuthBackend) DeleteUser(username string) error {
 	result, err := b.deleteStmt.Exec(username)
@@ -177,12 +688,545 @@ func (b SqlAuthBackend) DeleteUser(username string) error {
 	return nil
 }
 
+// Group returns the group with the given name. Error is set to
+// ErrMissingGroup if the group is not found.
+func (b SqlAuthBackend) Group(name string) (group Group, e error) {
+	var roles, permissions string
+	err := b.groupStmt.QueryRow(name).Scan(&roles, &permissions)
+	if err == sql.ErrNoRows {
+		return group, ErrMissingGroup
+	} else if err != nil {
+		return group, mksqlerror(err.Error())
+	}
+	group.Name = name
+	if err := json.Unmarshal([]byte(roles), &group.Roles); err != nil {
+		return group, mksqlerror(err.Error())
+	}
+	if err := json.Unmarshal([]byte(permissions), &group.Permissions); err != nil {
+		return group, mksqlerror(err.Error())
+	}
+	rows, err := b.membersStmt.Query(name)
+	if err != nil {
+		return group, mksqlerror(err.Error())
+	}
+	groups := map[string]*Group{name: &group}
+	if err := scanGroupMembers(rows, groups); err != nil {
+		return group, err
+	}
+	return group, nil
+}
+
+// Groups returns a slice of all groups.
+func (b SqlAuthBackend) Groups() (groups []Group, e error) {
+	rows, err := b.groupsStmt.Query()
+	if err != nil {
+		return groups, mksqlerror(err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			group              Group
+			roles, permissions string
+		)
+		if err := rows.Scan(&group.Name, &roles, &permissions); err != nil {
+			return groups, mksqlerror(err.Error())
+		}
+		if err := json.Unmarshal([]byte(roles), &group.Roles); err != nil {
+			return groups, mksqlerror(err.Error())
+		}
+		if err := json.Unmarshal([]byte(permissions), &group.Permissions); err != nil {
+			return groups, mksqlerror(err.Error())
+		}
+		groups = append(groups, group)
+	}
+	byName := make(map[string]*Group, len(groups))
+	for i := range groups {
+		byName[groups[i].Name] = &groups[i]
+	}
+	rows, err = b.allMembersStmt.Query()
+	if err != nil {
+		return groups, mksqlerror(err.Error())
+	}
+	return groups, scanGroupMembers(rows, byName)
+}
+
+// UserGroupNames returns the names of the groups the user is a direct member
+// of.
+func (b SqlAuthBackend) UserGroupNames(username string) ([]string, error) {
+	return b.memberOf(username, 0)
+}
+
+// ParentGroupNames returns the names of the groups the named group is directly
+// nested in.
+func (b SqlAuthBackend) ParentGroupNames(name string) ([]string, error) {
+	return b.memberOf(name, 1)
+}
+
+func (b SqlAuthBackend) memberOf(member string, isGroup int) (names []string, e error) {
+	rows, err := b.memberOfStmt.Query(member, isGroup)
+	if err != nil {
+		return nil, mksqlerror(err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, mksqlerror(err.Error())
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, mksqlerror(err.Error())
+	}
+	return names, nil
+}
+
+// scanGroupMembers reads rows from goauth_group_members into groups.
+func scanGroupMembers(rows *sql.Rows, groups map[string]*Group) error {
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			groupName, member string
+			isGroup           int
+		)
+		if err := rows.Scan(&groupName, &member, &isGroup); err != nil {
+			return mksqlerror(err.Error())
+		}
+		group, ok := groups[groupName]
+		if !ok {
+			continue
+		}
+		if isGroup != 0 {
+			group.Groups = append(group.Groups, member)
+		} else {
+			group.Users = append(group.Users, member)
+		}
+	}
+	return nil
+}
+
+// SaveGroup adds a new group, replacing one with the same name. Members are
+// stored as rows in the goauth_group_members table.
+func (b SqlAuthBackend) SaveGroup(group Group) error {
+	roles, _ := json.Marshal(group.Roles)
+	permissions, _ := json.Marshal(group.Permissions)
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	var oldRoles, oldPermissions string
+	exists := tx.Stmt(b.groupStmt).QueryRow(group.Name).Scan(&oldRoles, &oldPermissions)
+	if exists != nil && exists != sql.ErrNoRows {
+		tx.Rollback()
+		return mksqlerror(exists.Error())
+	}
+	if exists == nil {
+		_, err = tx.Stmt(b.updateGroupStmt).Exec(string(roles), string(permissions), group.Name)
+	} else {
+		_, err = tx.Stmt(b.insertGroupStmt).Exec(group.Name, string(roles), string(permissions))
+	}
+	if err != nil {
+		tx.Rollback()
+		return mksqlerror(err.Error())
+	}
+	if _, err := tx.Stmt(b.deleteMembersStmt).Exec(group.Name); err != nil {
+		tx.Rollback()
+		return mksqlerror(err.Error())
+	}
+	insert := tx.Stmt(b.insertMemberStmt)
+	for _, username := range group.Users {
+		if _, err := insert.Exec(group.Name, username, 0); err != nil {
+			tx.Rollback()
+			return mksqlerror(err.Error())
+		}
+	}
+	for _, child := range group.Groups {
+		if _, err := insert.Exec(group.Name, child, 1); err != nil {
+			tx.Rollback()
+			return mksqlerror(err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// DeleteGroup removes a group and its memberships, raising ErrMissingGroup if
+// that group was missing.
+func (b SqlAuthBackend) DeleteGroup(name string) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	if _, err := tx.Stmt(b.deleteMembersStmt).Exec(name); err != nil {
+		tx.Rollback()
+		return mksqlerror(err.Error())
+	}
+	result, err := tx.Stmt(b.deleteGroupStmt).Exec(name)
+	if err != nil {
+		tx.Rollback()
+		return mksqlerror(err.Error())
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return mksqlerror(err.Error())
+	}
+	if rows == 0 {
+		tx.Rollback()
+		return ErrMissingGroup
+	}
+	if err := tx.Commit(); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// Tenant returns the tenant with the given name. Error is set to
+// ErrMissingTenant if the tenant is not found.
+func (b SqlAuthBackend) Tenant(name string) (tenant Tenant, e error) {
+	err := b.tenantStmt.QueryRow(name).Scan(&tenant.DisplayName)
+	if err == sql.ErrNoRows {
+		return tenant, ErrMissingTenant
+	} else if err != nil {
+		return tenant, mksqlerror(err.Error())
+	}
+	tenant.Name = name
+	return tenant, nil
+}
+
+// Tenants returns a slice of all tenants.
+func (b SqlAuthBackend) Tenants() (tenants []Tenant, e error) {
+	rows, err := b.tenantsStmt.Query()
+	if err != nil {
+		return tenants, mksqlerror(err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tenant Tenant
+		if err := rows.Scan(&tenant.Name, &tenant.DisplayName); err != nil {
+			return tenants, mksqlerror(err.Error())
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, nil
+}
+
+// SaveTenant adds a new tenant, replacing one with the same name.
+func (b SqlAuthBackend) SaveTenant(tenant Tenant) (err error) {
+	if _, terr := b.Tenant(tenant.Name); terr == nil {
+		_, err = b.updateTenantStmt.Exec(tenant.DisplayName, tenant.Name)
+	} else {
+		_, err = b.insertTenantStmt.Exec(tenant.Name, tenant.DisplayName)
+	}
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// DeleteTenant removes a tenant and its memberships, raising ErrMissingTenant
+// if that tenant was missing.
+func (b SqlAuthBackend) DeleteTenant(name string) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	if _, err := tx.Stmt(b.deleteMembershipsStmt).Exec(name); err != nil {
+		tx.Rollback()
+		return mksqlerror(err.Error())
+	}
+	result, err := tx.Stmt(b.deleteTenantStmt).Exec(name)
+	if err != nil {
+		tx.Rollback()
+		return mksqlerror(err.Error())
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		tx.Rollback()
+		if err != nil {
+			return mksqlerror(err.Error())
+		}
+		return ErrMissingTenant
+	}
+	if err := tx.Commit(); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// SaveMembership adds a user to a tenant, replacing their previous role.
+func (b SqlAuthBackend) SaveMembership(m Membership) (err error) {
+	var role string
+	if merr := b.membershipStmt.QueryRow(m.Tenant, m.Username).Scan(&role); merr == nil {
+		_, err = b.updateMembershipStmt.Exec(m.Role, m.Tenant, m.Username)
+	} else {
+		_, err = b.insertMembershipStmt.Exec(m.Tenant, m.Username, m.Role)
+	}
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// DeleteMembership removes a user from a tenant, raising ErrMissingMembership
+// if they weren't a member.
+func (b SqlAuthBackend) DeleteMembership(tenant string, username string) error {
+	result, err := b.deleteMembershipStmt.Exec(tenant, username)
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	if rows == 0 {
+		return ErrMissingMembership
+	}
+	return nil
+}
+
+// Memberships returns a user's tenant memberships, sorted by tenant.
+func (b SqlAuthBackend) Memberships(username string) ([]Membership, error) {
+	return scanMemberships(b.membershipsStmt.Query(username))
+}
+
+// TenantMembers returns a tenant's memberships, sorted by username.
+func (b SqlAuthBackend) TenantMembers(tenant string) ([]Membership, error) {
+	return scanMemberships(b.tenantMembersStmt.Query(tenant))
+}
+
+func scanMemberships(rows *sql.Rows, err error) (memberships []Membership, e error) {
+	if err != nil {
+		return memberships, mksqlerror(err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m Membership
+		if err := rows.Scan(&m.Tenant, &m.Username, &m.Role); err != nil {
+			return memberships, mksqlerror(err.Error())
+		}
+		memberships = append(memberships, m)
+	}
+	return memberships, nil
+}
+
+// SaveLoginAttempt records a login attempt.
+func (b SqlAuthBackend) SaveLoginAttempt(attempt LoginAttempt) error {
+	_, err := b.insertLoginStmt.Exec(attempt.Username, attempt.Time.UnixNano(), attempt.IP, attempt.UserAgent, attempt.Outcome)
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// LoginAttempts returns a user's login attempts, newest first.
+func (b SqlAuthBackend) LoginAttempts(username string, offset, limit int) (attempts []LoginAttempt, total int, e error) {
+	if err := b.countLoginsStmt.QueryRow(username).Scan(&total); err != nil {
+		return nil, 0, mksqlerror(err.Error())
+	}
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	rows, err := b.loginsStmt.Query(username, limit, offset)
+	if err != nil {
+		return nil, 0, mksqlerror(err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			attempt LoginAttempt
+			t       int64
+		)
+		if err := rows.Scan(&attempt.Username, &t, &attempt.IP, &attempt.UserAgent, &attempt.Outcome); err != nil {
+			return nil, 0, mksqlerror(err.Error())
+		}
+		attempt.Time = time.Unix(0, t)
+		attempts = append(attempts, attempt)
+	}
+	return attempts, total, nil
+}
+
+// KnownDevice reports whether a user has logged in successfully from an IP
+// address with a user agent before.
+func (b SqlAuthBackend) KnownDevice(username, ip, userAgent string) (bool, error) {
+	var n int
+	if err := b.knownDeviceStmt.QueryRow(username, ip, userAgent, LoginSuccess).Scan(&n); err != nil {
+		return false, mksqlerror(err.Error())
+	}
+	return n > 0, nil
+}
+
+// PruneLoginAttempts removes old login attempts.
+func (b SqlAuthBackend) PruneLoginAttempts(username string, before time.Time, keep int) error {
+	if !before.IsZero() {
+		var err error
+		if username == "" {
+			_, err = b.pruneAllLoginsStmt.Exec(before.UnixNano())
+		} else {
+			_, err = b.pruneLoginsStmt.Exec(username, before.UnixNano())
+		}
+		if err != nil {
+			return mksqlerror(err.Error())
+		}
+	}
+	if username == "" || keep <= 0 {
+		return nil
+	}
+	var oldest int64
+	err := b.nthLoginStmt.QueryRow(username, keep-1).Scan(&oldest)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return mksqlerror(err.Error())
+	}
+	if _, err := b.pruneLoginsStmt.Exec(username, oldest); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// DeleteLoginAttempts removes all of a user's login attempts.
+func (b SqlAuthBackend) DeleteLoginAttempts(username string) error {
+	if _, err := b.deleteLoginsStmt.Exec(username); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+const webhookFields = `ID, URL, Event, Payload, Attempts, NextAttempt, LastError, Dead, CreatedAt`
+
+func scanWebhook(row rowScanner) (d WebhookDelivery, e error) {
+	var (
+		payload                string
+		nextAttempt, createdAt int64
+		dead                   int
+	)
+	err := row.Scan(&d.ID, &d.URL, &d.Event, &payload, &d.Attempts, &nextAttempt, &d.LastError, &dead, &createdAt)
+	if err != nil {
+		return d, err
+	}
+	d.Payload = []byte(payload)
+	d.NextAttempt = time.Unix(0, nextAttempt)
+	d.CreatedAt = time.Unix(0, createdAt)
+	d.Dead = dead != 0
+	return d, nil
+}
+
+// SaveWebhookDelivery queues a webhook delivery, replacing the one with the
+// same ID.
+func (b SqlAuthBackend) SaveWebhookDelivery(d WebhookDelivery) error {
+	dead := 0
+	if d.Dead {
+		dead = 1
+	}
+	args := []interface{}{d.URL, d.Event, string(d.Payload), d.Attempts, d.NextAttempt.UnixNano(), d.LastError, dead, d.CreatedAt.UnixNano(), d.ID}
+	result, err := b.updateWebhookStmt.Exec(args...)
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows > 0 {
+		return nil
+	}
+	if _, err := b.insertWebhookStmt.Exec(args...); err != nil {
+		return mksqlerror(err.Error())
+	}
+	return nil
+}
+
+// WebhookDelivery returns the webhook delivery with the given ID. Error is set
+// to ErrMissingDelivery if it is not found.
+func (b SqlAuthBackend) WebhookDelivery(id string) (d WebhookDelivery, e error) {
+	d, err := scanWebhook(b.webhookStmt.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return d, ErrMissingDelivery
+	} else if err != nil {
+		return d, mksqlerror(err.Error())
+	}
+	return d, nil
+}
+
+// WebhookDeliveries returns pending or dead webhook deliveries, oldest first.
+func (b SqlAuthBackend) WebhookDeliveries(dead bool) (deliveries []WebhookDelivery, e error) {
+	isDead := 0
+	if dead {
+		isDead = 1
+	}
+	rows, err := b.webhooksStmt.Query(isDead)
+	if err != nil {
+		return nil, mksqlerror(err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d, err := scanWebhook(rows)
+		if err != nil {
+			return nil, mksqlerror(err.Error())
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// DeleteWebhookDelivery removes a webhook delivery, raising ErrMissingDelivery
+// if it was missing.
+func (b SqlAuthBackend) DeleteWebhookDelivery(id string) error {
+	result, err := b.deleteWebhookStmt.Exec(id)
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return mksqlerror(err.Error())
+	}
+	if rows == 0 {
+		return ErrMissingDelivery
+	}
+	return nil
+}
+
 // Close cleans up the backend by terminating the database connection.
 func (b SqlAuthBackend) Close() {
 	b.db.Close()
 	b.userStmt.Close()
+	b.emailStmt.Close()
 	b.usersStmt.Close()
 	b.insertStmt.Close()
 	b.updateStmt.Close()
 	b.deleteStmt.Close()
+	b.groupStmt.Close()
+	b.groupsStmt.Close()
+	b.membersStmt.Close()
+	b.allMembersStmt.Close()
+	b.memberOfStmt.Close()
+	b.insertGroupStmt.Close()
+	b.updateGroupStmt.Close()
+	b.deleteGroupStmt.Close()
+	b.insertMemberStmt.Close()
+	b.deleteMembersStmt.Close()
+	b.tenantStmt.Close()
+	b.tenantsStmt.Close()
+	b.insertTenantStmt.Close()
+	b.updateTenantStmt.Close()
+	b.deleteTenantStmt.Close()
+	b.membershipStmt.Close()
+	b.membershipsStmt.Close()
+	b.tenantMembersStmt.Close()
+	b.insertMembershipStmt.Close()
+	b.updateMembershipStmt.Close()
+	b.deleteMembershipStmt.Close()
+	b.deleteMembershipsStmt.Close()
+	b.insertLoginStmt.Close()
+	b.loginsStmt.Close()
+	b.countLoginsStmt.Close()
+	b.knownDeviceStmt.Close()
+	b.nthLoginStmt.Close()
+	b.pruneLoginsStmt.Close()
+	b.pruneAllLoginsStmt.Close()
+	b.deleteLoginsStmt.Close()
+	b.webhookStmt.Close()
+	b.webhooksStmt.Close()
+	b.insertWebhookStmt.Close()
+	b.updateWebhookStmt.Close()
+	b.deleteWebhookStmt.Close()
 }
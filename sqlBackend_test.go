@@ -8,6 +8,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"os"
 	"testing"
+	"time"
 )
 
 func testSqlInit(t *testing.T, driver string, info string) {
@@ -25,6 +26,12 @@ func testSqlInit(t *testing.T, driver string, info string) {
 		os.Exit(1)
 	}
 	con.Exec("drop table goauth")
+	con.Exec("drop table goauth_groups")
+	con.Exec("drop table goauth_group_members")
+	con.Exec("drop table goauth_tenants")
+	con.Exec("drop table goauth_tenant_members")
+	con.Exec("drop table goauth_logins")
+	con.Exec("drop table goauth_webhooks")
 }
 
 func testSqlBackend(t *testing.T, driver string, info string) {
@@ -93,3 +100,73 @@ func TestSqliteBackend(t *testing.T) {
 	sqlTests(t, "sqlite3", "./httpauth_test_sqlite.db")
 	os.Remove("./httpauth_test_sqlite.db")
 }
+
+func TestSqliteLegacySchema(t *testing.T) {
+	os.Create("./httpauth_test_legacy.db")
+	defer os.Remove("./httpauth_test_legacy.db")
+	con, err := sql.Open("sqlite3", "./httpauth_test_legacy.db")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer con.Close()
+	con.Exec(`create table goauth (Username varchar(255), Email varchar(255), Hash varchar(255), Role varchar(255), primary key (Username))`)
+	con.Exec(`insert into goauth (Username, Email, Hash, Role) values ('legacy', 'legacy@example.com', 'hash', 'user')`)
+
+	backend, err := NewSqlAuthBackend("sqlite3", "./httpauth_test_legacy.db")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer backend.Close()
+	user, err := backend.User("legacy")
+	if err != nil {
+		t.Fatalf("Legacy user not loaded: %v", err)
+	}
+	if user.Email != "legacy@example.com" || user.AccountStatus(time.Now()) != StatusActive {
+		t.Fatalf("Legacy user not loaded properly: %v", user)
+	}
+	user.Status = StatusDisabled
+	if err := backend.SaveUser(user); err != nil {
+		t.Fatalf("SaveUser on migrated table: %v", err)
+	}
+}
+
+func TestSqliteClosed(t *testing.T) {
+	os.Create("./httpauth_test_closed.db")
+	defer os.Remove("./httpauth_test_closed.db")
+	backend, err := NewSqlAuthBackend("sqlite3", "./httpauth_test_closed.db")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	backend.Close()
+	if err := backend.SaveTenant(Tenant{"tenant", "Tenant"}); err == nil {
+		t.Error("SaveTenant: expected an error with a closed database")
+	}
+	if err := backend.SaveMembership(Membership{"tenant", "user", "user"}); err == nil {
+		t.Error("SaveMembership: expected an error with a closed database")
+	}
+	if err := backend.SaveGroup(Group{Name: "group"}); err == nil {
+		t.Error("SaveGroup: expected an error with a closed database")
+	}
+}
+
+func TestSqliteCorruptGroup(t *testing.T) {
+	os.Create("./httpauth_test_corrupt.db")
+	defer os.Remove("./httpauth_test_corrupt.db")
+	backend, err := NewSqlAuthBackend("sqlite3", "./httpauth_test_corrupt.db")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer backend.Close()
+	if err := backend.SaveGroup(Group{Name: "group", Roles: []string{"user"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := backend.db.Exec(`update goauth_groups set Roles = 'not json'`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := backend.Group("group"); err == nil {
+		t.Error("Group: expected an error for undecodable roles")
+	}
+	if _, err := backend.Groups(); err == nil {
+		t.Error("Groups: expected an error for undecodable roles")
+	}
+}
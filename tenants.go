@@ -0,0 +1,297 @@
+package httpauth
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ErrMissingTenant is returned by TenantBackends when a tenant is not found,
+// and ErrMissingMembership when a user doesn't belong to a tenant.
+var (
+	ErrMissingTenant     = mkerror("can't find tenant")
+	ErrMissingMembership = mkerror("user isn't a member of tenant")
+)
+
+// TenantSeparator separates a tenant's name from a username in the usernames
+// of users registered in a tenant. Tenant names and the usernames given to
+// Register and RegisterInTenant can't contain it.
+const TenantSeparator = ":"
+
+// Tenant is an organization, such as a customer, users can belong to.
+//
+// Users registered with Register have a single global account, and can be
+// added to each tenant they work in with a role specific to that tenant.
+// Users registered with RegisterInTenant belong to their tenant: their
+// username only has to be unique within it, and they log in with
+// LoginInTenant.
+type Tenant struct {
+	Name        string `bson:"Name"`
+	DisplayName string `bson:"DisplayName"`
+}
+
+// Membership records a user's role in a tenant.
+type Membership struct {
+	Tenant   string `bson:"Tenant"`
+	Username string `bson:"Username"`
+	Role     string `bson:"Role"`
+}
+
+// The TenantBackend interface is implemented by AuthBackends able to store
+// tenants and their members. All backends in this package implement it.
+type TenantBackend interface {
+	SaveTenant(t Tenant) error
+	Tenant(name string) (tenant Tenant, e error)
+	Tenants() (tenants []Tenant, e error)
+	// DeleteTenant also removes all of the tenant's memberships.
+	DeleteTenant(name string) error
+
+	SaveMembership(m Membership) error
+	DeleteMembership(tenant string, username string) error
+	Memberships(username string) (memberships []Membership, e error)
+	TenantMembers(tenant string) (memberships []Membership, e error)
+}
+
+func (a Authorizer) tenantBackend() (TenantBackend, error) {
+	tb, ok := asTenantBackend(a.backend)
+	if !ok {
+		return nil, mkerror("backend doesn't support tenants")
+	}
+	return tb, nil
+}
+
+// SaveTenant creates or updates a tenant.
+func (a Authorizer) SaveTenant(t Tenant) error {
+	tb, err := a.tenantBackend()
+	if err != nil {
+		return err
+	}
+	if t.Name == "" {
+		return mkerror("no tenant name given")
+	}
+	if strings.Contains(t.Name, TenantSeparator) {
+		return mkerror("invalid tenant name")
+	}
+	if err := tb.SaveTenant(t); err != nil {
+		return mkerror(err.Error())
+	}
+	return nil
+}
+
+// DeleteTenant removes a tenant and its memberships. ErrMissingTenant is
+// returned if the tenant isn't found. Users registered in the tenant are kept,
+// without any role in it.
+func (a Authorizer) DeleteTenant(name string) error {
+	tb, err := a.tenantBackend()
+	if err != nil {
+		return err
+	}
+	err = tb.DeleteTenant(name)
+	if err != nil && err != ErrMissingTenant {
+		return mkerror(err.Error())
+	}
+	return err
+}
+
+// AddTenantMember adds a user to a tenant with a role, or changes their role
+// if they're already a member.
+func (a Authorizer) AddTenantMember(tenant string, username string, role string) error {
+	tb, err := a.tenantBackend()
+	if err != nil {
+		return err
+	}
+	if _, ok := a.roles[role]; !ok {
+		return ErrNonexistentRole
+	}
+	if _, err := tb.Tenant(tenant); err != nil {
+		return err
+	}
+	if _, err := a.backend.User(username); err != nil {
+		return err
+	}
+	if err := tb.SaveMembership(Membership{tenant, username, role}); err != nil {
+		return mkerror(err.Error())
+	}
+	return nil
+}
+
+// TenantUsername returns the username of the user registered in a tenant with
+// RegisterInTenant as username.
+func TenantUsername(tenant string, username string) string {
+	return tenant + TenantSeparator + username
+}
+
+// SplitTenantUsername splits a username returned by TenantUsername into the
+// tenant and the username within it. The tenant is empty for other usernames.
+func SplitTenantUsername(username string) (tenant string, name string) {
+	if i := strings.Index(username, TenantSeparator); i >= 0 {
+		return username[:i], username[i+len(TenantSeparator):]
+	}
+	return "", username
+}
+
+// RegisterInTenant registers a user belonging to a tenant, as Register does,
+// and makes them a member of it with role, or the default role if it's empty.
+// The user is saved as TenantUsername(tenant, user.Username), so users of
+// different tenants can have the same username. They log in with
+// LoginInTenant, which selects their tenant.
+func (a Authorizer) RegisterInTenant(rw http.ResponseWriter, req *http.Request, tenant string, user UserData, password string, role string) error {
+	tb, err := a.tenantBackend()
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		role = a.defaultRole
+	} else if _, ok := a.roles[role]; !ok {
+		return ErrNonexistentRole
+	}
+	if _, err := tb.Tenant(tenant); err != nil {
+		return err
+	}
+	if err := a.register(rw, req, user, password, tenant); err != nil {
+		return err
+	}
+	username := TenantUsername(tenant, user.Username)
+	if err := tb.SaveMembership(Membership{tenant, username, role}); err != nil {
+		a.backend.DeleteUser(username)
+		return mkerror(err.Error())
+	}
+	return nil
+}
+
+// LoginInTenant logs in a user registered in a tenant with RegisterInTenant,
+// as Login does, selecting the tenant in their session.
+func (a Authorizer) LoginInTenant(rw http.ResponseWriter, req *http.Request, tenant string, username string, password string, dest string) error {
+	if tenant == "" || strings.Contains(username, TenantSeparator) {
+		a.addMessage(rw, req, "Invalid username or password.")
+		return ErrUserNotFound
+	}
+	return a.Login(rw, req, TenantUsername(tenant, username), password, dest)
+}
+
+// userTenant returns the tenant a user was registered in with
+// RegisterInTenant, if they're still a member of it, or "".
+func (a Authorizer) userTenant(username string) string {
+	tenant, _ := SplitTenantUsername(username)
+	if tenant == "" {
+		return ""
+	}
+	if _, err := a.membership(tenant, username); err != nil {
+		return ""
+	}
+	return tenant
+}
+
+// RemoveTenantMember removes a user from a tenant. ErrMissingMembership is
+// returned if they weren't a member.
+func (a Authorizer) RemoveTenantMember(tenant string, username string) error {
+	tb, err := a.tenantBackend()
+	if err != nil {
+		return err
+	}
+	err = tb.DeleteMembership(tenant, username)
+	if err != nil && err != ErrMissingMembership {
+		return mkerror(err.Error())
+	}
+	return err
+}
+
+// UserTenants returns the tenants a user belongs to, with their role in each.
+func (a Authorizer) UserTenants(username string) ([]Membership, error) {
+	tb, err := a.tenantBackend()
+	if err != nil {
+		return nil, err
+	}
+	return tb.Memberships(username)
+}
+
+func (a Authorizer) membership(tenant string, username string) (Membership, error) {
+	memberships, err := a.UserTenants(username)
+	if err != nil {
+		return Membership{}, err
+	}
+	for _, m := range memberships {
+		if m.Tenant == tenant {
+			return m, nil
+		}
+	}
+	return Membership{}, ErrMissingMembership
+}
+
+// SelectTenant stores the tenant the current user is working in in their
+// session. From then on, AuthorizeRole and AuthorizePermission evaluate the
+// user's role in that tenant instead of their own role and groups. Passing an
+// empty tenant clears the selection.
+func (a Authorizer) SelectTenant(rw http.ResponseWriter, req *http.Request, tenant string) error {
+	user, err := a.CurrentUser(rw, req)
+	if err != nil {
+		return err
+	}
+	authSession, _ := a.cookiejar.Get(req, "auth")
+	if tenant == "" {
+		delete(authSession.Values, "tenant")
+		return authSession.Save(req, rw)
+	}
+	if _, err := a.membership(tenant, user.Username); err != nil {
+		a.addMessage(rw, req, "You don't belong to that organization.")
+		return err
+	}
+	authSession.Values["tenant"] = tenant
+	return authSession.Save(req, rw)
+}
+
+// CurrentTenant returns the current user's membership in the tenant selected
+// in their session. ErrMissingTenant is returned if none is selected.
+func (a Authorizer) CurrentTenant(rw http.ResponseWriter, req *http.Request) (m Membership, e error) {
+	user, err := a.CurrentUser(rw, req)
+	if err != nil {
+		return m, err
+	}
+	authSession, _ := a.cookiejar.Get(req, "auth")
+	tenant, ok := authSession.Values["tenant"].(string)
+	if !ok {
+		return m, ErrMissingTenant
+	}
+	return a.membership(tenant, user.Username)
+}
+
+// requestGrants returns the roles and extra permissions to evaluate for a
+// user in a request: their role in the selected tenant if there is one,
+// otherwise their own and inherited grants.
+func (a Authorizer) requestGrants(rw http.ResponseWriter, req *http.Request, user UserData) (roles []string, permissions []string, e error) {
+	authSession, _ := a.cookiejar.Get(req, "auth")
+	tenant, ok := authSession.Values["tenant"].(string)
+	if !ok {
+		return a.grants(user)
+	}
+	m, err := a.membership(tenant, user.Username)
+	if err == ErrMissingMembership {
+		// removed from the tenant since selecting it
+		delete(authSession.Values, "tenant")
+		authSession.Save(req, rw)
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return []string{m.Role}, nil, nil
+}
+
+// membershipKey identifies a membership in backends keeping them in a map.
+func membershipKey(tenant string, username string) string {
+	return tenant + "\x00" + username
+}
+
+func sortMemberships(memberships []Membership) {
+	sort.Sort(byMembership(memberships))
+}
+
+type byMembership []Membership
+
+func (m byMembership) Len() int      { return len(m) }
+func (m byMembership) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byMembership) Less(i, j int) bool {
+	if m[i].Tenant != m[j].Tenant {
+		return m[i].Tenant < m[j].Tenant
+	}
+	return m[i].Username < m[j].Username
+}
@@ -0,0 +1,154 @@
+package httpauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "tenants_test.gob")
+	defer done()
+	cookies := testLogin(t, auth, "tenantuser", "user")
+
+	if err := auth.SaveTenant(Tenant{Name: "acme", DisplayName: "Acme"}); err != nil {
+		t.Fatalf("SaveTenant: %v", err)
+	}
+	if err := auth.SaveTenant(Tenant{Name: "globex", DisplayName: "Globex"}); err != nil {
+		t.Fatalf("SaveTenant: %v", err)
+	}
+	if err := auth.AddTenantMember("acme", "tenantuser", "nonexistent"); err == nil {
+		t.Fatal("AddTenantMember: accepted nonexistent role")
+	}
+	if err := auth.AddTenantMember("initech", "tenantuser", "admin"); err != ErrMissingTenant {
+		t.Fatalf("AddTenantMember: expected ErrMissingTenant, got %v", err)
+	}
+	if err := auth.AddTenantMember("acme", "tenantuser", "admin"); err != nil {
+		t.Fatalf("AddTenantMember: %v", err)
+	}
+	if err := auth.AddTenantMember("globex", "tenantuser", "user"); err != nil {
+		t.Fatalf("AddTenantMember: %v", err)
+	}
+	memberships, err := auth.UserTenants("tenantuser")
+	if err != nil || len(memberships) != 2 {
+		t.Fatalf("UserTenants: %v, %v", memberships, err)
+	}
+
+	rw := httptest.NewRecorder()
+	req := requestWithCookies("GET", "/", cookies)
+	if _, err := auth.CurrentTenant(rw, req); err != ErrMissingTenant {
+		t.Fatalf("CurrentTenant: expected ErrMissingTenant, got %v", err)
+	}
+	if err := auth.SelectTenant(rw, req, "initech"); err != ErrMissingMembership {
+		t.Fatalf("SelectTenant: expected ErrMissingMembership, got %v", err)
+	}
+	if err := auth.AuthorizeRole(rw, req, "admin", false); err == nil {
+		t.Fatal("AuthorizeRole: user authorized as admin without a tenant")
+	}
+
+	rw = httptest.NewRecorder()
+	if err := auth.SelectTenant(rw, req, "acme"); err != nil {
+		t.Fatalf("SelectTenant: %v", err)
+	}
+	acmeCookies := responseCookies(rw)
+	acme := requestWithCookies("GET", "/", acmeCookies)
+	if m, err := auth.CurrentTenant(rw, acme); err != nil || m.Tenant != "acme" || m.Role != "admin" {
+		t.Fatalf("CurrentTenant: %v, %v", m, err)
+	}
+	if err := auth.AuthorizeRole(rw, acme, "admin", false); err != nil {
+		t.Fatalf("AuthorizeRole: tenant role not used: %v", err)
+	}
+
+	rw = httptest.NewRecorder()
+	if err := auth.SelectTenant(rw, acme, "globex"); err != nil {
+		t.Fatalf("SelectTenant: %v", err)
+	}
+	globex := requestWithCookies("GET", "/", responseCookies(rw))
+	if err := auth.AuthorizeRole(rw, globex, "admin", false); err == nil {
+		t.Fatal("AuthorizeRole: admin in one tenant was admin in another")
+	}
+	if err := auth.AuthorizeRole(rw, globex, "user", false); err != nil {
+		t.Fatalf("AuthorizeRole: %v", err)
+	}
+
+	if err := auth.RemoveTenantMember("acme", "tenantuser"); err != nil {
+		t.Fatalf("RemoveTenantMember: %v", err)
+	}
+	acme = requestWithCookies("GET", "/", acmeCookies)
+	if err := auth.AuthorizeRole(rw, acme, "user", false); err == nil {
+		t.Fatal("AuthorizeRole: removed member still authorized in tenant")
+	}
+
+	if err := auth.DeleteUser("tenantuser"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if members, _ := auth.backend.(TenantBackend).TenantMembers("globex"); len(members) != 0 {
+		t.Errorf("DeleteUser: deleted user still a member: %v", members)
+	}
+	if err := auth.DeleteTenant("acme"); err != nil {
+		t.Fatalf("DeleteTenant: %v", err)
+	}
+}
+
+func TestRegisterInTenant(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "tenants_test.gob")
+	defer done()
+	for _, name := range []string{"acme", "globex"} {
+		if err := auth.SaveTenant(Tenant{Name: name}); err != nil {
+			t.Fatalf("SaveTenant: %v", err)
+		}
+	}
+	if err := auth.SaveTenant(Tenant{Name: "acme:west"}); err == nil {
+		t.Error("SaveTenant: accepted a name containing the separator")
+	}
+	req := requestWithCookies("POST", "/", nil)
+	register := func(tenant string, username string, password string, role string) error {
+		user := UserData{Username: username, Email: username + "@" + tenant + ".example"}
+		return auth.RegisterInTenant(httptest.NewRecorder(), req, tenant, user, password, role)
+	}
+	if err := register("acme", "boss", "acme-password", "admin"); err != nil {
+		t.Fatalf("RegisterInTenant: %v", err)
+	}
+	if err := register("globex", "boss", "globex-password", ""); err != nil {
+		t.Fatalf("RegisterInTenant: same username in another tenant: %v", err)
+	}
+	if err := register("acme", "boss", "password", ""); err != ErrUserExists {
+		t.Errorf("RegisterInTenant: expected ErrUserExists, got %v", err)
+	}
+	if err := register("initech", "boss", "password", ""); err != ErrMissingTenant {
+		t.Errorf("RegisterInTenant: expected ErrMissingTenant, got %v", err)
+	}
+	if err := auth.Register(httptest.NewRecorder(), req, UserData{Username: "acme:boss", Email: "x@example.com"}, "password"); err != ErrInvalidUsername {
+		t.Errorf("Register: expected ErrInvalidUsername, got %v", err)
+	}
+
+	login := func(tenant string, password string) (*http.Request, error) {
+		rw := httptest.NewRecorder()
+		err := auth.LoginInTenant(rw, requestWithCookies("POST", "/", nil), tenant, "boss", password, "/")
+		return requestWithCookies("GET", "/", responseCookies(rw)), err
+	}
+	if _, err := login("globex", "acme-password"); err != ErrWrongPassword {
+		t.Errorf("LoginInTenant: expected ErrWrongPassword with another tenant's password, got %v", err)
+	}
+	acme, err := login("acme", "acme-password")
+	if err != nil {
+		t.Fatalf("LoginInTenant: %v", err)
+	}
+	rw := httptest.NewRecorder()
+	if m, err := auth.CurrentTenant(rw, acme); err != nil || m.Tenant != "acme" || m.Username != "acme:boss" {
+		t.Errorf("CurrentTenant: expected acme to be selected, got %v, %v", m, err)
+	}
+	if err := auth.AuthorizeRole(rw, acme, "admin", false); err != nil {
+		t.Errorf("AuthorizeRole: %v", err)
+	}
+	globex, err := login("globex", "globex-password")
+	if err != nil {
+		t.Fatalf("LoginInTenant: %v", err)
+	}
+	if err := auth.AuthorizeRole(rw, globex, "admin", false); err == nil {
+		t.Error("AuthorizeRole: globex's boss was given acme's boss's role")
+	}
+	if tenant, name := SplitTenantUsername("acme:boss"); tenant != "acme" || name != "boss" {
+		t.Errorf("SplitTenantUsername: got %q, %q", tenant, name)
+	}
+}
@@ -0,0 +1,170 @@
+package httpauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tracer starts spans, for example by wrapping an OpenTelemetry tracer. Spans
+// are named "httpauth.<Method>" for Authorizer methods and
+// "httpauth.backend.<Method>" for backend calls, and may carry the
+// attributes:
+//
+//     username_hash   the first 16 hex digits of the SHA-256 of the username
+//     role            the user's role, or the role required by AuthorizeRole
+//     permission      the permission required by AuthorizePermission
+//     outcome         "success" or "failure"
+type Tracer interface {
+	// Start starts a span as a child of any span in ctx, returning a
+	// context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is an operation being traced.
+type Span interface {
+	SetAttribute(key string, value string)
+	// End finishes the span. err is the operation's error, if any.
+	End(err error)
+}
+
+// SetTracer makes the Authorizer trace its methods, and the backend calls
+// they make, with t. Spans are children of the span in the request's
+// context. Pass nil to stop.
+func (a Authorizer) SetTracer(t Tracer) {
+	a.ext.tracer = t
+}
+
+// spanBackend is the backend of an Authorizer returned by startSpan. Backend
+// calls are traced as children of ctx, the span of the method making them.
+type spanBackend struct {
+	wrappedBackend
+	ctx context.Context
+}
+
+// startSpan starts a span for an Authorizer method, returning a copy of the
+// Authorizer whose backend calls, and nested methods, are traced as its
+// children. Without a tracer, it returns a and a span doing nothing.
+func (a Authorizer) startSpan(req *http.Request, method string) (Authorizer, Span) {
+	tracer := a.ext.tracer
+	if tracer == nil {
+		return a, noopSpan{}
+	}
+	ctx := context.Background()
+	backend := a.backend
+	if sb, ok := backend.(spanBackend); ok {
+		ctx = sb.ctx
+		backend = sb.backend
+	} else if req != nil {
+		ctx = req.Context()
+	}
+	ctx, span := tracer.Start(ctx, "httpauth."+method)
+	a.backend = spanBackend{
+		wrappedBackend{backend, func(call string) backendCall {
+			_, span := tracer.Start(ctx, "httpauth.backend."+call)
+			return func(err error) { endSpan(span, err) }
+		}},
+		ctx,
+	}
+	return a, span
+}
+
+// endSpan records the outcome of an operation and ends its span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.SetAttribute("outcome", OutcomeFailure)
+	} else {
+		span.SetAttribute("outcome", OutcomeSuccess)
+	}
+	span.End(err)
+}
+
+// setSpanUser records the user an operation is about, without revealing
+// their username.
+func setSpanUser(span Span, username string) {
+	if username != "" {
+		span.SetAttribute("username_hash", hashUsername(username))
+	}
+}
+
+func hashUsername(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return hex.EncodeToString(sum[:8])
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value string) {}
+func (noopSpan) End(err error)                         {}
+
+// SpanRecorder is a Tracer keeping finished spans in memory, for tests.
+type SpanRecorder struct {
+	mu     sync.Mutex
+	nextID int
+	spans  []RecordedSpan
+}
+
+// RecordedSpan is a span finished by a SpanRecorder. Parent is the ID of the
+// parent span, or 0 for root spans.
+type RecordedSpan struct {
+	ID         int
+	Parent     int
+	Name       string
+	Attributes map[string]string
+	Err        error
+	Start      time.Time
+	End        time.Time
+}
+
+type recordedSpanKey struct{}
+
+type recordingSpan struct {
+	recorder *SpanRecorder
+	span     RecordedSpan
+}
+
+// Start starts a span as a child of the recorder's span in ctx, if any.
+func (r *SpanRecorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	r.mu.Lock()
+	r.nextID++
+	id := r.nextID
+	r.mu.Unlock()
+	parent, _ := ctx.Value(recordedSpanKey{}).(int)
+	s := &recordingSpan{r, RecordedSpan{
+		ID:         id,
+		Parent:     parent,
+		Name:       name,
+		Attributes: make(map[string]string),
+		Start:      time.Now(),
+	}}
+	return context.WithValue(ctx, recordedSpanKey{}, id), s
+}
+
+func (s *recordingSpan) SetAttribute(key string, value string) {
+	s.span.Attributes[key] = value
+}
+
+func (s *recordingSpan) End(err error) {
+	s.span.Err = err
+	s.span.End = time.Now()
+	s.recorder.mu.Lock()
+	s.recorder.spans = append(s.recorder.spans, s.span)
+	s.recorder.mu.Unlock()
+}
+
+// Spans returns the spans finished so far, in the order they ended.
+func (r *SpanRecorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RecordedSpan(nil), r.spans...)
+}
+
+// Reset forgets recorded spans.
+func (r *SpanRecorder) Reset() {
+	r.mu.Lock()
+	r.spans = nil
+	r.mu.Unlock()
+}
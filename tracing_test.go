@@ -0,0 +1,128 @@
+package httpauth
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// usersOnlyBackend implements AuthBackend and none of the optional
+// interfaces.
+type usersOnlyBackend struct {
+	AuthBackend
+}
+
+func TestTracing(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "tracing_test.gob")
+	defer done()
+	recorder := &SpanRecorder{}
+	auth.SetTracer(recorder)
+
+	cookies := testLogin(t, auth, "traced", "user")
+	spans := recorder.Spans()
+	login := findSpan(t, spans, "httpauth.Login")
+	if login.Attributes["username_hash"] != hashUsername("traced") || login.Attributes["role"] != "user" || login.Attributes["outcome"] != OutcomeSuccess {
+		t.Errorf("Login span attributes not correct: %v", login.Attributes)
+	}
+	if login.Parent != 0 {
+		t.Errorf("Login span should be a root span")
+	}
+	user := findSpan(t, spans, "httpauth.backend.User")
+	if register := findSpan(t, spans, "httpauth.Register"); user.Parent != register.ID {
+		t.Errorf("backend span not a child of Register: %v", user)
+	}
+	for _, span := range spans {
+		for key, value := range span.Attributes {
+			if strings.Contains(value, "traced") {
+				t.Errorf("span %s attribute %s reveals the username", span.Name, key)
+			}
+		}
+	}
+
+	recorder.Reset()
+	rw := httptest.NewRecorder()
+	ctx, parent := recorder.Start(context.Background(), "handler")
+	req := requestWithCookies("GET", "/", cookies).WithContext(ctx)
+	if err := auth.AuthorizeRole(rw, req, "admin", false); err == nil {
+		t.Fatal("AuthorizeRole: expected denial")
+	}
+	parent.End(nil)
+	spans = recorder.Spans()
+	role := findSpan(t, spans, "httpauth.AuthorizeRole")
+	authorize := findSpan(t, spans, "httpauth.Authorize")
+	handler := findSpan(t, spans, "handler")
+	if role.Parent != handler.ID || authorize.Parent != role.ID {
+		t.Errorf("spans not nested: handler %d, AuthorizeRole %d (parent %d), Authorize parent %d", handler.ID, role.ID, role.Parent, authorize.Parent)
+	}
+	if role.Attributes["role"] != "admin" || role.Attributes["outcome"] != OutcomeFailure || role.Err == nil {
+		t.Errorf("AuthorizeRole span not correct: %v", role)
+	}
+	if authorize.Attributes["outcome"] != OutcomeSuccess {
+		t.Errorf("Authorize span not correct: %v", authorize)
+	}
+	var backendCalls int
+	for _, span := range spans {
+		if strings.HasPrefix(span.Name, "httpauth.backend.") {
+			backendCalls++
+			if span.Parent != role.ID && span.Parent != authorize.ID {
+				t.Errorf("backend span %s has parent %d", span.Name, span.Parent)
+			}
+		}
+	}
+	if backendCalls == 0 {
+		t.Error("no backend spans recorded")
+	}
+
+	auth.SetTracer(nil)
+	recorder.Reset()
+	auth.Authorize(rw, requestWithCookies("GET", "/", cookies), false)
+	if spans := recorder.Spans(); len(spans) != 0 {
+		t.Errorf("spans recorded without a tracer: %v", spans)
+	}
+}
+
+func TestWrappedBackendOptionalInterfaces(t *testing.T) {
+	file := "tracing_test.gob"
+	os.Remove(file)
+	if _, err := os.Create(file); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(file)
+	gob, err := NewGobFileAuthBackend(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	backend := InstrumentBackend(usersOnlyBackend{gob}, NewMetrics())
+	auth, err := NewAuthorizer(backend, []byte("testkey"), "user", map[string]Role{"user": 40, "admin": 80})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	auth.SetTracer(&SpanRecorder{})
+
+	cookies := testLogin(t, auth, "plain", "user")
+	rw := httptest.NewRecorder()
+	if err := auth.AuthorizeRole(rw, requestWithCookies("GET", "/", cookies), "user", false); err != nil {
+		t.Errorf("AuthorizeRole with a backend without groups: %v", err)
+	}
+	if err := auth.SaveGroup(Group{Name: "staff"}); err == nil || err.Error() != "httpauth: backend doesn't support groups" {
+		t.Errorf("SaveGroup: expected unsupported error, got %v", err)
+	}
+	if err := auth.DeleteUser("plain"); err != nil {
+		t.Errorf("DeleteUser: %v", err)
+	}
+	if _, err := NewWebhookDispatcher(backend); err == nil {
+		t.Error("NewWebhookDispatcher: expected unsupported error")
+	}
+}
+
+func findSpan(t *testing.T, spans []RecordedSpan, name string) RecordedSpan {
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no %s span in %v", name, spans)
+	return RecordedSpan{}
+}
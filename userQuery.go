@@ -0,0 +1,314 @@
+package httpauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sort orders for UserQuery. Prefix one with "-" to sort in descending
+// order. Users sorting equally are ordered by username.
+const (
+	SortByUsername  = "username"
+	SortByEmail     = "email"
+	SortByCreated   = "created"
+	SortByLastLogin = "last_login"
+)
+
+// Limits on the number of users returned by a query.
+const (
+	DefaultUserQueryLimit = 100
+	MaxUserQueryLimit     = 1000
+)
+
+// Errors returned for invalid queries.
+var (
+	ErrInvalidCursor = mkerror("invalid cursor")
+	ErrInvalidSort   = mkerror("invalid sort order")
+)
+
+// ErrStopIteration can be returned by the function passed to ForEachUser to
+// stop without ForEachUser returning an error.
+var ErrStopIteration = mkerror("stop iteration")
+
+// UserQuery selects a page of users. Prefixes are matched ignoring case.
+type UserQuery struct {
+	Role           string // only users with this role, if set
+	UsernamePrefix string
+	EmailPrefix    string
+	// Sort is one of the SortBy constants, optionally prefixed by "-".
+	// Defaults to SortByUsername.
+	Sort string
+	// Limit is the most users returned, DefaultUserQueryLimit if <= 0 and
+	// at most MaxUserQueryLimit.
+	Limit int
+	// Cursor is the NextCursor of the previous page, or empty for the
+	// first page. It's only valid with the same Sort.
+	Cursor string
+}
+
+// UserPage is a page of users returned by a query.
+type UserPage struct {
+	Users []UserData
+	// NextCursor fetches the next page, and is empty on the last.
+	NextCursor string
+}
+
+// The UserQueryBackend interface is implemented by AuthBackends able to
+// list users a page at a time. All backends in this package implement it.
+type UserQueryBackend interface {
+	QueryUsers(q UserQuery) (UserPage, error)
+	// CountUsers returns the number of users matching a query's filters,
+	// ignoring its Limit and Cursor.
+	CountUsers(q UserQuery) (int, error)
+}
+
+// The UserIteratorBackend interface is implemented by AuthBackends able to
+// walk through every user without loading them all at once. All backends in
+// this package implement it.
+type UserIteratorBackend interface {
+	// ForEachUser calls fn with each user, in username order, stopping when
+	// fn returns an error or ctx is done. It returns nil if fn returned
+	// ErrStopIteration, and fn's other errors as they are.
+	ForEachUser(ctx context.Context, fn func(user UserData) error) error
+}
+
+// userCursor is the position after the last user of a page, encoded as JSON
+// in base64.
+type userCursor struct {
+	Sort     string    `json:"s"`
+	Key      string    `json:"k,omitempty"` // email
+	Time     time.Time `json:"t,omitempty"` // created or last_login
+	Username string    `json:"u"`
+}
+
+// userQueryPlan is a validated UserQuery.
+type userQueryPlan struct {
+	UserQuery
+	field string // a SortBy constant
+	desc  bool
+	after *userCursor // nil for the first page
+}
+
+// plan validates a query, filling in defaults.
+func (q UserQuery) plan() (userQueryPlan, error) {
+	p := userQueryPlan{UserQuery: q, field: strings.TrimPrefix(q.Sort, "-"), desc: strings.HasPrefix(q.Sort, "-")}
+	if q.Sort == "" {
+		p.field = SortByUsername
+	}
+	switch p.field {
+	case SortByUsername, SortByEmail, SortByCreated, SortByLastLogin:
+	default:
+		return p, ErrInvalidSort
+	}
+	if p.Limit <= 0 {
+		p.Limit = DefaultUserQueryLimit
+	} else if p.Limit > MaxUserQueryLimit {
+		p.Limit = MaxUserQueryLimit
+	}
+	if q.Cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil {
+			return p, ErrInvalidCursor
+		}
+		p.after = new(userCursor)
+		if err := json.Unmarshal(data, p.after); err != nil || p.after.Sort != p.Sort {
+			return p, ErrInvalidCursor
+		}
+	}
+	return p, nil
+}
+
+// filters validates a query's filters and sort order for counting, ignoring
+// its cursor.
+func (q UserQuery) filters() (userQueryPlan, error) {
+	q.Cursor = ""
+	return q.plan()
+}
+
+// key returns the position of a user in a query's order.
+func (p userQueryPlan) key(user UserData) userCursor {
+	c := userCursor{Sort: p.Sort, Username: user.Username}
+	switch p.field {
+	case SortByEmail:
+		c.Key = user.Email
+	case SortByCreated:
+		c.Time = user.CreatedAt
+	case SortByLastLogin:
+		c.Time = user.LastLoginAt
+	}
+	return c
+}
+
+// cursor returns the cursor for the page ending with user.
+func (p userQueryPlan) cursor(user UserData) string {
+	data, _ := json.Marshal(p.key(user))
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// page returns the page of a query's results given up to Limit+1 users,
+// setting NextCursor if there are more than Limit.
+func (p userQueryPlan) page(users []UserData) UserPage {
+	if len(users) <= p.Limit {
+		return UserPage{Users: users}
+	}
+	users = users[:p.Limit]
+	return UserPage{Users: users, NextCursor: p.cursor(users[len(users)-1])}
+}
+
+// The following helpers implement UserQueryBackend for backends keeping
+// users in memory.
+
+// matches reports whether a user passes a query's filters.
+func (p userQueryPlan) matches(user UserData) bool {
+	return (p.Role == "" || user.Role == p.Role) &&
+		strings.HasPrefix(strings.ToLower(user.Username), strings.ToLower(p.UsernamePrefix)) &&
+		strings.HasPrefix(strings.ToLower(user.Email), strings.ToLower(p.EmailPrefix))
+}
+
+// before reports whether position a comes before b in a query's order.
+func (p userQueryPlan) before(a, b userCursor) bool {
+	n := strings.Compare(a.Key, b.Key)
+	if n == 0 {
+		n = compareTimes(a.Time, b.Time)
+	}
+	if n == 0 {
+		n = strings.Compare(a.Username, b.Username)
+	}
+	if p.desc {
+		return n > 0
+	}
+	return n < 0
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func queryUsers(users []UserData, q UserQuery) (UserPage, error) {
+	p, err := q.plan()
+	if err != nil {
+		return UserPage{}, err
+	}
+	var found []UserData
+	for _, user := range users {
+		if p.matches(user) && (p.after == nil || p.before(*p.after, p.key(user))) {
+			found = append(found, user)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return p.before(p.key(found[i]), p.key(found[j])) })
+	if len(found) > p.Limit+1 {
+		found = found[:p.Limit+1]
+	}
+	return p.page(found), nil
+}
+
+func countUsers(users []UserData, q UserQuery) (int, error) {
+	p, err := q.filters()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, user := range users {
+		if p.matches(user) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// stopIteration returns the error ForEachUser returns when fn returns err.
+func stopIteration(err error) error {
+	if err == ErrStopIteration {
+		return nil
+	}
+	return err
+}
+
+func forEachUser(ctx context.Context, users []UserData, fn func(user UserData) error) error {
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	for _, user := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return stopIteration(err)
+		}
+	}
+	return nil
+}
+
+// QueryUsers returns a page of the users matching a query. Backends not
+// implementing UserQueryBackend are queried by loading every user.
+func (a Authorizer) QueryUsers(q UserQuery) (UserPage, error) {
+	if _, err := q.plan(); err != nil {
+		return UserPage{}, err
+	}
+	var (
+		page UserPage
+		err  error
+	)
+	if qb, ok := asUserQueryBackend(a.backend); ok {
+		page, err = qb.QueryUsers(q)
+	} else {
+		var users []UserData
+		if users, err = a.backend.Users(); err == nil {
+			page, err = queryUsers(users, q)
+		}
+	}
+	if err != nil {
+		return UserPage{}, mkerror(err.Error())
+	}
+	return page, nil
+}
+
+// CountUsers returns the number of users matching a query's filters.
+func (a Authorizer) CountUsers(q UserQuery) (int, error) {
+	if _, err := q.filters(); err != nil {
+		return 0, err
+	}
+	var (
+		n   int
+		err error
+	)
+	if qb, ok := asUserQueryBackend(a.backend); ok {
+		n, err = qb.CountUsers(q)
+	} else {
+		var users []UserData
+		if users, err = a.backend.Users(); err == nil {
+			n, err = countUsers(users, q)
+		}
+	}
+	if err != nil {
+		return 0, mkerror(err.Error())
+	}
+	return n, nil
+}
+
+// ForEachUser calls fn with each user, in username order, until fn returns an
+// error or ctx is done. Unless fn returns ErrStopIteration, its error is
+// returned. Backends not implementing UserIteratorBackend load every user
+// first.
+//
+// Changing users from fn may fail with databases locking the tables being
+// read, such as SQLite. Collect the users to change and change them
+// afterwards, or page through users with QueryUsers instead.
+func (a Authorizer) ForEachUser(ctx context.Context, fn func(user UserData) error) error {
+	if ib, ok := asUserIteratorBackend(a.backend); ok {
+		return ib.ForEachUser(ctx, fn)
+	}
+	users, err := a.backend.Users()
+	if err != nil {
+		return mkerror(err.Error())
+	}
+	return forEachUser(ctx, users, fn)
+}
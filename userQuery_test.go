@@ -0,0 +1,124 @@
+package httpauth
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueryUsers(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "userQuery_test.gob")
+	defer done()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		role := "user"
+		if i%2 == 1 {
+			role = "admin"
+		}
+		user := UserData{Username: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@example.com", i), Role: role,
+			LastLoginAt: start.Add(time.Duration(i%3) * time.Hour)}
+		if err := auth.backend.SaveUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	query := func(auth Authorizer, q UserQuery) (pages [][]string) {
+		for {
+			page, err := auth.QueryUsers(q)
+			if err != nil {
+				t.Fatalf("QueryUsers(%+v) error: %v", q, err)
+			}
+			var names []string
+			for _, user := range page.Users {
+				names = append(names, user.Username)
+			}
+			pages = append(pages, names)
+			if page.NextCursor == "" {
+				return pages
+			}
+			q.Cursor = page.NextCursor
+		}
+	}
+
+	fallback := auth
+	fallback.backend = usersOnlyBackend{auth.backend}
+	if _, ok := asUserQueryBackend(fallback.backend); ok {
+		t.Fatal("usersOnlyBackend shouldn't implement UserQueryBackend")
+	}
+	tests := []struct {
+		query UserQuery
+		pages [][]string
+	}{
+		{UserQuery{Role: "admin", Limit: 2}, [][]string{{"user1", "user3"}, {"user5"}}},
+		{UserQuery{Sort: "-last_login", Limit: 3}, [][]string{{"user5", "user2", "user4"}, {"user1", "user6", "user3"}, {"user0"}}},
+		{UserQuery{EmailPrefix: "USER6@"}, [][]string{{"user6"}}},
+		{UserQuery{Role: "user", UsernamePrefix: "user1"}, [][]string{nil}},
+	}
+	for _, test := range tests {
+		for _, a := range []Authorizer{auth, fallback} {
+			if pages := query(a, test.query); !reflect.DeepEqual(pages, test.pages) {
+				t.Errorf("QueryUsers(%+v): expected %v, got %v", test.query, test.pages, pages)
+			}
+		}
+	}
+
+	for _, a := range []Authorizer{auth, fallback} {
+		if n, err := a.CountUsers(UserQuery{Role: "user"}); err != nil || n != 4 {
+			t.Errorf("CountUsers: expected 4, got %d, %v", n, err)
+		}
+		if _, err := a.CountUsers(UserQuery{Sort: "-"}); err != ErrInvalidSort {
+			t.Errorf("CountUsers: expected ErrInvalidSort, got %v", err)
+		}
+	}
+	page, _ := auth.QueryUsers(UserQuery{Limit: MaxUserQueryLimit + 1})
+	if len(page.Users) != 7 {
+		t.Errorf("QueryUsers: expected 7 users, got %d", len(page.Users))
+	}
+}
+
+func TestUserQueryPlan(t *testing.T) {
+	p, err := UserQuery{Limit: MaxUserQueryLimit + 1}.plan()
+	if err != nil || p.Limit != MaxUserQueryLimit || p.field != SortByUsername || p.desc {
+		t.Errorf("plan: unexpected %+v, %v", p, err)
+	}
+	if p, _ = (UserQuery{Sort: "-created"}).plan(); p.Limit != DefaultUserQueryLimit || p.field != SortByCreated || !p.desc {
+		t.Errorf("plan: unexpected %+v", p)
+	}
+	if _, err := (UserQuery{Cursor: "e30"}).plan(); err != nil {
+		t.Errorf("plan: expected cursor of the default sort to be accepted, got %v", err)
+	}
+	if _, err := (UserQuery{Sort: "email", Cursor: "e30"}).plan(); err != ErrInvalidCursor {
+		t.Errorf("plan: expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestForEachUser(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "forEachUser_test.gob")
+	defer done()
+	for _, username := range []string{"b", "c", "a"} {
+		if err := auth.backend.SaveUser(UserData{Username: username}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fallback := auth
+	fallback.backend = usersOnlyBackend{auth.backend}
+	for _, a := range []Authorizer{auth, fallback} {
+		var names []string
+		err := a.ForEachUser(context.Background(), func(user UserData) error {
+			names = append(names, user.Username)
+			if user.Username == "b" {
+				return ErrStopIteration
+			}
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(names, []string{"a", "b"}) {
+			t.Errorf("ForEachUser: expected to stop after a, b, got %v, %v", names, err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := a.ForEachUser(ctx, func(user UserData) error { return nil }); err != context.Canceled {
+			t.Errorf("ForEachUser: expected context.Canceled, got %v", err)
+		}
+	}
+}
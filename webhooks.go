@@ -0,0 +1,419 @@
+package httpauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Webhook event types.
+const (
+	WebhookUserCreated  = "user.created"
+	WebhookUserUpdated  = "user.updated"
+	WebhookUserDisabled = "user.disabled"
+	WebhookUserEnabled  = "user.enabled"
+	WebhookUserLocked   = "user.locked"
+	WebhookUserDeleted  = "user.deleted"
+)
+
+// webhookActions maps the Authorizer actions webhooks are sent for to their
+// event types.
+var webhookActions = map[string]string{
+	ActionRegister:         WebhookUserCreated,
+	ActionUpdate:           WebhookUserUpdated,
+	ActionUpdateAttributes: WebhookUserUpdated,
+	ActionSetUserExpiry:    WebhookUserUpdated,
+	ActionSetRole:          WebhookUserUpdated,
+	ActionDisableUser:      WebhookUserDisabled,
+	ActionEnableUser:       WebhookUserEnabled,
+	ActionLockUser:         WebhookUserLocked,
+	ActionDeleteUser:       WebhookUserDeleted,
+}
+
+// WebhookPayload is the JSON body POSTed to webhook endpoints.
+type WebhookPayload struct {
+	ID    string      `json:"id"`
+	Type  string      `json:"type"`
+	Time  time.Time   `json:"time"`
+	User  WebhookUser `json:"user"`
+	Actor string      `json:"actor,omitempty"`
+}
+
+// WebhookUser is the user a webhook is about. It leaves out the password
+// hash.
+type WebhookUser struct {
+	Username    string     `json:"username"`
+	Email       string     `json:"email"`
+	Role        string     `json:"role"`
+	Status      string     `json:"status"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Attributes  Attributes `json:"attributes,omitempty"`
+}
+
+// WebhookDelivery is a payload waiting to be delivered to an endpoint, or,
+// once Dead, one that couldn't be.
+type WebhookDelivery struct {
+	ID          string    `bson:"ID"`
+	URL         string    `bson:"URL"`
+	Event       string    `bson:"Event"`
+	Payload     []byte    `bson:"Payload"`
+	Attempts    int       `bson:"Attempts"`
+	NextAttempt time.Time `bson:"NextAttempt"`
+	LastError   string    `bson:"LastError"`
+	Dead        bool      `bson:"Dead"`
+	CreatedAt   time.Time `bson:"CreatedAt"`
+}
+
+// The WebhookBackend interface is implemented by AuthBackends able to store
+// a queue of webhook deliveries. All backends in this package implement it.
+type WebhookBackend interface {
+	// SaveWebhookDelivery adds a delivery or replaces the one with its ID.
+	SaveWebhookDelivery(d WebhookDelivery) error
+	// WebhookDelivery returns the delivery with an ID, or ErrMissingDelivery.
+	WebhookDelivery(id string) (d WebhookDelivery, e error)
+	// WebhookDeliveries returns pending deliveries, or dead ones, oldest
+	// first.
+	WebhookDeliveries(dead bool) (deliveries []WebhookDelivery, e error)
+	DeleteWebhookDelivery(id string) error
+}
+
+// ErrMissingDelivery is returned by WebhookBackends when a delivery is not
+// found.
+var ErrMissingDelivery = mkerror("can't find webhook delivery")
+
+// WebhookEndpoint is a URL webhooks are POSTed to. Each payload is signed
+// with Secret; see WebhookDispatcher. If Events is empty, every event is
+// sent.
+type WebhookEndpoint struct {
+	URL    string
+	Secret []byte
+	Events []string
+}
+
+// WebhookDispatcher POSTs JSON payloads describing changes to users to
+// webhook endpoints.
+//
+// Deliveries are queued in the backend before being attempted, so they
+// survive restarts. Requests carry the headers X-Httpauth-Event,
+// X-Httpauth-Delivery and X-Httpauth-Signature, the last being "sha256="
+// followed by the hex HMAC-SHA256 of the body keyed with the endpoint's
+// secret. Any 2xx response is a success; otherwise the delivery is retried
+// with exponential backoff, starting at BaseDelay and capped at MaxDelay,
+// and after MaxAttempts it's moved to the dead letter list, from which it can
+// be replayed. Deliveries queued for a URL that's no longer an endpoint, for
+// instance after a restart, are moved there without being sent.
+type WebhookDispatcher struct {
+	Client      *http.Client
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Logger      *log.Logger
+
+	backend     WebhookBackend
+	endpoints   []WebhookEndpoint
+	endpointsMu sync.RWMutex
+
+	mu   sync.Mutex // held while processing the queue
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWebhookDispatcher returns a dispatcher queueing deliveries in backend,
+// which must implement WebhookBackend.
+func NewWebhookDispatcher(backend AuthBackend) (*WebhookDispatcher, error) {
+	wb, ok := asWebhookBackend(backend)
+	if !ok {
+		return nil, mkerror("backend doesn't support webhooks")
+	}
+	return &WebhookDispatcher{
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: 8,
+		BaseDelay:   time.Minute,
+		MaxDelay:    6 * time.Hour,
+		Logger:      log.New(os.Stderr, "httpauth: ", log.LstdFlags),
+		backend:     wb,
+	}, nil
+}
+
+// AddEndpoint adds a URL to send events to. If no events are given, all
+// events are sent. Endpoints should be added before events are queued.
+func (d *WebhookDispatcher) AddEndpoint(url string, secret []byte, events ...string) {
+	d.endpointsMu.Lock()
+	defer d.endpointsMu.Unlock()
+	d.endpoints = append(d.endpoints, WebhookEndpoint{url, secret, events})
+}
+
+// currentEndpoints returns the endpoints added so far.
+func (d *WebhookDispatcher) currentEndpoints() []WebhookEndpoint {
+	d.endpointsMu.RLock()
+	defer d.endpointsMu.RUnlock()
+	return d.endpoints
+}
+
+// Attach makes an Authorizer queue webhooks when users are created, updated,
+// disabled, enabled, locked or deleted. Call ProcessQueue, or Start, to
+// deliver them.
+func (d *WebhookDispatcher) Attach(a Authorizer) {
+	for action, event := range webhookActions {
+		event := event
+		a.AddAfterHook(action, func(e HookEvent) error {
+			actor := e.Actor
+			if actor == "" && e.Action == ActionRegister {
+				// self-registration, as in the audit log
+				actor = e.User.Username
+			}
+			return d.Enqueue(event, e.User, actor)
+		})
+	}
+}
+
+// Enqueue queues an event about a user for every endpoint interested in it.
+func (d *WebhookDispatcher) Enqueue(event string, user UserData, actor string) error {
+	now := time.Now()
+	payload := WebhookPayload{
+		ID:    newWebhookID(),
+		Type:  event,
+		Time:  now,
+		Actor: actor,
+		User: WebhookUser{
+			Username:   user.Username,
+			Email:      user.Email,
+			Role:       user.Role,
+			Status:     user.AccountStatus(now),
+			Attributes: user.Attributes,
+		},
+	}
+	if !user.LockedUntil.IsZero() {
+		payload.User.LockedUntil = &user.LockedUntil
+	}
+	if !user.ExpiresAt.IsZero() {
+		payload.User.ExpiresAt = &user.ExpiresAt
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return mkerror(err.Error())
+	}
+	for _, endpoint := range d.currentEndpoints() {
+		if len(endpoint.Events) > 0 && !containsString(endpoint.Events, event) {
+			continue
+		}
+		delivery := WebhookDelivery{
+			ID:          newWebhookID(),
+			URL:         endpoint.URL,
+			Event:       event,
+			Payload:     body,
+			NextAttempt: now,
+			CreatedAt:   now,
+		}
+		if err := d.backend.SaveWebhookDelivery(delivery); err != nil {
+			return mkerror(err.Error())
+		}
+	}
+	return nil
+}
+
+// ProcessQueue attempts every delivery that's due.
+func (d *WebhookDispatcher) ProcessQueue() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deliveries, err := d.backend.WebhookDeliveries(false)
+	if err != nil {
+		return mkerror(err.Error())
+	}
+	now := time.Now()
+	for _, delivery := range deliveries {
+		if delivery.NextAttempt.After(now) {
+			continue
+		}
+		if err := d.deliver(delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver attempts a delivery, then removes it from the queue or schedules a
+// retry. Deliveries to URLs no longer among the endpoints are dead lettered
+// without being sent, as there's no secret to sign them with.
+func (d *WebhookDispatcher) deliver(delivery WebhookDelivery) error {
+	secret, ok := d.secret(delivery.URL)
+	if !ok {
+		delivery.Dead = true
+		delivery.LastError = "no webhook endpoint for " + delivery.URL
+		d.Logger.Printf("webhook %s to %s not sent: endpoint removed", delivery.ID, delivery.URL)
+		if err := d.backend.SaveWebhookDelivery(delivery); err != nil {
+			return mkerror(err.Error())
+		}
+		return nil
+	}
+	err := d.post(delivery, secret)
+	if err == nil {
+		if err := d.backend.DeleteWebhookDelivery(delivery.ID); err != nil {
+			return mkerror(err.Error())
+		}
+		return nil
+	}
+	delivery.Attempts++
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= d.MaxAttempts {
+		delivery.Dead = true
+		d.Logger.Printf("webhook %s to %s failed %d times, giving up: %v", delivery.ID, delivery.URL, delivery.Attempts, err)
+	} else {
+		delivery.NextAttempt = time.Now().Add(d.backoff(delivery.Attempts))
+	}
+	if err := d.backend.SaveWebhookDelivery(delivery); err != nil {
+		return mkerror(err.Error())
+	}
+	return nil
+}
+
+// backoff returns how long to wait after a number of failed attempts.
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < attempts && delay < d.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxDelay {
+		delay = d.MaxDelay
+	}
+	return delay
+}
+
+// secret returns the secret of the endpoint with a URL.
+func (d *WebhookDispatcher) secret(url string) ([]byte, bool) {
+	for _, endpoint := range d.currentEndpoints() {
+		if endpoint.URL == url {
+			return endpoint.Secret, true
+		}
+	}
+	return nil, false
+}
+
+func (d *WebhookDispatcher) post(delivery WebhookDelivery, secret []byte) error {
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Httpauth-Event", delivery.Event)
+	req.Header.Set("X-Httpauth-Delivery", delivery.ID)
+	req.Header.Set("X-Httpauth-Signature", SignWebhook(secret, delivery.Payload))
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", delivery.URL, resp.Status)
+	}
+	return nil
+}
+
+// Start processes the queue every interval in the background until Stop is
+// called.
+func (d *WebhookDispatcher) Start(interval time.Duration) {
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := d.ProcessQueue(); err != nil {
+				d.Logger.Printf("webhooks: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops processing started with Start, waiting for the current run to
+// finish.
+func (d *WebhookDispatcher) Stop() {
+	if d.stop == nil {
+		return
+	}
+	close(d.stop)
+	<-d.done
+	d.stop = nil
+}
+
+// Pending returns the deliveries waiting to be attempted, oldest first.
+func (d *WebhookDispatcher) Pending() ([]WebhookDelivery, error) {
+	return d.backend.WebhookDeliveries(false)
+}
+
+// DeadLetters returns the deliveries that were given up on, oldest first.
+func (d *WebhookDispatcher) DeadLetters() ([]WebhookDelivery, error) {
+	return d.backend.WebhookDeliveries(true)
+}
+
+// Replay moves a dead delivery back into the queue, to be attempted on the
+// next run with a fresh set of retries. Deliveries to removed endpoints are
+// dead lettered again unless an endpoint with their URL has been added back.
+func (d *WebhookDispatcher) Replay(id string) error {
+	delivery, err := d.backend.WebhookDelivery(id)
+	if err != nil {
+		return err
+	}
+	if !delivery.Dead {
+		return mkerror("webhook delivery isn't dead")
+	}
+	delivery.Dead = false
+	delivery.Attempts = 0
+	delivery.NextAttempt = time.Now()
+	if err := d.backend.SaveWebhookDelivery(delivery); err != nil {
+		return mkerror(err.Error())
+	}
+	return nil
+}
+
+// SignWebhook returns the X-Httpauth-Signature header value for a payload.
+// Receivers should compute it themselves and compare with hmac.Equal.
+func SignWebhook(secret []byte, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// sortDeliveries sorts deliveries oldest first.
+func sortDeliveries(deliveries []WebhookDelivery) {
+	sort.Sort(byCreated(deliveries))
+}
+
+type byCreated []WebhookDelivery
+
+func (d byCreated) Len() int      { return len(d) }
+func (d byCreated) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d byCreated) Less(i, j int) bool {
+	if !d[i].CreatedAt.Equal(d[j].CreatedAt) {
+		return d[i].CreatedAt.Before(d[j].CreatedAt)
+	}
+	return d[i].ID < d[j].ID
+}
@@ -0,0 +1,262 @@
+package httpauth
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the webhooks POSTed to it, responding with status.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	payloads []WebhookPayload
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func (r *webhookReceiver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var payload WebhookPayload
+	json.Unmarshal(body, &payload)
+	r.payloads = append(r.payloads, payload)
+	r.headers = append(r.headers, req.Header)
+	r.bodies = append(r.bodies, body)
+	rw.WriteHeader(r.status)
+}
+
+func newTestDispatcher(t *testing.T, auth Authorizer) *WebhookDispatcher {
+	d, err := NewWebhookDispatcher(auth.backend)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	d.BaseDelay = time.Millisecond
+	d.MaxDelay = 4 * time.Millisecond
+	d.MaxAttempts = 3
+	d.Logger = log.New(ioutil.Discard, "", 0)
+	return d
+}
+
+func TestWebhooks(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "webhooks_test.gob")
+	defer done()
+	receiver := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	filtered := &webhookReceiver{status: http.StatusOK}
+	filteredServer := httptest.NewServer(filtered)
+	defer filteredServer.Close()
+
+	d := newTestDispatcher(t, auth)
+	secret := []byte("webhook secret")
+	d.AddEndpoint(server.URL, secret)
+	d.AddEndpoint(filteredServer.URL, secret, WebhookUserDeleted)
+	d.Attach(auth)
+
+	testLogin(t, auth, "hooked", "user")
+	if err := auth.DisableUser("hooked", "left"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := auth.DeleteUser("hooked"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pending, _ := d.Pending(); len(pending) != 4 {
+		t.Fatalf("expected 4 queued deliveries, got %d", len(pending))
+	}
+	if err := d.ProcessQueue(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if pending, _ := d.Pending(); len(pending) != 0 {
+		t.Fatalf("delivered webhooks still queued: %v", pending)
+	}
+
+	expected := []string{WebhookUserCreated, WebhookUserDisabled, WebhookUserDeleted}
+	if len(receiver.payloads) != len(expected) {
+		t.Fatalf("expected %d webhooks, got %d", len(expected), len(receiver.payloads))
+	}
+	for i, payload := range receiver.payloads {
+		if payload.Type != expected[i] || payload.User.Username != "hooked" {
+			t.Errorf("webhook %d: expected %s for hooked, got %v", i, expected[i], payload)
+		}
+		header := receiver.headers[i]
+		if header.Get("X-Httpauth-Event") != expected[i] || header.Get("X-Httpauth-Delivery") == "" {
+			t.Errorf("webhook %d: headers not set: %v", i, header)
+		}
+		signature := SignWebhook(secret, receiver.bodies[i])
+		if !hmac.Equal([]byte(header.Get("X-Httpauth-Signature")), []byte(signature)) {
+			t.Errorf("webhook %d: bad signature %q", i, header.Get("X-Httpauth-Signature"))
+		}
+	}
+	if receiver.payloads[0].Actor != "hooked" {
+		t.Errorf("user.created: expected actor hooked, got %q", receiver.payloads[0].Actor)
+	}
+	if receiver.payloads[1].User.Status != StatusDisabled {
+		t.Errorf("user.disabled: expected disabled status, got %q", receiver.payloads[1].User.Status)
+	}
+	if len(filtered.payloads) != 1 || filtered.payloads[0].Type != WebhookUserDeleted {
+		t.Errorf("endpoint filter not applied: %v", filtered.payloads)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "webhooks_test.gob")
+	defer done()
+	receiver := &webhookReceiver{status: http.StatusInternalServerError}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	d := newTestDispatcher(t, auth)
+	d.AddEndpoint(server.URL, []byte("secret"))
+	if err := d.Enqueue(WebhookUserUpdated, UserData{Username: "retried"}, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := d.ProcessQueue(); err != nil {
+		t.Fatal(err.Error())
+	}
+	pending, _ := d.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError == "" {
+		t.Fatalf("failed delivery not rescheduled: %v", pending)
+	}
+	if !pending[0].NextAttempt.After(time.Now().Add(-time.Second)) {
+		t.Errorf("retry not delayed: %v", pending[0].NextAttempt)
+	}
+	if err := d.ProcessQueue(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(receiver.payloads) != 1 {
+		t.Errorf("delivery retried before its backoff elapsed")
+	}
+	for i := 0; i < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if err := d.ProcessQueue(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if pending, _ := d.Pending(); len(pending) != 0 {
+		t.Fatalf("delivery still pending after MaxAttempts: %v", pending)
+	}
+	dead, _ := d.DeadLetters()
+	if len(dead) != 1 || dead[0].Attempts != 3 {
+		t.Fatalf("expected a dead letter after 3 attempts, got %v", dead)
+	}
+
+	receiver.mu.Lock()
+	receiver.status = http.StatusNoContent
+	receiver.mu.Unlock()
+	if err := d.Replay(dead[0].ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := d.ProcessQueue(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if dead, _ := d.DeadLetters(); len(dead) != 0 {
+		t.Errorf("replayed delivery still dead: %v", dead)
+	}
+	if len(receiver.payloads) != 4 || receiver.payloads[3].User.Username != "retried" {
+		t.Errorf("replayed delivery not sent: %d webhooks", len(receiver.payloads))
+	}
+	if err := d.Replay(dead[0].ID); err != ErrMissingDelivery {
+		t.Errorf("Replay: expected ErrMissingDelivery, got %v", err)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	d := &WebhookDispatcher{BaseDelay: time.Minute, MaxDelay: 10 * time.Minute}
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, delay := range expected {
+		if got := d.backoff(i + 1); got != delay {
+			t.Errorf("backoff(%d): expected %v, got %v", i+1, delay, got)
+		}
+	}
+}
+
+// TestWebhookStart registers users while the queue is processed in the
+// background; run with -race to check the backend is safe to share.
+func TestWebhookStart(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "webhooks_test.gob")
+	defer done()
+	receiver := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	d := newTestDispatcher(t, auth)
+	d.AddEndpoint(server.URL, []byte("secret"))
+	d.Attach(auth)
+	d.Start(time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				req, _ := http.NewRequest("POST", "/", nil)
+				user := UserData{Username: fmt.Sprintf("user%d-%d", i, j), Email: "user@example.com"}
+				if err := auth.Register(httptest.NewRecorder(), req, user, "password"); err != nil {
+					t.Error(err.Error())
+				}
+			}
+		}(i)
+	}
+	d.AddEndpoint(server.URL, []byte("other secret"), WebhookUserDeleted)
+	wg.Wait()
+	d.Stop()
+	if err := d.ProcessQueue(); err != nil {
+		t.Fatal(err.Error())
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.payloads) != 20 {
+		t.Errorf("expected 20 webhooks, got %d", len(receiver.payloads))
+	}
+}
+
+func TestWebhookRemovedEndpoint(t *testing.T) {
+	auth, done := newTestAuthorizer(t, "webhooks_test.gob")
+	defer done()
+	receiver := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	d := newTestDispatcher(t, auth)
+	d.AddEndpoint(server.URL, []byte("secret"))
+	if err := d.Enqueue(WebhookUserUpdated, UserData{Username: "orphaned"}, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	// a restarted dispatcher without the endpoint
+	d = newTestDispatcher(t, auth)
+	if err := d.ProcessQueue(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(receiver.payloads) != 0 {
+		t.Fatal("delivery sent to a removed endpoint")
+	}
+	dead, _ := d.DeadLetters()
+	if len(dead) != 1 || dead[0].Attempts != 0 || dead[0].LastError == "" {
+		t.Fatalf("expected delivery to a removed endpoint to be dead lettered, got %v", dead)
+	}
+
+	secret := []byte("new secret")
+	d.AddEndpoint(server.URL, secret)
+	if err := d.Replay(dead[0].ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := d.ProcessQueue(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(receiver.payloads) != 1 {
+		t.Fatalf("replayed delivery not sent: %d webhooks", len(receiver.payloads))
+	}
+	if !hmac.Equal([]byte(receiver.headers[0].Get("X-Httpauth-Signature")), []byte(SignWebhook(secret, receiver.bodies[0]))) {
+		t.Error("replayed delivery not signed with the endpoint's secret")
+	}
+}
@@ -0,0 +1,432 @@
+package httpauth
+
+import (
+	"context"
+	"time"
+)
+
+// wrappedBackend passes calls through to backend, calling call before each
+// and the function it returns with the call's error afterwards. It implements
+// every optional backend interface; calls to ones backend doesn't implement
+// return an error, so callers check with the as...Backend functions.
+type wrappedBackend struct {
+	backend AuthBackend
+	call    func(method string) backendCall
+}
+
+// backendCall is called when a wrapped backend call returns.
+type backendCall func(err error)
+
+func (c backendCall) end(err *error) {
+	c(*err)
+}
+
+// passThrough is the call of a wrappedBackend doing nothing around calls.
+func passThrough(method string) backendCall {
+	return func(err error) {}
+}
+
+// backendWrapper is implemented by backends wrapping another.
+type backendWrapper interface {
+	wrapped() AuthBackend
+}
+
+func (b wrappedBackend) wrapped() AuthBackend {
+	return b.backend
+}
+
+// innerBackend returns the backend at the bottom of any wrappers.
+func innerBackend(backend AuthBackend) AuthBackend {
+	for {
+		w, ok := backend.(backendWrapper)
+		if !ok {
+			return backend
+		}
+		backend = w.wrapped()
+	}
+}
+
+// asGroupBackend, asTenantBackend, asLoginHistoryBackend, asWebhookBackend,
+// asUserQueryBackend, asUserIteratorBackend and asEmailBackend check whether
+// backend, underneath any wrappers, implements an optional interface.
+
+func asGroupBackend(backend AuthBackend) (GroupBackend, bool) {
+	if _, ok := innerBackend(backend).(GroupBackend); !ok {
+		return nil, false
+	}
+	gb, ok := backend.(GroupBackend)
+	return gb, ok
+}
+
+func asTenantBackend(backend AuthBackend) (TenantBackend, bool) {
+	if _, ok := innerBackend(backend).(TenantBackend); !ok {
+		return nil, false
+	}
+	tb, ok := backend.(TenantBackend)
+	return tb, ok
+}
+
+func asLoginHistoryBackend(backend AuthBackend) (LoginHistoryBackend, bool) {
+	if _, ok := innerBackend(backend).(LoginHistoryBackend); !ok {
+		return nil, false
+	}
+	hb, ok := backend.(LoginHistoryBackend)
+	return hb, ok
+}
+
+func asWebhookBackend(backend AuthBackend) (WebhookBackend, bool) {
+	if _, ok := innerBackend(backend).(WebhookBackend); !ok {
+		return nil, false
+	}
+	wb, ok := backend.(WebhookBackend)
+	return wb, ok
+}
+
+func asUserQueryBackend(backend AuthBackend) (UserQueryBackend, bool) {
+	if _, ok := innerBackend(backend).(UserQueryBackend); !ok {
+		return nil, false
+	}
+	qb, ok := backend.(UserQueryBackend)
+	return qb, ok
+}
+
+func asUserIteratorBackend(backend AuthBackend) (UserIteratorBackend, bool) {
+	if _, ok := innerBackend(backend).(UserIteratorBackend); !ok {
+		return nil, false
+	}
+	ib, ok := backend.(UserIteratorBackend)
+	return ib, ok
+}
+
+func asEmailBackend(backend AuthBackend) (EmailBackend, bool) {
+	if _, ok := innerBackend(backend).(EmailBackend); !ok {
+		return nil, false
+	}
+	eb, ok := backend.(EmailBackend)
+	return eb, ok
+}
+
+func asUniqueEmailBackend(backend AuthBackend) (UniqueEmailBackend, bool) {
+	if _, ok := innerBackend(backend).(UniqueEmailBackend); !ok {
+		return nil, false
+	}
+	ub, ok := backend.(UniqueEmailBackend)
+	return ub, ok
+}
+
+func (b wrappedBackend) SaveUser(u UserData) (err error) {
+	defer b.call("SaveUser").end(&err)
+	return b.backend.SaveUser(u)
+}
+
+func (b wrappedBackend) User(username string) (user UserData, err error) {
+	defer b.call("User").end(&err)
+	return b.backend.User(username)
+}
+
+func (b wrappedBackend) Users() (users []UserData, err error) {
+	defer b.call("Users").end(&err)
+	return b.backend.Users()
+}
+
+func (b wrappedBackend) DeleteUser(username string) (err error) {
+	defer b.call("DeleteUser").end(&err)
+	return b.backend.DeleteUser(username)
+}
+
+func (b wrappedBackend) Close() {
+	defer b.call("Close")(nil)
+	b.backend.Close()
+}
+
+func (b wrappedBackend) groups() (GroupBackend, error) {
+	gb, ok := b.backend.(GroupBackend)
+	if !ok {
+		return nil, mkerror("backend doesn't support groups")
+	}
+	return gb, nil
+}
+
+func (b wrappedBackend) SaveGroup(g Group) (err error) {
+	defer b.call("SaveGroup").end(&err)
+	gb, err := b.groups()
+	if err != nil {
+		return err
+	}
+	return gb.SaveGroup(g)
+}
+
+func (b wrappedBackend) Group(name string) (group Group, err error) {
+	defer b.call("Group").end(&err)
+	gb, err := b.groups()
+	if err != nil {
+		return Group{}, err
+	}
+	return gb.Group(name)
+}
+
+func (b wrappedBackend) Groups() (groups []Group, err error) {
+	defer b.call("Groups").end(&err)
+	gb, err := b.groups()
+	if err != nil {
+		return nil, err
+	}
+	return gb.Groups()
+}
+
+func (b wrappedBackend) UserGroupNames(username string) (names []string, err error) {
+	defer b.call("UserGroupNames").end(&err)
+	gb, err := b.groups()
+	if err != nil {
+		return nil, err
+	}
+	return gb.UserGroupNames(username)
+}
+
+func (b wrappedBackend) ParentGroupNames(name string) (names []string, err error) {
+	defer b.call("ParentGroupNames").end(&err)
+	gb, err := b.groups()
+	if err != nil {
+		return nil, err
+	}
+	return gb.ParentGroupNames(name)
+}
+
+func (b wrappedBackend) DeleteGroup(name string) (err error) {
+	defer b.call("DeleteGroup").end(&err)
+	gb, err := b.groups()
+	if err != nil {
+		return err
+	}
+	return gb.DeleteGroup(name)
+}
+
+func (b wrappedBackend) tenants() (TenantBackend, error) {
+	tb, ok := b.backend.(TenantBackend)
+	if !ok {
+		return nil, mkerror("backend doesn't support tenants")
+	}
+	return tb, nil
+}
+
+func (b wrappedBackend) SaveTenant(t Tenant) (err error) {
+	defer b.call("SaveTenant").end(&err)
+	tb, err := b.tenants()
+	if err != nil {
+		return err
+	}
+	return tb.SaveTenant(t)
+}
+
+func (b wrappedBackend) Tenant(name string) (tenant Tenant, err error) {
+	defer b.call("Tenant").end(&err)
+	tb, err := b.tenants()
+	if err != nil {
+		return Tenant{}, err
+	}
+	return tb.Tenant(name)
+}
+
+func (b wrappedBackend) Tenants() (tenants []Tenant, err error) {
+	defer b.call("Tenants").end(&err)
+	tb, err := b.tenants()
+	if err != nil {
+		return nil, err
+	}
+	return tb.Tenants()
+}
+
+func (b wrappedBackend) DeleteTenant(name string) (err error) {
+	defer b.call("DeleteTenant").end(&err)
+	tb, err := b.tenants()
+	if err != nil {
+		return err
+	}
+	return tb.DeleteTenant(name)
+}
+
+func (b wrappedBackend) SaveMembership(m Membership) (err error) {
+	defer b.call("SaveMembership").end(&err)
+	tb, err := b.tenants()
+	if err != nil {
+		return err
+	}
+	return tb.SaveMembership(m)
+}
+
+func (b wrappedBackend) DeleteMembership(tenant string, username string) (err error) {
+	defer b.call("DeleteMembership").end(&err)
+	tb, err := b.tenants()
+	if err != nil {
+		return err
+	}
+	return tb.DeleteMembership(tenant, username)
+}
+
+func (b wrappedBackend) Memberships(username string) (memberships []Membership, err error) {
+	defer b.call("Memberships").end(&err)
+	tb, err := b.tenants()
+	if err != nil {
+		return nil, err
+	}
+	return tb.Memberships(username)
+}
+
+func (b wrappedBackend) TenantMembers(tenant string) (memberships []Membership, err error) {
+	defer b.call("TenantMembers").end(&err)
+	tb, err := b.tenants()
+	if err != nil {
+		return nil, err
+	}
+	return tb.TenantMembers(tenant)
+}
+
+func (b wrappedBackend) loginHistory() (LoginHistoryBackend, error) {
+	hb, ok := b.backend.(LoginHistoryBackend)
+	if !ok {
+		return nil, mkerror("backend doesn't support login history")
+	}
+	return hb, nil
+}
+
+func (b wrappedBackend) SaveLoginAttempt(attempt LoginAttempt) (err error) {
+	defer b.call("SaveLoginAttempt").end(&err)
+	hb, err := b.loginHistory()
+	if err != nil {
+		return err
+	}
+	return hb.SaveLoginAttempt(attempt)
+}
+
+func (b wrappedBackend) LoginAttempts(username string, offset, limit int) (attempts []LoginAttempt, total int, err error) {
+	defer b.call("LoginAttempts").end(&err)
+	hb, err := b.loginHistory()
+	if err != nil {
+		return nil, 0, err
+	}
+	return hb.LoginAttempts(username, offset, limit)
+}
+
+func (b wrappedBackend) KnownDevice(username, ip, userAgent string) (known bool, err error) {
+	defer b.call("KnownDevice").end(&err)
+	hb, err := b.loginHistory()
+	if err != nil {
+		return false, err
+	}
+	return hb.KnownDevice(username, ip, userAgent)
+}
+
+func (b wrappedBackend) PruneLoginAttempts(username string, before time.Time, keep int) (err error) {
+	defer b.call("PruneLoginAttempts").end(&err)
+	hb, err := b.loginHistory()
+	if err != nil {
+		return err
+	}
+	return hb.PruneLoginAttempts(username, before, keep)
+}
+
+func (b wrappedBackend) DeleteLoginAttempts(username string) (err error) {
+	defer b.call("DeleteLoginAttempts").end(&err)
+	hb, err := b.loginHistory()
+	if err != nil {
+		return err
+	}
+	return hb.DeleteLoginAttempts(username)
+}
+
+func (b wrappedBackend) webhooks() (WebhookBackend, error) {
+	wb, ok := b.backend.(WebhookBackend)
+	if !ok {
+		return nil, mkerror("backend doesn't support webhooks")
+	}
+	return wb, nil
+}
+
+func (b wrappedBackend) SaveWebhookDelivery(d WebhookDelivery) (err error) {
+	defer b.call("SaveWebhookDelivery").end(&err)
+	wb, err := b.webhooks()
+	if err != nil {
+		return err
+	}
+	return wb.SaveWebhookDelivery(d)
+}
+
+func (b wrappedBackend) WebhookDelivery(id string) (d WebhookDelivery, err error) {
+	defer b.call("WebhookDelivery").end(&err)
+	wb, err := b.webhooks()
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	return wb.WebhookDelivery(id)
+}
+
+func (b wrappedBackend) WebhookDeliveries(dead bool) (deliveries []WebhookDelivery, err error) {
+	defer b.call("WebhookDeliveries").end(&err)
+	wb, err := b.webhooks()
+	if err != nil {
+		return nil, err
+	}
+	return wb.WebhookDeliveries(dead)
+}
+
+func (b wrappedBackend) DeleteWebhookDelivery(id string) (err error) {
+	defer b.call("DeleteWebhookDelivery").end(&err)
+	wb, err := b.webhooks()
+	if err != nil {
+		return err
+	}
+	return wb.DeleteWebhookDelivery(id)
+}
+
+func (b wrappedBackend) userQueries() (UserQueryBackend, error) {
+	qb, ok := b.backend.(UserQueryBackend)
+	if !ok {
+		return nil, mkerror("backend doesn't support user queries")
+	}
+	return qb, nil
+}
+
+func (b wrappedBackend) QueryUsers(q UserQuery) (page UserPage, err error) {
+	defer b.call("QueryUsers").end(&err)
+	qb, err := b.userQueries()
+	if err != nil {
+		return page, err
+	}
+	return qb.QueryUsers(q)
+}
+
+func (b wrappedBackend) CountUsers(q UserQuery) (n int, err error) {
+	defer b.call("CountUsers").end(&err)
+	qb, err := b.userQueries()
+	if err != nil {
+		return 0, err
+	}
+	return qb.CountUsers(q)
+}
+
+func (b wrappedBackend) ForEachUser(ctx context.Context, fn func(user UserData) error) (err error) {
+	defer b.call("ForEachUser").end(&err)
+	ib, ok := b.backend.(UserIteratorBackend)
+	if !ok {
+		return mkerror("backend doesn't support iterating over users")
+	}
+	return ib.ForEachUser(ctx, fn)
+}
+
+func (b wrappedBackend) UserByEmail(email string) (user UserData, err error) {
+	defer b.call("UserByEmail").end(&err)
+	eb, ok := b.backend.(EmailBackend)
+	if !ok {
+		return user, mkerror("backend doesn't support looking users up by email")
+	}
+	return eb.UserByEmail(email)
+}
+
+func (b wrappedBackend) RequireUniqueEmails() (err error) {
+	defer b.call("RequireUniqueEmails").end(&err)
+	ub, ok := b.backend.(UniqueEmailBackend)
+	if !ok {
+		return mkerror("backend doesn't support unique emails")
+	}
+	return ub.RequireUniqueEmails()
+}